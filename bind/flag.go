@@ -12,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/mmatczuk/anyflag"
 	"github.com/saucelabs/forwarder"
@@ -53,7 +54,7 @@ func DNSConfig(fs *pflag.FlagSet, cfg *forwarder.DNSConfig) {
 }
 
 func PAC(fs *pflag.FlagSet, pac **url.URL) {
-	fs.VarP(anyflag.NewValue[*url.URL](*pac, pac, fileurl.ParseFilePathOrURL),
+	fs.VarP(anyflag.NewValue[*url.URL](*pac, pac, parsePACURL),
 		"pac", "p", "`<path or URL>`"+
 			"Proxy Auto-Configuration file to use for upstream proxy selection. "+
 			"<p/>"+
@@ -63,9 +64,92 @@ func PAC(fs *pflag.FlagSet, pac **url.URL) {
 			"<li>URL: <code>http://example.com/proxy.pac</code>"+
 			"<li>Embed: <code>data:base64,<base64 encoded data></code>"+
 			"<li>Stdin: <code>-</code>"+
+			"<li>WPAD: <code>auto</code>, the file is discovered at <code>http://wpad.<domain>/wpad.dat</code> for the DNS search domains"+
 			"</ul>")
 }
 
+func parsePACURL(val string) (*url.URL, error) {
+	if val == forwarder.WPADURL.Opaque {
+		u := *forwarder.WPADURL
+		return &u, nil
+	}
+	return fileurl.ParseFilePathOrURL(val)
+}
+
+func PACConfig(fs *pflag.FlagSet, cfg *forwarder.PACConfig) {
+	fs.DurationVar(&cfg.RefreshInterval,
+		"pac-refresh-interval", cfg.RefreshInterval, "<duration>"+
+			"Interval between re-fetching the PAC file, if the file is a local file or an http(s) URL. "+
+			"HTTP caching headers are honored, the file is downloaded only if it has changed. "+
+			"A new file is compiled and tested before it replaces the current one. "+
+			"Zero disables refreshing. ")
+
+	fs.DurationVar(&cfg.Timeout,
+		"pac-timeout", cfg.Timeout, "<duration>"+
+			"Timeout for a single PAC script evaluation including DNS lookups. "+
+			"Requests that need the PAC script to run for longer fail. "+
+			"Zero means no timeout. ")
+
+	fs.Uint32Var(&cfg.CacheSize,
+		"pac-cache-size", cfg.CacheSize, "<size>"+
+			"Maximum number of cached PAC script results. "+
+			"Zero disables caching. ")
+
+	fs.DurationVar(&cfg.CacheTTL,
+		"pac-cache-ttl", cfg.CacheTTL, "<duration>"+
+			"Time after which a cached PAC script result expires. ")
+
+	cacheKeyValues := []forwarder.PACCacheKey{
+		forwarder.PACCacheKeyHost,
+		forwarder.PACCacheKeySchemeHost,
+		forwarder.PACCacheKeyURL,
+	}
+	fs.Var(anyflag.NewValue[forwarder.PACCacheKey](cfg.CacheKey, &cfg.CacheKey, anyflag.EnumParser[forwarder.PACCacheKey](cacheKeyValues...)),
+		"pac-cache-key", "<host|scheme-host|url>"+
+			"Granularity of the PAC script results cache. "+
+			"Setting this to host caches results per host name, "+
+			"scheme-host per scheme, host name and port, "+
+			"and url per full URL. "+
+			"Use url if the PAC script depends on the URL path. ")
+}
+
+func PACServerConfig(fs *pflag.FlagSet, cfg *forwarder.PACServerConfig) {
+	fs.DurationVar(&cfg.MaxAge,
+		"pac-max-age", cfg.MaxAge, "<duration>"+
+			"Cache-Control max-age of the served PAC file. "+
+			"The file is served with ETag and Last-Modified headers, clients can revalidate it with conditional requests. "+
+			"Zero disables caching by clients. ")
+
+	fs.BoolVar(&cfg.Template,
+		"pac-template", cfg.Template, ""+
+			"Execute the PAC file as a Go text/template for every request. "+
+			"The template data fields are: "+
+			"<ul>"+
+			"<li><code>.ClientIP</code> - IP address of the client"+
+			"<li><code>.UserAgent</code> - User-Agent header of the request"+
+			"<li><code>.Query</code> - query parameters of the request, e.g. <code>{{ js (.Query.Get \"env\") }}</code>"+
+			"</ul>"+
+			"Use the js function to escape values inserted into JavaScript strings. ")
+}
+
+func PACGeneratorConfig(fs *pflag.FlagSet, cfg *forwarder.PACGeneratorConfig,
+	directDomains, denyDomains *[]ruleset.ListItem, directDomainsFile, denyDomainsFile **url.URL,
+) {
+	fs.VarP(anyflag.NewValue[*url.URL](cfg.Proxy, &cfg.Proxy, forwarder.ParseProxyURL),
+		"proxy", "x", "<[protocol://]host:port>"+
+			"Generate the PAC file instead of reading it, the generated file sends requests to this proxy. "+
+			"This is typically the address of the Forwarder instance the clients should use. "+
+			"The supported protocols are: http, https, socks4, socks5. "+
+			"The --deny-domains, --deny-domains-file, --direct-domains, --direct-domains-file and --proxy-localhost flags "+
+			"are applied the same way the proxy applies them. ")
+
+	ProxyLocalhost(fs, &cfg.ProxyLocalhost)
+	DenyDomains(fs, denyDomains)
+	domainsFile(fs, denyDomainsFile, "deny-domains-file", "--deny-domains", false)
+	DirectDomains(fs, directDomains)
+	domainsFile(fs, directDomainsFile, "direct-domains-file", "--direct-domains", false)
+}
+
 func ProxyHeaders(fs *pflag.FlagSet, headers *[]header.Header) {
 	fs.Var(anyflag.NewSliceValueWithRedact[header.Header](*headers, headers, header.ParseHeader, RedactHeader),
 		"proxy-header", "<header>")
@@ -106,53 +190,264 @@ func ResponseHeaders(fs *pflag.FlagSet, headers *[]header.Header) {
 
 func HTTPProxyConfig(fs *pflag.FlagSet, cfg *forwarder.HTTPProxyConfig, lcfg *log.Config) {
 	HTTPServerConfig(fs, &cfg.HTTPServerConfig, "", forwarder.HTTPScheme, forwarder.HTTPSScheme)
+	TLSClientAuthConfig(fs, &cfg.ClientAuth)
 	LogConfig(fs, lcfg)
 
-	fs.VarP(anyflag.NewValueWithRedact[*url.URL](cfg.UpstreamProxy, &cfg.UpstreamProxy, forwarder.ParseProxyURL, RedactURL),
+	// The proxy chain is stored as the upstream proxy and the proxies used to reach it.
+	parseProxyChain := func(val string) (*url.URL, error) {
+		chain, err := forwarder.ParseProxyChain(val)
+		if err != nil {
+			return nil, err
+		}
+		cfg.UpstreamProxyVia = chain[:len(chain)-1]
+		return chain[len(chain)-1], nil
+	}
+	redactProxyChain := func(u *url.URL) string {
+		via := cfg.UpstreamProxyVia
+		return forwarder.RedactProxyChain(append(via[:len(via):len(via)], u))
+	}
+	fs.VarP(anyflag.NewValueWithRedact[*url.URL](cfg.UpstreamProxy, &cfg.UpstreamProxy, parseProxyChain, redactProxyChain),
 		"proxy", "x", "<[protocol://]host:port>"+
 			"Upstream proxy to use. "+
-			"The supported protocols are: http, https, socks5. "+
+			"The supported protocols are: http, https, socks4, socks4a, socks5, ssh. "+
 			"No protocol specified will be treated as HTTP proxy. "+
 			"The basic authentication username and password can be specified in the host string e.g. user:pass@host:port. "+
 			"Alternatively, you can use the -c, --credentials flag to specify the credentials. "+
-			"If both are specified, the proxy flag takes precedence. ")
+			"If both are specified, the proxy flag takes precedence. "+
+			"The ssh protocol e.g. ssh://user@host:port tunnels connections through an SSH server, "+
+			"see the --ssh-* flags for authentication and host key verification. "+
+			"The socks4 protocol resolves host names locally, socks4a sends them to the proxy, the username is sent as the SOCKS4 user ID. "+
+			"<p/>"+
+			"Proxies can be chained with ->, e.g. socks5://a:1080 -> http://b:3128 -> https://c:443. "+
+			"Requests are sent to the last proxy, each proxy is reached through the previous one. "+
+			"Every proxy of the chain can have its own credentials. "+
+			"The connect timeout applies to each hop, it can be overridden for a proxy with the timeout query parameter e.g. socks5://a:1080?timeout=5s. ")
+
+	fs.Var(anyflag.NewSliceValue[forwarder.UpstreamAuth](cfg.UpstreamAuth, &cfg.UpstreamAuth, forwarder.ParseUpstreamAuth),
+		"proxy-auth", "<[host:port=]basic|digest|ntlm|negotiate>,..."+
+			"Authentication scheme used with upstream HTTP proxies. "+
+			"The scheme without host:port applies to all upstream proxies, host:port entries take precedence. "+
+			"The credentials are taken from the proxy URL or from --credentials, "+
+			"use DOMAIN\\user as the username to specify the NTLM domain. "+
+			"The ntlm and negotiate schemes run the NTLMv2 handshake once per connection, "+
+			"authenticated connections are kept alive and reused for the same proxy and credentials, "+
+			"Kerberos is not supported. "+
+			"The digest scheme sends the credentials only in response to a Digest challenge, "+
+			"the challenge is cached and later requests send credentials up front until the proxy challenges again. "+
+			"By default, basic authentication is used, "+
+			"and Digest authentication is used once the upstream proxy sends a Digest challenge. ")
+
+	UpstreamHTTP2Config(fs, &cfg.UpstreamHTTP2)
+
+	ProxyLocalhost(fs, &cfg.ProxyLocalhost)
+
+	fs.StringVar(&cfg.Name, "name", cfg.Name, "<string>"+
+		"Name of this proxy instance. This value is used in the Via header in requests. "+
+		"The name value in Via header is extended with a random string to avoid collisions when several proxies are chained. ")
+
+	fs.StringVar(&cfg.RequestIDHeader, "log-http-request-id-header", cfg.RequestIDHeader,
+		"<name>"+
+			"If the header is present in the request, "+
+			"the proxy will associate the value with the request in the logs. ")
+
+	fs.StringVar(&cfg.ErrorPagesDir, "error-pages-dir", cfg.ErrorPagesDir, "<path>"+
+		"Directory with error page templates that override the built-in ones. "+
+		"Templates are named after the error label i.e. <label>.html or <label>.json, "+
+		"use default.html or default.json to override the template for all labels. "+
+		"HTML pages are sent to browsers and JSON to API clients based on the Accept header, "+
+		"other clients get a plain text error message. "+
+		"The error label is also sent in the X-Forwarder-Error-Label header. ")
+
+	TunnelConfig(fs, &cfg.TunnelConfig)
+}
+
+func UpstreamHTTP2Config(fs *pflag.FlagSet, cfg *forwarder.UpstreamHTTP2Config) {
+	fs.BoolVar(&cfg.Enabled, "proxy-http2", cfg.Enabled, ""+
+		"Open CONNECT tunnels to HTTPS upstream proxies as HTTP/2 streams multiplexed over a small pool of shared connections, "+
+		"instead of a new TCP and TLS connection per tunnel. "+
+		"If the upstream proxy does not negotiate h2, HTTP/1.1 CONNECT is used. "+
+		"Only basic authentication is supported over HTTP/2, other schemes use HTTP/1.1 CONNECT. ")
+
+	fs.IntVar(&cfg.MaxConns, "proxy-http2-max-conns", cfg.MaxConns, "<int>"+
+		"Maximum number of HTTP/2 connections to an upstream proxy. "+
+		"When all connections are busy, new tunnels wait for a free stream. "+
+		"Zero means no limit. ")
+
+	fs.IntVar(&cfg.MaxStreamsPerConn, "proxy-http2-max-streams-per-conn", cfg.MaxStreamsPerConn, "<int>"+
+		"Maximum number of tunnels multiplexed over a single HTTP/2 connection. "+
+		"Zero means the limit advertised by the upstream proxy. ")
+
+	fs.Var(&cfg.ConnWindow, "proxy-http2-conn-window", "<size>"+
+		"HTTP/2 flow-control window per connection i.e. how much data the upstream proxy can send before it is read. "+
+		"Accepts binary format (e.g. 1Mi, 1Gi). "+
+		"Zero means the default. ")
+
+	fs.Var(&cfg.StreamWindow, "proxy-http2-stream-window", "<size>"+
+		"HTTP/2 flow-control window per tunnel. "+
+		"Accepts binary format (e.g. 256Ki, 4Mi). "+
+		"Zero means the default. ")
+
+	fs.DurationVar(&cfg.ReadIdleTimeout, "proxy-http2-read-idle-timeout", cfg.ReadIdleTimeout, "<duration>"+
+		"Time after which a health check ping is sent if no frame is received on an HTTP/2 connection, "+
+		"the connection is closed if the ping is not answered. "+
+		"Zero disables health checks. ")
+}
 
+func TunnelConfig(fs *pflag.FlagSet, cfg *forwarder.TunnelConfig) {
+	fs.DurationVar(&cfg.TunnelIdleTimeout, "tunnel-idle-timeout", cfg.TunnelIdleTimeout,
+		"The maximum amount of time a CONNECT or upgrade tunnel is kept open "+
+			"when no data is transferred in either direction. "+
+			"Zero means no limit. ")
+
+	fs.DurationVar(&cfg.TunnelWriteTimeout, "tunnel-write-timeout", cfg.TunnelWriteTimeout,
+		"The maximum amount of time a single write to either side of a CONNECT or upgrade tunnel may block. "+
+			"Use it to close tunnels to peers that stopped reading data. "+
+			"Zero means no limit. ")
+
+	fs.DurationVar(&cfg.TunnelMaxLifetime, "tunnel-max-lifetime", cfg.TunnelMaxLifetime,
+		"The maximum amount of time a CONNECT or upgrade tunnel is kept open regardless of activity. "+
+			"Zero means no limit. ")
+}
+
+func ProxyLocalhost(fs *pflag.FlagSet, mode *forwarder.ProxyLocalhostMode) {
 	proxyLocalhostValues := []forwarder.ProxyLocalhostMode{
 		forwarder.DenyProxyLocalhost,
 		forwarder.AllowProxyLocalhost,
 		forwarder.DirectProxyLocalhost,
 	}
-	fs.VarP(anyflag.NewValue[forwarder.ProxyLocalhostMode](cfg.ProxyLocalhost, &cfg.ProxyLocalhost, anyflag.EnumParser[forwarder.ProxyLocalhostMode](proxyLocalhostValues...)),
+	fs.VarP(anyflag.NewValue[forwarder.ProxyLocalhostMode](*mode, mode, anyflag.EnumParser[forwarder.ProxyLocalhostMode](proxyLocalhostValues...)),
 		"proxy-localhost", "", "<allow|deny|direct>"+
 			"Setting this to allow enables sending requests to localhost through the upstream proxy. "+
 			"Setting this to direct sends requests to localhost directly without using the upstream proxy. "+
 			"By default, requests to localhost are denied. ")
-
-	fs.StringVar(&cfg.Name, "name", cfg.Name, "<string>"+
-		"Name of this proxy instance. This value is used in the Via header in requests. "+
-		"The name value in Via header is extended with a random string to avoid collisions when several proxies are chained. ")
-
-	fs.StringVar(&cfg.RequestIDHeader, "log-http-request-id-header", cfg.RequestIDHeader,
-		"<name>"+
-			"If the header is present in the request, "+
-			"the proxy will associate the value with the request in the logs. ")
 }
 
-func DenyDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
-	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*cfg, cfg, ruleset.ParseRegexpListItem),
-		"deny-domains", "[-]<regexp>,..."+
+func DenyDomains(fs *pflag.FlagSet, cfg *[]ruleset.ListItem) {
+	fs.Var(anyflag.NewSliceValue[ruleset.ListItem](*cfg, cfg, ruleset.ParseListItem),
+		"deny-domains", "[-]<regexp|host:pattern>,..."+
 			"Deny requests to the specified domains. "+
-			"Prefix domains with '-' to exclude requests to certain domains from being denied.")
+			"Prefix domains with '-' to exclude requests to certain domains from being denied. "+
+			domainsSyntax)
 }
 
-func DirectDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
-	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*cfg, cfg, ruleset.ParseRegexpListItem),
-		"direct-domains", "[-]<regexp>,..."+
+func DirectDomains(fs *pflag.FlagSet, cfg *[]ruleset.ListItem) {
+	fs.Var(anyflag.NewSliceValue[ruleset.ListItem](*cfg, cfg, ruleset.ParseListItem),
+		"direct-domains", "[-]<regexp|host:pattern>,..."+
 			"Connect directly to the specified domains without using the upstream proxy. "+
 			"Prefix domains with '-' to exclude requests to certain domains from being directed. "+
-			"This flag takes precedence over the PAC script.")
+			"This flag takes precedence over the PAC script. "+
+			domainsSyntax)
+}
+
+func RoutesFile(fs *pflag.FlagSet, u **url.URL) {
+	fs.Var(anyflag.NewValue[*url.URL](*u, u, fileurl.ParseFilePathOrURL),
+		"routes-file", "`<path or URL>`"+
+			"YAML file with the upstream routing table. "+
+			"Routes are evaluated in order and the first matching route selects DIRECT, an upstream proxy URL or a named upstream group. "+
+			"Requests that do not match any route use --proxy or --pac if set, or go direct otherwise. "+
+			"This flag takes precedence over the --proxy and --pac flags, and --direct-domains takes precedence over it. "+
+			"Upstream credentials are taken from the URL or from --credentials. "+
+			"Use <code>forwarder route explain</code> to test the routing table. "+
+			"<p/>"+
+			"Syntax:"+
+			"<ul>"+
+			"<li>File: <code>/path/to/routes.yaml</code>"+
+			"<li>URL: <code>http://example.com/routes.yaml</code>"+
+			"<li>Embed: <code>data:base64,<base64 encoded data></code>"+
+			"</ul>"+
+			"<p/>"+
+			"Routes match on <code>hosts</code> (NO_PROXY-style host patterns), <code>ports</code>, <code>schemes</code>, "+
+			"<code>listeners</code> and authenticated <code>users</code>, empty fields match everything. "+
+			"The main listener is named <code>main</code>. "+
+			"CONNECT requests have the https scheme. "+
+			"The <code>upstream</code> field is DIRECT, a proxy URL with scheme, a proxy chain, or a name from <code>upstreams</code>. "+
+			"Proxy chains have the same format as in --proxy e.g. <code>socks5://a:1080 -> http://b:3128</code>, and can be used in upstream groups. "+
+			"Requests routed to an upstream group are distributed round-robin. ")
+}
+
+func DenyIPs(fs *pflag.FlagSet, cfg *[]forwarder.IPRange) {
+	fs.Var(anyflag.NewSliceValue[forwarder.IPRange](*cfg, cfg, forwarder.ParseIPRange),
+		"deny-ips", "<CIDR|IP|preset>,..."+
+			"Deny connections to destinations that resolve to the specified IP addresses. "+
+			"The IP address is checked after DNS resolution and --connect-to redirection, "+
+			"which protects against DNS rebinding and requests to internal services. "+
+			"Connections to upstream proxies are not affected. "+
+			"By default the link-local and metadata presets are denied, setting the flag replaces the defaults. "+
+			"When --proxy-localhost is set to deny (the default), the loopback preset is denied as well. "+
+			"Use --allow-ips to allow specific addresses. "+
+			ipPresetsSyntax)
+}
+
+func AllowIPs(fs *pflag.FlagSet, cfg *[]forwarder.IPRange) {
+	fs.Var(anyflag.NewSliceValue[forwarder.IPRange](*cfg, cfg, forwarder.ParseIPRange),
+		"allow-ips", "<CIDR|IP|preset>,..."+
+			"Allow connections to the specified IP addresses even if they are denied by --deny-ips. "+
+			ipPresetsSyntax)
+}
+
+const ipPresetsSyntax = "<p/>" +
+	"Presets:" +
+	"<ul>" +
+	"<li><code>loopback</code>: 127.0.0.0/8, 0.0.0.0, ::1, ::" +
+	"<li><code>link-local</code>: 169.254.0.0/16, fe80::/10" +
+	"<li><code>private</code>: 10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16, fc00::/7" +
+	"<li><code>metadata</code>: cloud instance metadata services, for example 169.254.169.254" +
+	"</ul>"
+
+func DenyDomainsFile(fs *pflag.FlagSet, u **url.URL) {
+	domainsFile(fs, u, "deny-domains-file", "--deny-domains", true)
 }
 
+func DirectDomainsFile(fs *pflag.FlagSet, u **url.URL) {
+	domainsFile(fs, u, "direct-domains-file", "--direct-domains", true)
+}
+
+func MITMDomainsFile(fs *pflag.FlagSet, u **url.URL) {
+	domainsFile(fs, u, "mitm-domains-file", "--mitm-domains", true)
+}
+
+func domainsFile(fs *pflag.FlagSet, u **url.URL, name, list string, reload bool) {
+	load := "The file is read once at startup. "
+	if reload {
+		load = "The file is reloaded every --domains-file-refresh-interval, " +
+			"if it cannot be loaded the last loaded domains are used. "
+	}
+	fs.Var(anyflag.NewValue[*url.URL](*u, u, fileurl.ParseFilePathOrURL),
+		name, "`<path or URL>`"+
+			"File with domains to add to the "+list+" flag values, one domain per line. "+
+			"Empty lines and lines starting with '#' are ignored. "+
+			load+
+			"<p/>"+
+			"Syntax:"+
+			"<ul>"+
+			"<li>File: <code>/path/to/domains.txt</code>"+
+			"<li>URL: <code>http://example.com/domains.txt</code>"+
+			"<li>Embed: <code>data:base64,<base64 encoded data></code>"+
+			"</ul>")
+}
+
+func DomainsFileRefreshInterval(fs *pflag.FlagSet, d *time.Duration) {
+	fs.DurationVar(d, "domains-file-refresh-interval", *d,
+		"Interval to reload the --deny-domains-file, --direct-domains-file and --mitm-domains-file files. "+
+			"For HTTP URLs, the ETag and Last-Modified headers are used to avoid downloading unchanged files. "+
+			"Zero disables reloading. ")
+}
+
+const domainsSyntax = "<p/>" +
+	"Domains are regular expressions matched against the host name, " +
+	"or NO_PROXY-style host patterns if prefixed with 'host:'. " +
+	"Host patterns are matched against the host name and port, and are much faster than regular expressions for large lists." +
+	"<p/>" +
+	"Host pattern syntax:" +
+	"<ul>" +
+	"<li>Domain and subdomains: <code>host:example.com</code>" +
+	"<li>Subdomains only: <code>host:.example.com</code> or <code>host:*.example.com</code>" +
+	"<li>Host and port: <code>host:example.com:443</code>" +
+	"<li>IP address: <code>host:192.168.0.1</code> or <code>host:[::1]:8080</code>" +
+	"<li>CIDR: <code>host:10.0.0.0/8</code> or <code>host:fd00::/8</code>" +
+	"<li>All hosts: <code>host:*</code>" +
+	"</ul>"
+
 const pathOrBase64Syntax = "<p/>" +
 	"Syntax:" +
 	"<ul>" +
@@ -160,6 +455,165 @@ const pathOrBase64Syntax = "<p/>" +
 	"<li>Embed: <code>data:base64,<base64 encoded data></code>" +
 	"</ul>"
 
+func SSHConfig(fs *pflag.FlagSet, cfg *forwarder.SSHConfig) {
+	fs.Var(anyflag.NewSliceValueWithRedact[string](cfg.KeyFiles, &cfg.KeyFiles, func(val string) (string, error) { return val, nil }, RedactBase64),
+		"ssh-key-file", "<path or base64>"+
+			"Private key file used to authenticate with upstream SSH proxies. "+
+			"Passphrase protected keys are not supported, use the SSH agent instead. "+
+			"If the proxy URL contains a password, password authentication is tried after the keys. "+
+			"Use this flag multiple times to specify multiple key files."+
+			pathOrBase64Syntax)
+
+	fs.BoolVar(&cfg.Agent, "ssh-agent", cfg.Agent, ""+
+		"Use the keys from the SSH agent listening on SSH_AUTH_SOCK to authenticate with upstream SSH proxies. ")
+
+	fs.Var(anyflag.NewSliceValue[string](cfg.KnownHostsFiles, &cfg.KnownHostsFiles, func(val string) (string, error) { return val, nil }),
+		"ssh-known-hosts-file", "<path>"+
+			"File with the trusted host keys of upstream SSH proxies in OpenSSH known_hosts format. "+
+			"Connections to SSH servers with unknown host keys are rejected. "+
+			"By default, ~/.ssh/known_hosts is used. "+
+			"Use this flag multiple times to specify multiple files. ")
+
+	fs.DurationVar(&cfg.KeepAlive, "ssh-keep-alive", cfg.KeepAlive, "<duration>"+
+		"Interval of keep-alive requests sent to upstream SSH proxies. "+
+		"The SSH connection is shared by all requests and tunnels to a proxy, "+
+		"it is closed and established again if the server does not respond. "+
+		"Zero disables keep-alive. ")
+}
+
+func JWTAuthConfig(fs *pflag.FlagSet, cfg *forwarder.JWTAuthConfig) {
+	fs.Var(anyflag.NewValue[*url.URL](cfg.JWKS, &cfg.JWKS, fileurl.ParseFilePathOrURL),
+		"jwt-jwks", "`<path or URL>`"+
+			"JSON Web Key Set used to verify JWTs sent by clients in the Proxy-Authorization header with the Bearer scheme. "+
+			"Tokens signed with RS256, ES256 and EdDSA are supported. "+
+			"If --basic-auth is also set, clients can authenticate with either method. "+
+			"The key set is reloaded every --jwt-jwks-refresh-interval, "+
+			"if it cannot be loaded the last loaded keys are used. "+
+			"<p/>"+
+			"Syntax:"+
+			"<ul>"+
+			"<li>File: <code>/path/to/jwks.json</code>"+
+			"<li>URL: <code>https://example.com/.well-known/jwks.json</code>"+
+			"<li>Embed: <code>data:base64,<base64 encoded data></code>"+
+			"</ul>")
+
+	fs.DurationVar(&cfg.JWKSRefreshInterval, "jwt-jwks-refresh-interval", cfg.JWKSRefreshInterval,
+		"<duration>"+
+			"Interval between reloads of the --jwt-jwks key set. "+
+			"Zero disables reloading. ")
+
+	fs.StringSliceVar(&cfg.Audience, "jwt-audience", cfg.Audience, "<value>,..."+
+		"If set, the token aud claim must contain one of the values. ")
+
+	fs.DurationVar(&cfg.Leeway, "jwt-leeway", cfg.Leeway, "<duration>"+
+		"Allowed clock skew when checking the token exp and nbf claims. ")
+
+	fs.DurationVar(&cfg.MaxLifetime, "jwt-max-lifetime", cfg.MaxLifetime, "<duration>"+
+		"If set, tokens that expire later than the duration from now are rejected. "+
+		"Tokens without the exp claim are always rejected. ")
+
+	fs.Uint32Var(&cfg.CacheSize, "jwt-cache-size", cfg.CacheSize, "<size>"+
+		"Maximum number of verified tokens cached until they expire or the key set changes. "+
+		"Zero disables caching. ")
+
+	fs.StringVar(&cfg.UserClaim, "jwt-user-claim", cfg.UserClaim, "<name>"+
+		"Claim used as the authenticated user name e.g. in routing rules and logs. ")
+
+	fs.StringVar(&cfg.SessionClaim, "jwt-session-claim", cfg.SessionClaim, "<name>"+
+		"Claim with the session ID, it is prepended to the request trace ID in logs and error pages. ")
+
+	fs.StringVar(&cfg.DomainsClaim, "jwt-domains-claim", cfg.DomainsClaim, "<name>"+
+		"Claim with the list of domains the client can access, in the --deny-domains syntax. "+
+		"Requests to other domains are denied, tokens without the claim can access all domains. ")
+
+	fs.StringVar(&cfg.UpstreamClaim, "jwt-upstream-claim", cfg.UpstreamClaim, "<name>"+
+		"Claim with the upstream proxy URL or proxy chain for the client requests, in the --proxy syntax. "+
+		"It takes precedence over --routes-file, --proxy and --pac. ")
+}
+
+func ExtAuthzConfig(fs *pflag.FlagSet, cfg *forwarder.ExtAuthzConfig) {
+	fs.Var(anyflag.NewValue[*url.URL](cfg.URL, &cfg.URL, forwarder.ParseExtAuthzURL),
+		"ext-authz-url", "<URL>"+
+			"External authorization service that allows or denies proxied requests. "+
+			"The service receives the client address, user and listener, the request method, host, URL and the --ext-authz-headers. "+
+			"It answers with the decision and headers to set on allowed requests. "+
+			"Denied requests get 403 Forbidden. "+
+			"<p/>"+
+			"Supported protocols:"+
+			"<ul>"+
+			"<li>HTTP: <code>http://localhost:9000/check</code>, the request is sent as JSON in a POST request body"+
+			"<li>gRPC: <code>grpc://localhost:9001</code>, the /forwarder.authz.v1.Authorization/Check method is called with google.protobuf.Struct messages"+
+			"</ul>"+
+			"Use https or grpcs for TLS. ")
+
+	fs.DurationVar(&cfg.Timeout, "ext-authz-timeout", cfg.Timeout, "<duration>"+
+		"Timeout for a single authorization check. "+
+		"Zero means no timeout. ")
+
+	fs.StringSliceVar(&cfg.Headers, "ext-authz-headers", cfg.Headers, "<name>,..."+
+		"Request headers sent to the authorization service. ")
+
+	fs.Uint32Var(&cfg.CacheSize, "ext-authz-cache-size", cfg.CacheSize, "<size>"+
+		"Maximum number of cached authorization decisions. "+
+		"Zero disables caching. ")
+
+	fs.DurationVar(&cfg.CacheTTL, "ext-authz-cache-ttl", cfg.CacheTTL, "<duration>"+
+		"Time after which a cached authorization decision expires. ")
+
+	fs.BoolVar(&cfg.FailOpen, "ext-authz-fail-open", cfg.FailOpen,
+		"Allow requests if the authorization service fails or times out. "+
+			"By default, such requests get 503 Service Unavailable. ")
+}
+
+func ICAPConfig(fs *pflag.FlagSet, cfg *forwarder.ICAPConfig) {
+	fs.Var(anyflag.NewValue[*url.URL](cfg.ReqModURL, &cfg.ReqModURL, forwarder.ParseICAPURL),
+		"icap-reqmod-url", "<URL>"+
+			"ICAP REQMOD service URL, for example icap://localhost:1344/reqmod. "+
+			"Request bodies are sent to the service for scanning, e.g. by an antivirus or DLP engine. "+
+			"The service can pass the request, replace its headers and body, or block it with 403 Forbidden. "+
+			"Use --mitm to scan HTTPS requests. ")
+
+	fs.Var(anyflag.NewValue[*url.URL](cfg.RespModURL, &cfg.RespModURL, forwarder.ParseICAPURL),
+		"icap-respmod-url", "<URL>"+
+			"ICAP RESPMOD service URL, for example icap://localhost:1344/respmod. "+
+			"Response bodies are sent to the service for scanning. "+
+			"The service can pass the response or replace its status, headers and body. "+
+			"Responses with the X-Infection-Found or X-Violations-Found ICAP headers are blocked with 403 Forbidden. "+
+			"Use --mitm to scan HTTPS responses. ")
+
+	fs.StringSliceVar(&cfg.ContentTypes, "icap-content-types", cfg.ContentTypes, "<media type>,..."+
+		"Limit scanning to bodies with the specified media types, wildcards such as image/* are supported. "+
+		"If not set, all bodies are scanned. "+
+		"Streaming bodies such as text/event-stream are never scanned. ")
+
+	fs.IntVar(&cfg.Preview, "icap-preview", cfg.Preview, "<size>"+
+		"Number of body bytes sent in the ICAP preview, "+
+		"the service can decide based on the preview if it needs the rest of the body. "+
+		"Negative value disables preview. ")
+
+	fs.Var(&cfg.MaxBodySize, "icap-max-body-size", "<size>"+
+		"Maximum size of a body that is scanned, larger bodies are passed unscanned. ")
+
+	fs.BoolVar(&cfg.RejectOversized, "icap-reject-oversized", cfg.RejectOversized,
+		"Handle bodies larger than --icap-max-body-size as ICAP service errors instead of passing them unscanned. ")
+
+	fs.DurationVar(&cfg.Timeout, "icap-timeout", cfg.Timeout, "<duration>"+
+		"Timeout for a single ICAP request. "+
+		"Zero means no timeout. ")
+
+	fs.BoolVar(&cfg.FailOpen, "icap-fail-open", cfg.FailOpen,
+		"Pass messages unscanned if the ICAP service fails, times out, or the body is oversized and --icap-reject-oversized is set. "+
+			"By default, such requests get 503 Service Unavailable. ")
+}
+
+func ICAPDomains(fs *pflag.FlagSet, cfg *[]ruleset.ListItem) {
+	fs.Var(anyflag.NewSliceValue[ruleset.ListItem](*cfg, cfg, ruleset.ParseListItem),
+		"icap-domains", "[-]<regexp|host:pattern>,..."+
+			"Limit ICAP scanning to the specified domains. "+
+			"Prefix domains with '-' to exclude requests to certain domains from being scanned. "+
+			domainsSyntax)
+}
+
 func MITMConfig(fs *pflag.FlagSet, mitm *bool, cfg *forwarder.MITMConfig) {
 	fs.BoolVar(mitm, "mitm", *mitm, ""+
 		"Enable Man-in-the-Middle (MITM) mode. "+
@@ -193,11 +647,12 @@ func MITMConfig(fs *pflag.FlagSet, mitm *bool, cfg *forwarder.MITMConfig) {
 		"Expiration time of the cached certificates. ")
 }
 
-func MITMDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
-	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*cfg, cfg, ruleset.ParseRegexpListItem),
-		"mitm-domains", "[-]<regexp>,..."+
+func MITMDomains(fs *pflag.FlagSet, cfg *[]ruleset.ListItem) {
+	fs.Var(anyflag.NewSliceValue[ruleset.ListItem](*cfg, cfg, ruleset.ParseListItem),
+		"mitm-domains", "[-]<regexp|host:pattern>,..."+
 			"Limit MITM to the specified domains. "+
-			"Prefix domains with '-' to exclude requests to certain domains from being MITMed.")
+			"Prefix domains with '-' to exclude requests to certain domains from being MITMed. "+
+			domainsSyntax)
 }
 
 func ProxyProtocol(fs *pflag.FlagSet, enabled *bool, cfg *forwarder.ProxyProtocolConfig) {
@@ -211,6 +666,25 @@ func ProxyProtocol(fs *pflag.FlagSet, enabled *bool, cfg *forwarder.ProxyProtoco
 			"Zero means no limit. ")
 }
 
+func TracingConfig(fs *pflag.FlagSet, cfg *forwarder.TracingConfig) {
+	fs.Var(anyflag.NewValue[*url.URL](cfg.Endpoint, &cfg.Endpoint, forwarder.ParseOTLPEndpoint),
+		"tracing-endpoint", "<URL>"+
+			"OpenTelemetry collector OTLP/HTTP endpoint to export traces to, for example http://localhost:4318. "+
+			"If the URL path is empty, /v1/traces is used. "+
+			"The W3C traceparent header of incoming requests is used as the parent of the proxy spans. "+
+			"If not set, tracing is disabled. ")
+
+	fs.Float64Var(&cfg.SampleRatio, "tracing-sample-ratio", cfg.SampleRatio,
+		"The fraction of new traces that are sampled, between 0 and 1. "+
+			"Sampling decisions of incoming traces are respected. ")
+
+	fs.StringVar(&cfg.ServiceName, "tracing-service-name", cfg.ServiceName,
+		"The service name reported to the OpenTelemetry collector. ")
+
+	fs.BoolVar(&cfg.Inject, "tracing-inject", cfg.Inject,
+		"Propagate the trace context to upstream servers in the W3C traceparent header. ")
+}
+
 func Credentials(fs *pflag.FlagSet, credentials *[]*forwarder.HostPortUser) {
 	fs.VarP(anyflag.NewSliceValueWithRedact[*forwarder.HostPortUser](*credentials, credentials, forwarder.ParseHostPortUser, forwarder.RedactHostPortUser),
 		"credentials", "s", "<username[:password]@host:port,...>"+
@@ -340,6 +814,18 @@ func HTTPServerConfig(fs *pflag.FlagSet, cfg *forwarder.HTTPServerConfig, prefix
 	fs.VarP(anyflag.NewValueWithRedact[*url.Userinfo](cfg.BasicAuth, &cfg.BasicAuth, forwarder.ParseUserinfo, RedactUserinfo),
 		namePrefix+"basic-auth", "", "<username[:password]>"+
 			"Basic authentication credentials to protect the server. ")
+
+	fs.BoolVar(&cfg.DigestAuth, namePrefix+"digest-auth", cfg.DigestAuth, ""+
+		"Use Digest authentication (RFC 7616) with the --"+namePrefix+"basic-auth credentials instead of basic authentication, "+
+		"so that the password is not sent in clear text. "+
+		"Clients are offered the SHA-256 and MD5 algorithms, nonces expire after 5 minutes "+
+		"and each nonce count can be used once to protect against replay attacks. ")
+
+	fs.Var(anyflag.NewSliceValue[forwarder.IPRange](cfg.TrustedClients, &cfg.TrustedClients, forwarder.ParseIPRange),
+		namePrefix+"trusted-clients", "<CIDR|IP|preset>,..."+
+			"Clients with the specified IP addresses are not required to authenticate. "+
+			"The client address is the connection source address, or the address from the PROXY protocol header if enabled. "+
+			ipPresetsSyntax)
 }
 
 func ListenerConfig(fs *pflag.FlagSet, cfg *forwarder.ListenerConfig, prefix string) {
@@ -360,6 +846,19 @@ func ListenerConfig(fs *pflag.FlagSet, cfg *forwarder.ListenerConfig, prefix str
 	fs.Var(&cfg.WriteLimit, namePrefix+"write-limit", "<bandwidth>"+
 		"Global write rate limit in bytes per second i.e. how many bytes per second you can send to proxy. "+
 		"Accepts binary format (e.g. 1.5Ki, 1Mi, 3.6Gi). ")
+
+	fs.Var(anyflag.NewSliceValue[forwarder.IPRange](cfg.AllowClients, &cfg.AllowClients, forwarder.ParseIPRange),
+		namePrefix+"allow-clients", "<CIDR|IP|preset>,..."+
+			"Only accept connections from clients with the specified IP addresses. "+
+			"The client address is the connection source address, or the address from the PROXY protocol header if enabled. "+
+			"By default, all clients are allowed. "+
+			ipPresetsSyntax)
+
+	fs.Var(anyflag.NewSliceValue[forwarder.IPRange](cfg.DenyClients, &cfg.DenyClients, forwarder.ParseIPRange),
+		namePrefix+"deny-clients", "<CIDR|IP|preset>,..."+
+			"Reject connections from clients with the specified IP addresses. "+
+			"This flag takes precedence over --"+namePrefix+"allow-clients. "+
+			ipPresetsSyntax)
 }
 
 func HTTPLogConfig(fs *pflag.FlagSet, cfg []NamedParam[httplog.Mode]) {
@@ -429,6 +928,37 @@ func TLSServerConfig(fs *pflag.FlagSet, cfg *forwarder.TLSServerConfig, namePref
 			pathOrBase64Syntax)
 }
 
+func TLSClientAuthConfig(fs *pflag.FlagSet, cfg *forwarder.TLSClientAuthConfig) {
+	fs.Var(anyflag.NewSliceValueWithRedact[string](cfg.CACertFiles, &cfg.CACertFiles, func(val string) (string, error) { return val, nil }, RedactBase64),
+		"tls-client-cacert-file", "<path or base64>"+
+			"CA certificates to verify TLS client certificates against, requires the https protocol. "+
+			"When set, clients must present a certificate signed by one of the CAs, "+
+			"and the user name is taken from the certificate field specified by --tls-client-cert-user. "+
+			"Clients authenticated with a certificate are not required to use basic authentication. "+
+			"Use this flag multiple times to specify multiple CA certificate files."+
+			pathOrBase64Syntax)
+
+	fs.Var(anyflag.NewSliceValueWithRedact[string](cfg.CRLFiles, &cfg.CRLFiles, func(val string) (string, error) { return val, nil }, RedactBase64),
+		"tls-client-crl-file", "<path or base64>"+
+			"PEM or DER encoded certificate revocation list, client certificates revoked by the list are rejected. "+
+			"The list must be signed by one of the --tls-client-cacert-file CAs. "+
+			"The list is read at startup, restart the proxy to pick up a new list. "+
+			"Once the list is past its next update time, client certificates of its issuer are rejected. "+
+			"Use this flag multiple times to specify multiple CRL files."+
+			pathOrBase64Syntax)
+
+	fs.BoolVar(&cfg.Optional, "tls-client-cert-optional", cfg.Optional, ""+
+		"Allow clients that do not present a TLS client certificate, "+
+		"such clients must use basic authentication if --basic-auth is set. ")
+
+	fs.Var(anyflag.NewValue[forwarder.CertUserField](cfg.UserField, &cfg.UserField,
+		anyflag.EnumParser[forwarder.CertUserField](forwarder.CertUserCommonName, forwarder.CertUserEmail, forwarder.CertUserDNSName, forwarder.CertUserURI)),
+		"tls-client-cert-user", "<cn|email|dns|uri>"+
+			"TLS client certificate field used as the authenticated user name e.g. in routing rules and logs. "+
+			"The cn value is the subject common name, email, dns and uri use the first subject alternative name of that type. "+
+			"Certificates without the field are rejected. ")
+}
+
 func LogConfig(fs *pflag.FlagSet, cfg *log.Config) {
 	fs.VarP(struct{ pflag.Value }{anyflag.NewValueWithRedact[*os.File](cfg.File, &cfg.File,
 		forwarder.OpenFileParser(log.DefaultFileFlags, log.DefaultFileMode, log.DefaultDirMode), DisplayFileName)},
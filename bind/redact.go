@@ -12,6 +12,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/saucelabs/forwarder"
 	"github.com/saucelabs/forwarder/header"
 )
 
@@ -20,13 +21,7 @@ func RedactURL(u *url.URL) string {
 }
 
 func RedactUserinfo(ui *url.Userinfo) string {
-	if ui == nil {
-		return ""
-	}
-	if _, has := ui.Password(); has {
-		return ui.Username() + ":xxxxx"
-	}
-	return ui.Username()
+	return forwarder.RedactUserinfo(ui)
 }
 
 func RedactHeader(h header.Header) string {
@@ -10,6 +10,7 @@ import (
 	"github.com/saucelabs/forwarder/bind"
 	"github.com/saucelabs/forwarder/command/pac"
 	"github.com/saucelabs/forwarder/command/ready"
+	"github.com/saucelabs/forwarder/command/route"
 	"github.com/saucelabs/forwarder/command/run"
 	"github.com/saucelabs/forwarder/command/test/grpc"
 	"github.com/saucelabs/forwarder/command/test/httpbin"
@@ -31,6 +32,7 @@ func CommandGroups() templates.CommandGroups {
 			Commands: []*cobra.Command{
 				run.Command(),
 				pac.Command(),
+				route.Command(),
 				ready.Command(),
 			},
 		},
@@ -54,6 +56,10 @@ func FlagGroups() templates.FlagGroups {
 
 				"direct-domains",
 				"deny-domains",
+				"domains-file",
+				"deny-ips",
+				"allow-ips",
+				"routes",
 
 				"header",
 				"connect-header",
@@ -61,6 +67,22 @@ func FlagGroups() templates.FlagGroups {
 				"response-header",
 			},
 		},
+		{
+			Name:   "External authorization options",
+			Prefix: []string{"ext-authz"},
+		},
+		{
+			Name:   "ICAP options",
+			Prefix: []string{"icap"},
+		},
+		{
+			Name:   "JWT options",
+			Prefix: []string{"jwt"},
+		},
+		{
+			Name:   "SSH options",
+			Prefix: []string{"ssh"},
+		},
 		{
 			Name:   "MITM options",
 			Prefix: []string{"mitm"},
@@ -85,6 +107,10 @@ func FlagGroups() templates.FlagGroups {
 				"prom",
 			},
 		},
+		{
+			Name:   "Tracing options",
+			Prefix: []string{"tracing"},
+		},
 		{
 			Name:   "Logging options",
 			Prefix: []string{"log"},
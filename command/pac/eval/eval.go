@@ -7,22 +7,44 @@
 package eval
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 
+	"github.com/mmatczuk/anyflag"
 	"github.com/saucelabs/forwarder"
 	"github.com/saucelabs/forwarder/bind"
+	"github.com/saucelabs/forwarder/fileurl"
 	"github.com/saucelabs/forwarder/pac"
 	"github.com/spf13/cobra"
 )
 
 type command struct {
 	pac                 *url.URL
+	testFile            *url.URL
+	lint                bool
+	json                bool
 	dnsConfig           *forwarder.DNSConfig
 	httpTransportConfig *forwarder.HTTPTransportConfig
 }
 
+type evalResult struct {
+	URL    string `json:"url"`
+	Result string `json:"result"`
+}
+
+type report struct {
+	Eval   []evalResult     `json:"eval,omitempty"`
+	Tests  []pac.TestResult `json:"tests,omitempty"`
+	Passed int              `json:"passed"`
+	Failed int              `json:"failed"`
+	Lint   []pac.LintIssue  `json:"lint,omitempty"`
+}
+
 func (c *command) runE(cmd *cobra.Command, args []string) error {
 	if len(c.dnsConfig.Servers) > 0 {
 		if err := c.dnsConfig.Apply(); err != nil {
@@ -35,33 +57,116 @@ func (c *command) runE(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	script, err := forwarder.ReadURLString(c.pac, t)
+	pacURL, err := forwarder.ResolvePACURL(context.Background(), c.pac, t)
 	if err != nil {
-		return fmt.Errorf("read PAC file: %w", err)
-	}
-	cfg := pac.ProxyResolverConfig{
-		Script:    script,
-		AlertSink: os.Stderr,
+		return err
 	}
-	pr, err := pac.NewProxyResolver(&cfg, nil)
+	script, err := forwarder.ReadURLString(pacURL, t)
 	if err != nil {
-		return err
+		return fmt.Errorf("read PAC file: %w", err)
 	}
+	var r report
 
-	w := cmd.OutOrStdout()
-	for _, arg := range args {
-		u, err := url.Parse(arg)
+	if c.lint {
+		r.Lint, err = pac.Lint(script)
+		if err != nil {
+			return fmt.Errorf("lint: %w", err)
+		}
+	}
+
+	if c.testFile != nil {
+		b, err := forwarder.ReadURL(c.testFile, t)
 		if err != nil {
-			return fmt.Errorf("parse URL: %w", err)
+			return fmt.Errorf("read test file: %w", err)
 		}
-		proxy, err := pr.FindProxyForURL(u, "")
+		s, err := pac.ParseTestSuite(b)
+		if err != nil {
+			return fmt.Errorf("parse test file: %w", err)
+		}
+		r.Tests, err = s.Run(script, os.Stderr)
 		if err != nil {
 			return err
 		}
-		fmt.Fprintln(w, proxy)
+		for _, tr := range r.Tests {
+			if tr.Pass {
+				r.Passed++
+			} else {
+				r.Failed++
+			}
+		}
 	}
 
-	return nil
+	if len(args) > 0 {
+		cfg := pac.ProxyResolverConfig{
+			Script:    script,
+			AlertSink: os.Stderr,
+		}
+		pr, err := pac.NewProxyResolver(&cfg, nil)
+		if err != nil {
+			return err
+		}
+		for _, arg := range args {
+			u, err := url.Parse(arg)
+			if err != nil {
+				return fmt.Errorf("parse URL: %w", err)
+			}
+			proxy, err := pr.FindProxyForURL(u, "")
+			if err != nil {
+				return err
+			}
+			r.Eval = append(r.Eval, evalResult{URL: arg, Result: proxy})
+		}
+	}
+
+	w := cmd.OutOrStdout()
+	if c.json {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	} else {
+		writeText(w, &r)
+	}
+
+	switch {
+	case r.Failed > 0:
+		return fmt.Errorf("%d of %d tests failed", r.Failed, len(r.Tests))
+	case len(r.Lint) > 0:
+		return fmt.Errorf("found %d lint issues", len(r.Lint))
+	default:
+		return nil
+	}
+}
+
+func writeText(w io.Writer, r *report) {
+	for _, e := range r.Eval {
+		fmt.Fprintln(w, e.Result)
+	}
+
+	for _, tr := range r.Tests {
+		name := tr.URL
+		if tr.Name != "" {
+			name = tr.Name + " " + tr.URL
+		}
+		if tr.Pass {
+			fmt.Fprintf(w, "PASS %s\n", name)
+			continue
+		}
+		fmt.Fprintf(w, "FAIL %s\n", name)
+		if tr.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", tr.Error)
+		} else {
+			fmt.Fprintf(w, "  - %s\n  + %s\n", tr.Expect, tr.Got)
+		}
+	}
+	if len(r.Tests) > 0 {
+		fmt.Fprintf(w, "%d passed, %d failed\n", r.Passed, r.Failed)
+	}
+
+	for _, i := range r.Lint {
+		fmt.Fprintf(w, "lint: %s\n", i)
+	}
 }
 
 func Command() *cobra.Command {
@@ -72,15 +177,31 @@ func Command() *cobra.Command {
 	}
 
 	cmd := &cobra.Command{
-		Use:     "eval --pac <file|url> [flags] <url>...",
-		Short:   "Evaluate a PAC file for given URL (or URLs)",
-		Long:    long,
+		Use:   "eval --pac <file|url> [flags] <url>...",
+		Short: "Evaluate a PAC file for given URL (or URLs)",
+		Long:  long,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 && c.testFile == nil && !c.lint {
+				return errors.New("requires at least one URL, --test-file or --lint")
+			}
+			return nil
+		},
 		RunE:    c.runE,
 		Example: example,
 	}
 
 	fs := cmd.Flags()
 	bind.PAC(fs, &c.pac)
+	fs.Var(anyflag.NewValue[*url.URL](c.testFile, &c.testFile, fileurl.ParseFilePathOrURL),
+		"test-file", "`<path or URL>`"+
+			"YAML or JSON file with test cases to run against the PAC file. "+
+			"DNS lookups, myIpAddress and the current time are mocked, see the example below. "+
+			"Hosts not listed in dns do not resolve. ")
+	fs.BoolVar(&c.lint, "lint", c.lint,
+		"Check the PAC file for unreachable code, constant conditions, non-ASCII return values "+
+			"and calls to functions that are not supported. ")
+	fs.BoolVar(&c.json, "json", c.json,
+		"Print the results as JSON. ")
 	bind.DNSConfig(fs, c.dnsConfig)
 	bind.HTTPTransportConfig(fs, c.httpTransportConfig)
 
@@ -94,8 +215,28 @@ The output is a list of proxy strings, one per URL.
 The PAC file can be specified as a file path or URL with scheme "file", "http" or "https".
 The PAC file must contain FindProxyForURL or FindProxyForURLEx and must be valid.
 Alerts are written to stderr.
+
+With --test-file, the PAC file is evaluated for each test case and the result is compared with the expected one.
+The command fails if any test case fails or, with --lint, if any issue is found.
+Date and time functions without the GMT argument use the local time zone, set the TZ environment variable to change it.
 `
 
 const example = `  # Evaluate PAC file for multiple URLs
   forwarder pac eval --pac pac.js https://www.google.com https://www.facebook.com
+
+  # Run test cases and lint the PAC file, print results as JSON
+  forwarder pac eval --pac pac.js --test-file pac_test.yaml --lint --json
+
+  # Example test file
+  now: 2024-01-06T12:00:00Z
+  my_ip_address: [192.168.1.10]
+  dns:
+    intranet.example.com: [10.0.0.1]
+  tests:
+    - url: http://intranet.example.com/
+      expect: DIRECT
+    - name: weekday
+      url: https://www.google.com/
+      now: 2024-01-03T12:00:00Z
+      expect: PROXY proxy.example.com:3128; DIRECT
 `
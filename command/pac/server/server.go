@@ -7,27 +7,38 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/saucelabs/forwarder"
 	"github.com/saucelabs/forwarder/bind"
 	"github.com/saucelabs/forwarder/httplog"
+	"github.com/saucelabs/forwarder/internal/version"
 	"github.com/saucelabs/forwarder/log"
 	"github.com/saucelabs/forwarder/log/stdlog"
-	"github.com/saucelabs/forwarder/pac"
+	"github.com/saucelabs/forwarder/ruleset"
 	"github.com/saucelabs/forwarder/runctx"
 	"github.com/saucelabs/forwarder/utils/cobrautil"
 	"github.com/spf13/cobra"
 )
 
 type command struct {
+	promReg             *prometheus.Registry
 	pac                 *url.URL
+	pacGeneratorConfig  *forwarder.PACGeneratorConfig
+	pacServerConfig     *forwarder.PACServerConfig
+	denyDomains         []ruleset.ListItem
+	directDomains       []ruleset.ListItem
+	denyDomainsFile     *url.URL
+	directDomainsFile   *url.URL
 	dnsConfig           *forwarder.DNSConfig
 	httpTransportConfig *forwarder.HTTPTransportConfig
 	httpServerConfig    *forwarder.HTTPServerConfig
+	apiServerConfig     *forwarder.HTTPServerConfig
 	logConfig           *log.Config
 }
 
@@ -85,55 +96,109 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		}
 	}
 
-	t, err := forwarder.NewHTTPTransport(c.httpTransportConfig)
+	script, err := c.script()
 	if err != nil {
 		return err
 	}
 
-	script, err := forwarder.ReadURLString(c.pac, t)
+	ps, err := forwarder.NewPACServer(script, c.pacServerConfig, logger.Named("pac"))
 	if err != nil {
-		return fmt.Errorf("read PAC file: %w", err)
-	}
-	if err := validatePACScript(script); err != nil {
 		return err
 	}
 
-	s, err := forwarder.NewHTTPServer(c.httpServerConfig, servePAC(script), logger.Named("server"))
+	// The PAC file is served on all paths including /wpad.dat, the path used by WPAD clients.
+	mux := http.NewServeMux()
+	mux.Handle("/", ps)
+
+	s, err := forwarder.NewHTTPServer(c.httpServerConfig, mux, logger.Named("server"))
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
-	return runctx.NewGroup(s.Run).Run()
+	g := runctx.NewGroup(s.Run)
+
+	if c.apiServerConfig.Address != "" {
+		h := forwarder.NewAPIHandler("Forwarder PAC server "+version.Version, c.promReg, nil)
+		a, err := forwarder.NewHTTPServer(c.apiServerConfig, h, logger.Named("api"))
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+		g.Add(a.Run)
+	}
+
+	return g.Run()
 }
 
-func validatePACScript(script string) error {
-	pr, err := pac.NewProxyResolver(&pac.ProxyResolverConfig{Script: script}, nil)
+// script returns the PAC script generated from the proxy configuration if --proxy is set,
+// otherwise it reads the PAC file.
+func (c *command) script() (string, error) {
+	t, err := forwarder.NewHTTPTransport(c.httpTransportConfig)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	if c.pacGeneratorConfig.Proxy != nil {
+		denyDomains, err := readDomains(c.denyDomains, c.denyDomainsFile, t)
+		if err != nil {
+			return "", fmt.Errorf("read deny domains file: %w", err)
+		}
+		directDomains, err := readDomains(c.directDomains, c.directDomainsFile, t)
+		if err != nil {
+			return "", fmt.Errorf("read direct domains file: %w", err)
+		}
+		c.pacGeneratorConfig.DenyDomains = denyDomains
+		c.pacGeneratorConfig.DirectDomains = directDomains
+		return forwarder.GeneratePAC(c.pacGeneratorConfig)
 	}
-	_, err = pr.FindProxyForURL(&url.URL{Scheme: "https", Host: "saucelabs.com"}, "")
-	return err
+
+	pacURL, err := forwarder.ResolvePACURL(context.Background(), c.pac, t)
+	if err != nil {
+		return "", err
+	}
+	script, err := forwarder.ReadURLString(pacURL, t)
+	if err != nil {
+		return "", fmt.Errorf("read PAC file: %w", err)
+	}
+
+	return script, nil
 }
 
-func servePAC(script string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
-		w.Write([]byte(script))
-	})
+// readDomains returns the static domains followed by the domains read from the file, if set.
+func readDomains(static []ruleset.ListItem, u *url.URL, rt http.RoundTripper) ([]ruleset.ListItem, error) {
+	if u == nil {
+		return static, nil
+	}
+	items, err := forwarder.ReadRuleList(u, rt)
+	if err != nil {
+		return nil, err
+	}
+	return append(static[:len(static):len(static)], items...), nil
 }
 
+const promNs = "forwarder"
+
 func Command() *cobra.Command {
 	c := command{
+		promReg:             prometheus.NewRegistry(),
 		pac:                 &url.URL{Scheme: "file", Path: "pac.js"},
+		pacGeneratorConfig:  forwarder.DefaultPACGeneratorConfig(),
+		pacServerConfig:     forwarder.DefaultPACServerConfig(),
 		dnsConfig:           forwarder.DefaultDNSConfig(),
 		httpTransportConfig: forwarder.DefaultHTTPTransportConfig(),
 		httpServerConfig:    forwarder.DefaultHTTPServerConfig(),
+		apiServerConfig:     forwarder.DefaultHTTPServerConfig(),
 		logConfig:           log.DefaultConfig(),
 	}
+	c.pacServerConfig.PromRegistry = c.promReg
+	c.pacServerConfig.PromNamespace = promNs
+	c.httpServerConfig.PromRegistry = c.promReg
+	c.httpServerConfig.PromNamespace = promNs
+	c.apiServerConfig.Address = ""
 
 	cmd := &cobra.Command{
-		Use:     "server --pac <file|url> [--protocol <http|https|h2>] [--address <host:port>] [flags]",
+		Use:     "server --pac <file|url> | --proxy <host:port> [--protocol <http|https|h2>] [--address <host:port>] [flags]",
 		Short:   "Start HTTP server that serves a PAC file",
 		Long:    long,
 		RunE:    c.runE,
@@ -142,14 +207,20 @@ func Command() *cobra.Command {
 
 	fs := cmd.Flags()
 	bind.PAC(fs, &c.pac)
+	bind.PACGeneratorConfig(fs, c.pacGeneratorConfig, &c.directDomains, &c.denyDomains, &c.directDomainsFile, &c.denyDomainsFile)
+	bind.PACServerConfig(fs, c.pacServerConfig)
 	bind.DNSConfig(fs, c.dnsConfig)
 	bind.HTTPServerConfig(fs, c.httpServerConfig, "")
+	bind.HTTPServerConfig(fs, c.apiServerConfig, "api", forwarder.HTTPScheme)
 	bind.HTTPTransportConfig(fs, c.httpTransportConfig)
 	bind.HTTPLogConfig(fs, []bind.NamedParam[httplog.Mode]{
 		{Name: "server", Param: &c.httpServerConfig.LogHTTPMode},
+		{Name: "api", Param: &c.apiServerConfig.LogHTTPMode},
 	})
 	bind.LogConfig(fs, c.logConfig)
 
+	cmd.MarkFlagsMutuallyExclusive("pac", "proxy")
+
 	bind.AutoMarkFlagFilename(cmd)
 
 	return cmd
@@ -164,6 +235,17 @@ the server will generate a self-signed certificate on startup.
 The PAC file can be specified as a file path or URL with scheme "file", "http" or "https".
 The PAC file must contain FindProxyForURL or FindProxyForURLEx and must be valid.
 Alerts are ignored.
+
+Alternatively, the PAC file can be generated from the proxy configuration with the --proxy flag.
+The generated file applies the --deny-domains, --direct-domains and --proxy-localhost flags,
+and the domains read from --deny-domains-file and --direct-domains-file at startup, the same way the proxy does, so that clients and the proxy agree on which requests are proxied.
+
+With --pac-template the PAC file is executed as a Go text/template for every request,
+this allows serving environment specific files based on the client IP, user agent or query parameters.
+
+The PAC file is served on all paths including /wpad.dat.
+Responses include ETag, Last-Modified and Cache-Control headers.
+If --api-address is set, the API server exposes metrics including the number of PAC file fetches.
 `
 
 const example = `  # HTTP server with basic authentication
@@ -172,6 +254,12 @@ const example = `  # HTTP server with basic authentication
   # HTTPS server with self-signed certificate
   forwarder pac server --pac pac.js --protocol https --address localhost:80443
 
+  # Generate the PAC file from the proxy configuration
+  forwarder pac server --proxy localhost:3128 --direct-domains "host:.internal" --proxy-localhost direct
+
+  # Serve a templated PAC file, e.g. /proxy.pac?env=staging
+  forwarder pac server --pac pac.js.tmpl --pac-template --api-address localhost:10000
+
   # HTTPS server with custom certificate
   forwarder pac server --pac pac.js --protocol https --address localhost:80443 --tls-cert-file cert.pem --tls-key-file key.pem
 `
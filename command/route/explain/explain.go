@@ -0,0 +1,213 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package explain
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/saucelabs/forwarder"
+	"github.com/saucelabs/forwarder/bind"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/spf13/cobra"
+)
+
+type command struct {
+	apiAddr             string
+	method              string
+	timeout             time.Duration
+	routesFile          *url.URL
+	credentials         []*forwarder.HostPortUser
+	listener            string
+	user                string
+	httpTransportConfig *forwarder.HTTPTransportConfig
+}
+
+func (c *command) runE(cmd *cobra.Command, args []string) error {
+	if c.routesFile == nil {
+		return c.explainAPI(cmd, args)
+	}
+	return c.explainOffline(cmd, args)
+}
+
+// explainAPI queries the /debug/route endpoint of a running Forwarder instance.
+func (c *command) explainAPI(cmd *cobra.Command, args []string) error {
+	var (
+		addr string
+		tr   http.Transport
+	)
+	if socketPath, ok := strings.CutPrefix(c.apiAddr, "unix:"); ok {
+		addr = "unix"
+		tr.DialContext = func(_ context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		}
+	} else {
+		host, port, err := net.SplitHostPort(c.apiAddr)
+		if err != nil {
+			return err
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+
+	httpc := http.Client{
+		Transport: &tr,
+		Timeout:   c.timeout,
+	}
+
+	w := cmd.OutOrStdout()
+	for _, arg := range args {
+		q := url.Values{}
+		q.Set("url", arg)
+		if c.method != "" {
+			q.Set("method", c.method)
+		}
+		if c.listener != "" {
+			q.Set("listener", c.listener)
+		}
+		if c.user != "" {
+			q.Set("user", c.user)
+		}
+
+		resp, err := httpc.Get(fmt.Sprintf("http://%s/debug/route?%s", addr, q.Encode()))
+		if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: unexpected status code: %d: %s", arg, resp.StatusCode, strings.TrimSpace(string(b)))
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// explainOffline evaluates the routing table from the routes file.
+func (c *command) explainOffline(cmd *cobra.Command, args []string) error {
+	t, err := forwarder.NewHTTPTransport(c.httpTransportConfig)
+	if err != nil {
+		return err
+	}
+
+	b, err := forwarder.ReadURL(c.routesFile, t)
+	if err != nil {
+		return fmt.Errorf("read routes file: %w", err)
+	}
+	cfg, err := forwarder.ParseRoutingTableConfig(b)
+	if err != nil {
+		return fmt.Errorf("parse routes file: %w", err)
+	}
+	cm, err := forwarder.NewCredentialsMatcher(c.credentials, stdlog.Default())
+	if err != nil {
+		return fmt.Errorf("credentials: %w", err)
+	}
+	rt, err := forwarder.NewRoutingTable(cfg, cm)
+	if err != nil {
+		return err
+	}
+
+	w := cmd.OutOrStdout()
+	for _, arg := range args {
+		u, err := url.Parse(arg)
+		if err != nil {
+			return fmt.Errorf("parse URL: %w", err)
+		}
+		m := rt.Route(forwarder.RouteRequest{
+			URL:      u,
+			Listener: c.listener,
+			User:     c.user,
+		})
+		switch {
+		case m == nil:
+			fmt.Fprintf(w, "%s no matching route\n", u.Redacted())
+		case m.Upstream == nil:
+			fmt.Fprintf(w, "%s route=%s upstream=%s\n", u.Redacted(), m.Rule, forwarder.DirectUpstream)
+		default:
+			chain := slices.Concat(m.Via, []*url.URL{m.Upstream})
+			fmt.Fprintf(w, "%s route=%s upstream=%s\n", u.Redacted(), m.Rule, forwarder.RedactProxyChain(chain))
+		}
+	}
+
+	return nil
+}
+
+func Command() *cobra.Command {
+	c := command{
+		apiAddr:             "localhost:10000",
+		timeout:             5 * time.Second,
+		listener:            forwarder.MainListenerName,
+		httpTransportConfig: forwarder.DefaultHTTPTransportConfig(),
+	}
+	if os.Getenv("PLATFORM") == "container" {
+		c.apiAddr = "unix:" + forwarder.APIUnixSocket
+	}
+
+	cmd := &cobra.Command{
+		Use:     "explain [--api-address <host:port>] [flags] <url>...",
+		Short:   "Show which route and upstream are selected for given URL (or URLs)",
+		Long:    long,
+		Args:    cobra.MinimumNArgs(1),
+		RunE:    c.runE,
+		Example: example,
+	}
+
+	fs := cmd.Flags()
+	fs.StringVar(&c.apiAddr, "api-address", c.apiAddr, "<host:port>"+
+		"The API server address of the running Forwarder instance, use unix:<path> for a Unix socket. ")
+	fs.StringVar(&c.method, "method", c.method, "<method>"+
+		"HTTP method of the requests, by default GET for URLs with a scheme and CONNECT for host:port. "+
+		"Ignored with --routes-file. ")
+	fs.DurationVar(&c.timeout, "timeout", c.timeout, "<duration>"+
+		"Timeout for the API requests. ")
+	bind.RoutesFile(fs, &c.routesFile)
+	bind.Credentials(fs, &c.credentials)
+	fs.StringVar(&c.listener, "listener", c.listener, "<name>"+
+		"Name of the listener the requests are received on. ")
+	fs.StringVar(&c.user, "user", c.user, "<username>"+
+		"Name of the authenticated user sending the requests. ")
+	bind.HTTPTransportConfig(fs, c.httpTransportConfig)
+
+	bind.AutoMarkFlagFilename(cmd)
+
+	return cmd
+}
+
+const long = `Show which route and upstream are selected for given URL (or URLs).
+By default, the running Forwarder instance is asked to explain the routing decision using the /debug/route API endpoint.
+The report is a JSON object per URL with the decision (localhost, direct_domains, route, pac, proxy_func, upstream_proxy or direct), the matched route, the upstream, the credentials source, whether the request would be intercepted (MITM) and the header changes.
+With --routes-file, only the routing table is evaluated offline.
+The output is one line per URL with the matched route name and upstream.
+Use the https scheme for URLs that would be requested with CONNECT.
+No requests are sent to the URLs and credentials are redacted.
+`
+
+const example = `  # Explain routing decisions of the running instance
+  forwarder route explain https://www.google.com www.google.com:443
+
+  # Explain routing for multiple URLs using the routes file only
+  forwarder route explain --routes-file routes.yaml https://www.google.com http://intranet.corp.example.com
+
+  # Explain routing for an authenticated user
+  forwarder route explain --routes-file routes.yaml --user ci https://www.google.com
+`
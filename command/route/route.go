@@ -0,0 +1,23 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package route
+
+import (
+	"github.com/saucelabs/forwarder/command/route/explain"
+	"github.com/spf13/cobra"
+)
+
+func Command() (cmd *cobra.Command) {
+	cmd = &cobra.Command{
+		Use:   "route",
+		Short: "Tools for working with upstream routing tables",
+	}
+	cmd.AddCommand(
+		explain.Command(),
+	)
+	return cmd
+}
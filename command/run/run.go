@@ -15,6 +15,7 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
@@ -26,7 +27,6 @@ import (
 	"github.com/saucelabs/forwarder/log"
 	"github.com/saucelabs/forwarder/log/martianlog"
 	"github.com/saucelabs/forwarder/log/stdlog"
-	"github.com/saucelabs/forwarder/pac"
 	"github.com/saucelabs/forwarder/ruleset"
 	"github.com/saucelabs/forwarder/runctx"
 	"github.com/saucelabs/forwarder/utils/cobrautil"
@@ -43,19 +43,30 @@ type command struct {
 	httpTransportConfig *forwarder.HTTPTransportConfig
 	connectTo           []forwarder.HostPortPair
 	pac                 *url.URL
+	pacConfig           *forwarder.PACConfig
+	routesFile          *url.URL
 	credentials         []*forwarder.HostPortUser
-	denyDomains         []ruleset.RegexpListItem
-	directDomains       []ruleset.RegexpListItem
+	denyDomains         []ruleset.ListItem
+	denyDomainsFile     *url.URL
+	directDomains       []ruleset.ListItem
+	directDomainsFile   *url.URL
+	domainsFileRefresh  time.Duration
+	jwtAuthConfig       *forwarder.JWTAuthConfig
+	extAuthzConfig      *forwarder.ExtAuthzConfig
+	icapConfig          *forwarder.ICAPConfig
+	icapDomains         []ruleset.ListItem
 	connectHeaders      []header.Header
 	requestHeaders      []header.Header
 	responseHeaders     []header.Header
 	httpProxyConfig     *forwarder.HTTPProxyConfig
 	mitm                bool
 	mitmConfig          *forwarder.MITMConfig
-	mitmDomains         []ruleset.RegexpListItem
+	mitmDomains         []ruleset.ListItem
+	mitmDomainsFile     *url.URL
 	proxyProtocol       bool
 	proxyProtocolConfig *forwarder.ProxyProtocolConfig
 	apiServerConfig     *forwarder.HTTPServerConfig
+	tracingConfig       *forwarder.TracingConfig
 	logConfig           *log.Config
 
 	dryRun bool
@@ -144,7 +155,18 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		c.httpTransportConfig.RedirectFunc = forwarder.DialRedirectFromHostPortPairs(c.connectTo)
 	}
 
-	var pr forwarder.PACResolver
+	if c.httpProxyConfig.ProxyLocalhost == forwarder.DenyProxyLocalhost {
+		lo, err := forwarder.ParseIPRange("loopback")
+		if err != nil {
+			return err
+		}
+		c.httpTransportConfig.DenyIPs = append(c.httpTransportConfig.DenyIPs, lo)
+	}
+
+	var (
+		pr        forwarder.PACResolver
+		pacScript *forwarder.PACScript
+	)
 	if c.pac != nil {
 		// Disable metrics for receiving PAC file.
 		cfg := *c.httpTransportConfig
@@ -154,25 +176,33 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 			return err
 		}
 
-		script, err := forwarder.ReadURLString(c.pac, rt)
-		if err != nil {
-			return fmt.Errorf("read PAC file: %w", err)
-		}
-		pr, err = pac.NewProxyResolverPool(&pac.ProxyResolverConfig{Script: script}, nil)
+		pacURL, err := forwarder.ResolvePACURL(context.Background(), c.pac, rt)
 		if err != nil {
 			return err
 		}
-		if _, err := pr.FindProxyForURL(&url.URL{Scheme: "https", Host: "saucelabs.com"}, ""); err != nil {
-			return err
+		if forwarder.IsWPAD(c.pac) {
+			logger.Named("pac").Infof("discovered PAC file url=%s", pacURL.Redacted())
 		}
-		pr = &forwarder.LoggingPACResolver{
-			Resolver: pr,
+
+		ps, err := forwarder.NewPACScript(pacURL, c.pacConfig, rt, logger.Named("pac"))
+		if err != nil {
+			return fmt.Errorf("PAC: %w", err)
+		}
+		pacScript = ps
+
+		cr, err := forwarder.NewCachingPACResolver(&forwarder.LoggingPACResolver{
+			Resolver: ps,
 			Logger:   logger.Named("pac"),
+		}, c.pacConfig)
+		if err != nil {
+			return fmt.Errorf("PAC: %w", err)
 		}
+		ps.OnUpdate(cr.Purge)
+		pr = cr
 
 		ep = append(ep, forwarder.APIEndpoint{
 			Path:    "/pac",
-			Handler: httphandler.SendFileString("application/x-ns-proxy-autoconfig", script),
+			Handler: ps,
 		})
 	}
 
@@ -181,16 +211,100 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		return fmt.Errorf("credentials: %w", err)
 	}
 
-	if len(c.denyDomains) > 0 {
-		dd, err := ruleset.NewRegexpMatcherFromList(c.denyDomains)
+	if c.routesFile != nil {
+		// Disable metrics for receiving routes file.
+		cfg := *c.httpTransportConfig
+		cfg.PromRegistry = nil
+		rt, err := forwarder.NewHTTPTransport(&cfg)
+		if err != nil {
+			return err
+		}
+
+		b, err := forwarder.ReadURL(c.routesFile, rt)
+		if err != nil {
+			return fmt.Errorf("read routes file: %w", err)
+		}
+		rc, err := forwarder.ParseRoutingTableConfig(b)
+		if err != nil {
+			return fmt.Errorf("parse routes file: %w", err)
+		}
+		c.httpProxyConfig.RoutingTable, err = forwarder.NewRoutingTable(rc, cm)
+		if err != nil {
+			return fmt.Errorf("routes: %w", err)
+		}
+	}
+
+	var jwtAuth *forwarder.JWTAuth
+	if c.jwtAuthConfig.JWKS != nil {
+		// Disable metrics for receiving JWKS.
+		cfg := *c.httpTransportConfig
+		cfg.PromRegistry = nil
+		rt, err := forwarder.NewHTTPTransport(&cfg)
+		if err != nil {
+			return err
+		}
+
+		jwtAuth, err = forwarder.NewJWTAuth(c.jwtAuthConfig, rt, logger.Named("jwt"))
+		if err != nil {
+			return fmt.Errorf("jwt: %w", err)
+		}
+		c.httpProxyConfig.JWTAuth = jwtAuth
+	}
+
+	if c.extAuthzConfig.URL != nil {
+		// Disable metrics for authorization checks.
+		cfg := *c.httpTransportConfig
+		cfg.PromRegistry = nil
+		rt, err := forwarder.NewHTTPTransport(&cfg)
+		if err != nil {
+			return err
+		}
+
+		a, err := forwarder.NewExtAuthz(c.extAuthzConfig, rt, logger.Named("ext-authz"))
+		if err != nil {
+			return fmt.Errorf("ext-authz: %w", err)
+		}
+		defer a.Close()
+		c.httpProxyConfig.ExtAuthz = a
+	}
+
+	var ruleLists []*forwarder.RuleList
+
+	domainsMatcher := func(name string, items []ruleset.ListItem, u *url.URL) (forwarder.Matcher, error) {
+		if u == nil {
+			return ruleset.NewMatcherFromList(items)
+		}
+
+		// Disable metrics for receiving domains files.
+		cfg := *c.httpTransportConfig
+		cfg.PromRegistry = nil
+		rt, err := forwarder.NewHTTPTransport(&cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		rl, err := forwarder.NewRuleList(name, &forwarder.RuleListConfig{
+			URL:             u,
+			RefreshInterval: c.domainsFileRefresh,
+			PromConfig:      c.httpProxyConfig.PromConfig,
+		}, items, rt, logger.Named(name+"-domains"))
+		if err != nil {
+			return nil, err
+		}
+		ruleLists = append(ruleLists, rl)
+		return rl, nil
+	}
+
+	if len(c.denyDomains) > 0 || c.denyDomainsFile != nil {
+		dd, err := domainsMatcher("deny", c.denyDomains, c.denyDomainsFile)
 		if err != nil {
 			return fmt.Errorf("deny domains: %w", err)
 		}
 		c.httpProxyConfig.DenyDomains = dd
 	}
 
-	if len(c.directDomains) > 0 {
-		dd, err := ruleset.NewRegexpMatcherFromList(c.directDomains)
+	if len(c.directDomains) > 0 || c.directDomainsFile != nil {
+		dd, err := domainsMatcher("direct", c.directDomains, c.directDomainsFile)
 		if err != nil {
 			return fmt.Errorf("direct domains: %w", err)
 		}
@@ -199,11 +313,11 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 
 	c.configureHeadersModifiers()
 
-	if c.mitm || c.mitmConfig.CACertFile != "" || len(c.mitmDomains) > 0 {
+	if c.mitm || c.mitmConfig.CACertFile != "" || len(c.mitmDomains) > 0 || c.mitmDomainsFile != nil {
 		c.httpProxyConfig.MITM = c.mitmConfig
 
-		if len(c.mitmDomains) > 0 {
-			dd, err := ruleset.NewRegexpMatcherFromList(c.mitmDomains)
+		if len(c.mitmDomains) > 0 || c.mitmDomainsFile != nil {
+			dd, err := domainsMatcher("mitm", c.mitmDomains, c.mitmDomainsFile)
 			if err != nil {
 				return fmt.Errorf("mitm domains: %w", err)
 			}
@@ -211,11 +325,49 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		}
 	}
 
+	if c.icapConfig.ReqModURL != nil || c.icapConfig.RespModURL != nil {
+		c.httpProxyConfig.ICAP = c.icapConfig
+
+		if len(c.icapDomains) > 0 {
+			dd, err := ruleset.NewMatcherFromList(c.icapDomains)
+			if err != nil {
+				return fmt.Errorf("icap domains: %w", err)
+			}
+			c.httpProxyConfig.ICAPDomains = dd
+		}
+	}
+
 	if c.proxyProtocol {
 		c.httpProxyConfig.ProxyProtocolConfig = c.proxyProtocolConfig
 	}
 
+	if c.tracingConfig.Endpoint != nil {
+		logger.Named("tracing").Infof("exporting traces to %s", c.tracingConfig.Endpoint.Redacted())
+		tp, err := forwarder.NewTracerProvider(c.tracingConfig)
+		if err != nil {
+			return fmt.Errorf("tracing: %w", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tp.Shutdown(ctx); err != nil {
+				logger.Named("tracing").Errorf("flush traces: %s", err)
+			}
+		}()
+		c.httpProxyConfig.TracerProvider = tp
+		c.httpProxyConfig.TracingInject = c.tracingConfig.Inject
+	}
+
 	g := runctx.NewGroup()
+	for _, rl := range ruleLists {
+		g.Add(rl.Run)
+	}
+	if jwtAuth != nil {
+		g.Add(jwtAuth.Run)
+	}
+	if pacScript != nil {
+		g.Add(pacScript.Run)
+	}
 	{
 		rt, err := forwarder.NewHTTPTransport(c.httpTransportConfig)
 		if err != nil {
@@ -224,6 +376,10 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		rt.DialContext = martianlog.LoggingDialContext(rt.DialContext)
 		c.transportWithProxyConnectHeader(rt)
 
+		// The transport dialer filters destination IPs, the proxy explains routes with a dialer configured the same way.
+		dcfg := c.httpTransportConfig.DialConfig
+		dcfg.PromRegistry = nil
+		c.httpProxyConfig.CheckDestination = forwarder.NewDialer(&dcfg).CheckDestination
 		p, err := forwarder.NewHTTPProxy(c.httpProxyConfig, pr, cm, rt, logger.Named("proxy"))
 		if err != nil {
 			return err
@@ -231,6 +387,11 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		defer p.Close()
 		g.Add(p.Run)
 
+		ep = append(ep, forwarder.APIEndpoint{
+			Path:    "/debug/route",
+			Handler: p.ExplainRouteHandler(),
+		})
+
 		if ca := p.MITMCACert(); ca != nil {
 			ep = append(ep, forwarder.APIEndpoint{
 				Path:    "/cacert",
@@ -422,17 +583,31 @@ func Command() *cobra.Command {
 	bind.HTTPTransportConfig(fs, c.httpTransportConfig)
 	bind.ConnectTo(fs, &c.connectTo)
 	bind.PAC(fs, &c.pac)
+	bind.PACConfig(fs, c.pacConfig)
+	bind.RoutesFile(fs, &c.routesFile)
 	bind.Credentials(fs, &c.credentials)
 	bind.DenyDomains(fs, &c.denyDomains)
 	bind.DirectDomains(fs, &c.directDomains)
+	bind.DenyIPs(fs, &c.httpTransportConfig.DenyIPs)
+	bind.AllowIPs(fs, &c.httpTransportConfig.AllowIPs)
+	bind.DenyDomainsFile(fs, &c.denyDomainsFile)
+	bind.DirectDomainsFile(fs, &c.directDomainsFile)
+	bind.DomainsFileRefreshInterval(fs, &c.domainsFileRefresh)
 	bind.ConnectHeaders(fs, &c.connectHeaders)
 	bind.RequestHeaders(fs, &c.requestHeaders)
 	bind.ResponseHeaders(fs, &c.responseHeaders)
 	bind.HTTPProxyConfig(fs, c.httpProxyConfig, c.logConfig)
+	bind.SSHConfig(fs, &c.httpProxyConfig.SSH)
+	bind.JWTAuthConfig(fs, c.jwtAuthConfig)
+	bind.ExtAuthzConfig(fs, c.extAuthzConfig)
+	bind.ICAPConfig(fs, c.icapConfig)
+	bind.ICAPDomains(fs, &c.icapDomains)
 	bind.MITMConfig(fs, &c.mitm, c.mitmConfig)
 	bind.MITMDomains(fs, &c.mitmDomains)
+	bind.MITMDomainsFile(fs, &c.mitmDomainsFile)
 	bind.ProxyProtocol(fs, &c.proxyProtocol, c.proxyProtocolConfig)
 	bind.HTTPServerConfig(fs, c.apiServerConfig, "api", forwarder.HTTPScheme)
+	bind.TracingConfig(fs, c.tracingConfig)
 	bind.HTTPLogConfig(fs, []bind.NamedParam[httplog.Mode]{
 		{Name: "api", Param: &c.apiServerConfig.LogHTTPMode},
 		{Name: "proxy", Param: &c.httpProxyConfig.LogHTTPMode},
@@ -483,15 +658,25 @@ func makeCommand() command {
 		dnsConfig:           forwarder.DefaultDNSConfig(),
 		httpTransportConfig: forwarder.DefaultHTTPTransportConfig(),
 		httpProxyConfig:     forwarder.DefaultHTTPProxyConfig(),
+		jwtAuthConfig:       forwarder.DefaultJWTAuthConfig(),
+		extAuthzConfig:      forwarder.DefaultExtAuthzConfig(),
+		icapConfig:          forwarder.DefaultICAPConfig(),
+		pacConfig:           forwarder.DefaultPACConfig(),
 		mitmConfig:          forwarder.DefaultMITMConfig(),
 		proxyProtocolConfig: forwarder.DefaultProxyProtocolConfig(),
 		apiServerConfig:     forwarder.DefaultHTTPServerConfig(),
+		tracingConfig:       forwarder.DefaultTracingConfig(),
 		logConfig:           log.DefaultConfig(),
+		domainsFileRefresh:  forwarder.DefaultRuleListConfig().RefreshInterval,
 	}
 	c.httpTransportConfig.PromRegistry = c.promReg
 	c.httpTransportConfig.PromNamespace = promNs
 	c.httpProxyConfig.PromRegistry = c.promReg
 	c.httpProxyConfig.PromNamespace = promNs
+	c.pacConfig.PromRegistry = c.promReg
+	c.pacConfig.PromNamespace = promNs
+	c.extAuthzConfig.PromRegistry = c.promReg
+	c.extAuthzConfig.PromNamespace = promNs
 	c.apiServerConfig.Address = "localhost:10000"
 
 	return c
@@ -17,6 +17,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	_ "unsafe" // for go:linkname
 
 	"golang.org/x/exp/slices"
@@ -85,11 +86,13 @@ func ParseProxyURL(val string) (*url.URL, error) {
 	} else {
 		hp = hpu
 	}
+	hp, q, _ := strings.Cut(hp, "?")
 
 	u := &url.URL{
-		Scheme: scheme,
-		Host:   hp,
-		User:   ui,
+		Scheme:   scheme,
+		Host:     hp,
+		User:     ui,
+		RawQuery: q,
 	}
 	if err := validateProxyURL(u); err != nil {
 		return nil, err
@@ -107,7 +110,10 @@ func validateProxyURL(u *url.URL) error {
 		supportedSchemes := []string{
 			"http",
 			"https",
+			"socks4",
+			"socks4a",
 			"socks5",
+			"ssh",
 		}
 		if !slices.Contains(supportedSchemes, u.Scheme) {
 			return fmt.Errorf("unsupported scheme %q, supported schemes are: %s", u.Scheme, strings.Join(supportedSchemes, ", "))
@@ -126,8 +132,31 @@ func validateProxyURL(u *url.URL) error {
 
 		uu := *u
 		uu.User = nil
+		uu.RawQuery = ""
 		if uu.String() != c.String() {
-			return errors.New("unsupported URL elements, format: [<protocol>://]<host>:<port>")
+			return errors.New("unsupported URL elements, format: [<protocol>://]<host>:<port>[?timeout=<duration>]")
+		}
+	}
+
+	if u.RawQuery != "" {
+		q, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			return err
+		}
+		for k, v := range q {
+			if k != "timeout" {
+				return fmt.Errorf("unsupported query parameter %q, supported parameters are: timeout", k)
+			}
+			if len(v) != 1 {
+				return errors.New("timeout must be set once")
+			}
+			d, err := time.ParseDuration(v[0])
+			if err != nil {
+				return fmt.Errorf("timeout: %w", err)
+			}
+			if d <= 0 {
+				return errors.New("timeout must be positive")
+			}
 		}
 	}
 
@@ -72,7 +72,7 @@ func NewCredentialsMatcher(credentials []*HostPortUser, log log.Logger) (*Creden
 	return m, nil
 }
 
-// MatchURL adds standard http and https ports if they are missing in URL and calls Match function.
+// MatchURL adds standard http, https and ssh ports if they are missing in URL and calls Match function.
 func (m *CredentialsMatcher) MatchURL(u *url.URL) *url.Userinfo {
 	if m == nil || u == nil {
 		return nil
@@ -81,6 +81,7 @@ func (m *CredentialsMatcher) MatchURL(u *url.URL) *url.Userinfo {
 	const (
 		httpPort  = 80
 		httpsPort = 443
+		sshPort   = 22
 	)
 
 	hostport := u.Host
@@ -90,6 +91,8 @@ func (m *CredentialsMatcher) MatchURL(u *url.URL) *url.Userinfo {
 			hostport = fmt.Sprintf("%s:%d", u.Host, httpPort)
 		case "https":
 			hostport = fmt.Sprintf("%s:%d", u.Host, httpsPort)
+		case "ssh":
+			hostport = fmt.Sprintf("%s:%d", u.Host, sshPort)
 		default:
 			m.log.Errorf("cannot to determine port for %s", u.Redacted())
 			return nil
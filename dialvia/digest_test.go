@@ -0,0 +1,137 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dialvia_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/dialvia"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+func TestHTTPProxyDialerDigest(t *testing.T) {
+	da := middleware.NewProxyDigestAuth("test")
+	h := da.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + string(b)))
+	}), "user", "pass")
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		h.ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	newDialer := func(scheme dialvia.AuthScheme) *dialvia.HTTPProxyDialer {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.User = url.UserPassword("user", "pass")
+		d := dialvia.HTTPProxy((&net.Dialer{Timeout: 5 * time.Second}).DialContext, u)
+		d.AuthScheme = scheme
+		return d
+	}
+
+	roundTrip := func(t *testing.T, d *dialvia.HTTPProxyDialer, body io.Reader) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, "http://example.com/", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := d.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	t.Run("connect", func(t *testing.T) {
+		for _, scheme := range []dialvia.AuthScheme{dialvia.BasicAuth, dialvia.DigestAuth} {
+			conn, err := newDialer(scheme).DialContext(context.Background(), "tcp", "example.com:443")
+			if err != nil {
+				t.Fatalf("%s: %v", scheme, err)
+			}
+			conn.Close()
+		}
+	})
+
+	t.Run("forward", func(t *testing.T) {
+		for _, scheme := range []dialvia.AuthScheme{dialvia.BasicAuth, dialvia.DigestAuth} {
+			code, body := roundTrip(t, newDialer(scheme), strings.NewReader("hello"))
+			if code != http.StatusOK || body != "POST hello" {
+				t.Fatalf("%s: unexpected response %d %q", scheme, code, body)
+			}
+		}
+	})
+
+	t.Run("forward body not rewindable", func(t *testing.T) {
+		code, _ := roundTrip(t, newDialer(dialvia.BasicAuth), io.NopCloser(strings.NewReader("hello")))
+		if code != http.StatusProxyAuthRequired {
+			t.Fatalf("expected %d, got %d", http.StatusProxyAuthRequired, code)
+		}
+		code, body := roundTrip(t, newDialer(dialvia.DigestAuth), io.NopCloser(strings.NewReader("hello")))
+		if code != http.StatusOK || body != "POST hello" {
+			t.Fatalf("unexpected response %d %q", code, body)
+		}
+	})
+	t.Run("cached challenge", func(t *testing.T) {
+		session := new(dialvia.DigestSession)
+		newSessionDialer := func() *dialvia.HTTPProxyDialer {
+			d := newDialer(dialvia.DigestAuth)
+			d.Digest = session
+			return d
+		}
+
+		// The first request is challenged, subsequent requests send credentials up front with an increasing nonce count.
+		requests.Store(0)
+		code, body := roundTrip(t, newSessionDialer(), strings.NewReader("hello"))
+		if code != http.StatusOK || body != "POST hello" {
+			t.Fatalf("unexpected response %d %q", code, body)
+		}
+		if got := requests.Load(); got != 2 {
+			t.Fatalf("expected 2 requests, got %d", got)
+		}
+
+		requests.Store(0)
+		for range 3 {
+			code, body := roundTrip(t, newSessionDialer(), strings.NewReader("hello"))
+			if code != http.StatusOK || body != "POST hello" {
+				t.Fatalf("unexpected response %d %q", code, body)
+			}
+			conn, err := newSessionDialer().DialContext(context.Background(), "tcp", "example.com:443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		}
+		if got := requests.Load(); got != 6 {
+			t.Fatalf("expected 6 requests, got %d", got)
+		}
+
+		// A body that cannot be sent again is sent after probing the proxy.
+		requests.Store(0)
+		code, body = roundTrip(t, newSessionDialer(), io.NopCloser(strings.NewReader("hello")))
+		if code != http.StatusOK || body != "POST hello" {
+			t.Fatalf("unexpected response %d %q", code, body)
+		}
+		if got := requests.Load(); got != 2 {
+			t.Fatalf("expected 2 requests, got %d", got)
+		}
+	})
+}
@@ -15,13 +15,51 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/saucelabs/forwarder/digest"
+	"github.com/saucelabs/forwarder/ntlm"
 	"golang.org/x/exp/maps"
 )
 
+// AuthScheme is the scheme used to authenticate with the proxy using the proxy URL credentials.
+type AuthScheme string
+
+const (
+	BasicAuth AuthScheme = "basic"
+	// NTLMAuth and NegotiateAuth run the NTLMv2 handshake on the connection, see package ntlm.
+	// NegotiateAuth sends the NTLM messages with the Negotiate scheme name, Kerberos is not supported.
+	NTLMAuth      AuthScheme = "ntlm"
+	NegotiateAuth AuthScheme = "negotiate"
+	// DigestAuth sends the request without credentials and answers the Digest challenge, see package digest.
+	// With BasicAuth, Digest challenges are answered as well but basic credentials are sent first.
+	DigestAuth AuthScheme = "digest"
+)
+
+func (s *AuthScheme) UnmarshalText(text []byte) error {
+	switch AuthScheme(text) {
+	case BasicAuth, NTLMAuth, NegotiateAuth, DigestAuth:
+		*s = AuthScheme(text)
+		return nil
+	default:
+		return fmt.Errorf("invalid auth scheme: %s", text)
+	}
+}
+
+func (s AuthScheme) String() string {
+	return string(s)
+}
+
+// ConnectionOriented returns true if the scheme authenticates the connection with a multi-round handshake.
+func (s AuthScheme) ConnectionOriented() bool {
+	return s == NTLMAuth || s == NegotiateAuth
+}
+
 type HTTPProxyDialer struct {
 	dial      ContextDialerFunc
 	proxyURL  *url.URL
@@ -29,6 +67,64 @@ type HTTPProxyDialer struct {
 
 	Timeout            time.Duration
 	ProxyConnectHeader http.Header
+	// AuthScheme specifies how the proxy URL credentials are sent, the default is basic authentication.
+	AuthScheme AuthScheme
+	// HTTP2 optionally specifies the pool used to open tunnels as HTTP/2 CONNECT streams to an HTTPS proxy.
+	// It is used with basic authentication only, other schemes use HTTP/1.1 CONNECT.
+	HTTP2 *HTTP2ProxyPool
+	// MaxIdleConns is the maximum number of idle connections kept by RoundTrip for reuse.
+	// Only connections authenticated with a connection oriented scheme are kept,
+	// requests sent over them are not authenticated again. Zero disables reuse.
+	MaxIdleConns int
+	// IdleConnTimeout is the maximum amount of time an idle connection is kept, zero means no limit.
+	IdleConnTimeout time.Duration
+	// Digest optionally caches the Digest challenge of the proxy across requests and dialers,
+	// so that Digest credentials are sent with the request instead of waiting for a challenge.
+	Digest *DigestSession
+
+	idleMu sync.Mutex
+	idle   []idleConn
+}
+
+// DigestSession is the Digest challenge last sent by a proxy and the number of requests authorized with its nonce.
+// The zero value is ready to use, it is safe for concurrent use.
+type DigestSession struct {
+	mu sync.Mutex
+	c  *digest.Challenge
+	nc uint32
+}
+
+// authorize returns the credentials for the request with the cached challenge and the next nonce count,
+// or nil if there is no challenge.
+func (s *DigestSession) authorize(req *http.Request, u *url.Userinfo) (*digest.Credentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.c == nil {
+		return nil, nil
+	}
+	s.nc++
+	pass, _ := u.Password()
+	return digest.Authorize(s.c, req.Method, digestURI(req), u.Username(), pass, s.nc)
+}
+
+// update caches the challenge and resets the nonce count.
+// Challenges without qop are not cached, as their nonce cannot be used more than once.
+func (s *DigestSession) update(c *digest.Challenge) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(c.QOP) == 0 {
+		s.c = nil
+	} else {
+		s.c = c
+	}
+	s.nc = 0
+}
+
+type idleConn struct {
+	pc    *proxyConn
+	since time.Time
 }
 
 func HTTPProxy(dial ContextDialerFunc, proxyURL *url.URL) *HTTPProxyDialer {
@@ -109,47 +205,488 @@ func (d *HTTPProxyDialer) DialContextR(ctx context.Context, network, addr string
 		defer cancel()
 	}
 
-	conn, err := d.dial(ctx, "tcp", d.proxyURL.Host)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	// Don't send the default Go HTTP client User-Agent.
+	req.Header.Add("User-Agent", "")
+	maps.Copy(req.Header, d.ProxyConnectHeader)
+
+	// If the proxy does not support HTTP/2, the connection dialed by the pool is used for HTTP/1.1.
+	var fallback net.Conn
+	if d.HTTP2 != nil && (d.AuthScheme == "" || d.AuthScheme == BasicAuth) {
+		if u := d.proxyURL.User; u != nil && req.Header.Get("Proxy-Authorization") == "" {
+			pass, _ := u.Password()
+			auth := u.Username() + ":" + pass
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+		}
+		res, conn, err := d.HTTP2.connect(ctx, req)
+		if res != nil || err != nil {
+			return res, conn, err
+		}
+		fallback = conn
+	}
+
+	dial := func() (*proxyConn, error) {
+		conn := fallback
+		fallback = nil
+		if conn == nil {
+			var err error
+			if conn, err = d.dialProxy(ctx); err != nil {
+				return nil, err
+			}
+		}
+		return &proxyConn{
+			Conn: conn,
+			bw:   bufio.NewWriterSize(conn, 512),
+			br:   bufio.NewReaderSize(byteReader{conn}, 128),
+		}, nil
+	}
+
+	res, pc, err := d.authenticate(ctx, dial, req, (*http.Request).Write)
 	if err != nil {
 		return nil, nil, err
 	}
+
+	return res, pc.Conn, nil
+}
+
+// RoundTrip sends the request to the proxy and returns the response.
+// If AuthScheme is connection oriented, the request is sent over an idle authenticated connection if any,
+// otherwise a new connection is authenticated with the request.
+// If the idle connection fails after the request was written, the request is sent again only if it is replayable.
+// The connection is kept for reuse or closed when the response body is closed, see MaxIdleConns.
+func (d *HTTPProxyDialer) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	r := new(http.Request)
+	*r = *req
+	r.Header = req.Header.Clone()
+
+	if pc := d.idleConn(r); pc != nil {
+		pc.written = false
+		var res *http.Response
+		ok, err := d.setDigestCredentials(r)
+		if err == nil {
+			res, err = pc.roundTrip(ctx, r, (*http.Request).WriteProxy)
+		}
+		switch {
+		case err == nil && res.StatusCode != http.StatusProxyAuthRequired:
+			return d.connResponse(ctx, r, res, pc), nil
+		case err == nil:
+			// The proxy no longer considers the connection authenticated, or the Digest nonce is stale.
+			if c, found := digest.SelectChallenge(res.Header.Values("Proxy-Authenticate")); found && ok {
+				d.Digest.update(c)
+			}
+			io.Copy(io.Discard, res.Body) //nolint:errcheck // connection is closed anyway
+			res.Body.Close()
+		case ctx.Err() != nil, pc.written && !isReplayable(r):
+			// The request may have been processed, sending it again could duplicate side effects.
+			pc.Close()
+			return nil, err
+		}
+		pc.Close()
+
+		if r.Body != nil && r.Body != http.NoBody {
+			if r.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	dial := func() (*proxyConn, error) {
+		dctx := ctx
+		if d.Timeout > 0 {
+			var cancel context.CancelFunc
+			dctx, cancel = context.WithTimeout(ctx, d.Timeout)
+			defer cancel()
+		}
+		conn, err := d.dialProxy(dctx)
+		if err != nil {
+			return nil, err
+		}
+		pc := &proxyConn{
+			Conn: conn,
+			br:   bufio.NewReader(conn),
+		}
+		pc.bw = bufio.NewWriter(pc)
+		return pc, nil
+	}
+
+	res, pc, err := d.authenticate(ctx, dial, r, (*http.Request).WriteProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.connResponse(ctx, r, res, pc), nil
+}
+
+// connResponse wraps the response body so that the connection is kept for reuse or closed when the body is closed.
+// Once the body is read to EOF, canceling ctx no longer closes the connection.
+func (d *HTTPProxyDialer) connResponse(ctx context.Context, req *http.Request, res *http.Response, pc *proxyConn) *http.Response {
+	b := &connBody{
+		ReadCloser: res.Body,
+		pc:         pc,
+		stop:       context.AfterFunc(ctx, func() { pc.Close() }),
+	}
+	if res.Body == http.NoBody {
+		b.done = b.stop()
+	}
+	if !res.Close && !req.Close && res.StatusCode != http.StatusSwitchingProtocols {
+		b.put = d.putIdleConn
+	}
+	res.Body = b
+	return res
+}
+
+type connBody struct {
+	io.ReadCloser
+	pc   *proxyConn
+	stop func() bool
+	done bool
+	put  func(pc *proxyConn) bool
+}
+
+func (b *connBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = b.stop()
+	}
+	return n, err
+}
+
+func (b *connBody) Close() error {
+	b.ReadCloser.Close()
+	if b.done && b.put != nil && b.put(b.pc) {
+		return nil
+	}
+	b.stop()
+	return b.pc.Close()
+}
+
+// idleConn returns an idle authenticated connection, or nil if there is none or the request cannot be sent again.
+// The request body must be replayable in case the proxy closed the connection in the meantime.
+func (d *HTTPProxyDialer) idleConn(req *http.Request) *proxyConn {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return nil
+	}
+
+	d.idleMu.Lock()
+	defer d.idleMu.Unlock()
+
+	for len(d.idle) > 0 {
+		ic := d.idle[len(d.idle)-1]
+		d.idle = d.idle[:len(d.idle)-1]
+		if d.IdleConnTimeout > 0 && time.Since(ic.since) > d.IdleConnTimeout {
+			ic.pc.Close()
+			continue
+		}
+		return ic.pc
+	}
+	return nil
+}
+
+// putIdleConn keeps the connection for reuse, it returns false if the connection is not kept.
+func (d *HTTPProxyDialer) putIdleConn(pc *proxyConn) bool {
+	if d.MaxIdleConns <= 0 || d.proxyURL.User == nil {
+		return false
+	}
+	if !d.AuthScheme.ConnectionOriented() && (d.AuthScheme != DigestAuth || d.Digest == nil) {
+		return false
+	}
+
+	d.idleMu.Lock()
+	defer d.idleMu.Unlock()
+
+	if len(d.idle) >= d.MaxIdleConns {
+		d.idle[0].pc.Close()
+		d.idle = d.idle[1:]
+	}
+	d.idle = append(d.idle, idleConn{pc: pc, since: time.Now()})
+	return true
+}
+
+// CloseIdleConnections closes the connections kept for reuse by RoundTrip.
+func (d *HTTPProxyDialer) CloseIdleConnections() {
+	d.idleMu.Lock()
+	defer d.idleMu.Unlock()
+
+	for _, ic := range d.idle {
+		ic.pc.Close()
+	}
+	d.idle = nil
+}
+
+func (d *HTTPProxyDialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	conn, err := d.dial(ctx, "tcp", d.proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
 	if d.proxyURL.Scheme == "https" {
-		conn = tls.Client(conn, d.tlsConfig)
+		tconn := tls.Client(conn, d.tlsConfig)
+		if err := TLSHandshake(ctx, tconn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tconn
 	}
+	return conn, nil
+}
 
-	pbw := bufio.NewWriterSize(conn, 512)
-	pbr := bufio.NewReaderSize(byteReader{conn}, 128)
+// proxyConn is a connection to the proxy with buffered reader and writer.
+type proxyConn struct {
+	net.Conn
+	bw *bufio.Writer
+	br *bufio.Reader
 
-	req := http.Request{
-		Method: http.MethodConnect,
-		URL:    &url.URL{Host: addr},
-		Host:   addr,
-		Header: http.Header{},
+	// written is set when any bytes are written to the connection with Write.
+	written bool
+}
+
+func (pc *proxyConn) Write(b []byte) (int, error) {
+	n, err := pc.Conn.Write(b)
+	if n > 0 {
+		pc.written = true
 	}
+	return n, err
+}
 
-	// Don't send the default Go HTTP client User-Agent.
-	req.Header.Add("User-Agent", "")
-	if u := d.proxyURL.User; u != nil {
-		pass, _ := u.Password()
-		auth := u.Username() + ":" + pass
-		req.Header.Add("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+// isReplayable reports whether the request can be sent again after a failure on a reused connection,
+// it follows the net/http rules: the method is idempotent or the request has an idempotency key.
+func isReplayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
 	}
-	maps.Copy(req.Header, d.ProxyConnectHeader)
+	_, ok := req.Header["Idempotency-Key"]
+	if !ok {
+		_, ok = req.Header["X-Idempotency-Key"]
+	}
+	return ok
+}
 
-	if err := req.Write(pbw); err != nil {
-		conn.Close()
+type writeFunc func(req *http.Request, w io.Writer) error
+
+// authenticate sends the request with the proxy URL credentials and returns the response,
+// and the connection the response was read from.
+// Connection oriented schemes run the handshake on the connection.
+// The Digest scheme sends credentials computed from the cached challenge if any.
+// If the proxy responds with a Digest challenge, the challenge is cached and the request is sent again
+// with Digest credentials, on a new connection if the proxy closed the connection.
+func (d *HTTPProxyDialer) authenticate(ctx context.Context, dial func() (*proxyConn, error),
+	req *http.Request, write writeFunc,
+) (*http.Response, *proxyConn, error) {
+	pc, err := dial()
+	if err != nil {
 		return nil, nil, err
 	}
-	if err := pbw.Flush(); err != nil {
-		conn.Close()
+
+	u := d.proxyURL.User
+	var (
+		res    *http.Response
+		cached bool
+	)
+	switch {
+	case u == nil:
+		res, err = pc.roundTrip(ctx, req, write)
+	case d.AuthScheme.ConnectionOriented():
+		res, err = d.ntlmHandshake(ctx, pc, req, write)
+	case d.AuthScheme == DigestAuth:
+		// Without a cached challenge, or if the body cannot be sent again after a challenge, the proxy is probed without body.
+		if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+			cached, err = d.setDigestCredentials(req)
+		}
+		if err == nil {
+			if cached {
+				res, err = pc.roundTrip(ctx, req, write)
+			} else {
+				r := withoutBody(req)
+				r.Header.Del("Proxy-Authorization")
+				res, err = pc.roundTrip(ctx, r, write)
+			}
+		}
+	default:
+		if req.Header.Get("Proxy-Authorization") == "" {
+			pass, _ := u.Password()
+			auth := u.Username() + ":" + pass
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+		}
+		res, err = pc.roundTrip(ctx, req, write)
+	}
+	if err != nil {
+		pc.Close()
 		return nil, nil, err
 	}
 
+	if u == nil || res.StatusCode != http.StatusProxyAuthRequired || d.AuthScheme.ConnectionOriented() {
+		return res, pc, nil
+	}
+	c, ok := digest.SelectChallenge(res.Header.Values("Proxy-Authenticate"))
+	if !ok {
+		return res, pc, nil
+	}
+	if d.Digest != nil {
+		d.Digest.update(c)
+	}
+	// The request body was sent with the basic or cached Digest credentials and cannot be sent again.
+	if (d.AuthScheme != DigestAuth || cached) && req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return res, pc, nil
+		}
+		if req.Body, err = req.GetBody(); err != nil {
+			res.Body.Close()
+			pc.Close()
+			return nil, nil, err
+		}
+	}
+
+	if _, err := io.Copy(io.Discard, res.Body); err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+	res.Body.Close()
+	if res.Close {
+		pc.Close()
+		if pc, err = dial(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var cr *digest.Credentials
+	if d.Digest != nil {
+		cr, err = d.Digest.authorize(req, u)
+	}
+	if cr == nil && err == nil {
+		pass, _ := u.Password()
+		cr, err = digest.Authorize(c, req.Method, digestURI(req), u.Username(), pass, 1)
+	}
+	if err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+	req.Header.Set("Proxy-Authorization", cr.String())
+
+	if res, err = pc.roundTrip(ctx, req, write); err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+	return res, pc, nil
+}
+
+// setDigestCredentials sets the Digest credentials computed from the cached challenge,
+// it returns false if the scheme is not Digest or there is no cached challenge.
+func (d *HTTPProxyDialer) setDigestCredentials(req *http.Request) (bool, error) {
+	if d.AuthScheme != DigestAuth || d.Digest == nil || d.proxyURL.User == nil {
+		return false, nil
+	}
+	cr, err := d.Digest.authorize(req, d.proxyURL.User)
+	if cr == nil || err != nil {
+		return false, err
+	}
+	req.Header.Set("Proxy-Authorization", cr.String())
+	return true, nil
+}
+
+// digestURI returns the request target as written by Request.WriteProxy.
+func digestURI(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return req.Host
+	}
+	return req.URL.Scheme + "://" + req.URL.Host + req.URL.RequestURI()
+}
+
+// withoutBody returns a shallow copy of the request with cloned header and without body.
+func withoutBody(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = req.Header.Clone()
+	if req.Body != nil && req.Body != http.NoBody {
+		r.Body = http.NoBody
+		r.ContentLength = 0
+		r.TransferEncoding = nil
+	}
+	return r
+}
+
+// ntlmHandshake sends the NTLM negotiate message, and if the proxy responds with a challenge,
+// sends the request with the authenticate message on the same connection.
+// The negotiate message is sent without the request body.
+func (d *HTTPProxyDialer) ntlmHandshake(ctx context.Context, pc *proxyConn, req *http.Request, write writeFunc) (*http.Response, error) {
+	scheme := "NTLM"
+	if d.AuthScheme == NegotiateAuth {
+		scheme = "Negotiate"
+	}
+
+	nreq := withoutBody(req)
+	nreq.Header.Set("Proxy-Authorization", scheme+" "+base64.StdEncoding.EncodeToString(ntlm.NegotiateMessage()))
+
+	res, err := pc.roundTrip(ctx, nreq, write)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		return res, nil
+	}
+
+	var token string
+	for _, v := range res.Header.Values("Proxy-Authenticate") {
+		if t, ok := strings.CutPrefix(v, scheme+" "); ok {
+			token = strings.TrimSpace(t)
+			break
+		}
+	}
+	if token == "" {
+		return res, nil
+	}
+
+	if _, err := io.Copy(io.Discard, res.Body); err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.Close {
+		return nil, fmt.Errorf("proxy closed the connection during %s handshake", scheme)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s challenge: %w", scheme, err)
+	}
+	c, err := ntlm.ParseChallenge(b)
+	if err != nil {
+		return nil, err
+	}
+	u := d.proxyURL.User
+	pass, _ := u.Password()
+	domain, user := ntlm.SplitUsername(u.Username())
+	msg, err := ntlm.AuthenticateMessage(c, domain, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Proxy-Authorization", scheme+" "+base64.StdEncoding.EncodeToString(msg))
+
+	return pc.roundTrip(ctx, req, write)
+}
+
+// roundTrip writes the request to the connection and reads the response.
+// If ctx is done before the response is read, the connection is closed.
+func (pc *proxyConn) roundTrip(ctx context.Context, req *http.Request, write writeFunc) (*http.Response, error) {
+	if err := write(req, pc.bw); err != nil {
+		return nil, err
+	}
+	if err := pc.bw.Flush(); err != nil {
+		return nil, err
+	}
+
 	resCh := make(chan *http.Response, 1)
 	errCh := make(chan error, 1)
 
 	go func() {
-		res, err := http.ReadResponse(pbr, &req) //nolint:bodyclose // caller is responsible for closing the response body
+		res, err := http.ReadResponse(pc.br, req) //nolint:bodyclose // caller is responsible for closing the response body
 		if err != nil {
 			errCh <- err
 		} else {
@@ -159,13 +696,12 @@ func (d *HTTPProxyDialer) DialContextR(ctx context.Context, network, addr string
 
 	select {
 	case <-ctx.Done():
-		conn.Close()
-		return nil, nil, ctx.Err()
+		pc.Close()
+		return nil, ctx.Err()
 	case err := <-errCh:
-		conn.Close()
-		return nil, nil, err
+		return nil, err
 	case res := <-resCh:
-		return res, conn, nil
+		return res, nil
 	}
 }
 
@@ -176,3 +712,16 @@ type byteReader struct {
 func (r byteReader) Read(p []byte) (int, error) {
 	return r.r.Read(p[:1])
 }
+
+// TLSHandshake runs the handshake and reports it to httptrace.ClientTrace in ctx if any.
+func TLSHandshake(ctx context.Context, conn *tls.Conn) error {
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	err := conn.HandshakeContext(ctx)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(conn.ConnectionState(), err)
+	}
+	return err
+}
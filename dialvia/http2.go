@@ -0,0 +1,412 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dialvia
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/multierr"
+	"golang.org/x/net/http2"
+)
+
+// HTTP2Options specify how HTTP/2 connections to the proxy are used.
+type HTTP2Options struct {
+	// MaxConns is the maximum number of HTTP/2 connections to the proxy.
+	// When all connections are busy, new tunnels wait for a free stream.
+	// Zero means no limit.
+	MaxConns int
+
+	// MaxStreamsPerConn is the maximum number of tunnels multiplexed over a single connection.
+	// Zero means the limit advertised by the proxy.
+	MaxStreamsPerConn int
+
+	// MaxReceiveBufferPerConnection and MaxReceiveBufferPerStream are the flow-control windows
+	// advertised to the proxy, they limit the data buffered for tunnels that are not read.
+	// Zero means the golang.org/x/net/http2 defaults.
+	// They require Go 1.24 or newer, and are ignored otherwise.
+	MaxReceiveBufferPerConnection int
+	MaxReceiveBufferPerStream     int
+
+	// ReadIdleTimeout is the time after which a health check using ping frame is sent
+	// if no frame is received on the connection, the connection is closed if the ping is not answered.
+	// Zero disables health checks.
+	ReadIdleTimeout time.Duration
+}
+
+// HTTP2Stats are the statistics of HTTP2ProxyPool.
+type HTTP2Stats struct {
+	// Conns is the number of open HTTP/2 connections.
+	Conns int
+	// ActiveStreams is the number of open tunnels.
+	ActiveStreams int
+	// Streams is the total number of tunnels opened as HTTP/2 streams.
+	Streams uint64
+	// Fallbacks is the total number of connections that fell back to HTTP/1.1
+	// because the proxy did not negotiate h2.
+	Fallbacks uint64
+}
+
+// http2RetryInterval is the time HTTP/1.1 is used after the proxy did not negotiate h2.
+const http2RetryInterval = 5 * time.Minute
+
+// HTTP2ProxyPool multiplexes CONNECT tunnels to an HTTPS proxy as HTTP/2 streams over a pool of shared connections.
+// It is used by HTTPProxyDialer, see HTTPProxyDialer.HTTP2.
+// If the proxy does not negotiate h2 with ALPN, HTTP/1.1 CONNECT is used, and h2 is retried later.
+type HTTP2ProxyPool struct {
+	dial      ContextDialerFunc
+	proxyURL  *url.URL
+	tlsConfig *tls.Config
+	opts      HTTP2Options
+	t         *http2.Transport
+
+	mu        sync.Mutex
+	conns     []*http2ClientConn
+	h1Until   time.Time
+	closed    bool
+	streams   atomic.Uint64
+	fallbacks atomic.Uint64
+}
+
+// http2ClientConn is a pooled connection to the proxy.
+type http2ClientConn struct {
+	*http2.ClientConn
+	local  net.Addr
+	remote net.Addr
+}
+
+func NewHTTP2ProxyPool(dial ContextDialerFunc, proxyURL *url.URL, tlsConfig *tls.Config, opts HTTP2Options) *HTTP2ProxyPool {
+	if dial == nil {
+		panic("dial is required")
+	}
+	if proxyURL == nil {
+		panic("proxy URL is required")
+	}
+	if proxyURL.Scheme != "https" {
+		panic("proxy URL scheme must be https")
+	}
+	if tlsConfig == nil {
+		panic("TLS config is required")
+	}
+
+	tlsConfig.ServerName = proxyURL.Hostname()
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+
+	t1 := &http.Transport{}
+	setHTTP2ReceiveBuffers(t1, opts.MaxReceiveBufferPerConnection, opts.MaxReceiveBufferPerStream)
+	t, err := http2.ConfigureTransports(t1)
+	if err != nil {
+		panic(err)
+	}
+	t.ReadIdleTimeout = opts.ReadIdleTimeout
+	t.StrictMaxConcurrentStreams = true
+
+	return &HTTP2ProxyPool{
+		dial:      dial,
+		proxyURL:  proxyURL,
+		tlsConfig: tlsConfig,
+		opts:      opts,
+		t:         t,
+	}
+}
+
+// clientConn returns a connection with a reserved stream.
+// If the proxy does not support HTTP/2, it returns nil connection and the TLS connection to use with HTTP/1.1 if one was dialed.
+// Connections are dialed one at a time, so that tunnels opened at the same time share a connection.
+func (p *HTTP2ProxyPool) clientConn(ctx context.Context) (*http2ClientConn, net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, nil, net.ErrClosed
+	}
+	if time.Now().Before(p.h1Until) {
+		return nil, nil, nil
+	}
+
+	var (
+		best  *http2ClientConn
+		bestN int
+	)
+	live := p.conns[:0]
+	for _, cc := range p.conns {
+		s := cc.State()
+		if s.Closed || s.Closing {
+			continue
+		}
+		live = append(live, cc)
+
+		n := s.StreamsActive + s.StreamsReserved + s.StreamsPending
+		if p.opts.MaxStreamsPerConn > 0 && n >= p.opts.MaxStreamsPerConn {
+			continue
+		}
+		if !cc.CanTakeNewRequest() {
+			continue
+		}
+		if best == nil || n < bestN {
+			best, bestN = cc, n
+		}
+	}
+	clear(p.conns[len(live):])
+	p.conns = live
+
+	if best != nil && best.ReserveNewRequest() {
+		return best, nil, nil
+	}
+
+	// All connections are busy, wait for a stream on the least loaded one.
+	if p.opts.MaxConns > 0 && len(p.conns) >= p.opts.MaxConns {
+		return p.leastLoaded(), nil, nil
+	}
+
+	conn, err := p.dialTLS(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		p.h1Until = time.Now().Add(http2RetryInterval)
+		p.fallbacks.Add(1)
+		return nil, conn, nil
+	}
+
+	c, err := p.t.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	c.ReserveNewRequest()
+	cc := &http2ClientConn{ClientConn: c, local: conn.LocalAddr(), remote: conn.RemoteAddr()}
+	p.conns = append(p.conns, cc)
+
+	return cc, nil, nil
+}
+
+func (p *HTTP2ProxyPool) leastLoaded() *http2ClientConn {
+	var (
+		best  *http2ClientConn
+		bestN int
+	)
+	for _, cc := range p.conns {
+		s := cc.State()
+		if n := s.StreamsActive + s.StreamsReserved + s.StreamsPending; best == nil || n < bestN {
+			best, bestN = cc, n
+		}
+	}
+	return best
+}
+
+func (p *HTTP2ProxyPool) dialTLS(ctx context.Context) (*tls.Conn, error) {
+	conn, err := p.dial(ctx, "tcp", p.proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	tconn := tls.Client(conn, p.tlsConfig)
+	if err := TLSHandshake(ctx, tconn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// connect opens a tunnel to req.Host as an HTTP/2 CONNECT stream.
+// If the proxy does not support HTTP/2, it returns nil response and the connection to use with HTTP/1.1 if any.
+func (p *HTTP2ProxyPool) connect(ctx context.Context, req *http.Request) (*http.Response, net.Conn, error) {
+	cc, fallback, err := p.clientConn(ctx)
+	if err != nil || cc == nil {
+		return nil, fallback, err
+	}
+
+	// The stream outlives the dial context, it is canceled when the tunnel is closed.
+	sctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+
+	pr, pw := io.Pipe()
+	r := &http.Request{
+		Method:        http.MethodConnect,
+		URL:           req.URL,
+		Host:          req.Host,
+		Header:        withoutHopHeaders(req.Header),
+		Body:          pr,
+		ContentLength: -1,
+	}
+	r = r.WithContext(sctx)
+
+	res, err := cc.RoundTrip(r)
+	if !stop() {
+		if err == nil {
+			res.Body.Close()
+		}
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		pw.Close()
+		return nil, nil, fmt.Errorf("http2: %w", err)
+	}
+	p.streams.Add(1)
+
+	conn := &http2Conn{
+		body:   res.Body,
+		pw:     pw,
+		cancel: cancel,
+		local:  cc.local,
+		remote: cc.remote,
+	}
+	// The response body of a successful CONNECT is the tunnel, it is read with the connection.
+	if res.StatusCode/100 == 2 {
+		res.Body = http.NoBody
+	}
+	res.Request = req
+
+	return res, conn, nil
+}
+
+// withoutHopHeaders returns a copy of h without connection-specific headers that are not allowed in HTTP/2.
+func withoutHopHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range []string{"Connection", "Proxy-Connection", "Keep-Alive", "Upgrade", "Transfer-Encoding", "Te"} {
+		h.Del(k)
+	}
+	return h
+}
+
+// Stats returns the pool statistics.
+func (p *HTTP2ProxyPool) Stats() HTTP2Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := HTTP2Stats{
+		Streams:   p.streams.Load(),
+		Fallbacks: p.fallbacks.Load(),
+	}
+	for _, cc := range p.conns {
+		cs := cc.State()
+		if cs.Closed {
+			continue
+		}
+		s.Conns++
+		s.ActiveStreams += cs.StreamsActive
+	}
+	return s
+}
+
+// Close closes all connections, tunnels using them are closed as well.
+func (p *HTTP2ProxyPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+
+	var err error
+	for _, cc := range p.conns {
+		err = multierr.Append(err, cc.Close())
+	}
+	p.conns = nil
+	return err
+}
+
+// http2Conn is a tunnel over an HTTP/2 CONNECT stream.
+// Deadlines are supported, when a deadline is exceeded the stream is canceled.
+type http2Conn struct {
+	body   io.ReadCloser
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	local  net.Addr
+	remote net.Addr
+
+	mu           sync.Mutex
+	readTimer    *time.Timer
+	writeTimer   *time.Timer
+	readExpired  atomic.Bool
+	writeExpired atomic.Bool
+}
+
+func (c *http2Conn) Read(b []byte) (int, error) {
+	n, err := c.body.Read(b)
+	if err != nil && c.readExpired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *http2Conn) Write(b []byte) (int, error) {
+	n, err := c.pw.Write(b)
+	if err != nil && c.writeExpired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the stream, the proxy receives END_STREAM.
+func (c *http2Conn) CloseWrite() error {
+	return c.pw.Close()
+}
+
+func (c *http2Conn) Close() error {
+	c.mu.Lock()
+	stopTimer(c.readTimer)
+	stopTimer(c.writeTimer)
+	c.mu.Unlock()
+
+	c.pw.Close()
+	c.cancel()
+	return c.body.Close()
+}
+
+func (c *http2Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *http2Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *http2Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *http2Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readTimer = c.resetTimer(c.readTimer, t, &c.readExpired)
+	return nil
+}
+
+func (c *http2Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeTimer = c.resetTimer(c.writeTimer, t, &c.writeExpired)
+	return nil
+}
+
+func (c *http2Conn) resetTimer(timer *time.Timer, t time.Time, expired *atomic.Bool) *time.Timer {
+	stopTimer(timer)
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		expired.Store(true)
+		c.pw.CloseWithError(os.ErrDeadlineExceeded)
+		c.cancel()
+	})
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build go1.24
+
+package dialvia
+
+import "net/http"
+
+func setHTTP2ReceiveBuffers(t *http.Transport, conn, stream int) {
+	if conn == 0 && stream == 0 {
+		return
+	}
+	t.HTTP2 = &http.HTTP2Config{
+		MaxReceiveBufferPerConnection: conn,
+		MaxReceiveBufferPerStream:     stream,
+	}
+}
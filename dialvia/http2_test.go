@@ -0,0 +1,254 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dialvia
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoConnectHandler accepts CONNECT requests and echoes the tunnel data.
+func echoConnectHandler(t *testing.T, auth *sync.Map) http.HandlerFunc {
+	t.Helper()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if auth != nil {
+			auth.Store(r.Header.Get("Proxy-Authorization"), r.ProtoMajor)
+		}
+
+		if r.ProtoMajor == 1 {
+			conn, brw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			io.Copy(conn, brw)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		rc.Flush()
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func newConnectServer(t *testing.T, h2 bool, auth *sync.Map) *httptest.Server {
+	t.Helper()
+
+	s := httptest.NewUnstartedServer(echoConnectHandler(t, auth))
+	s.EnableHTTP2 = h2
+	s.StartTLS()
+	return s
+}
+
+func newHTTP2Dialer(t *testing.T, s *httptest.Server, user *url.Userinfo, opts HTTP2Options) *HTTPProxyDialer {
+	t.Helper()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = user
+
+	dial := (&net.Dialer{Timeout: 5 * time.Second}).DialContext
+	tlsConfig := func() *tls.Config {
+		return &tls.Config{InsecureSkipVerify: true} //nolint:gosec // test server certificate
+	}
+	d := HTTPSProxy(dial, u, tlsConfig())
+	d.HTTP2 = NewHTTP2ProxyPool(dial, u, tlsConfig(), opts)
+	t.Cleanup(func() { d.HTTP2.Close() })
+	return d
+}
+
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != msg {
+		t.Fatalf("got %q, want %q", b, msg)
+	}
+}
+
+func TestHTTP2ProxyPool(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("multiplexed", func(t *testing.T) {
+		var auth sync.Map
+		s := newConnectServer(t, true, &auth)
+		defer s.Close()
+
+		d := newHTTP2Dialer(t, s, url.UserPassword("user", "pass"), HTTP2Options{})
+
+		var conns []net.Conn
+		for range 10 {
+			conn, err := d.DialContext(ctx, "tcp", "foobar.com:443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			echo(t, conn, "hello")
+		}
+
+		st := d.HTTP2.Stats()
+		if st.Conns != 1 || st.ActiveStreams != 10 || st.Streams != 10 {
+			t.Fatalf("unexpected stats %+v", st)
+		}
+		if v, ok := auth.Load("Basic dXNlcjpwYXNz"); !ok || v != 2 {
+			t.Fatalf("expected basic credentials over HTTP/2, got %v", v)
+		}
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for d.HTTP2.Stats().ActiveStreams != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("streams not closed %+v", d.HTTP2.Stats())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("max streams per conn", func(t *testing.T) {
+		s := newConnectServer(t, true, nil)
+		defer s.Close()
+
+		d := newHTTP2Dialer(t, s, nil, HTTP2Options{MaxStreamsPerConn: 2})
+
+		for range 5 {
+			conn, err := d.DialContext(ctx, "tcp", "foobar.com:443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			echo(t, conn, "hello")
+		}
+
+		if st := d.HTTP2.Stats(); st.Conns != 3 {
+			t.Fatalf("expected 3 connections, got %+v", st)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		var auth sync.Map
+		s := newConnectServer(t, false, &auth)
+		defer s.Close()
+
+		d := newHTTP2Dialer(t, s, url.UserPassword("user", "pass"), HTTP2Options{})
+
+		for range 3 {
+			conn, err := d.DialContext(ctx, "tcp", "foobar.com:443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			echo(t, conn, "hello")
+			conn.Close()
+		}
+
+		if st := d.HTTP2.Stats(); st.Conns != 0 || st.Fallbacks != 1 {
+			t.Fatalf("unexpected stats %+v", st)
+		}
+		if v, ok := auth.Load("Basic dXNlcjpwYXNz"); !ok || v != 1 {
+			t.Fatalf("expected basic credentials over HTTP/1.1, got %v", v)
+		}
+	})
+
+	t.Run("read deadline", func(t *testing.T) {
+		s := newConnectServer(t, true, nil)
+		defer s.Close()
+
+		d := newHTTP2Dialer(t, s, nil, HTTP2Options{})
+
+		conn, err := d.DialContext(ctx, "tcp", "foobar.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("write deadline", func(t *testing.T) {
+		s := newConnectServer(t, true, nil)
+		defer s.Close()
+
+		d := newHTTP2Dialer(t, s, nil, HTTP2Options{})
+
+		conn, err := d.DialContext(ctx, "tcp", "foobar.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.SetWriteDeadline(time.Now().Add(-time.Second))
+		time.Sleep(10 * time.Millisecond)
+		if _, err := conn.Write([]byte("hello")); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected %v, got %v", os.ErrDeadlineExceeded, err)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		s := newConnectServer(t, true, nil)
+		defer s.Close()
+
+		d := newHTTP2Dialer(t, s, nil, HTTP2Options{})
+
+		conn, err := d.DialContext(ctx, "tcp", "foobar.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		d.HTTP2.Close()
+
+		if _, err := bufio.NewReader(conn).ReadByte(); err == nil {
+			t.Fatal("expected error")
+		}
+		if _, err := d.DialContext(ctx, "tcp", "foobar.com:443"); !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected %v, got %v", net.ErrClosed, err)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dialvia
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/ntlm/ntlmtest"
+)
+
+func TestHTTPProxyDialerNTLM(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write([]byte("hello " + r.Method + " " + string(b)))
+	}))
+	defer backend.Close()
+
+	for _, scheme := range []AuthScheme{NTLMAuth, NegotiateAuth} {
+		t.Run(string(scheme), func(t *testing.T) {
+			p := &ntlmtest.Proxy{
+				Domain:   "CORP",
+				User:     "alice",
+				Password: "secret",
+			}
+			if scheme == NegotiateAuth {
+				p.Scheme = "Negotiate"
+			}
+			s := ntlmtest.NewServer(p)
+			defer s.Close()
+
+			newDialer := func(password string) *HTTPProxyDialer {
+				u, err := url.Parse(s.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				u.User = url.UserPassword(`CORP\alice`, password)
+				d := HTTPProxy((&net.Dialer{Timeout: 5 * time.Second}).DialContext, u)
+				d.AuthScheme = scheme
+				return d
+			}
+
+			t.Run("connect", func(t *testing.T) {
+				conn, err := newDialer("secret").DialContext(context.Background(), "tcp", backend.Listener.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+
+				req, err := http.NewRequest(http.MethodGet, backend.URL, http.NoBody)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := req.Write(conn); err != nil {
+					t.Fatal(err)
+				}
+				res, err := http.ReadResponse(bufio.NewReader(conn), req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+				if b, _ := io.ReadAll(res.Body); string(b) != "hello GET " {
+					t.Fatalf("unexpected body %q", b)
+				}
+			})
+
+			t.Run("forward", func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodPost, backend.URL, strings.NewReader("world"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				res, err := newDialer("secret").RoundTrip(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("unexpected status %d", res.StatusCode)
+				}
+				if b, _ := io.ReadAll(res.Body); string(b) != "hello POST world" {
+					t.Fatalf("unexpected body %q", b)
+				}
+			})
+
+			if got := p.Handshakes(); got != 2 {
+				t.Fatalf("expected 2 handshakes, got %d", got)
+			}
+
+			t.Run("reuse", func(t *testing.T) {
+				d := newDialer("secret")
+				d.MaxIdleConns = 1
+				defer d.CloseIdleConnections()
+
+				do := func(t *testing.T, method string) error {
+					t.Helper()
+					req, err := http.NewRequest(method, backend.URL, strings.NewReader("world"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					res, err := d.RoundTrip(req)
+					if err != nil {
+						return err
+					}
+					b, _ := io.ReadAll(res.Body)
+					res.Body.Close()
+					if want := "hello " + method + " world"; string(b) != want {
+						t.Fatalf("unexpected body %q, want %q", b, want)
+					}
+					return nil
+				}
+
+				for range 3 {
+					if err := do(t, http.MethodGet); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if got := p.Handshakes(); got != 3 {
+					t.Fatalf("expected 3 handshakes, got %d", got)
+				}
+
+				// The request is sent again on a new connection if the idle connection was closed by the proxy.
+				s.CloseClientConnections()
+				if err := do(t, http.MethodGet); err != nil {
+					t.Fatal(err)
+				}
+				if got := p.Handshakes(); got != 4 {
+					t.Fatalf("expected 4 handshakes, got %d", got)
+				}
+
+				// Non-idempotent requests are not sent again once written.
+				s.CloseClientConnections()
+				if err := do(t, http.MethodPost); err == nil {
+					t.Fatal("expected error")
+				}
+				if got := p.Handshakes(); got != 4 {
+					t.Fatalf("expected 4 handshakes, got %d", got)
+				}
+			})
+
+			t.Run("wrong password", func(t *testing.T) {
+				res, conn, err := newDialer("wrong").DialContextR(context.Background(), "tcp", backend.Listener.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				defer res.Body.Close()
+				if res.StatusCode != http.StatusProxyAuthRequired {
+					t.Fatalf("expected %d, got %d", http.StatusProxyAuthRequired, res.StatusCode)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dialvia
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS4ProxyDialer dials connections through a SOCKS4 or SOCKS4a proxy.
+// With the socks4 scheme the destination host is resolved locally,
+// with the socks4a scheme the host name is sent to the proxy and resolved there.
+// The user ID is taken from the proxy URL username, SOCKS4 has no password authentication.
+type SOCKS4ProxyDialer struct {
+	dial     ContextDialerFunc
+	proxyURL *url.URL
+
+	// Resolver is used to resolve the destination host with the socks4 scheme.
+	// If nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+
+	Timeout time.Duration
+}
+
+func SOCKS4Proxy(dial ContextDialerFunc, proxyURL *url.URL) *SOCKS4ProxyDialer {
+	if dial == nil {
+		panic("dial is required")
+	}
+	if proxyURL == nil {
+		panic("proxy URL is required")
+	}
+	if proxyURL.Scheme != "socks4" && proxyURL.Scheme != "socks4a" {
+		panic("proxy URL scheme must be socks4 or socks4a")
+	}
+
+	return &SOCKS4ProxyDialer{
+		dial:     dial,
+		proxyURL: proxyURL,
+	}
+}
+
+const (
+	socks4Version       = 0x04
+	socks4CmdConnect    = 0x01
+	socks4ReplyVersion  = 0x00
+	socks4ReplyGranted  = 0x5a
+	socks4ReplyRejected = 0x5b
+)
+
+func (d *SOCKS4ProxyDialer) DialContext(ctx context.Context, network, addr string) (_ net.Conn, err error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	req, err := d.request(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyPort := d.proxyURL.Port()
+	if proxyPort == "" {
+		proxyPort = "1080"
+	}
+	conn, err := d.dial(ctx, "tcp", net.JoinHostPort(d.proxyURL.Hostname(), proxyPort))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	// Abort the handshake when the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer func() {
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+	}()
+
+	if err := d.handshake(conn, req, addr); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (d *SOCKS4ProxyDialer) handshake(conn net.Conn, req []byte, addr string) error {
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("socks4 write request: %w", err)
+	}
+
+	var res [8]byte
+	if _, err := io.ReadFull(conn, res[:]); err != nil {
+		return fmt.Errorf("socks4 read response: %w", err)
+	}
+	if res[0] != socks4ReplyVersion {
+		return fmt.Errorf("socks4 unexpected reply version %d", res[0])
+	}
+	if res[1] != socks4ReplyGranted {
+		return fmt.Errorf("socks4 connect %s: %s", addr, socks4ReplyText(res[1]))
+	}
+
+	return nil
+}
+
+// request returns the CONNECT request for addr.
+func (d *SOCKS4ProxyDialer) request(ctx context.Context, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		ip = netip.Addr{}
+		if d.proxyURL.Scheme == "socks4" {
+			if ip, err = d.resolve(ctx, host); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if ip.IsValid() {
+		ip = ip.Unmap()
+		if !ip.Is4() {
+			return nil, fmt.Errorf("socks4 does not support IPv6 address %s", ip)
+		}
+	}
+
+	req := []byte{socks4Version, socks4CmdConnect}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if ip.IsValid() {
+		req = append(req, ip.AsSlice()...)
+	} else {
+		// SOCKS4a: invalid IP 0.0.0.x followed by the host name.
+		req = append(req, 0, 0, 0, 1)
+	}
+	req = append(req, d.proxyURL.User.Username()...)
+	req = append(req, 0)
+	if !ip.IsValid() {
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+
+	return req, nil
+}
+
+func (d *SOCKS4ProxyDialer) resolve(ctx context.Context, host string) (netip.Addr, error) {
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ips, err := r.LookupNetIP(ctx, "ip4", host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if len(ips) == 0 {
+		return netip.Addr{}, errors.New("socks4 no IPv4 address for " + host)
+	}
+	return ips[0], nil
+}
+
+func socks4ReplyText(code byte) string {
+	switch code {
+	case socks4ReplyRejected:
+		return "request rejected or failed"
+	case 0x5c:
+		return "request rejected, proxy cannot connect to identd on the client"
+	case 0x5d:
+		return "request rejected, user ID mismatch"
+	default:
+		return fmt.Sprintf("unknown reply code %#x", code)
+	}
+}
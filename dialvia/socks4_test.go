@@ -0,0 +1,173 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dialvia
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type socks4Request struct {
+	addr   string
+	userID string
+	host   string
+}
+
+// serveSOCKS4 accepts a single SOCKS4 connection, records the request and grants it if userID matches.
+func serveSOCKS4(t *testing.T, l net.Listener, userID string, reqc chan<- socks4Request) {
+	t.Helper()
+
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	var hdr [8]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		t.Error(err)
+		return
+	}
+	readString := func() string {
+		s, err := br.ReadString(0)
+		if err != nil {
+			t.Error(err)
+		}
+		return strings.TrimSuffix(s, "\x00")
+	}
+
+	var r socks4Request
+	r.addr = net.JoinHostPort(net.IP(hdr[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(hdr[2:4]))))
+	r.userID = readString()
+	if hdr[4] == 0 && hdr[5] == 0 && hdr[6] == 0 && hdr[7] != 0 {
+		r.host = readString()
+	}
+	reqc <- r
+
+	code := byte(socks4ReplyGranted)
+	if r.userID != userID {
+		code = 0x5d
+	}
+	conn.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+	if code == socks4ReplyGranted {
+		conn.Write([]byte("hello"))
+	}
+}
+
+func TestSOCKS4ProxyDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	nd := &net.Dialer{Timeout: 5 * time.Second}
+
+	tests := []struct {
+		name  string
+		proxy string
+		addr  string
+		want  socks4Request
+	}{
+		{
+			name:  "socks4 ip",
+			proxy: "socks4://user@" + l.Addr().String(),
+			addr:  "10.1.2.3:8080",
+			want:  socks4Request{addr: "10.1.2.3:8080", userID: "user"},
+		},
+		{
+			name:  "socks4 resolve",
+			proxy: "socks4://user@" + l.Addr().String(),
+			addr:  "localhost:80",
+			want:  socks4Request{addr: "127.0.0.1:80", userID: "user"},
+		},
+		{
+			name:  "socks4a",
+			proxy: "socks4a://user@" + l.Addr().String(),
+			addr:  "example.com:443",
+			want:  socks4Request{addr: "0.0.0.1:443", userID: "user", host: "example.com"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reqc := make(chan socks4Request, 1)
+			go serveSOCKS4(t, l, "user", reqc)
+
+			u, err := url.Parse(tc.proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := SOCKS4Proxy(nd.DialContext, u).DialContext(context.Background(), "tcp", tc.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if got := <-reqc; got != tc.want {
+				t.Fatalf("got request %+v, want %+v", got, tc.want)
+			}
+			b, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "hello" {
+				t.Fatalf("got %q, want hello", b)
+			}
+		})
+	}
+
+	t.Run("rejected", func(t *testing.T) {
+		reqc := make(chan socks4Request, 1)
+		go serveSOCKS4(t, l, "user", reqc)
+
+		u := &url.URL{Scheme: "socks4a", User: url.User("other"), Host: l.Addr().String()}
+		_, err := SOCKS4Proxy(nd.DialContext, u).DialContext(context.Background(), "tcp", "example.com:443")
+		if err == nil || !strings.Contains(err.Error(), "user ID mismatch") {
+			t.Fatalf("expected user ID mismatch error, got %v", err)
+		}
+		<-reqc
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		u := &url.URL{Scheme: "socks4", Host: l.Addr().String()}
+		if _, err := SOCKS4Proxy(nd.DialContext, u).DialContext(context.Background(), "tcp", "[::1]:80"); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		d := SOCKS4Proxy(nd.DialContext, &url.URL{Scheme: "socks4a", Host: l.Addr().String()})
+
+		donec := make(chan struct{})
+		go func() {
+			_, err := d.DialContext(ctx, "tcp", "foobar.com:80")
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v, want %v", err, context.Canceled)
+			}
+			close(donec)
+		}()
+
+		cancel()
+		select {
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+		case <-donec:
+		}
+	})
+}
@@ -0,0 +1,176 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dialvia
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHProxyDialer dials connections through an SSH server using direct-tcpip channels.
+// The SSH connection is established on first use and shared by all connections,
+// it is established again if it is closed or does not respond to keep-alive requests.
+type SSHProxyDialer struct {
+	dial     ContextDialerFunc
+	proxyURL *url.URL
+	config   *ssh.ClientConfig
+
+	// Timeout is the maximum amount of time to establish the SSH connection.
+	Timeout time.Duration
+	// KeepAlive is the interval of keep-alive requests sent to the SSH server, zero disables keep-alive.
+	KeepAlive time.Duration
+
+	mu     sync.Mutex
+	client *ssh.Client
+	closed bool
+}
+
+func SSHProxy(dial ContextDialerFunc, proxyURL *url.URL, config *ssh.ClientConfig) *SSHProxyDialer {
+	if dial == nil {
+		panic("dial is required")
+	}
+	if proxyURL == nil {
+		panic("proxy URL is required")
+	}
+	if proxyURL.Scheme != "ssh" {
+		panic("proxy URL scheme must be ssh")
+	}
+	if config == nil {
+		panic("SSH client config is required")
+	}
+
+	return &SSHProxyDialer{
+		dial:     dial,
+		proxyURL: proxyURL,
+		config:   config,
+	}
+}
+
+func (d *SSHProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := d.sshClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.DialContext(ctx, network, addr)
+}
+
+var errSSHDialerClosed = errors.New("ssh dialer closed")
+
+// sshClient returns the shared SSH client, it establishes the SSH connection if needed.
+func (d *SSHProxyDialer) sshClient(ctx context.Context) (*ssh.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil, errSSHDialerClosed
+	}
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	addr := d.proxyURL.Host
+	if d.proxyURL.Port() == "" {
+		addr = net.JoinHostPort(d.proxyURL.Hostname(), "22")
+	}
+	conn, err := d.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The SSH handshake does not support context, close the connection to abort it.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	cc, chans, reqs, err := ssh.NewClientConn(conn, addr, d.config)
+	if !stop() {
+		err = errors.Join(err, ctx.Err())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := ssh.NewClient(cc, chans, reqs)
+	d.client = c
+
+	go func() {
+		c.Wait()
+		d.mu.Lock()
+		if d.client == c {
+			d.client = nil
+		}
+		d.mu.Unlock()
+	}()
+	if d.KeepAlive > 0 {
+		go keepAlive(c, d.KeepAlive)
+	}
+
+	return c, nil
+}
+
+// keepAlive sends keep-alive requests until the connection is closed,
+// it closes the connection if the server does not respond within the interval.
+func keepAlive(c *ssh.Client, interval time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(done)
+	}()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+			errCh <- err
+		}()
+
+		select {
+		case <-done:
+			return
+		case err := <-errCh:
+			if err != nil {
+				c.Close()
+				return
+			}
+		case <-time.After(interval):
+			c.Close()
+			return
+		}
+	}
+}
+
+// Close closes the SSH connection, connections dialed through it are closed as well.
+func (d *SSHProxyDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	if d.client == nil {
+		return nil
+	}
+	err := d.client.Close()
+	d.client = nil
+	return err
+}
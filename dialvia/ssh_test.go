@@ -0,0 +1,160 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dialvia
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/dialvia/sshtest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestSSHProxyDialer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	key := sshtest.NewKey()
+	s := sshtest.NewServer("user", "pass", key.PublicKey())
+	defer s.Close()
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(s.KnownHosts()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newDialer := func(auth ...ssh.AuthMethod) *SSHProxyDialer {
+		d := SSHProxy(
+			(&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+			&url.URL{Scheme: "ssh", Host: s.Addr},
+			&ssh.ClientConfig{
+				User:            "user",
+				Auth:            auth,
+				HostKeyCallback: hostKeyCallback,
+			},
+		)
+		d.Timeout = 5 * time.Second
+		d.KeepAlive = 10 * time.Millisecond
+		return d
+	}
+
+	get := func(t *testing.T, d *SSHProxyDialer) {
+		t.Helper()
+		tr := &http.Transport{DialContext: d.DialContext, DisableKeepAlives: true}
+		res, err := (&http.Client{Transport: tr}).Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if b, _ := io.ReadAll(res.Body); string(b) != "hello" {
+			t.Fatalf("unexpected body %q", b)
+		}
+	}
+
+	t.Run("pooled", func(t *testing.T) {
+		conns, channels := s.Conns(), s.Channels()
+
+		d := newDialer(ssh.PublicKeys(key))
+		defer d.Close()
+		for range 3 {
+			get(t, d)
+		}
+		// Let keep-alive requests run.
+		time.Sleep(50 * time.Millisecond)
+		get(t, d)
+
+		if got := s.Conns() - conns; got != 1 {
+			t.Fatalf("expected 1 SSH connection, got %d", got)
+		}
+		if got := s.Channels() - channels; got != 4 {
+			t.Fatalf("expected 4 channels, got %d", got)
+		}
+	})
+
+	t.Run("password", func(t *testing.T) {
+		d := newDialer(ssh.Password("pass"))
+		defer d.Close()
+		get(t, d)
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		conns := s.Conns()
+
+		d := newDialer(ssh.PublicKeys(key))
+		defer d.Close()
+		get(t, d)
+		d.mu.Lock()
+		d.client.Close()
+		d.mu.Unlock()
+
+		// Wait for the closed client to be removed from the pool.
+		for range 100 {
+			d.mu.Lock()
+			c := d.client
+			d.mu.Unlock()
+			if c == nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		get(t, d)
+
+		if got := s.Conns() - conns; got != 2 {
+			t.Fatalf("expected 2 SSH connections, got %d", got)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		d := newDialer(ssh.Password("wrong"))
+		defer d.Close()
+		if _, err := d.DialContext(context.Background(), "tcp", backend.Listener.Addr().String()); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("unknown host key", func(t *testing.T) {
+		other := sshtest.NewServer("user", "pass")
+		defer other.Close()
+
+		d := SSHProxy(
+			(&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+			&url.URL{Scheme: "ssh", Host: other.Addr},
+			&ssh.ClientConfig{
+				User:            "user",
+				Auth:            []ssh.AuthMethod{ssh.Password("pass")},
+				HostKeyCallback: hostKeyCallback,
+			},
+		)
+		defer d.Close()
+		if _, err := d.DialContext(context.Background(), "tcp", backend.Listener.Addr().String()); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		d := newDialer(ssh.Password("pass"))
+		d.Close()
+		if _, err := d.DialContext(context.Background(), "tcp", backend.Listener.Addr().String()); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
@@ -0,0 +1,206 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package sshtest provides an in-process SSH server that forwards direct-tcpip channels.
+package sshtest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Server is an SSH server listening on a loopback address.
+// Clients authenticate with User and Password, or with a key from AuthorizedKeys.
+type Server struct {
+	Addr           string
+	User           string
+	Password       string
+	AuthorizedKeys []ssh.PublicKey
+
+	hostKey  ssh.Signer
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	conns    atomic.Int32
+	channels atomic.Int32
+}
+
+// NewServer starts a server with a new host key.
+func NewServer(user, password string, authorizedKeys ...ssh.PublicKey) *Server {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		panic(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	s := &Server{
+		Addr:           l.Addr().String(),
+		User:           user,
+		Password:       password,
+		AuthorizedKeys: authorizedKeys,
+		hostKey:        hostKey,
+		listener:       l,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// NewKey returns a new client key.
+func NewKey() ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	s, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// KnownHosts returns the known_hosts file line for the server.
+func (s *Server) KnownHosts() string {
+	return knownhosts.Line([]string{knownhosts.Normalize(s.Addr)}, s.hostKey.PublicKey()) + "\n"
+}
+
+// Conns returns the number of accepted SSH connections.
+func (s *Server) Conns() int {
+	return int(s.conns.Load())
+}
+
+// Channels returns the number of opened direct-tcpip channels.
+func (s *Server) Channels() int {
+	return int(s.channels.Load())
+}
+
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) config() *ssh.ServerConfig {
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if s.Password != "" && c.User() == s.User && string(password) == s.Password {
+				return nil, nil
+			}
+			return nil, errors.New("invalid password")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, k := range s.AuthorizedKeys {
+				if c.User() == s.User && bytes.Equal(k.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	cfg.AddHostKey(s.hostKey)
+	return cfg
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	cfg := s.config()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn, cfg)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn, cfg *ssh.ServerConfig) {
+	sc, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sc.Close()
+	s.conns.Add(1)
+
+	go func() {
+		for r := range reqs {
+			if r.WantReply {
+				r.Reply(r.Type == "keepalive@openssh.com", nil)
+			}
+		}
+	}()
+
+	for nc := range chans {
+		if nc.ChannelType() != "direct-tcpip" {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		go s.handleDirectTCPIP(nc)
+	}
+}
+
+// directTCPIP is the direct-tcpip channel extra data, see RFC 4254 section 7.2.
+type directTCPIP struct {
+	Host     string
+	Port     uint32
+	OrigHost string
+	OrigPort uint32
+}
+
+func (s *Server) handleDirectTCPIP(nc ssh.NewChannel) {
+	var d directTCPIP
+	if err := ssh.Unmarshal(nc.ExtraData(), &d); err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	if d.Port > 0xffff {
+		nc.Reject(ssh.ConnectionFailed, "invalid port")
+		return
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(d.Host, strconv.Itoa(int(d.Port))))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	s.channels.Add(1)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(conn, ch)
+		conn.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(ch, conn)
+	ch.CloseWrite()
+	<-done
+}
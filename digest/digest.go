@@ -0,0 +1,345 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package digest implements HTTP Digest Access Authentication as specified in RFC 7616.
+// The MD5, MD5-sess, SHA-256 and SHA-256-sess algorithms with the auth quality of protection are supported,
+// auth-int and username hashing are not.
+package digest
+
+import (
+	"crypto/md5" //nolint:gosec // required by the protocol
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+)
+
+type Algorithm string
+
+const (
+	MD5        Algorithm = "MD5"
+	MD5Sess    Algorithm = "MD5-sess"
+	SHA256     Algorithm = "SHA-256"
+	SHA256Sess Algorithm = "SHA-256-sess"
+)
+
+// canonical returns the algorithm with canonical case, MD5 if empty, or empty string if not supported.
+func (a Algorithm) canonical() Algorithm {
+	if a == "" {
+		return MD5
+	}
+	for _, v := range []Algorithm{MD5, MD5Sess, SHA256, SHA256Sess} {
+		if strings.EqualFold(string(a), string(v)) {
+			return v
+		}
+	}
+	return ""
+}
+
+func (a Algorithm) hash() func() hash.Hash {
+	switch a.canonical() {
+	case MD5, MD5Sess:
+		return md5.New
+	case SHA256, SHA256Sess:
+		return sha256.New
+	default:
+		return nil
+	}
+}
+
+func (a Algorithm) sess() bool {
+	c := a.canonical()
+	return c == MD5Sess || c == SHA256Sess
+}
+
+func (a Algorithm) strength() int {
+	switch a.canonical() {
+	case SHA256, SHA256Sess:
+		return 2
+	case MD5, MD5Sess:
+		return 1
+	default:
+		return 0
+	}
+}
+
+const qopAuth = "auth"
+
+// Test hooks.
+var randRead = rand.Read
+
+var errNotDigest = errors.New("digest: not a Digest authentication header")
+
+// Challenge is the WWW-Authenticate or Proxy-Authenticate Digest challenge.
+type Challenge struct {
+	Realm     string
+	Nonce     string
+	Opaque    string
+	Algorithm Algorithm
+	// QOP is the list of quality of protection options, empty for RFC 2069 compatibility.
+	QOP   []string
+	Stale bool
+}
+
+// ParseChallenge parses the Digest challenge header value.
+func ParseChallenge(s string) (*Challenge, error) {
+	p, err := parseHeader(s)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Challenge{
+		Realm:     p["realm"],
+		Nonce:     p["nonce"],
+		Opaque:    p["opaque"],
+		Algorithm: Algorithm(p["algorithm"]),
+		Stale:     strings.EqualFold(p["stale"], "true"),
+	}
+	if v := p["qop"]; v != "" {
+		for _, q := range strings.Split(v, ",") {
+			c.QOP = append(c.QOP, strings.TrimSpace(q))
+		}
+	}
+	if c.Nonce == "" {
+		return nil, errors.New("digest: missing nonce")
+	}
+
+	return c, nil
+}
+
+// SelectChallenge returns the strongest supported Digest challenge from the header values.
+func SelectChallenge(values []string) (*Challenge, bool) {
+	var best *Challenge
+	for _, v := range values {
+		c, err := ParseChallenge(v)
+		if err != nil || !c.supported() {
+			continue
+		}
+		if best == nil || c.Algorithm.strength() > best.Algorithm.strength() {
+			best = c
+		}
+	}
+	return best, best != nil
+}
+
+func (c *Challenge) supported() bool {
+	return c.Algorithm.hash() != nil && (len(c.QOP) == 0 || slices.Contains(c.QOP, qopAuth))
+}
+
+func (c *Challenge) String() string {
+	var b strings.Builder
+	b.WriteString("Digest ")
+	writeParam(&b, "realm", c.Realm, true)
+	if len(c.QOP) > 0 {
+		writeParam(&b, "qop", strings.Join(c.QOP, ", "), true)
+	}
+	if c.Algorithm != "" {
+		writeParam(&b, "algorithm", string(c.Algorithm), false)
+	}
+	writeParam(&b, "nonce", c.Nonce, true)
+	if c.Opaque != "" {
+		writeParam(&b, "opaque", c.Opaque, true)
+	}
+	if c.Stale {
+		writeParam(&b, "stale", "true", false)
+	}
+	return b.String()
+}
+
+// Credentials is the Authorization or Proxy-Authorization Digest response.
+type Credentials struct {
+	Username  string
+	Realm     string
+	Nonce     string
+	URI       string
+	Response  string
+	Algorithm Algorithm
+	CNonce    string
+	Opaque    string
+	QOP       string
+	NC        string
+	UserHash  bool
+}
+
+// ParseCredentials parses the Digest credentials header value.
+func ParseCredentials(s string) (*Credentials, error) {
+	p, err := parseHeader(s)
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &Credentials{
+		Username:  p["username"],
+		Realm:     p["realm"],
+		Nonce:     p["nonce"],
+		URI:       p["uri"],
+		Response:  p["response"],
+		Algorithm: Algorithm(p["algorithm"]),
+		CNonce:    p["cnonce"],
+		Opaque:    p["opaque"],
+		QOP:       p["qop"],
+		NC:        p["nc"],
+		UserHash:  strings.EqualFold(p["userhash"], "true"),
+	}
+	if cr.Username == "" || cr.Nonce == "" || cr.URI == "" || cr.Response == "" {
+		return nil, errors.New("digest: missing credentials parameter")
+	}
+	if cr.QOP != "" && (cr.CNonce == "" || cr.NC == "") {
+		return nil, errors.New("digest: missing cnonce or nc")
+	}
+
+	return cr, nil
+}
+
+// Authorize returns the credentials responding to the challenge for the request method and URI.
+// The nc value is the number of requests sent with the challenge nonce including this one.
+func Authorize(c *Challenge, method, uri, username, password string, nc uint32) (*Credentials, error) {
+	if !c.supported() {
+		return nil, fmt.Errorf("digest: unsupported algorithm %q or qop %q", c.Algorithm, c.QOP)
+	}
+
+	cr := &Credentials{
+		Username:  username,
+		Realm:     c.Realm,
+		Nonce:     c.Nonce,
+		URI:       uri,
+		Algorithm: c.Algorithm,
+		Opaque:    c.Opaque,
+	}
+	if len(c.QOP) > 0 || c.Algorithm.sess() {
+		b := make([]byte, 16)
+		if _, err := randRead(b); err != nil {
+			return nil, err
+		}
+		cr.CNonce = hex.EncodeToString(b)
+	}
+	if len(c.QOP) > 0 {
+		cr.QOP = qopAuth
+		cr.NC = fmt.Sprintf("%08x", nc)
+	}
+	cr.Response = cr.response(method, password)
+
+	return cr, nil
+}
+
+// Verify returns true if the response matches the request method and password.
+func (cr *Credentials) Verify(method, password string) bool {
+	if cr.UserHash || cr.Algorithm.hash() == nil || (cr.QOP != "" && cr.QOP != qopAuth) {
+		return false
+	}
+	want := cr.response(method, password)
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(cr.Response)), []byte(want)) == 1
+}
+
+func (cr *Credentials) response(method, password string) string {
+	h := cr.Algorithm.hash()
+	ha1 := hexHash(h, cr.Username, cr.Realm, password)
+	if cr.Algorithm.sess() {
+		ha1 = hexHash(h, ha1, cr.Nonce, cr.CNonce)
+	}
+	ha2 := hexHash(h, method, cr.URI)
+	if cr.QOP == "" {
+		return hexHash(h, ha1, cr.Nonce, ha2)
+	}
+	return hexHash(h, ha1, cr.Nonce, cr.NC, cr.CNonce, cr.QOP, ha2)
+}
+
+func (cr *Credentials) String() string {
+	var b strings.Builder
+	b.WriteString("Digest ")
+	writeParam(&b, "username", cr.Username, true)
+	writeParam(&b, "realm", cr.Realm, true)
+	writeParam(&b, "uri", cr.URI, true)
+	if cr.Algorithm != "" {
+		writeParam(&b, "algorithm", string(cr.Algorithm), false)
+	}
+	writeParam(&b, "nonce", cr.Nonce, true)
+	if cr.QOP != "" {
+		writeParam(&b, "nc", cr.NC, false)
+		writeParam(&b, "cnonce", cr.CNonce, true)
+		writeParam(&b, "qop", cr.QOP, false)
+	} else if cr.CNonce != "" {
+		writeParam(&b, "cnonce", cr.CNonce, true)
+	}
+	writeParam(&b, "response", cr.Response, true)
+	if cr.Opaque != "" {
+		writeParam(&b, "opaque", cr.Opaque, true)
+	}
+	return b.String()
+}
+
+func hexHash(h func() hash.Hash, parts ...string) string {
+	d := h()
+	d.Write([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(d.Sum(nil))
+}
+
+// parseHeader parses the Digest scheme header value into lower case parameter names and values.
+func parseHeader(s string) (map[string]string, error) {
+	scheme, params, _ := strings.Cut(strings.TrimSpace(s), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, errNotDigest
+	}
+
+	p := make(map[string]string)
+	for {
+		params = strings.TrimLeft(params, " \t,")
+		if params == "" {
+			return p, nil
+		}
+		i := strings.IndexByte(params, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("digest: invalid parameter %q", params)
+		}
+		k := strings.ToLower(strings.TrimSpace(params[:i]))
+		params = strings.TrimLeft(params[i+1:], " \t")
+
+		var v string
+		if strings.HasPrefix(params, `"`) {
+			var b strings.Builder
+			j := 1
+			for ; j < len(params) && params[j] != '"'; j++ {
+				if params[j] == '\\' && j+1 < len(params) {
+					j++
+				}
+				b.WriteByte(params[j])
+			}
+			if j == len(params) {
+				return nil, fmt.Errorf("digest: unterminated quoted value of %s", k)
+			}
+			v = b.String()
+			params = params[j+1:]
+		} else {
+			j := strings.IndexByte(params, ',')
+			if j < 0 {
+				j = len(params)
+			}
+			v = strings.TrimSpace(params[:j])
+			params = params[j:]
+		}
+		p[k] = v
+	}
+}
+
+func writeParam(b *strings.Builder, k, v string, quote bool) {
+	if !strings.HasSuffix(b.String(), " ") {
+		b.WriteString(", ")
+	}
+	b.WriteString(k)
+	b.WriteByte('=')
+	if quote {
+		b.WriteByte('"')
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v))
+		b.WriteByte('"')
+	} else {
+		b.WriteString(v)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package digest
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestRFC7616 uses the examples from RFC 7616 section 3.9.1.
+func TestRFC7616(t *testing.T) {
+	origRandRead := randRead
+	t.Cleanup(func() { randRead = origRandRead })
+
+	tests := []struct {
+		algorithm Algorithm
+		response  string
+	}{
+		{MD5, "8ca523f5e9506fed4657c9700eebdbec"},
+		{SHA256, "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+
+	for _, tc := range tests {
+		t.Run(string(tc.algorithm), func(t *testing.T) {
+			c, err := ParseChallenge(`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=` + string(tc.algorithm) +
+				`, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cr, err := Authorize(c, "GET", "/dir/index.html", "Mufasa", "Circle of Life", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Replace the random cnonce with the one from the example.
+			cr.CNonce = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+			cr.Response = cr.response("GET", "Circle of Life")
+			if cr.Response != tc.response {
+				t.Fatalf("response = %s, want %s", cr.Response, tc.response)
+			}
+
+			pcr, err := ParseCredentials(cr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *pcr != *cr {
+				t.Fatalf("round trip mismatch:\n%+v\n%+v", pcr, cr)
+			}
+			if !pcr.Verify("GET", "Circle of Life") {
+				t.Fatal("Verify failed")
+			}
+			if pcr.Verify("GET", "wrong") || pcr.Verify("POST", "Circle of Life") {
+				t.Fatal("Verify succeeded with wrong password or method")
+			}
+		})
+	}
+}
+
+func TestSelectChallenge(t *testing.T) {
+	c, ok := SelectChallenge([]string{
+		`Basic realm="proxy"`,
+		`Digest realm="proxy", nonce="a", algorithm=MD5, qop="auth"`,
+		`Digest realm="proxy", nonce="b", algorithm=SHA-256, qop="auth"`,
+		`Digest realm="proxy", nonce="c", algorithm=SHA-512-256, qop="auth"`,
+		`Digest realm="proxy", nonce="d", algorithm=SHA-256, qop="auth-int"`,
+	})
+	if !ok {
+		t.Fatal("no challenge selected")
+	}
+	if c.Nonce != "b" {
+		t.Fatalf("selected nonce %q, want b", c.Nonce)
+	}
+
+	if _, ok := SelectChallenge([]string{`Basic realm="proxy"`}); ok {
+		t.Fatal("expected no challenge")
+	}
+}
+
+func TestChallengeString(t *testing.T) {
+	c := &Challenge{
+		Realm:     `say "hi"`,
+		Nonce:     "n",
+		Algorithm: SHA256,
+		QOP:       []string{"auth"},
+		Stale:     true,
+	}
+	const want = `Digest realm="say \"hi\"", qop="auth", algorithm=SHA-256, nonce="n", stale=true`
+	if got := c.String(); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	pc, err := ParseChallenge(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc.Realm != c.Realm || !pc.Stale {
+		t.Fatalf("unexpected challenge %+v", pc)
+	}
+}
+
+func TestAuthorizeRFC2069(t *testing.T) {
+	c := &Challenge{Realm: "r", Nonce: "n"}
+	cr, err := Authorize(c, "CONNECT", "example.com:443", "user", "pass", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.QOP != "" || cr.NC != "" || cr.CNonce != "" {
+		t.Fatalf("unexpected qop parameters %+v", cr)
+	}
+	if _, err := hex.DecodeString(cr.Response); err != nil || len(cr.Response) != 32 {
+		t.Fatalf("unexpected response %q", cr.Response)
+	}
+	if !cr.Verify("CONNECT", "pass") {
+		t.Fatal("Verify failed")
+	}
+}
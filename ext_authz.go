@@ -0,0 +1,417 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/elastic/go-freelru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/saucelabs/forwarder/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ExtAuthzCheckMethod is the full name of the gRPC method called by ExtAuthz.
+// The request and response messages are google.protobuf.Struct with the same fields as the JSON bodies of the HTTP protocol.
+const ExtAuthzCheckMethod = "/forwarder.authz.v1.Authorization/Check"
+
+// ExtAuthzConfig configures delegation of allow/deny decisions to an external authorization service.
+//
+// For http and https URLs, the check request is sent as a JSON POST request body:
+//
+//	{
+//	  "client": {"address": "10.0.0.1", "user": "alice", "listener": "main", "session": "s1"},
+//	  "method": "GET",
+//	  "host": "example.com",
+//	  "url": "http://example.com/path",
+//	  "headers": {"User-Agent": "curl/8.0"}
+//	}
+//
+// The service must respond with status 200 and a JSON body:
+//
+//	{"allow": true, "reason": "", "headers": {"X-Tenant": "acme"}}
+//
+// The headers are set on allowed requests before they are forwarded.
+// For grpc and grpcs URLs, ExtAuthzCheckMethod is called with the same messages.
+type ExtAuthzConfig struct {
+	// URL is the authorization service URL, supported schemes are http, https, grpc and grpcs.
+	URL *url.URL
+
+	// Timeout limits the time of a single check request, zero means no timeout.
+	Timeout time.Duration
+
+	// Headers is the list of request headers sent to the authorization service.
+	Headers []string
+
+	// CacheSize is the maximum number of cached decisions, zero disables caching.
+	CacheSize uint32
+	// CacheTTL is the time after which a cached decision expires.
+	CacheTTL time.Duration
+
+	// FailOpen allows requests if the authorization service cannot be reached or returns an invalid response.
+	// Otherwise, the requests are rejected with 503 Service Unavailable.
+	FailOpen bool
+
+	PromConfig
+}
+
+func DefaultExtAuthzConfig() *ExtAuthzConfig {
+	return &ExtAuthzConfig{
+		Timeout:   time.Second,
+		CacheSize: 10000,
+		CacheTTL:  time.Minute,
+	}
+}
+
+func (c *ExtAuthzConfig) Validate() error {
+	if c.URL == nil {
+		return errors.New("URL is required")
+	}
+	if err := validateExtAuthzURL(c.URL); err != nil {
+		return fmt.Errorf("URL: %w", err)
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout must be non-negative")
+	}
+	if c.CacheSize > 0 && c.CacheTTL <= 0 {
+		return errors.New("cache TTL must be positive")
+	}
+	return nil
+}
+
+// ParseExtAuthzURL parses the authorization service URL i.e. http://localhost:9000/check or grpc://localhost:9001.
+func ParseExtAuthzURL(val string) (*url.URL, error) {
+	u, err := url.Parse(val)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateExtAuthzURL(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func validateExtAuthzURL(u *url.URL) error {
+	switch u.Scheme {
+	case "http", "https", "grpc", "grpcs":
+	default:
+		return fmt.Errorf("unsupported scheme %q, supported schemes are: http, https, grpc, grpcs", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	return nil
+}
+
+type extAuthzClient struct {
+	Address  string `json:"address"`
+	User     string `json:"user,omitempty"`
+	Listener string `json:"listener,omitempty"`
+	Session  string `json:"session,omitempty"`
+}
+
+type extAuthzRequest struct {
+	Client  extAuthzClient    `json:"client"`
+	Method  string            `json:"method"`
+	Host    string            `json:"host"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type extAuthzResponse struct {
+	Allow   bool              `json:"allow"`
+	Reason  string            `json:"reason,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// extAuthzError is returned when the authorization service fails and the proxy is configured to fail closed.
+type extAuthzError struct {
+	error
+}
+
+func (e extAuthzError) Unwrap() error {
+	return e.error
+}
+
+// ExtAuthz sends check requests to the external authorization service and caches the decisions.
+// Errors are not cached.
+type ExtAuthz struct {
+	config  ExtAuthzConfig
+	rt      http.RoundTripper
+	conn    *grpc.ClientConn
+	cache   *freelru.SyncedLRU[string, *extAuthzResponse]
+	log     log.Logger
+	metrics *extAuthzMetrics
+}
+
+// NewExtAuthz returns an ExtAuthz, rt is used for http and https URLs,
+// for grpcs URLs the TLS client configuration of rt is used if it is an *http.Transport.
+func NewExtAuthz(cfg *ExtAuthzConfig, rt http.RoundTripper, log log.Logger) (*ExtAuthz, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	a := &ExtAuthz{
+		config:  *cfg,
+		rt:      rt,
+		log:     log,
+		metrics: newExtAuthzMetrics(cfg.PromRegistry, cfg.PromNamespace),
+	}
+
+	if cfg.CacheSize > 0 {
+		c, err := freelru.NewSynced[string, *extAuthzResponse](cfg.CacheSize, func(k string) uint32 {
+			return uint32(xxhash.Sum64String(k)) //nolint:gosec // no overflow
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.SetLifetime(cfg.CacheTTL)
+		a.cache = c
+	}
+
+	switch cfg.URL.Scheme {
+	case "grpc", "grpcs":
+		creds := insecure.NewCredentials()
+		if cfg.URL.Scheme == "grpcs" {
+			var tlsCfg *tls.Config
+			if tr, ok := rt.(*http.Transport); ok && tr.TLSClientConfig != nil {
+				tlsCfg = tr.TLSClientConfig.Clone()
+			} else {
+				tlsCfg = new(tls.Config)
+			}
+			creds = credentials.NewTLS(tlsCfg)
+		}
+		conn, err := grpc.NewClient(cfg.URL.Host, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, fmt.Errorf("grpc: %w", err)
+		}
+		a.conn = conn
+	}
+
+	return a, nil
+}
+
+// Close closes the gRPC connection if any.
+func (a *ExtAuthz) Close() error {
+	if a.conn != nil {
+		return a.conn.Close()
+	}
+	return nil
+}
+
+// check returns the decision for the request, from the cache if possible.
+// If the request is being explained, only the cache is consulted and nil is returned if the decision is not cached,
+// the service is not queried and the cache and metrics are not updated.
+func (a *ExtAuthz) check(req *http.Request) (*extAuthzResponse, error) {
+	b, err := json.Marshal(a.checkRequest(req))
+	if err != nil {
+		return nil, err
+	}
+
+	key := string(b)
+	if explaining(req) {
+		if a.cache != nil {
+			if res, ok := a.cache.Peek(key); ok {
+				return res, nil
+			}
+		}
+		return nil, nil //nolint:nilnil // not cached
+	}
+	if a.cache != nil {
+		if res, ok := a.cache.Get(key); ok {
+			a.metrics.cacheHits.Inc()
+			return res, nil
+		}
+		a.metrics.cacheMisses.Inc()
+	}
+
+	ctx := req.Context()
+	if a.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.config.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	var res *extAuthzResponse
+	if a.conn != nil {
+		res, err = a.checkGRPC(ctx, b)
+	} else {
+		res, err = a.checkHTTP(ctx, b)
+	}
+	a.metrics.duration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			a.metrics.requests.WithLabelValues("timeout").Inc()
+		} else {
+			a.metrics.requests.WithLabelValues("error").Inc()
+		}
+		return nil, err
+	}
+	if res.Allow {
+		a.metrics.requests.WithLabelValues("allow").Inc()
+	} else {
+		a.metrics.requests.WithLabelValues("deny").Inc()
+	}
+
+	if a.cache != nil {
+		a.cache.Add(key, res)
+	}
+
+	return res, nil
+}
+
+func (a *ExtAuthz) checkRequest(req *http.Request) *extAuthzRequest {
+	r := &extAuthzRequest{
+		Method: req.Method,
+		Host:   req.Host,
+	}
+
+	r.Client.Address = req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		r.Client.Address = host
+	}
+	if ci := clientInfoFromContext(req.Context()); ci != nil {
+		r.Client.User = ci.User
+		r.Client.Listener = ci.Listener
+		if ci.JWT != nil {
+			r.Client.Session = ci.JWT.ID
+		}
+	}
+
+	u := *req.URL
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+	if u.Scheme == "" && req.Method != http.MethodConnect {
+		u.Scheme = "http"
+		if req.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	u.User = nil
+	r.URL = u.String()
+
+	for _, h := range a.config.Headers {
+		if v := req.Header.Get(h); v != "" {
+			if r.Headers == nil {
+				r.Headers = make(map[string]string, len(a.config.Headers))
+			}
+			r.Headers[http.CanonicalHeaderKey(h)] = v
+		}
+	}
+
+	return r
+}
+
+func (a *ExtAuthz) checkHTTP(ctx context.Context, body []byte) (*extAuthzResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.config.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeExtAuthzResponse(b)
+}
+
+func (a *ExtAuthz) checkGRPC(ctx context.Context, body []byte) (*extAuthzResponse, error) {
+	in := new(structpb.Struct)
+	if err := protojson.Unmarshal(body, in); err != nil {
+		return nil, err
+	}
+	out := new(structpb.Struct)
+	if err := a.conn.Invoke(ctx, ExtAuthzCheckMethod, in, out); err != nil {
+		return nil, err
+	}
+
+	b, err := protojson.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeExtAuthzResponse(b)
+}
+
+func decodeExtAuthzResponse(b []byte) (*extAuthzResponse, error) {
+	res := new(extAuthzResponse)
+	if err := json.Unmarshal(b, res); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return res, nil
+}
+
+type extAuthzMetrics struct {
+	requests    *prometheus.CounterVec
+	duration    prometheus.Histogram
+	cacheHits   prometheus.Counter
+	cacheMisses prometheus.Counter
+}
+
+func newExtAuthzMetrics(r prometheus.Registerer, namespace string) *extAuthzMetrics {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+
+	return &extAuthzMetrics{
+		requests: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "ext_authz_requests_total",
+			Namespace: namespace,
+			Help:      "Number of external authorization checks by result, allow, deny, timeout or error",
+		}, []string{"result"}),
+		duration: f.NewHistogram(prometheus.HistogramOpts{
+			Name:      "ext_authz_duration_seconds",
+			Namespace: namespace,
+			Help:      "External authorization check latency, cache hits are not included",
+			Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1, 5},
+		}),
+		cacheHits: f.NewCounter(prometheus.CounterOpts{
+			Name:      "ext_authz_cache_hits_total",
+			Namespace: namespace,
+			Help:      "Number of external authorization decisions served from cache",
+		}),
+		cacheMisses: f.NewCounter(prometheus.CounterOpts{
+			Name:      "ext_authz_cache_misses_total",
+			Namespace: namespace,
+			Help:      "Number of external authorization decisions not found in cache",
+		}),
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// extAuthzDecide allows requests with the X-Allow: yes header and injects the X-Tenant header.
+func extAuthzDecide(r *extAuthzRequest) map[string]any {
+	if r.Headers["X-Allow"] != "yes" {
+		return map[string]any{"allow": false, "reason": "not allowed"}
+	}
+	return map[string]any{"allow": true, "headers": map[string]any{"X-Tenant": "acme"}}
+}
+
+func TestHTTPProxyExtAuthz(t *testing.T) {
+	var (
+		calls atomic.Int32
+		mode  atomic.Value
+	)
+	mode.Store("")
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch mode.Load() {
+		case "error":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+		var req extAuthzRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode check request: %v", err)
+		}
+		if req.Client.Address != "127.0.0.1" || req.Method != http.MethodGet {
+			t.Errorf("unexpected check request: %+v", req)
+		}
+		json.NewEncoder(w).Encode(extAuthzDecide(&req))
+	}))
+	defer authz.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Tenant", r.Header.Get("X-Tenant"))
+	}))
+	defer backend.Close()
+
+	start := func(t *testing.T, failOpen bool) (string, *ExtAuthz) {
+		t.Helper()
+
+		acfg := DefaultExtAuthzConfig()
+		acfg.URL, _ = url.Parse(authz.URL)
+		acfg.Headers = []string{"x-allow"}
+		acfg.Timeout = 100 * time.Millisecond
+		acfg.FailOpen = failOpen
+		a, err := NewExtAuthz(acfg, nil, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := DefaultHTTPProxyConfig()
+		cfg.Address = "localhost:0"
+		cfg.ProxyLocalhost = AllowProxyLocalhost
+		cfg.ExtAuthz = a
+
+		p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go p.Run(ctx)
+
+		addrs, _ := p.Addr()
+		return addrs[0], a
+	}
+
+	get := func(t *testing.T, addr, allow string) *http.Response {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, backend.URL, http.NoBody)
+		req.RequestURI = ""
+		req.Header.Set("X-Allow", allow)
+
+		tr := &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr})}
+		defer tr.CloseIdleConnections()
+
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	t.Run("allow", func(t *testing.T) {
+		mode.Store("")
+		addr, a := start(t, false)
+		calls.Store(0)
+
+		for range 2 {
+			res := get(t, addr, "yes")
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected %d, got %d", http.StatusOK, res.StatusCode)
+			}
+			if got := res.Header.Get("X-Tenant"); got != "acme" {
+				t.Fatalf("expected injected header, got %q", got)
+			}
+		}
+		if n := calls.Load(); n != 1 {
+			t.Fatalf("expected decision to be cached, got %d calls", n)
+		}
+		if n := testutil.ToFloat64(a.metrics.cacheHits); n != 1 {
+			t.Fatalf("expected 1 cache hit, got %v", n)
+		}
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		mode.Store("")
+		addr, _ := start(t, false)
+
+		if res := get(t, addr, "no"); res.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected %d, got %d", http.StatusForbidden, res.StatusCode)
+		}
+	})
+
+	t.Run("fail closed", func(t *testing.T) {
+		mode.Store("error")
+		addr, _ := start(t, false)
+
+		res := get(t, addr, "yes")
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected %d, got %d", http.StatusServiceUnavailable, res.StatusCode)
+		}
+		if got := res.Header.Get(ErrorLabelHeader); got != "ext_authz" {
+			t.Fatalf("expected ext_authz error label, got %q", got)
+		}
+	})
+
+	t.Run("fail open", func(t *testing.T) {
+		mode.Store("error")
+		addr, _ := start(t, true)
+
+		if res := get(t, addr, "no"); res.StatusCode != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, res.StatusCode)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		mode.Store("slow")
+		addr, a := start(t, false)
+
+		if res := get(t, addr, "yes"); res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected %d, got %d", http.StatusServiceUnavailable, res.StatusCode)
+		}
+		if n := testutil.ToFloat64(a.metrics.requests.WithLabelValues("timeout")); n != 1 {
+			t.Fatalf("expected 1 timeout, got %v", n)
+		}
+	})
+}
+
+func TestExtAuthzGRPC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gs := grpc.NewServer()
+	gs.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "forwarder.authz.v1.Authorization",
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "Check",
+				Handler: func(_ any, _ context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+					in := new(structpb.Struct)
+					if err := dec(in); err != nil {
+						return nil, err
+					}
+					b, err := in.MarshalJSON()
+					if err != nil {
+						return nil, err
+					}
+					var req extAuthzRequest
+					if err := json.Unmarshal(b, &req); err != nil {
+						return nil, err
+					}
+					return structpb.NewStruct(extAuthzDecide(&req))
+				},
+			},
+		},
+	}, nil)
+	go gs.Serve(l)
+	defer gs.Stop()
+
+	cfg := DefaultExtAuthzConfig()
+	cfg.URL = &url.URL{Scheme: "grpc", Host: l.Addr().String()}
+	cfg.Headers = []string{"X-Allow"}
+	a, err := NewExtAuthz(cfg, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	for _, allow := range []string{"yes", "no"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+		req.Header.Set("X-Allow", allow)
+		res, err := a.check(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Allow != (allow == "yes") {
+			t.Fatalf("unexpected decision for X-Allow: %s: %+v", allow, res)
+		}
+		if res.Allow && res.Headers["X-Tenant"] != "acme" {
+			t.Fatalf("expected injected header, got %+v", res.Headers)
+		}
+	}
+}
@@ -135,6 +135,17 @@ func RedactHostPortUser(hpu *HostPortUser) string {
 	return fmt.Sprintf("%s:xxxxx@%s:%s", hpu.Username(), hpu.Host, port)
 }
 
+// RedactUserinfo returns the username and "xxxxx" in place of the password if set.
+func RedactUserinfo(ui *url.Userinfo) string {
+	if ui == nil {
+		return ""
+	}
+	if _, has := ui.Password(); has {
+		return ui.Username() + ":xxxxx"
+	}
+	return ui.Username()
+}
+
 type HostPortPair struct {
 	Src, Dst HostPort
 }
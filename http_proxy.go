@@ -17,6 +17,7 @@ import (
 	"net/http"
 	"net/url"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,6 +29,7 @@ import (
 	"github.com/saucelabs/forwarder/log"
 	"github.com/saucelabs/forwarder/middleware"
 	"github.com/saucelabs/forwarder/pac"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"go.uber.org/multierr"
 	"golang.org/x/sync/errgroup"
 )
@@ -80,23 +82,60 @@ type (
 // that the CONNECT request should be handled by martian.
 var ErrConnectFallback = martian.ErrConnectFallback
 
+// TunnelConfig specifies limits for CONNECT and upgrade (e.g. WebSocket) tunnels.
+type TunnelConfig struct {
+	// TunnelIdleTimeout is the maximum amount of time a tunnel is kept open
+	// when no data is read in either direction.
+	// Zero means no timeout.
+	TunnelIdleTimeout time.Duration
+
+	// TunnelWriteTimeout is the maximum amount of time a single write
+	// to either side of a tunnel may block.
+	// Zero means no timeout.
+	TunnelWriteTimeout time.Duration
+
+	// TunnelMaxLifetime is the maximum amount of time a tunnel is kept open regardless of activity.
+	// Zero means no limit.
+	TunnelMaxLifetime time.Duration
+}
+
+// MainListenerName is the name of the listener configured by HTTPServerConfig,
+// it is used in routing rules, logs and metrics.
+const MainListenerName = "main"
+
 type HTTPProxyConfig struct {
 	HTTPServerConfig
+	TunnelConfig
 	ExtraListeners    []NamedListenerConfig
+	ClientAuth        TLSClientAuthConfig
 	Name              string
 	MITM              *MITMConfig
 	MITMDomains       Matcher
+	ICAP              *ICAPConfig
+	ICAPDomains       Matcher
 	ProxyLocalhost    ProxyLocalhostMode
 	UpstreamProxy     *url.URL
+	UpstreamProxyVia  []*url.URL
 	UpstreamProxyFunc ProxyFunc
+	UpstreamAuth      []UpstreamAuth
+	UpstreamHTTP2     UpstreamHTTP2Config
+	JWTAuth           *JWTAuth
+	ExtAuthz          *ExtAuthz
+	SSH               SSHConfig
+	RoutingTable      *RoutingTable
 	DenyDomains       Matcher
 	DirectDomains     Matcher
+	CheckDestination  func(ctx context.Context, network, address string) error
 	RequestIDHeader   string
 	RequestModifiers  []RequestModifier
 	ResponseModifiers []ResponseModifier
 	ConnectFunc       ConnectFunc
 	ConnectTimeout    time.Duration
 	PromHTTPOpts      []middleware.PrometheusOpt
+	PromTunnelOpts    []middleware.TunnelPrometheusOpt
+	TracerProvider    oteltrace.TracerProvider
+	TracingInject     bool
+	ErrorPagesDir     string
 
 	// TestingHTTPHandler uses Martian's [http.Handler] implementation
 	// over [http.Server] instead of the default TCP server.
@@ -115,9 +154,12 @@ func DefaultHTTPProxyConfig() *HTTPProxyConfig {
 				HandshakeTimeout: 10 * time.Second,
 			},
 		},
+		ClientAuth:      *DefaultTLSClientAuthConfig(),
 		Name:            "forwarder",
 		ProxyLocalhost:  DenyProxyLocalhost,
 		RequestIDHeader: "X-Request-Id",
+		UpstreamHTTP2:   *DefaultUpstreamHTTP2Config(),
+		SSH:             *DefaultSSHConfig(),
 		ConnectTimeout:  60 * time.Second, // http.Transport sets a constant 1m timeout for CONNECT requests.
 	}
 }
@@ -126,13 +168,29 @@ func (c *HTTPProxyConfig) Validate() error {
 	if err := c.HTTPServerConfig.Validate(); err != nil {
 		return err
 	}
+	if c.Protocol != HTTPScheme && c.Protocol != HTTPSScheme {
+		return fmt.Errorf("unsupported protocol: %s", c.Protocol)
+	}
+	if err := c.ClientAuth.Validate(); err != nil {
+		return fmt.Errorf("client_auth: %w", err)
+	}
+	clientAuth := c.ClientAuth.enabled()
 	for _, lc := range c.ExtraListeners {
 		if lc.Name == "" {
 			return errors.New("extra listener name is required")
 		}
+		if lc.Name == MainListenerName {
+			return fmt.Errorf("extra listener name %q is reserved for the main listener", lc.Name)
+		}
+		if lc.ClientAuth != nil {
+			if err := lc.ClientAuth.Validate(); err != nil {
+				return fmt.Errorf("listener %s: client_auth: %w", lc.Name, err)
+			}
+			clientAuth = clientAuth || lc.ClientAuth.enabled()
+		}
 	}
-	if c.Protocol != HTTPScheme && c.Protocol != HTTPSScheme {
-		return fmt.Errorf("unsupported protocol: %s", c.Protocol)
+	if clientAuth && c.Protocol != HTTPSScheme {
+		return errors.New("client_auth: TLS client certificates require https protocol")
 	}
 	if !c.ProxyLocalhost.isValid() {
 		return fmt.Errorf("unsupported proxy_localhost: %s", c.ProxyLocalhost)
@@ -140,6 +198,30 @@ func (c *HTTPProxyConfig) Validate() error {
 	if err := validateProxyURL(c.UpstreamProxy); err != nil {
 		return fmt.Errorf("upstream_proxy_uri: %w", err)
 	}
+	if len(c.UpstreamProxyVia) > 0 && c.UpstreamProxy == nil {
+		return errors.New("upstream_proxy_via: upstream_proxy_uri is required")
+	}
+	for i, u := range c.UpstreamProxyVia {
+		if err := validateProxyURL(u); err != nil {
+			return fmt.Errorf("upstream_proxy_via: hop %d: %w", i+1, err)
+		}
+	}
+	for _, ua := range c.UpstreamAuth {
+		if err := ua.Validate(); err != nil {
+			return fmt.Errorf("proxy_auth: %w", err)
+		}
+	}
+	if err := c.UpstreamHTTP2.Validate(); err != nil {
+		return fmt.Errorf("upstream_http2: %w", err)
+	}
+	if err := c.SSH.Validate(); err != nil {
+		return fmt.Errorf("ssh: %w", err)
+	}
+	if c.ICAP != nil {
+		if err := c.ICAP.Validate(); err != nil {
+			return fmt.Errorf("icap: %w", err)
+		}
+	}
 
 	return nil
 }
@@ -148,16 +230,23 @@ type HTTPProxy struct {
 	config     HTTPProxyConfig
 	pac        PACResolver
 	creds      *CredentialsMatcher
+	digestAuth *middleware.DigestAuth
 	transport  http.RoundTripper
 	log        log.Logger
 	metrics    *httpProxyMetrics
+	errorPages *errorPages
+	tracing    *httpProxyTracing
 	proxy      *martian.Proxy
 	mitmCACert *x509.Certificate
-	proxyFunc  ProxyFunc
+	proxyFunc  proxyChainFunc
 	localhost  []string
 
 	tlsConfig *tls.Config
-	listeners []net.Listener
+	// clientAuth and clientAuthTLS hold the client certificate authentication config
+	// and the TLS config of listeners that verify client certificates, by listener name.
+	clientAuth    map[string]*TLSClientAuthConfig
+	clientAuthTLS map[string]*tls.Config
+	listeners     []net.Listener
 }
 
 // NewHTTPProxy creates a new HTTP proxy.
@@ -232,6 +321,18 @@ func newHTTPProxy(cfg *HTTPProxyConfig, pr PACResolver, cm *CredentialsMatcher,
 		metrics:   newHTTPProxyMetrics(cfg.PromRegistry, cfg.PromNamespace),
 		localhost: []string{"localhost", "0.0.0.0", "::"},
 	}
+	if cfg.TracerProvider != nil {
+		hp.tracing = newHTTPProxyTracing(cfg.TracerProvider, cfg.TracingInject)
+	}
+	if cfg.BasicAuth != nil && cfg.DigestAuth {
+		hp.digestAuth = middleware.NewProxyDigestAuth(cfg.Name)
+	}
+
+	ep, err := loadErrorPages(cfg.ErrorPagesDir)
+	if err != nil {
+		return nil, fmt.Errorf("error pages: %w", err)
+	}
+	hp.errorPages = ep
 
 	if err := hp.configureProxy(); err != nil {
 		return nil, err
@@ -249,7 +350,62 @@ func (hp *HTTPProxy) configureHTTPS() error {
 
 	hp.tlsConfig = httpsTLSConfigTemplate()
 
-	return hp.config.ConfigureTLSConfig(hp.tlsConfig)
+	if err := hp.config.ConfigureTLSConfig(hp.tlsConfig); err != nil {
+		return err
+	}
+
+	return hp.configureClientAuth()
+}
+
+// configureClientAuth creates TLS configs for listeners that verify client certificates.
+func (hp *HTTPProxy) configureClientAuth() error {
+	for _, lc := range hp.listenerConfigs() {
+		ca := lc.ClientAuth
+		if ca == nil {
+			ca = &hp.config.ClientAuth
+		}
+		if !ca.enabled() {
+			continue
+		}
+
+		tlsCfg := hp.tlsConfig.Clone()
+		if err := ca.ConfigureTLSConfig(tlsCfg); err != nil {
+			return fmt.Errorf("client_auth: %w", err)
+		}
+		verify := tlsCfg.VerifyConnection
+		tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.VerifiedChains) == 0 {
+				return nil
+			}
+			err := verify(cs)
+			hp.metrics.clientCert(lc.Name, err == nil)
+			return err
+		}
+
+		if hp.clientAuth == nil {
+			hp.clientAuth = make(map[string]*TLSClientAuthConfig)
+			hp.clientAuthTLS = make(map[string]*tls.Config)
+		}
+		hp.clientAuth[lc.Name] = ca
+		hp.clientAuthTLS[lc.Name] = tlsCfg
+
+		hp.log.Infof("TLS client certificate authentication enabled listener=%s optional=%t user_field=%s", lc.Name, ca.Optional, ca.UserField)
+	}
+
+	return nil
+}
+
+// listenerConfigs returns the main listener config followed by the extra listeners.
+func (hp *HTTPProxy) listenerConfigs() []NamedListenerConfig {
+	return append([]NamedListenerConfig{{Name: MainListenerName, ListenerConfig: hp.config.ListenerConfig}}, hp.config.ExtraListeners...)
+}
+
+// listenerTLSConfig returns the TLS config for the listener with the given name.
+func (hp *HTTPProxy) listenerTLSConfig(name string) *tls.Config {
+	if tlsCfg, ok := hp.clientAuthTLS[name]; ok {
+		return tlsCfg
+	}
+	return hp.tlsConfig
 }
 
 func (hp *HTTPProxy) configureProxy() error {
@@ -265,6 +421,11 @@ func (hp *HTTPProxy) configureProxy() error {
 	hp.proxy.ReadTimeout = hp.config.ReadTimeout
 	hp.proxy.ReadHeaderTimeout = hp.config.ReadHeaderTimeout
 	hp.proxy.WriteTimeout = hp.config.WriteTimeout
+	hp.proxy.TunnelIdleTimeout = hp.config.TunnelIdleTimeout
+	hp.proxy.TunnelWriteTimeout = hp.config.TunnelWriteTimeout
+	hp.proxy.TunnelMaxLifetime = hp.config.TunnelMaxLifetime
+	hp.proxy.RequestContext = hp.requestContext
+	hp.proxy.ConnContext = hp.connContext
 
 	if hp.config.MITM != nil {
 		mc, err := newMartianMITMConfig(hp.config.MITM)
@@ -283,7 +444,7 @@ func (hp *HTTPProxy) configureProxy() error {
 
 		if hp.config.MITMDomains != nil {
 			hp.proxy.MITMFilter = func(req *http.Request) bool {
-				return hp.config.MITMDomains.Match(req.URL.Hostname())
+				return matchURL(hp.config.MITMDomains, req.URL)
 			}
 		}
 		hp.proxy.MITMTLSHandshakeTimeout = hp.config.TLSServerConfig.HandshakeTimeout
@@ -293,11 +454,13 @@ func (hp *HTTPProxy) configureProxy() error {
 	switch {
 	case hp.config.UpstreamProxyFunc != nil:
 		hp.log.Infof("using external proxy function")
-		hp.proxyFunc = hp.config.UpstreamProxyFunc
+		hp.proxyFunc = hp.config.UpstreamProxyFunc.chain()
 	case hp.config.UpstreamProxy != nil:
-		u := hp.upstreamProxyURL()
-		hp.log.Infof("using upstream proxy: %s", u.Redacted())
-		hp.proxyFunc = http.ProxyURL(u)
+		chain := hp.upstreamProxyChain()
+		hp.log.Infof("using upstream proxy: %s", RedactProxyChain(chain))
+		hp.proxyFunc = func(*http.Request) ([]*url.URL, error) {
+			return chain, nil
+		}
 	case hp.pac != nil:
 		hp.log.Infof("using PAC proxy")
 		hp.proxyFunc = hp.pacProxy
@@ -305,6 +468,32 @@ func (hp *HTTPProxy) configureProxy() error {
 		hp.log.Infof("no upstream proxy specified")
 	}
 
+	if len(hp.config.UpstreamAuth) > 0 {
+		hp.proxy.ProxyAuthScheme = upstreamAuthScheme(hp.config.UpstreamAuth)
+	}
+
+	if o := hp.config.UpstreamHTTP2.options(); o != nil {
+		hp.log.Infof("using HTTP/2 CONNECT to HTTPS upstream proxies")
+		hp.proxy.UpstreamHTTP2 = o
+		registerUpstreamHTTP2Metrics(hp.config.PromRegistry, hp.config.PromNamespace, hp.proxy.UpstreamHTTP2Stats)
+	}
+
+	sshConfig, err := hp.config.SSH.clientConfigFunc()
+	if err != nil {
+		return fmt.Errorf("ssh: %w", err)
+	}
+	hp.proxy.SSHClientConfig = sshConfig
+	hp.proxy.SSHKeepAlive = hp.config.SSH.KeepAlive
+
+	if hp.config.RoutingTable != nil {
+		hp.log.Infof("using routing table")
+		hp.proxyFunc = hp.config.RoutingTable.proxyChainFunc(hp.proxyFunc)
+	}
+
+	if hp.config.JWTAuth != nil && hp.config.JWTAuth.config.UpstreamClaim != "" {
+		hp.proxyFunc = hp.jwtUpstream(hp.proxyFunc)
+	}
+
 	if hp.config.DirectDomains != nil {
 		hp.proxyFunc = hp.directDomains(hp.proxyFunc)
 	}
@@ -313,7 +502,7 @@ func (hp *HTTPProxy) configureProxy() error {
 	if hp.config.ProxyLocalhost == DirectProxyLocalhost {
 		hp.proxyFunc = hp.directLocalhost(hp.proxyFunc)
 	}
-	hp.proxy.ProxyURL = hp.proxyFunc
+	hp.proxy.ProxyChain = hp.proxyFunc
 
 	mw, trace := hp.middlewareStack()
 	hp.proxy.RequestModifier = mw
@@ -323,52 +512,85 @@ func (hp *HTTPProxy) configureProxy() error {
 	return nil
 }
 
-func (hp *HTTPProxy) upstreamProxyURL() *url.URL {
-	proxyURL := new(url.URL)
-	*proxyURL = *hp.config.UpstreamProxy
-
-	if proxyURL.User == nil {
-		if u := hp.creds.MatchURL(proxyURL); u != nil {
-			proxyURL.User = u
+// upstreamProxyChain returns the upstream proxy preceded by the via proxies,
+// proxy URLs without credentials get credentials from the credentials matcher.
+func (hp *HTTPProxy) upstreamProxyChain() []*url.URL {
+	chain := slices.Concat(hp.config.UpstreamProxyVia, []*url.URL{hp.config.UpstreamProxy})
+	for i := range chain {
+		proxyURL := new(url.URL)
+		*proxyURL = *chain[i]
+
+		if proxyURL.User == nil {
+			if u := hp.creds.MatchURL(proxyURL); u != nil {
+				proxyURL.User = u
+			}
 		}
+		chain[i] = proxyURL
 	}
 
-	return proxyURL
+	return chain
 }
 
-func (hp *HTTPProxy) pacProxy(r *http.Request) (*url.URL, error) {
-	s, err := hp.pac.FindProxyForURL(r.URL, "")
+func (hp *HTTPProxy) pacProxy(r *http.Request) ([]*url.URL, error) {
+	find := hp.pac.FindProxyForURL
+	if explaining(r) {
+		find = func(u *url.URL, hostname string) (string, error) {
+			return peekProxyForURL(hp.pac, u, hostname)
+		}
+	}
+	s, err := find(r.URL, "")
 	if err != nil {
 		return nil, err
 	}
+	if e := explainDecision(r, DecisionPAC); e != nil {
+		e.PAC = s
+	}
 
 	p, err := pac.Proxies(s).First()
 	if err != nil {
 		return nil, err
 	}
 
-	proxyURL := p.URL()
-	if u := hp.creds.MatchURL(proxyURL); u != nil {
-		proxyURL.User = u
+	chain := p.Chain()
+	for _, proxyURL := range chain {
+		if u := hp.creds.MatchURL(proxyURL); u != nil {
+			proxyURL.User = u
+		}
 	}
 
-	return proxyURL, nil
+	return chain, nil
 }
 
 func (hp *HTTPProxy) middlewareStack() (martian.RequestResponseModifier, *martian.ProxyTrace) {
-	var trace *martian.ProxyTrace
+	trace := &martian.ProxyTrace{
+		TunnelClosed: func(info martian.TunnelClosedInfo) {
+			hp.metrics.tunnelClosed(info.Reason.String())
+		},
+	}
 
 	// Wrap stack in a group so that we can run security checks before the httpspec modifiers.
 	topg := fifo.NewGroup()
 	if hp.config.BasicAuth != nil {
-		hp.log.Infof("basic auth enabled")
-		topg.AddRequestModifier(hp.basicAuth(hp.config.BasicAuth))
+		if hp.config.DigestAuth {
+			hp.log.Infof("digest auth enabled")
+			topg.AddRequestModifier(hp.digestAuthModifier(hp.config.BasicAuth))
+		} else {
+			hp.log.Infof("basic auth enabled")
+			topg.AddRequestModifier(hp.basicAuth(hp.config.BasicAuth))
+		}
 	}
-	if hp.config.ProxyLocalhost == DenyProxyLocalhost {
-		topg.AddRequestModifier(hp.denyLocalhost())
+	if hp.config.JWTAuth != nil {
+		hp.log.Infof("JWT auth enabled")
+		// With basic auth enabled, the basic auth modifier accepts the clients authenticated with a JWT.
+		if hp.config.BasicAuth == nil {
+			topg.AddRequestModifier(hp.jwtAuthModifier())
+		}
 	}
-	if hp.config.DenyDomains != nil {
-		topg.AddRequestModifier(hp.denyDomains(hp.config.DenyDomains))
+	if hp.config.ExtAuthz != nil {
+		hp.log.Infof("external authorization enabled url=%s fail_open=%t", hp.config.ExtAuthz.config.URL.Redacted(), hp.config.ExtAuthz.config.FailOpen)
+	}
+	for _, m := range hp.accessModifiers() {
+		topg.AddRequestModifier(m)
 	}
 
 	// stack contains the request/response modifiers in the order they are applied.
@@ -385,6 +607,18 @@ func (hp *HTTPProxy) middlewareStack() (martian.RequestResponseModifier, *martia
 		fg.AddResponseModifier(m)
 	}
 
+	if hp.config.ICAP != nil {
+		s := newICAPScanner(hp.config.ICAP, hp.config.ICAPDomains, hp.log, hp.config.PromRegistry, hp.config.PromNamespace)
+		if u := hp.config.ICAP.ReqModURL; u != nil {
+			hp.log.Infof("ICAP REQMOD enabled url=%s", u.Redacted())
+			fg.AddRequestModifier(martian.RequestModifierFunc(s.ModifyRequest))
+		}
+		if u := hp.config.ICAP.RespModURL; u != nil {
+			hp.log.Infof("ICAP RESPMOD enabled url=%s", u.Redacted())
+			fg.AddResponseModifier(martian.ResponseModifierFunc(s.ModifyResponse))
+		}
+	}
+
 	if hp.config.LogHTTPMode != httplog.None {
 		lf := httplog.NewLogger(hp.log.Infof, hp.config.LogHTTPMode).LogFunc()
 		fg.AddResponseModifier(lf)
@@ -393,7 +627,6 @@ func (hp *HTTPProxy) middlewareStack() (martian.RequestResponseModifier, *martia
 	if hp.config.PromRegistry != nil {
 		p := middleware.NewPrometheus(hp.config.PromRegistry, hp.config.PromNamespace, hp.config.PromHTTPOpts...)
 
-		trace = new(martian.ProxyTrace)
 		trace.ReadRequest = func(info martian.ReadRequestInfo) {
 			if info.Req != nil {
 				p.ReadRequest(info.Req)
@@ -404,27 +637,261 @@ func (hp *HTTPProxy) middlewareStack() (martian.RequestResponseModifier, *martia
 				p.WroteResponse(info.Res)
 			}
 		}
+		trace.ProxySelected = func(info martian.ProxySelectedInfo) {
+			if info.Err == nil {
+				p.ObservePhase(martian.PhaseProxySelect, info.Duration)
+			}
+		}
+		trace.DNSDone = func(info martian.DNSDoneInfo) {
+			if info.Err == nil {
+				p.ObservePhase(martian.PhaseDNS, info.Duration)
+			}
+		}
+		trace.ConnectDone = func(info martian.ConnectDoneInfo) {
+			if info.Err == nil {
+				p.ObservePhase(martian.PhaseConnect, info.Duration)
+			}
+		}
+		trace.TLSHandshakeDone = func(info martian.TLSHandshakeDoneInfo) {
+			if info.Err == nil {
+				p.ObservePhase(info.Phase, info.Duration)
+			}
+		}
+		trace.GotFirstResponseByte = func(info martian.GotFirstResponseByteInfo) {
+			p.ObservePhase(martian.PhaseFirstByte, info.Duration)
+		}
+
+		tp := middleware.NewTunnelPrometheus(hp.config.PromRegistry, hp.config.PromNamespace, hp.config.PromTunnelOpts...)
+
+		trace.ConnectFailed = func(info martian.ConnectFailedInfo) {
+			if label := hp.connectFailedLabel(info); label != deniedLabel {
+				upstream := connectUpstreamLabel(info.ProxyURL)
+				if info.ConnectFunc {
+					upstream = "custom"
+				}
+				tp.ConnectFailed(info.Req, label, upstream)
+			}
+		}
+		trace.TunnelOpened = tp.TunnelOpened
+		trace.TunnelClosed = func(info martian.TunnelClosedInfo) {
+			hp.metrics.tunnelClosed(info.Reason.String())
+			tp.TunnelClosed(info)
+		}
 	}
 
 	fg.AddRequestModifier(martian.RequestModifierFunc(hp.setBasicAuth))
 	fg.AddRequestModifier(martian.RequestModifierFunc(setEmptyUserAgent))
 
+	if hp.tracing != nil {
+		hp.tracing.configureTrace(trace, hp)
+	}
+
 	return topg.ToImmutable(), trace
 }
 
+// clientInfo holds information about the client that sent the request, it is stored in the request context.
+type clientInfo struct {
+	// Listener is the name of the listener that accepted the connection.
+	Listener string
+	// User is the name of the authenticated user, it is set by the authentication modifier.
+	User string
+	// CertUser is the user name from the verified TLS client certificate, it is set for the connection.
+	CertUser string
+	// JWT is the session of the client authenticated with a JWT.
+	JWT *jwtSession
+}
+
+type clientInfoKey struct{}
+
+func clientInfoFromContext(ctx context.Context) *clientInfo {
+	ci, _ := ctx.Value(clientInfoKey{}).(*clientInfo)
+	return ci
+}
+
+// connContext stores the name of the listener that accepted the connection.
+func (hp *HTTPProxy) connContext(ctx context.Context, l net.Listener, _ net.Conn) context.Context {
+	var name string
+	if fl, ok := l.(*Listener); ok {
+		name = fl.Name
+	}
+	return context.WithValue(ctx, clientInfoKey{}, &clientInfo{Listener: name})
+}
+
+// requestContext marks the request host as the dial target for IP filtering, and starts tracing if enabled.
+func (hp *HTTPProxy) requestContext(ctx context.Context, req *http.Request) context.Context {
+	host := req.URL.Hostname()
+	if host == "" {
+		// In MITM mode the request URL is not absolute.
+		host = req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	ctx = WithDialTarget(ctx, host)
+
+	// Each request gets its own copy of the connection client info,
+	// so that the authenticated user is not shared between requests.
+	ci := clientInfo{}
+	if c := clientInfoFromContext(ctx); c != nil {
+		// The TLS state is of the listener connection only until MITM,
+		// so the certificate user is stored for the connection on the first request.
+		if ca := hp.clientAuth[c.Listener]; ca != nil && c.CertUser == "" && req.TLS != nil {
+			if c.CertUser = ca.User(req.TLS); c.CertUser != "" {
+				hp.log.Debugf("TLS client certificate authenticated user=%s listener=%s", c.CertUser, c.Listener)
+			}
+		}
+		ci = *c
+		ci.User = ci.CertUser
+	}
+	if ci.User == "" && hp.config.JWTAuth != nil {
+		if token, ok := bearerToken(req); ok {
+			s, err := hp.config.JWTAuth.authenticate(token)
+			if err != nil {
+				hp.log.Debugf("JWT authentication failed listener=%s: %v", ci.Listener, err)
+			} else {
+				ci.User = s.User
+				ci.JWT = s
+				if s.ID != "" {
+					ctx = martian.WithTraceIDPrefix(ctx, s.ID)
+				}
+			}
+		}
+	}
+	ctx = context.WithValue(ctx, clientInfoKey{}, &ci)
+
+	if hp.tracing != nil {
+		ctx = hp.tracing.requestContext(ctx, req)
+	}
+	return ctx
+}
+
+func (hp *HTTPProxy) connectFailedLabel(info martian.ConnectFailedInfo) string {
+	if info.Err != nil {
+		_, _, label := hp.errorStatus(info.Req, info.Err)
+		return label
+	}
+	return "upstream_status_" + strconv.Itoa(info.Res.StatusCode)
+}
+
+func connectUpstreamLabel(proxyURL *url.URL) string {
+	if proxyURL == nil {
+		return "direct"
+	}
+	return proxyURL.Host
+}
+
 func (hp *HTTPProxy) basicAuth(u *url.Userinfo) martian.RequestModifier {
 	user := u.Username()
 	pass, _ := u.Password()
 	ba := middleware.NewProxyBasicAuth()
 
 	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if hp.config.trustedClient(req) || clientAuthenticated(req) {
+			return nil
+		}
 		if !ba.AuthenticatedRequest(req, user, pass) {
 			return ErrProxyAuthentication
 		}
+		if ci := clientInfoFromContext(req.Context()); ci != nil {
+			ci.User = user
+		}
+		return nil
+	})
+}
+
+func (hp *HTTPProxy) digestAuthModifier(u *url.Userinfo) martian.RequestModifier {
+	user := u.Username()
+	pass, _ := u.Password()
+
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if hp.config.trustedClient(req) || clientAuthenticated(req) {
+			return nil
+		}
+		ok, stale := hp.digestAuth.AuthenticatedRequest(req, user, pass)
+		if !ok {
+			if stale {
+				return errStaleNonce
+			}
+			return ErrProxyAuthentication
+		}
+		if ci := clientInfoFromContext(req.Context()); ci != nil {
+			ci.User = user
+		}
+		return nil
+	})
+}
+
+// clientAuthenticated returns true if the client authenticated with a TLS client certificate or a JWT.
+func clientAuthenticated(req *http.Request) bool {
+	ci := clientInfoFromContext(req.Context())
+	return ci != nil && (ci.CertUser != "" || ci.JWT != nil)
+}
+
+func (hp *HTTPProxy) jwtAuthModifier() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if hp.config.trustedClient(req) || clientAuthenticated(req) {
+			return nil
+		}
+		return ErrProxyAuthentication
+	})
+}
+
+// accessModifiers returns the request modifiers that deny authenticated clients access to destinations,
+// in the order they are applied. They are shared by the middleware stack and ExplainRoute.
+func (hp *HTTPProxy) accessModifiers() []martian.RequestModifier {
+	var mods []martian.RequestModifier
+	if hp.config.JWTAuth != nil {
+		mods = append(mods, hp.jwtAllowedDomains())
+	}
+	if hp.config.ProxyLocalhost == DenyProxyLocalhost {
+		mods = append(mods, hp.denyLocalhost())
+	}
+	if hp.config.DenyDomains != nil {
+		mods = append(mods, hp.denyDomains(hp.config.DenyDomains))
+	}
+	if hp.config.ExtAuthz != nil {
+		mods = append(mods, hp.extAuthz(hp.config.ExtAuthz))
+	}
+	return mods
+}
+
+// jwtAllowedDomains denies requests to domains not allowed by the client JWT.
+func (hp *HTTPProxy) jwtAllowedDomains() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		ci := clientInfoFromContext(req.Context())
+		if ci == nil || ci.JWT == nil || ci.JWT.Domains == nil {
+			return nil
+		}
+		if !matchURL(ci.JWT.Domains, req.URL) {
+			return ErrProxyDenied
+		}
 		return nil
 	})
 }
 
+// jwtUpstream selects the upstream proxy chain from the client JWT if set.
+func (hp *HTTPProxy) jwtUpstream(fn proxyChainFunc) proxyChainFunc {
+	return func(req *http.Request) ([]*url.URL, error) {
+		if ci := clientInfoFromContext(req.Context()); ci != nil && ci.JWT != nil && ci.JWT.Upstream != nil {
+			explainDecision(req, DecisionJWT)
+			chain := make([]*url.URL, len(ci.JWT.Upstream))
+			for i, u := range ci.JWT.Upstream {
+				proxyURL := new(url.URL)
+				*proxyURL = *u
+				if proxyURL.User == nil {
+					proxyURL.User = hp.creds.MatchURL(proxyURL)
+				}
+				chain[i] = proxyURL
+			}
+			return chain, nil
+		}
+		if fn == nil {
+			return nil, nil
+		}
+		return fn(req)
+	}
+}
+
 func (hp *HTTPProxy) denyLocalhost() martian.RequestModifier {
 	return martian.RequestModifierFunc(func(req *http.Request) error {
 		if hp.isLocalhost(req.URL.Hostname()) {
@@ -436,33 +903,64 @@ func (hp *HTTPProxy) denyLocalhost() martian.RequestModifier {
 
 func (hp *HTTPProxy) denyDomains(r Matcher) martian.RequestModifier {
 	return martian.RequestModifierFunc(func(req *http.Request) error {
-		if r.Match(req.URL.Hostname()) {
+		if matchURL(r, req.URL) {
 			return ErrProxyDenied
 		}
 		return nil
 	})
 }
 
-func (hp *HTTPProxy) directDomains(fn ProxyFunc) ProxyFunc {
+// extAuthz delegates the allow/deny decision to the external authorization service,
+// and sets the headers from the decision on allowed requests.
+func (hp *HTTPProxy) extAuthz(a *ExtAuthz) martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		res, err := a.check(req)
+		if res == nil && err == nil {
+			if e := routeExplanation(req); e != nil {
+				e.ExtAuthz = ExtAuthzNotCached
+			}
+			return nil
+		}
+		if err != nil {
+			if a.config.FailOpen {
+				hp.log.Errorf("external authorization check failed, allowing request host=%s: %v", req.Host, err)
+				return nil
+			}
+			return extAuthzError{err}
+		}
+		if !res.Allow {
+			hp.log.Debugf("external authorization denied request host=%s reason=%q", req.Host, res.Reason)
+			return ErrProxyDenied
+		}
+		for k, v := range res.Headers {
+			req.Header.Set(k, v)
+		}
+		return nil
+	})
+}
+
+func (hp *HTTPProxy) directDomains(fn proxyChainFunc) proxyChainFunc {
 	if fn == nil {
 		return nil
 	}
 
-	return func(req *http.Request) (*url.URL, error) {
-		if hp.config.DirectDomains.Match(req.URL.Hostname()) {
+	return func(req *http.Request) ([]*url.URL, error) {
+		if matchURL(hp.config.DirectDomains, req.URL) {
+			explainDecision(req, DecisionDirectDomains)
 			return nil, nil
 		}
 		return fn(req)
 	}
 }
 
-func (hp *HTTPProxy) directLocalhost(fn ProxyFunc) ProxyFunc {
+func (hp *HTTPProxy) directLocalhost(fn proxyChainFunc) proxyChainFunc {
 	if fn == nil {
 		return nil
 	}
 
-	return func(req *http.Request) (*url.URL, error) {
+	return func(req *http.Request) ([]*url.URL, error) {
 		if hp.isLocalhost(req.URL.Hostname()) {
+			explainDecision(req, DecisionLocalhost)
 			return nil, nil
 		}
 		return fn(req)
@@ -506,8 +1004,9 @@ func (hp *HTTPProxy) MITMCACert() *x509.Certificate {
 	return hp.mitmCACert
 }
 
+// ProxyFunc returns the upstream proxy selection function, for proxy chains it returns the last proxy of the chain.
 func (hp *HTTPProxy) ProxyFunc() ProxyFunc {
-	return hp.proxyFunc
+	return hp.proxyFunc.last()
 }
 
 func (hp *HTTPProxy) handler() http.Handler {
@@ -612,8 +1111,9 @@ func (hp *HTTPProxy) listen() ([]net.Listener, error) {
 
 	if len(hp.config.ExtraListeners) == 0 {
 		l := &Listener{
+			Name:           MainListenerName,
 			ListenerConfig: hp.config.ListenerConfig,
-			TLSConfig:      hp.tlsConfig,
+			TLSConfig:      hp.listenerTLSConfig(MainListenerName),
 			PromConfig: PromConfig{
 				PromNamespace: hp.config.PromNamespace,
 				PromRegistry:  hp.config.PromRegistry,
@@ -626,9 +1126,9 @@ func (hp *HTTPProxy) listen() ([]net.Listener, error) {
 	}
 
 	return MultiListener{
-		ListenerConfigs: append([]NamedListenerConfig{{ListenerConfig: hp.config.ListenerConfig}}, hp.config.ExtraListeners...),
+		ListenerConfigs: hp.listenerConfigs(),
 		TLSConfig: func(lc NamedListenerConfig) *tls.Config {
-			return hp.tlsConfig
+			return hp.listenerTLSConfig(lc.Name)
 		},
 		PromConfig: hp.config.PromConfig,
 	}.Listen()
@@ -0,0 +1,274 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// ErrorPageData is passed to error page templates.
+type ErrorPageData struct {
+	// Name is the name of the proxy instance.
+	Name string
+	// Code is the HTTP status code of the response.
+	Code int
+	// Status is the HTTP status text of the response.
+	Status string
+	// Label is the machine-readable error label, it is the same as the one in the ErrorLabelHeader.
+	Label string
+	// Message is a human-readable description of the error.
+	Message string
+	// Error is the underlying error message.
+	Error string
+	// Host is the target host of the request.
+	Host string
+	// TraceID is the request trace ID as logged by the proxy.
+	TraceID string
+	// Actions is a list of suggested actions to resolve the error.
+	Actions []string
+}
+
+type errorPageFormat string
+
+const (
+	errorPageText errorPageFormat = "text"
+	errorPageHTML errorPageFormat = "html"
+	errorPageJSON errorPageFormat = "json"
+)
+
+func (f errorPageFormat) contentType() string {
+	switch f {
+	case errorPageHTML:
+		return "text/html; charset=utf-8"
+	case errorPageJSON:
+		return "application/json"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// errorPageFormatFromAccept returns the error page format based on the Accept header.
+// HTML is returned for browsers, JSON for API clients, and plain text otherwise.
+// Wildcards are ignored so that clients that accept anything get plain text.
+func errorPageFormatFromAccept(accept string) errorPageFormat {
+	for _, v := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		switch {
+		case mt == "text/html" || mt == "application/xhtml+xml":
+			return errorPageHTML
+		case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+			return errorPageJSON
+		}
+	}
+	return errorPageText
+}
+
+type errorPageTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+// errorPages holds error page templates per error label and format.
+// Templates for label "default" are used if there is no template for the label.
+type errorPages struct {
+	templates map[errorPageFormat]map[string]errorPageTemplate
+}
+
+const defaultErrorPageLabel = "default"
+
+const defaultHTMLErrorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Code}} {{.Status}}</title>
+</head>
+<body>
+<h1>{{.Code}} {{.Status}}</h1>
+<p>{{.Name}} {{.Message}}</p>
+<pre>{{.Error}}</pre>
+{{- if .Actions}}
+<h2>Suggested actions</h2>
+<ul>
+{{- range .Actions}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+<hr>
+<p><small>error: {{.Label}}{{if .Host}}, host: {{.Host}}{{end}}{{if .TraceID}}, trace: {{.TraceID}}{{end}}</small></p>
+</body>
+</html>
+`
+
+const defaultJSONErrorPage = `{
+  "code": {{json .Code}},
+  "status": {{json .Status}},
+  "label": {{json .Label}},
+  "message": {{json .Message}},
+  "error": {{json .Error}},
+  "host": {{json .Host}},
+  "trace_id": {{json .TraceID}},
+  "actions": {{json .Actions}}
+}
+`
+
+func jsonTemplateFunc(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func parseErrorPageTemplate(format errorPageFormat, name, text string) (errorPageTemplate, error) {
+	funcs := map[string]any{
+		"json": jsonTemplateFunc,
+	}
+	if format == errorPageHTML {
+		return htmltemplate.New(name).Funcs(funcs).Parse(text)
+	}
+	return texttemplate.New(name).Funcs(funcs).Parse(text)
+}
+
+// loadErrorPages returns the built-in error pages overridden by templates from dir if not empty.
+// The templates in dir are named <label>.html or <label>.json, where label is the error label,
+// or "default" to override the template used for all labels.
+func loadErrorPages(dir string) (*errorPages, error) {
+	ep := &errorPages{
+		templates: map[errorPageFormat]map[string]errorPageTemplate{
+			errorPageHTML: {},
+			errorPageJSON: {},
+		},
+	}
+
+	for format, text := range map[errorPageFormat]string{
+		errorPageHTML: defaultHTMLErrorPage,
+		errorPageJSON: defaultJSONErrorPage,
+	} {
+		t, err := parseErrorPageTemplate(format, defaultErrorPageLabel, text)
+		if err != nil {
+			panic(err)
+		}
+		ep.templates[format][defaultErrorPageLabel] = t
+	}
+
+	if dir == "" {
+		return ep, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		ext := filepath.Ext(e.Name())
+		format := errorPageFormat(strings.TrimPrefix(ext, "."))
+		if format != errorPageHTML && format != errorPageJSON {
+			continue
+		}
+		label := strings.TrimSuffix(e.Name(), ext)
+
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseErrorPageTemplate(format, label, string(b))
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", e.Name(), err)
+		}
+		ep.templates[format][label] = t
+	}
+
+	return ep, nil
+}
+
+// render renders the error page for the label in the given format, it returns false if format is plain text.
+func (ep *errorPages) render(w *bytes.Buffer, format errorPageFormat, data *ErrorPageData) (bool, error) {
+	tt, ok := ep.templates[format]
+	if !ok {
+		return false, nil
+	}
+	t, ok := tt[data.Label]
+	if !ok {
+		t = tt[defaultErrorPageLabel]
+	}
+	if t == nil {
+		return false, errors.New("missing default template")
+	}
+	return true, t.Execute(w, data)
+}
+
+// errorActions returns suggested actions to resolve an error with the given label.
+func errorActions(label string) []string {
+	switch {
+	case label == "net_dial":
+		return []string{
+			"Check that the host name is correct and the host is reachable from the proxy.",
+			"If the host is only reachable through an upstream proxy, check the proxy configuration.",
+		}
+	case label == "net_read" || label == "net_write":
+		return []string{
+			"Check that the remote host is running and retry the request.",
+		}
+	case label == "tls_record_header":
+		return []string{
+			"Check that the URL scheme matches the server, for example use http:// for plain HTTP servers.",
+		}
+	case label == "tls_certificate":
+		return []string{
+			"Add the CA certificate of the remote host with the --cacert-file flag.",
+			"Alternatively, disable certificate verification with the --insecure flag.",
+		}
+	case strings.HasPrefix(label, "tls_"):
+		return []string{
+			"Check the TLS configuration of the remote host.",
+		}
+	case label == "ext_authz":
+		return []string{
+			"Check that the external authorization service set with the --ext-authz-url flag is running and reachable from the proxy.",
+		}
+	case label == "icap_blocked":
+		return []string{
+			"The content was blocked by the security policy, contact your administrator if you think this is a mistake.",
+		}
+	case label == "icap":
+		return []string{
+			"Check that the ICAP service set with the --icap-reqmod-url and --icap-respmod-url flags is running and reachable from the proxy.",
+		}
+	case label == "ssh_host_key":
+		return []string{
+			"Add the host key of the upstream SSH proxy with the --ssh-known-hosts-file flag.",
+		}
+	case label == "proxy_chain":
+		return []string{
+			"Check that the proxy at the failed hop of the upstream proxy chain is running and reachable from the previous hop.",
+		}
+	case label == "proxy_authentication":
+		return []string{
+			"Provide valid proxy credentials in the Proxy-Authorization header.",
+		}
+	case label == deniedLabel:
+		return []string{
+			"Ask the proxy administrator to allow requests to this host.",
+		}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestErrorPageFormatFromAccept(t *testing.T) {
+	tests := []struct {
+		accept string
+		format errorPageFormat
+	}{
+		{"", errorPageText},
+		{"*/*", errorPageText},
+		{"text/plain", errorPageText},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", errorPageHTML},
+		{"application/json", errorPageJSON},
+		{"application/problem+json", errorPageJSON},
+		{"application/json, text/plain, */*", errorPageJSON},
+		{"invalid;;", errorPageText},
+	}
+
+	for _, tc := range tests {
+		if got := errorPageFormatFromAccept(tc.accept); got != tc.format {
+			t.Errorf("%q: expected %s, got %s", tc.accept, tc.format, got)
+		}
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "proxy_denied.html"), []byte("<p>denied {{.Host}}</p>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	newHandler := func(t *testing.T, dir string) http.Handler {
+		t.Helper()
+
+		cfg := DefaultHTTPProxyConfig()
+		cfg.ErrorPagesDir = dir
+
+		h, err := NewHTTPProxyHandler(cfg, nil, nil, nil, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	do := func(h http.Handler, accept string) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+		req.Header.Set("X-Request-Id", "test-id")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		res := rw.Result()
+		b, _ := io.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	check := func(t *testing.T, res *http.Response, contentType string) {
+		t.Helper()
+
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected %d, got %d", http.StatusForbidden, res.StatusCode)
+		}
+		if got := res.Header.Get(ErrorLabelHeader); got != deniedLabel {
+			t.Fatalf("expected label %q, got %q", deniedLabel, got)
+		}
+		if got := res.Header.Get("Content-Type"); got != contentType {
+			t.Fatalf("expected content type %q, got %q", contentType, got)
+		}
+	}
+
+	t.Run("text", func(t *testing.T) {
+		res, body := do(newHandler(t, ""), "")
+		check(t, res, "text/plain; charset=utf-8")
+		if !strings.HasPrefix(body, "forwarder proxying is denied to host") {
+			t.Fatalf("unexpected body: %q", body)
+		}
+	})
+
+	t.Run("html", func(t *testing.T) {
+		res, body := do(newHandler(t, ""), "text/html")
+		check(t, res, "text/html; charset=utf-8")
+		for _, s := range []string{"<h1>403 Forbidden</h1>", "error: proxy_denied", "trace: test-id", "<li>"} {
+			if !strings.Contains(body, s) {
+				t.Errorf("expected body to contain %q, body=%q", s, body)
+			}
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		res, body := do(newHandler(t, ""), "application/json")
+		check(t, res, "application/json")
+
+		var data struct {
+			Code    int      `json:"code"`
+			Label   string   `json:"label"`
+			Host    string   `json:"host"`
+			TraceID string   `json:"trace_id"`
+			Actions []string `json:"actions"`
+		}
+		if err := json.Unmarshal([]byte(body), &data); err != nil {
+			t.Fatalf("invalid JSON: %v, body=%q", err, body)
+		}
+		if data.Code != http.StatusForbidden || data.Label != deniedLabel || data.Host != "localhost" || data.TraceID != "test-id" || len(data.Actions) == 0 {
+			t.Fatalf("unexpected data: %+v", data)
+		}
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		h := newHandler(t, dir)
+
+		res, body := do(h, "text/html")
+		check(t, res, "text/html; charset=utf-8")
+		if body != "<p>denied localhost</p>" {
+			t.Fatalf("unexpected body: %q", body)
+		}
+
+		// JSON falls back to the built-in template.
+		res, body = do(h, "application/json")
+		check(t, res, "application/json")
+		if !strings.Contains(body, `"label": "proxy_denied"`) {
+			t.Fatalf("unexpected body: %q", body)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "default.json"), []byte("{{.Code"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadErrorPages(dir); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
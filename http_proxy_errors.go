@@ -19,8 +19,11 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/saucelabs/forwarder/icap"
 	"github.com/saucelabs/forwarder/internal/martian"
 	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 type denyError struct {
@@ -30,33 +33,97 @@ type denyError struct {
 // ErrorHeader is the header that is set on error responses with the error message.
 const ErrorHeader = "X-Forwarder-Error"
 
+// ErrorLabelHeader is the header that is set on error responses with the machine-readable error label.
+// The label is the same as the reason label of the proxy_errors_total metric.
+const ErrorLabelHeader = "X-Forwarder-Error-Label"
+
 var (
 	ErrProxyAuthentication = errors.New("proxy authentication required")
+	errStaleNonce          = fmt.Errorf("%w: stale nonce", ErrProxyAuthentication)
 
 	ErrProxyLocalhost = denyError{errors.New("localhost proxying is disabled")}
 	ErrProxyDenied    = denyError{errors.New("proxying denied")}
 )
 
-const skipMetricsLabel = "-"
+// deniedLabel is the error label of denied requests, they are not counted as errors in metrics.
+const deniedLabel = "proxy_denied"
 
 func (hp *HTTPProxy) errorResponse(req *http.Request, err error) *http.Response {
+	code, msg, label := hp.errorStatus(req, err)
+
+	if label != deniedLabel {
+		hp.metrics.error(label)
+	}
+	if hp.tracing != nil {
+		hp.tracing.error(req, err, label)
+	}
+
+	format := errorPageFormatFromAccept(req.Header.Get("Accept"))
+
+	var body bytes.Buffer
+	ok, rerr := hp.errorPages.render(&body, format, &ErrorPageData{
+		Name:    hp.config.Name,
+		Code:    code,
+		Status:  http.StatusText(code),
+		Label:   label,
+		Message: msg,
+		Error:   err.Error(),
+		Host:    req.Host,
+		TraceID: martian.ContextTraceID(req.Context()),
+		Actions: errorActions(label),
+	})
+	if rerr != nil {
+		hp.log.Errorf("render %s error page for label %s: %v", format, label, rerr)
+		body.Reset()
+		ok = false
+	}
+	if !ok {
+		format = errorPageText
+		body.WriteString(hp.config.Name)
+		body.WriteString(" ")
+		body.WriteString(msg)
+		body.WriteString("\n")
+		body.WriteString(err.Error())
+		body.WriteString("\n")
+	}
+
+	resp := proxyutil.NewResponse(code, &body, req)
+	if code == http.StatusProxyAuthRequired {
+		if hp.digestAuth != nil {
+			hp.digestAuth.Challenge(resp.Header, errors.Is(err, errStaleNonce))
+		} else if hp.config.BasicAuth != nil || hp.config.JWTAuth == nil {
+			resp.Header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", hp.config.Name))
+		}
+		if hp.config.JWTAuth != nil {
+			resp.Header.Add("Proxy-Authenticate", fmt.Sprintf("Bearer realm=%q", hp.config.Name))
+		}
+	}
+	resp.Header.Set(ErrorHeader, hp.config.Name+" "+err.Error())
+	resp.Header.Set(ErrorLabelHeader, label)
+	resp.Header.Set("Content-Type", format.contentType())
+	resp.ContentLength = int64(body.Len())
+	return resp
+}
+
+// errorStatus returns the HTTP status code, message and metrics label for the error.
+func (hp *HTTPProxy) errorStatus(req *http.Request, err error) (code int, msg, label string) {
 	handlers := []errorHandler{
+		handleDenyError,
+		handleExtAuthzError,
+		handleICAPError,
+		handleProxyChainError,
 		handleWindowsNetError,
 		handleNetError,
 		handleTLSRecordHeader,
 		handleTLSCertificateError,
 		handleTLSECHRejectionError,
 		handleTLSAlertError,
+		handleSSHError,
 		handleMartianErrorStatus,
 		handleAuthenticationError,
-		handleDenyError,
 		handleStatusText,
 	}
 
-	var (
-		code       int
-		msg, label string
-	)
 	for _, h := range handlers {
 		code, msg, label = h(req, err)
 		if code != 0 {
@@ -70,26 +137,7 @@ func (hp *HTTPProxy) errorResponse(req *http.Request, err error) *http.Response
 		label = "unexpected_error"
 	}
 
-	if label != skipMetricsLabel {
-		hp.metrics.error(label)
-	}
-
-	var body bytes.Buffer
-	body.WriteString(hp.config.Name)
-	body.WriteString(" ")
-	body.WriteString(msg)
-	body.WriteString("\n")
-	body.WriteString(err.Error())
-	body.WriteString("\n")
-
-	resp := proxyutil.NewResponse(code, &body, req)
-	if code == http.StatusProxyAuthRequired {
-		resp.Header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", hp.config.Name))
-	}
-	resp.Header.Set(ErrorHeader, hp.config.Name+" "+err.Error())
-	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
-	resp.ContentLength = int64(body.Len())
-	return resp
+	return
 }
 
 type errorHandler func(*http.Request, error) (int, string, string)
@@ -193,6 +241,43 @@ func handleTLSAlertError(req *http.Request, err error) (code int, msg, label str
 	return
 }
 
+func handleSSHError(req *http.Request, err error) (code int, msg, label string) {
+	var (
+		keyErr     *knownhosts.KeyError
+		revokedErr *knownhosts.RevokedError
+		chanErr    *ssh.OpenChannelError
+	)
+	switch {
+	case errors.As(err, &keyErr), errors.As(err, &revokedErr):
+		code = http.StatusBadGateway
+		msg = "ssh host key verification failed for the upstream proxy"
+		label = "ssh_host_key"
+	case errors.As(err, &chanErr):
+		code = http.StatusBadGateway
+		msg = fmt.Sprintf("failed to connect to remote host %q through the upstream SSH proxy", req.Host)
+		label = "ssh_open_channel"
+	}
+
+	return
+}
+
+func handleProxyChainError(req *http.Request, err error) (code int, msg, label string) {
+	var chainErr *martian.ProxyChainError
+	if errors.As(err, &chainErr) {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			code = http.StatusGatewayTimeout
+			msg = fmt.Sprintf("timed out connecting to remote host %q through upstream proxy chain hop %d", req.Host, chainErr.Hop)
+		} else {
+			code = http.StatusBadGateway
+			msg = fmt.Sprintf("failed to connect to remote host %q through upstream proxy chain hop %d", req.Host, chainErr.Hop)
+		}
+		label = "proxy_chain"
+	}
+
+	return
+}
+
 func handleMartianErrorStatus(req *http.Request, err error) (code int, msg, label string) {
 	var martianErr martian.ErrorStatus
 	if errors.As(err, &martianErr) {
@@ -219,7 +304,40 @@ func handleDenyError(req *http.Request, err error) (code int, msg, label string)
 	if errors.As(err, &denyErr) {
 		code = http.StatusForbidden
 		msg = fmt.Sprintf("proxying is denied to host %q", req.Host)
-		label = skipMetricsLabel
+		label = deniedLabel
+	}
+
+	return
+}
+
+func handleExtAuthzError(req *http.Request, err error) (code int, msg, label string) {
+	var authzErr extAuthzError
+	if errors.As(err, &authzErr) {
+		code = http.StatusServiceUnavailable
+		msg = fmt.Sprintf("external authorization of request to host %q failed", req.Host)
+		label = "ext_authz"
+	}
+
+	return
+}
+
+func handleICAPError(req *http.Request, err error) (code int, msg, label string) {
+	var (
+		blockedErr *icapBlockedError
+		icapErr    icapError
+	)
+	switch {
+	case errors.As(err, &blockedErr):
+		code = http.StatusForbidden
+		msg = fmt.Sprintf("content from host %q was blocked by content scanning", req.Host)
+		if blockedErr.method == icap.MethodReqMod {
+			msg = fmt.Sprintf("request to host %q was blocked by content scanning", req.Host)
+		}
+		label = "icap_blocked"
+	case errors.As(err, &icapErr):
+		code = http.StatusServiceUnavailable
+		msg = fmt.Sprintf("content scanning of request to host %q failed", req.Host)
+		label = "icap"
 	}
 
 	return
@@ -0,0 +1,309 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Route decisions reported in RouteExplanation.Decision.
+const (
+	DecisionLocalhost     = "localhost"
+	DecisionDirectDomains = "direct_domains"
+	DecisionRoute         = "route"
+	DecisionJWT           = "jwt"
+	DecisionPAC           = "pac"
+	DecisionProxyFunc     = "proxy_func"
+	DecisionUpstreamProxy = "upstream_proxy"
+	DecisionDirect        = "direct"
+)
+
+// Credentials sources reported in RouteExplanation.
+const (
+	CredentialsFromURL         = "url"
+	CredentialsFromCredentials = "credentials"
+)
+
+// RouteExplanation describes how the proxy would handle a request.
+// Credentials are redacted.
+type RouteExplanation struct {
+	URL      string `json:"url"`
+	Method   string `json:"method"`
+	Listener string `json:"listener,omitempty"`
+	User     string `json:"user,omitempty"`
+
+	// Denied is the reason the request is denied, the rest of the fields are not set if the request is denied.
+	Denied string `json:"denied,omitempty"`
+	// MITM is true if the CONNECT request would be intercepted.
+	MITM bool `json:"mitm"`
+
+	// Decision is the step of the decision chain that selected the upstream.
+	Decision string `json:"decision"`
+	// Route is the name of the matched route if Decision is route.
+	Route string `json:"route,omitempty"`
+	// PAC is the PAC script result if Decision is pac.
+	PAC string `json:"pac,omitempty"`
+	// Upstream is the upstream proxy URL or DIRECT.
+	Upstream string `json:"upstream,omitempty"`
+	// Via are the proxies used to reach the upstream proxy if it is the last proxy of a chain.
+	Via []string `json:"via,omitempty"`
+	// UpstreamCredentials are the upstream proxy credentials and UpstreamCredentialsSource is where they come from.
+	UpstreamCredentials       string `json:"upstream_credentials,omitempty"`
+	UpstreamCredentialsSource string `json:"upstream_credentials_source,omitempty"`
+	// SiteCredentials are the credentials sent to the destination server.
+	SiteCredentials string `json:"site_credentials,omitempty"`
+
+	// ExtAuthz is set to ExtAuthzNotCached if the external authorization decision is not cached,
+	// the service is not queried when explaining and the request is assumed to be allowed.
+	ExtAuthz string `json:"ext_authz,omitempty"`
+
+	// Headers are the request header changes made by the request modifiers,
+	// "Name: value" for set headers and "-Name" for removed headers.
+	Headers []string `json:"headers,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// ExtAuthzNotCached is the RouteExplanation.ExtAuthz value when the decision would be queried from the service.
+const ExtAuthzNotCached = "not cached, would query ext_authz"
+
+type routeExplanationKey struct{}
+
+// routeExplanation returns the explanation if the request is being explained.
+func routeExplanation(req *http.Request) *RouteExplanation {
+	e, _ := req.Context().Value(routeExplanationKey{}).(*RouteExplanation)
+	return e
+}
+
+// explainDecision records the decision if the request is being explained.
+func explainDecision(req *http.Request, decision string) *RouteExplanation {
+	e := routeExplanation(req)
+	if e != nil {
+		e.Decision = decision
+	}
+	return e
+}
+
+// explaining returns true if the request is being explained.
+// The decision chain must not have side effects for such requests,
+// i.e. upstream group round-robin is not advanced, and caches and metrics are not updated.
+func explaining(req *http.Request) bool {
+	return req.Context().Value(routeExplanationKey{}) != nil
+}
+
+// ExplainRoute runs the proxy decision chain for the request without sending it.
+// The listener and user are taken from the request context, see WithRouteClient.
+// The access checks are the same as for proxied requests,
+// except that the external authorization service is not queried, only cached decisions are used.
+func (hp *HTTPProxy) ExplainRoute(req *http.Request) *RouteExplanation {
+	e := &RouteExplanation{
+		URL:    req.URL.Redacted(),
+		Method: req.Method,
+	}
+	if ci := clientInfoFromContext(req.Context()); ci != nil {
+		e.Listener = ci.Listener
+		e.User = ci.User
+	}
+	req = req.WithContext(context.WithValue(req.Context(), routeExplanationKey{}, e))
+
+	// The access modifiers may set headers, r is the request as modified by the proxy.
+	r := req.Clone(req.Context())
+	for _, m := range hp.accessModifiers() {
+		if err := m.ModifyRequest(r); err != nil {
+			e.Denied = err.Error()
+			return e
+		}
+	}
+
+	if r.Method == http.MethodConnect && hp.proxy.MITMConfig != nil {
+		e.MITM = hp.proxy.MITMFilter == nil || hp.proxy.MITMFilter(r)
+	}
+
+	var (
+		chain []*url.URL
+		err   error
+	)
+	if hp.proxyFunc != nil {
+		chain, err = hp.proxyFunc(r)
+	}
+	if err != nil {
+		e.Error = err.Error()
+		return e
+	}
+	if e.Decision == "" {
+		switch {
+		case hp.config.UpstreamProxyFunc != nil:
+			e.Decision = DecisionProxyFunc
+		case hp.config.UpstreamProxy != nil:
+			e.Decision = DecisionUpstreamProxy
+		default:
+			e.Decision = DecisionDirect
+		}
+	}
+
+	if len(chain) == 0 {
+		e.Upstream = DirectUpstream
+		if err := hp.explainDestination(r); err != nil {
+			if errors.Is(err, ErrDestinationDenied) {
+				e.Denied = err.Error()
+			} else {
+				e.Error = err.Error()
+			}
+			return e
+		}
+	} else {
+		proxyURL := chain[len(chain)-1]
+		for _, u := range chain[:len(chain)-1] {
+			e.Via = append(e.Via, u.Redacted())
+		}
+		e.Upstream = proxyURL.Redacted()
+		if proxyURL.User != nil {
+			e.UpstreamCredentials = RedactUserinfo(proxyURL.User)
+			e.UpstreamCredentialsSource = hp.credentialsSource(proxyURL)
+		}
+	}
+
+	if r.Method != http.MethodConnect {
+		hp.explainRequestModifiers(req, r, e)
+	}
+
+	return e
+}
+
+// explainDestination returns ErrDestinationDenied if the transport dialer would deny the request host.
+// Only direct connections are checked, connections to upstream proxies are not.
+func (hp *HTTPProxy) explainDestination(req *http.Request) error {
+	if hp.config.CheckDestination == nil {
+		return nil
+	}
+
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	ctx := WithDialTarget(req.Context(), host)
+	return hp.config.CheckDestination(ctx, "tcp", net.JoinHostPort(host, port))
+}
+
+// credentialsSource returns CredentialsFromCredentials if the URL credentials were set from the credentials matcher.
+func (hp *HTTPProxy) credentialsSource(u *url.URL) string {
+	uu := *u
+	uu.User = nil
+	if m := hp.creds.MatchURL(&uu); m != nil && *m == *u.User {
+		return CredentialsFromCredentials
+	}
+	return CredentialsFromURL
+}
+
+// explainRequestModifiers applies the request modifiers to r and records the header changes from the original request.
+func (hp *HTTPProxy) explainRequestModifiers(req, r *http.Request, e *RouteExplanation) {
+	for _, m := range hp.config.RequestModifiers {
+		if err := m.ModifyRequest(r); err != nil {
+			e.Error = err.Error()
+			return
+		}
+	}
+	for name, values := range r.Header {
+		if !slices.Equal(req.Header.Values(name), values) {
+			e.Headers = append(e.Headers, name+": "+strings.Join(values, ", "))
+		}
+	}
+	for name := range req.Header {
+		if _, ok := r.Header[name]; !ok {
+			e.Headers = append(e.Headers, "-"+name)
+		}
+	}
+	slices.Sort(e.Headers)
+
+	if r.Header.Get("Authorization") == "" {
+		if u := hp.creds.MatchURL(r.URL); u != nil {
+			e.SiteCredentials = RedactUserinfo(u)
+		}
+	}
+}
+
+// WithRouteClient sets the listener name and authenticated user used by ExplainRoute.
+func WithRouteClient(ctx context.Context, listener, user string) context.Context {
+	return context.WithValue(ctx, clientInfoKey{}, &clientInfo{Listener: listener, User: user})
+}
+
+// ExplainRouteHandler returns a handler that explains the route for the request in the query parameters:
+// url (required), method (default GET, CONNECT if the url has no scheme), listener (default main) and user.
+// The response is a JSON encoded RouteExplanation.
+func (hp *HTTPProxy) ExplainRouteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := explainRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		b, err := json.MarshalIndent(hp.ExplainRoute(req), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			hp.log.Debugf("explain route: write response: %v", err)
+		}
+	})
+}
+
+func explainRequest(r *http.Request) (*http.Request, error) {
+	q := r.URL.Query()
+
+	rawURL := q.Get("url")
+	if rawURL == "" {
+		return nil, errors.New("url query parameter is required")
+	}
+
+	method := strings.ToUpper(q.Get("method"))
+	if !strings.Contains(rawURL, "://") {
+		if method == "" {
+			method = http.MethodConnect
+		}
+		rawURL = "//" + rawURL
+	}
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("url must have a host")
+	}
+
+	listener := q.Get("listener")
+	if listener == "" {
+		listener = MainListenerName
+	}
+	ctx := WithRouteClient(r.Context(), listener, q.Get("user"))
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodConnect {
+		req.URL = &url.URL{Host: u.Host}
+	}
+	req.Host = u.Host
+
+	return req, nil
+}
@@ -0,0 +1,402 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/saucelabs/forwarder/icap"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// ICAPConfig configures scanning of request and response bodies with an ICAP (RFC 3507) service,
+// such as an antivirus or DLP engine.
+// With MITM enabled, bodies of HTTPS requests are scanned as well.
+type ICAPConfig struct {
+	// ReqModURL is the ICAP REQMOD service URL for request bodies i.e. icap://localhost:1344/reqmod.
+	// If nil, request bodies are not scanned.
+	ReqModURL *url.URL
+
+	// RespModURL is the ICAP RESPMOD service URL for response bodies i.e. icap://localhost:1344/respmod.
+	// If nil, response bodies are not scanned.
+	RespModURL *url.URL
+
+	// ContentTypes limits scanning to bodies with the media types, wildcards such as image/* are supported.
+	// If empty, all bodies are scanned.
+	ContentTypes []string
+
+	// Preview is the number of body bytes sent in the ICAP preview, negative value disables preview.
+	Preview int
+
+	// MaxBodySize is the maximum size of a body that is scanned.
+	// Larger bodies are passed unscanned unless RejectOversized is set.
+	MaxBodySize SizeSuffix
+
+	// RejectOversized handles bodies larger than MaxBodySize as ICAP errors.
+	RejectOversized bool
+
+	// Timeout limits the time of a single ICAP request, zero means no timeout.
+	Timeout time.Duration
+
+	// FailOpen passes messages unscanned if the ICAP service fails, or the body is too large and RejectOversized is set.
+	// Otherwise, the requests are rejected with 503 Service Unavailable.
+	FailOpen bool
+}
+
+func DefaultICAPConfig() *ICAPConfig {
+	return &ICAPConfig{
+		Preview:     4 * 1024,
+		MaxBodySize: 10 * Mebi,
+		Timeout:     30 * time.Second,
+	}
+}
+
+func (c *ICAPConfig) Validate() error {
+	if c.ReqModURL == nil && c.RespModURL == nil {
+		return errors.New("REQMOD or RESPMOD URL is required")
+	}
+	if c.ReqModURL != nil {
+		if err := validateICAPURL(c.ReqModURL); err != nil {
+			return fmt.Errorf("REQMOD URL: %w", err)
+		}
+	}
+	if c.RespModURL != nil {
+		if err := validateICAPURL(c.RespModURL); err != nil {
+			return fmt.Errorf("RESPMOD URL: %w", err)
+		}
+	}
+	for _, ct := range c.ContentTypes {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			return fmt.Errorf("content type %q: %w", ct, err)
+		}
+	}
+	if c.MaxBodySize <= 0 {
+		return errors.New("max body size must be positive")
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout must be non-negative")
+	}
+	return nil
+}
+
+// ParseICAPURL parses ICAP service URL i.e. icap://localhost:1344/reqmod.
+func ParseICAPURL(val string) (*url.URL, error) {
+	u, err := url.Parse(val)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateICAPURL(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func validateICAPURL(u *url.URL) error {
+	if u.Scheme != "icap" {
+		return fmt.Errorf("unsupported scheme %q, supported schemes are: icap", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	return nil
+}
+
+// icapBlockedError is returned when the ICAP service blocks a message.
+type icapBlockedError struct {
+	method string
+	threat string
+}
+
+func (e *icapBlockedError) Error() string {
+	if e.threat == "" {
+		return "blocked by ICAP " + e.method
+	}
+	return "blocked by ICAP " + e.method + ": " + e.threat
+}
+
+// icapError is returned when the ICAP service fails and the proxy is configured to fail closed.
+type icapError struct {
+	error
+}
+
+func (e icapError) Unwrap() error {
+	return e.error
+}
+
+var errICAPBodyTooLarge = errors.New("body exceeds ICAP max body size")
+
+// icapScanner sends bodies matching the host and content type filters to the ICAP service.
+type icapScanner struct {
+	config  ICAPConfig
+	domains Matcher
+	client  icap.Client
+	log     log.Logger
+	metrics *icapMetrics
+}
+
+func newICAPScanner(cfg *ICAPConfig, domains Matcher, log log.Logger, r prometheus.Registerer, namespace string) *icapScanner {
+	return &icapScanner{
+		config:  *cfg,
+		domains: domains,
+		client:  icap.Client{Timeout: cfg.Timeout},
+		log:     log,
+		metrics: newICAPMetrics(r, namespace),
+	}
+}
+
+// icapStreamingTypes are media types of streaming bodies that are never scanned,
+// buffering them would block the stream until the body is complete.
+var icapStreamingTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+	"application/stream+json",
+	"application/grpc",
+	"multipart/x-mixed-replace",
+}
+
+func (s *icapScanner) match(u *url.URL, contentType string) bool {
+	if s.domains != nil && !matchURL(s.domains, u) {
+		return false
+	}
+
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mt = "application/octet-stream"
+	}
+	for _, st := range icapStreamingTypes {
+		if mt == st || strings.HasPrefix(mt, st+"+") {
+			return false
+		}
+	}
+	if len(s.config.ContentTypes) == 0 {
+		return true
+	}
+
+	for _, ct := range s.config.ContentTypes {
+		if ct == "*/*" || strings.EqualFold(ct, mt) {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(ct, "/*"); ok && strings.HasPrefix(mt, strings.ToLower(prefix)+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ModifyRequest sends the request body to the REQMOD service.
+// If the service responds with an HTTP response the request is blocked,
+// otherwise the request headers and body are replaced with the modified ones.
+func (s *icapScanner) ModifyRequest(req *http.Request) error {
+	if req.Method == http.MethodConnect || !hasBody(req.Body, req.ContentLength) {
+		return nil
+	}
+	if !s.match(req.URL, req.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	body, err := readBodyLimit(&req.Body, int64(s.config.MaxBodySize))
+	if err != nil {
+		return s.oversized(icap.MethodReqMod, req, err)
+	}
+
+	res, err := s.do(req.Context(), &icap.Request{
+		Method:      icap.MethodReqMod,
+		URL:         s.config.ReqModURL,
+		HTTPRequest: req,
+		Body:        body,
+		Preview:     s.config.Preview,
+	})
+	if err != nil {
+		return s.fail(icap.MethodReqMod, req, err)
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNoContent:
+		s.metrics.result(icap.MethodReqMod, "unmodified")
+	case res.HTTPResponse != nil:
+		s.metrics.result(icap.MethodReqMod, "blocked")
+		return &icapBlockedError{method: icap.MethodReqMod, threat: icapThreat(res.Header)}
+	case res.HTTPRequest != nil:
+		s.metrics.result(icap.MethodReqMod, "modified")
+		req.Header = res.HTTPRequest.Header
+		req.Header.Del("Content-Length")
+		req.Body, req.ContentLength = io.NopCloser(bytes.NewReader(res.Body)), int64(len(res.Body))
+		req.TransferEncoding = nil
+	default:
+		s.metrics.result(icap.MethodReqMod, "unmodified")
+	}
+
+	return nil
+}
+
+// ModifyResponse sends the response body to the RESPMOD service.
+// If the service reports an infection or a violation the response is blocked,
+// otherwise the response status, headers and body are replaced with the modified ones.
+func (s *icapScanner) ModifyResponse(res *http.Response) error {
+	req := res.Request
+	if req.Method == http.MethodConnect || res.StatusCode == http.StatusSwitchingProtocols || !hasBody(res.Body, res.ContentLength) {
+		return nil
+	}
+	if !s.match(req.URL, res.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	body, err := readBodyLimit(&res.Body, int64(s.config.MaxBodySize))
+	if err != nil {
+		return s.oversized(icap.MethodRespMod, req, err)
+	}
+
+	ires, err := s.do(req.Context(), &icap.Request{
+		Method:       icap.MethodRespMod,
+		URL:          s.config.RespModURL,
+		HTTPRequest:  req,
+		HTTPResponse: res,
+		Body:         body,
+		Preview:      s.config.Preview,
+	})
+	if err != nil {
+		return s.fail(icap.MethodRespMod, req, err)
+	}
+
+	switch {
+	case ires.StatusCode == http.StatusNoContent || ires.HTTPResponse == nil:
+		s.metrics.result(icap.MethodRespMod, "unmodified")
+	case icapThreat(ires.Header) != "":
+		s.metrics.result(icap.MethodRespMod, "blocked")
+		return &icapBlockedError{method: icap.MethodRespMod, threat: icapThreat(ires.Header)}
+	default:
+		s.metrics.result(icap.MethodRespMod, "modified")
+		mod := ires.HTTPResponse
+		res.StatusCode, res.Status = mod.StatusCode, mod.Status
+		res.Header = mod.Header
+		res.Header.Del("Content-Length")
+		b := ires.Body
+		if b == nil {
+			b = []byte{}
+		}
+		res.Body, res.ContentLength = io.NopCloser(bytes.NewReader(b)), int64(len(b))
+		res.TransferEncoding = nil
+	}
+
+	return nil
+}
+
+func (s *icapScanner) do(ctx context.Context, req *icap.Request) (*icap.Response, error) {
+	start := time.Now()
+	res, err := s.client.Do(ctx, req)
+	s.metrics.duration.WithLabelValues(req.Method).Observe(time.Since(start).Seconds())
+	return res, err
+}
+
+// oversized passes messages with bodies larger than MaxBodySize unscanned unless RejectOversized is set.
+func (s *icapScanner) oversized(method string, req *http.Request, err error) error {
+	if errors.Is(err, errICAPBodyTooLarge) && !s.config.RejectOversized {
+		s.metrics.result(method, "skipped")
+		return nil
+	}
+	return s.fail(method, req, err)
+}
+
+// fail handles ICAP errors according to FailOpen, the request or response body must be restored by the caller.
+func (s *icapScanner) fail(method string, req *http.Request, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.metrics.result(method, "timeout")
+	} else {
+		s.metrics.result(method, "error")
+	}
+	if s.config.FailOpen {
+		s.log.Errorf("ICAP %s failed, passing unscanned host=%s: %v", method, req.Host, err)
+		return nil
+	}
+	return icapError{fmt.Errorf("%s: %w", method, err)}
+}
+
+// icapThreat returns the threat name from the de facto standard X-Infection-Found header or the X-Violations-Found header.
+func icapThreat(h http.Header) string {
+	if v := h.Get("X-Infection-Found"); v != "" {
+		for _, f := range strings.Split(v, ";") {
+			if k, t, ok := strings.Cut(strings.TrimSpace(f), "="); ok && strings.EqualFold(k, "Threat") {
+				return t
+			}
+		}
+		return v
+	}
+	if v := h.Get("X-Violations-Found"); v != "" {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return fmt.Sprintf("%d violations", n)
+		}
+		return v
+	}
+	return ""
+}
+
+func hasBody(body io.ReadCloser, contentLength int64) bool {
+	return body != nil && body != http.NoBody && contentLength != 0
+}
+
+// readBodyLimit reads the body up to limit bytes and replaces it with a reader of the read bytes.
+// If the body is larger than limit or cannot be read, the body is restored so that the read bytes are not lost,
+// and errICAPBodyTooLarge or the read error is returned.
+func readBodyLimit(body *io.ReadCloser, limit int64) ([]byte, error) {
+	orig := *body
+	b, err := io.ReadAll(io.LimitReader(orig, limit+1))
+	if err == nil && int64(len(b)) > limit {
+		err = errICAPBodyTooLarge
+	}
+	if err != nil {
+		*body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), orig), orig}
+		return nil, err
+	}
+	orig.Close()
+	*body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+type icapMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func newICAPMetrics(r prometheus.Registerer, namespace string) *icapMetrics {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+
+	return &icapMetrics{
+		requests: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "icap_requests_total",
+			Namespace: namespace,
+			Help:      "Number of ICAP scans by method and result, unmodified, modified, blocked, skipped, timeout or error",
+		}, []string{"method", "result"}),
+		duration: f.NewHistogramVec(prometheus.HistogramOpts{
+			Name:      "icap_duration_seconds",
+			Namespace: namespace,
+			Help:      "ICAP request latency by method",
+			Buckets:   []float64{.005, .01, .05, .1, .5, 1, 5, 10, 30},
+		}, []string{"method"}),
+	}
+}
+
+func (m *icapMetrics) result(method, result string) {
+	m.requests.WithLabelValues(method, result).Inc()
+}
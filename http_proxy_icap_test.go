@@ -0,0 +1,272 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+
+	"github.com/saucelabs/forwarder/icap"
+	"github.com/saucelabs/forwarder/icap/icaptest"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestHTTPProxyICAP(t *testing.T) {
+	var calls atomic.Int32
+	is := icaptest.NewServer(func(req *icap.Request) *icap.Response {
+		calls.Add(1)
+		switch {
+		case bytes.Contains(req.Body, []byte("EICAR")):
+			return &icap.Response{
+				StatusCode:   http.StatusOK,
+				Header:       http.Header{"X-Infection-Found": {"Type=0; Resolution=2; Threat=EICAR-Test-File;"}},
+				HTTPResponse: &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{}},
+				Body:         []byte("infected"),
+			}
+		case bytes.Contains(req.Body, []byte("secret")) && req.Method == icap.MethodReqMod:
+			r := req.HTTPRequest.Clone(context.Background())
+			return &icap.Response{
+				StatusCode:  http.StatusOK,
+				HTTPRequest: r,
+				Body:        bytes.ReplaceAll(req.Body, []byte("secret"), []byte("******")),
+			}
+		case bytes.Contains(req.Body, []byte("secret")):
+			return &icap.Response{
+				StatusCode:   http.StatusOK,
+				HTTPResponse: &http.Response{StatusCode: http.StatusOK, Header: req.HTTPResponse.Header},
+				Body:         bytes.ReplaceAll(req.Body, []byte("secret"), []byte("******")),
+			}
+		default:
+			return &icap.Response{StatusCode: http.StatusNoContent}
+		}
+	})
+	defer is.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			io.Copy(w, r.Body)
+			return
+		}
+		switch r.URL.Path {
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+	})
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(handler)
+	defer tlsBackend.Close()
+
+	start := func(t *testing.T, cfg *ICAPConfig) string {
+		t.Helper()
+
+		pcfg := DefaultHTTPProxyConfig()
+		pcfg.Address = "localhost:0"
+		pcfg.ProxyLocalhost = AllowProxyLocalhost
+		pcfg.MITM = DefaultMITMConfig()
+		pcfg.ICAP = cfg
+
+		rt := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}} //nolint:gosec // test server certificate
+		p, err := NewHTTPProxy(pcfg, nil, nil, rt, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go p.Run(ctx)
+
+		addrs, _ := p.Addr()
+		return addrs[0]
+	}
+
+	do := func(t *testing.T, addr, method, u, body string) (*http.Response, string) {
+		t.Helper()
+
+		req := httptest.NewRequest(method, u, strings.NewReader(body))
+		req.RequestURI = ""
+		if body == "" {
+			req.Body = http.NoBody
+		}
+		tr := &http.Transport{
+			Proxy:           http.ProxyURL(&url.URL{Scheme: "http", Host: addr}),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // MITM certificate
+		}
+		defer tr.CloseIdleConnections()
+
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	cfg := DefaultICAPConfig()
+	cfg.ReqModURL = is.URL("/reqmod")
+	cfg.RespModURL = is.URL("/respmod")
+	cfg.ContentTypes = []string{"text/*"}
+	cfg.Preview = 4
+	addr := start(t, cfg)
+
+	for _, b := range []*httptest.Server{backend, tlsBackend} {
+		t.Run(b.URL[:strings.Index(b.URL, ":")], func(t *testing.T) {
+			t.Run("clean", func(t *testing.T) {
+				calls.Store(0)
+				res, body := do(t, addr, http.MethodGet, b.URL+"/clean", "")
+				if res.StatusCode != http.StatusOK || body != "clean" {
+					t.Fatalf("expected clean response, got %d %q", res.StatusCode, body)
+				}
+				if n := calls.Load(); n != 1 {
+					t.Fatalf("expected 1 ICAP call, got %d", n)
+				}
+			})
+
+			t.Run("content type filter", func(t *testing.T) {
+				calls.Store(0)
+				res, body := do(t, addr, http.MethodGet, b.URL+"/image", "")
+				if res.StatusCode != http.StatusOK || body != "image" {
+					t.Fatalf("expected image response, got %d %q", res.StatusCode, body)
+				}
+				if n := calls.Load(); n != 0 {
+					t.Fatalf("expected no ICAP calls, got %d", n)
+				}
+			})
+
+			t.Run("streaming", func(t *testing.T) {
+				calls.Store(0)
+				res, body := do(t, addr, http.MethodGet, b.URL+"/events", "")
+				if res.StatusCode != http.StatusOK || body != "events" {
+					t.Fatalf("expected events response, got %d %q", res.StatusCode, body)
+				}
+				if n := calls.Load(); n != 0 {
+					t.Fatalf("expected no ICAP calls, got %d", n)
+				}
+			})
+
+			t.Run("response replaced", func(t *testing.T) {
+				res, body := do(t, addr, http.MethodGet, b.URL+"/my-secret-file", "")
+				if res.StatusCode != http.StatusOK || body != "my-******-file" {
+					t.Fatalf("expected replaced body, got %d %q", res.StatusCode, body)
+				}
+			})
+
+			t.Run("response blocked", func(t *testing.T) {
+				res, _ := do(t, addr, http.MethodGet, b.URL+"/EICAR", "")
+				if res.StatusCode != http.StatusForbidden {
+					t.Fatalf("expected %d, got %d", http.StatusForbidden, res.StatusCode)
+				}
+				if got := res.Header.Get(ErrorLabelHeader); got != "icap_blocked" {
+					t.Fatalf("expected icap_blocked error label, got %q", got)
+				}
+				if got := res.Header.Get(ErrorHeader); !strings.Contains(got, "EICAR-Test-File") {
+					t.Fatalf("expected threat name in error, got %q", got)
+				}
+			})
+
+			t.Run("request replaced", func(t *testing.T) {
+				res, body := do(t, addr, http.MethodPost, b.URL+"/upload", "my secret data")
+				if res.StatusCode != http.StatusOK || body != "my ****** data" {
+					t.Fatalf("expected replaced body, got %d %q", res.StatusCode, body)
+				}
+			})
+
+			t.Run("request blocked", func(t *testing.T) {
+				res, _ := do(t, addr, http.MethodPost, b.URL+"/upload", "EICAR")
+				if res.StatusCode != http.StatusForbidden {
+					t.Fatalf("expected %d, got %d", http.StatusForbidden, res.StatusCode)
+				}
+			})
+		})
+	}
+
+	t.Run("fail closed", func(t *testing.T) {
+		cfg := DefaultICAPConfig()
+		cfg.ReqModURL = &url.URL{Scheme: "icap", Host: "127.0.0.1:1"}
+		addr := start(t, cfg)
+
+		res, _ := do(t, addr, http.MethodPost, backend.URL+"/upload", "data")
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected %d, got %d", http.StatusServiceUnavailable, res.StatusCode)
+		}
+		if got := res.Header.Get(ErrorLabelHeader); got != "icap" {
+			t.Fatalf("expected icap error label, got %q", got)
+		}
+	})
+
+	t.Run("fail open", func(t *testing.T) {
+		cfg := DefaultICAPConfig()
+		cfg.ReqModURL = &url.URL{Scheme: "icap", Host: "127.0.0.1:1"}
+		cfg.FailOpen = true
+		addr := start(t, cfg)
+
+		res, body := do(t, addr, http.MethodPost, backend.URL+"/upload", "data")
+		if res.StatusCode != http.StatusOK || body != "data" {
+			t.Fatalf("expected unscanned body, got %d %q", res.StatusCode, body)
+		}
+	})
+
+	t.Run("oversized", func(t *testing.T) {
+		cfg := DefaultICAPConfig()
+		cfg.ReqModURL = is.URL("/reqmod")
+		cfg.RespModURL = is.URL("/respmod")
+		cfg.MaxBodySize = 4
+		addr := start(t, cfg)
+
+		calls.Store(0)
+		res, body := do(t, addr, http.MethodPost, backend.URL+"/upload", "large secret body")
+		if res.StatusCode != http.StatusOK || body != "large secret body" {
+			t.Fatalf("expected unscanned body, got %d %q", res.StatusCode, body)
+		}
+		if n := calls.Load(); n != 0 {
+			t.Fatalf("expected no ICAP calls, got %d", n)
+		}
+	})
+
+	t.Run("reject oversized", func(t *testing.T) {
+		cfg := DefaultICAPConfig()
+		cfg.ReqModURL = is.URL("/reqmod")
+		cfg.MaxBodySize = 4
+		cfg.RejectOversized = true
+		addr := start(t, cfg)
+
+		res, _ := do(t, addr, http.MethodPost, backend.URL+"/upload", "large secret body")
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected %d, got %d", http.StatusServiceUnavailable, res.StatusCode)
+		}
+	})
+}
+
+func TestReadBodyLimitError(t *testing.T) {
+	readErr := errors.New("read failed")
+	body := io.NopCloser(io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(readErr)))
+
+	if _, err := readBodyLimit(&body, 100); !errors.Is(err, readErr) {
+		t.Fatalf("expected %v, got %v", readErr, err)
+	}
+
+	// The read bytes are restored and the error is returned again, so the body is not forwarded truncated.
+	b, err := io.ReadAll(body)
+	if string(b) != "partial" || !errors.Is(err, readErr) {
+		t.Fatalf("expected restored body and error, got %q %v", b, err)
+	}
+}
@@ -9,11 +9,14 @@ package forwarder
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/saucelabs/forwarder/dialvia"
 	"github.com/saucelabs/forwarder/internal/martian/mitm/mitmprom"
 )
 
 type httpProxyMetrics struct {
-	errors *prometheus.CounterVec
+	errors        *prometheus.CounterVec
+	tunnelsClosed *prometheus.CounterVec
+	clientCerts   *prometheus.CounterVec
 }
 
 func newHTTPProxyMetrics(r prometheus.Registerer, namespace string) *httpProxyMetrics {
@@ -28,6 +31,16 @@ func newHTTPProxyMetrics(r prometheus.Registerer, namespace string) *httpProxyMe
 			Namespace: namespace,
 			Help:      "Number of proxy errors",
 		}, []string{"reason"}),
+		tunnelsClosed: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_tunnels_closed_total",
+			Namespace: namespace,
+			Help:      "Number of closed CONNECT and upgrade tunnels",
+		}, []string{"reason"}),
+		clientCerts: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_client_certs_total",
+			Namespace: namespace,
+			Help:      "Number of TLS client certificates with a valid chain, rejected certificates are revoked or have no user field",
+		}, []string{"listener", "result"}),
 	}
 }
 
@@ -35,9 +48,70 @@ func (m *httpProxyMetrics) error(reason string) {
 	m.errors.WithLabelValues(reason).Inc()
 }
 
+func (m *httpProxyMetrics) tunnelClosed(reason string) {
+	m.tunnelsClosed.WithLabelValues(reason).Inc()
+}
+
+func (m *httpProxyMetrics) clientCert(listener string, ok bool) {
+	result := "verified"
+	if !ok {
+		result = "rejected"
+	}
+	m.clientCerts.WithLabelValues(listener, result).Inc()
+}
+
 func registerMITMCacheMetrics(r prometheus.Registerer, namespace string, cm mitmprom.CacheMetricsFunc) {
 	if r == nil {
 		r = prometheus.NewRegistry() // This registry will be discarded.
 	}
 	r.MustRegister(mitmprom.NewCacheMetricsCollector(namespace, cm))
 }
+
+type upstreamHTTP2Collector struct {
+	conns     *prometheus.Desc
+	streams   *prometheus.Desc
+	perConn   *prometheus.Desc
+	opened    *prometheus.Desc
+	fallbacks *prometheus.Desc
+	stats     func() map[string]dialvia.HTTP2Stats
+}
+
+func registerUpstreamHTTP2Metrics(r prometheus.Registerer, namespace string, stats func() map[string]dialvia.HTTP2Stats) {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	name := func(n string) string {
+		return prometheus.BuildFQName(namespace, "upstream_http2", n)
+	}
+	labels := []string{"upstream"}
+	r.MustRegister(&upstreamHTTP2Collector{
+		conns:     prometheus.NewDesc(name("connections"), "Number of open HTTP/2 connections to the upstream proxy", labels, nil),
+		streams:   prometheus.NewDesc(name("streams"), "Number of open CONNECT tunnels multiplexed over HTTP/2 connections to the upstream proxy", labels, nil),
+		perConn:   prometheus.NewDesc(name("streams_per_connection"), "Average number of open CONNECT tunnels per HTTP/2 connection to the upstream proxy", labels, nil),
+		opened:    prometheus.NewDesc(name("streams_total"), "Number of CONNECT tunnels opened as HTTP/2 streams to the upstream proxy", labels, nil),
+		fallbacks: prometheus.NewDesc(name("fallbacks_total"), "Number of connections that fell back to HTTP/1.1 because the upstream proxy did not negotiate h2", labels, nil),
+		stats:     stats,
+	})
+}
+
+func (c *upstreamHTTP2Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.conns
+	ch <- c.streams
+	ch <- c.perConn
+	ch <- c.opened
+	ch <- c.fallbacks
+}
+
+func (c *upstreamHTTP2Collector) Collect(ch chan<- prometheus.Metric) {
+	for upstream, s := range c.stats() {
+		ch <- prometheus.MustNewConstMetric(c.conns, prometheus.GaugeValue, float64(s.Conns), upstream)
+		ch <- prometheus.MustNewConstMetric(c.streams, prometheus.GaugeValue, float64(s.ActiveStreams), upstream)
+		var perConn float64
+		if s.Conns > 0 {
+			perConn = float64(s.ActiveStreams) / float64(s.Conns)
+		}
+		ch <- prometheus.MustNewConstMetric(c.perConn, prometheus.GaugeValue, perConn, upstream)
+		ch <- prometheus.MustNewConstMetric(c.opened, prometheus.CounterValue, float64(s.Streams), upstream)
+		ch <- prometheus.MustNewConstMetric(c.fallbacks, prometheus.CounterValue, float64(s.Fallbacks), upstream)
+	}
+}
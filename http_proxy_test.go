@@ -8,6 +8,8 @@ package forwarder
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
 	"errors"
 	"io"
 	"net"
@@ -199,3 +201,133 @@ func TestErrorResponse(t *testing.T) {
 		}
 	})
 }
+
+func TestTrustedClients(t *testing.T) {
+	trusted, _ := ParseIPRange("192.0.2.0/24")
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.BasicAuth = url.UserPassword("user", "pass")
+	cfg.TrustedClients = []IPRange{trusted}
+
+	h, err := NewHTTPProxyHandler(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		status     int
+	}{
+		// Authentication is skipped, the request is denied because it's to localhost.
+		{"192.0.2.1:1234", http.StatusForbidden},
+		{"198.51.100.1:1234", http.StatusProxyAuthRequired},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+		req.RemoteAddr = tc.remoteAddr
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.remoteAddr, tc.status, rw.Code)
+		}
+	}
+}
+
+func TestHTTPProxyClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	caFile, _ := ca.writeFiles(t, t.TempDir())
+	alice := ca.issue(t, 2, pkix.Name{CommonName: "alice"})
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "corp")
+	}))
+	defer upstream.Close()
+
+	rcfg, err := ParseRoutingTableConfig([]byte("routes:\n  - users: [alice]\n    upstream: " + upstream.URL + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := NewRoutingTable(rcfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Address = "localhost:0"
+	cfg.Protocol = HTTPSScheme
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.BasicAuth = url.UserPassword("user", "pass")
+	cfg.RoutingTable = rt
+	cfg.ClientAuth.CACertFiles = []string{caFile}
+	cfg.ExtraListeners = []NamedListenerConfig{
+		{
+			Name:           "basic",
+			ListenerConfig: *DefaultListenerConfig("localhost:0"),
+			ClientAuth:     DefaultTLSClientAuthConfig(),
+		},
+	}
+
+	p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	addrs, _ := p.Addr()
+
+	get := func(t *testing.T, addr string, cert *tls.Certificate, user *url.Userinfo) *http.Response {
+		t.Helper()
+
+		tlsCfg := &tls.Config{InsecureSkipVerify: true} //nolint:gosec // test server certificate
+		if cert != nil {
+			tlsCfg.Certificates = []tls.Certificate{*cert}
+		}
+		tr := &http.Transport{
+			Proxy:           http.ProxyURL(&url.URL{Scheme: "https", Host: addr, User: user}),
+			TLSClientConfig: tlsCfg,
+		}
+		defer tr.CloseIdleConnections()
+
+		res, err := tr.RoundTrip(httptest.NewRequest(http.MethodGet, backend.URL, http.NoBody))
+		if err != nil {
+			return nil
+		}
+		res.Body.Close()
+		return res
+	}
+
+	t.Run("cert", func(t *testing.T) {
+		res := get(t, addrs[0], &alice, nil)
+		if res == nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("expected %d, got %v", http.StatusOK, res)
+		}
+		if got := res.Header.Get("X-Upstream"); got != "corp" {
+			t.Fatalf("expected request to be routed to upstream, got %q", got)
+		}
+	})
+
+	t.Run("no cert", func(t *testing.T) {
+		if res := get(t, addrs[0], nil, url.UserPassword("user", "pass")); res != nil {
+			t.Fatalf("expected handshake error, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("basic listener", func(t *testing.T) {
+		if res := get(t, addrs[1], nil, nil); res == nil || res.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("expected %d, got %v", http.StatusProxyAuthRequired, res)
+		}
+		res := get(t, addrs[1], nil, url.UserPassword("user", "pass"))
+		if res == nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("expected %d, got %v", http.StatusOK, res)
+		}
+		if got := res.Header.Get("X-Upstream"); got != "" {
+			t.Fatalf("expected request not to be routed to upstream, got %q", got)
+		}
+	})
+}
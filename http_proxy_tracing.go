@@ -0,0 +1,259 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/saucelabs/forwarder"
+
+const (
+	upstreamProxyKey = attribute.Key("forwarder.upstream_proxy")
+	mitmKey          = attribute.Key("forwarder.mitm")
+	errorLabelKey    = attribute.Key("forwarder.error")
+	traceIDKey       = attribute.Key("forwarder.trace_id")
+)
+
+// httpProxyTracing creates OpenTelemetry spans for proxied requests.
+// The server span covers the whole request handling including the tunnel lifetime or the MITM handshake,
+// the client span covers the upstream round trip or establishing the CONNECT tunnel.
+type httpProxyTracing struct {
+	tracer trace.Tracer
+	prop   propagation.TextMapPropagator
+	inject bool
+}
+
+func newHTTPProxyTracing(tp trace.TracerProvider, inject bool) *httpProxyTracing {
+	return &httpProxyTracing{
+		tracer: tp.Tracer(tracerName),
+		prop:   propagation.TraceContext{},
+		inject: inject,
+	}
+}
+
+type clientSpanKey struct{}
+
+// clientSpan holds the client span of a request, it is set in the request context by requestContext.
+type clientSpan struct {
+	mu   sync.Mutex
+	span trace.Span
+}
+
+func (c *clientSpan) start(s trace.Span) {
+	c.mu.Lock()
+	c.span = s
+	c.mu.Unlock()
+}
+
+func (c *clientSpan) get() trace.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.span
+}
+
+func (c *clientSpan) end() trace.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.span
+	c.span = nil
+	return s
+}
+
+func contextClientSpan(ctx context.Context) *clientSpan {
+	if v, ok := ctx.Value(clientSpanKey{}).(*clientSpan); ok {
+		return v
+	}
+	return new(clientSpan) // discarded
+}
+
+// requestContext extracts the W3C trace context from the request and starts the server span.
+func (t *httpProxyTracing) requestContext(ctx context.Context, req *http.Request) context.Context {
+	ctx = t.prop.Extract(ctx, propagation.HeaderCarrier(req.Header))
+	ctx, _ = t.tracer.Start(ctx, req.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.Redacted()),
+			semconv.ServerAddress(req.Host),
+			traceIDKey.String(martian.ContextTraceID(ctx)),
+		),
+		trace.WithAttributes(clientAddressAttributes(req.RemoteAddr)...),
+	)
+	return context.WithValue(ctx, clientSpanKey{}, new(clientSpan))
+}
+
+// clientAddressAttributes returns the client address and port attributes from the request remote address.
+func clientAddressAttributes(remoteAddr string) []attribute.KeyValue {
+	host, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return []attribute.KeyValue{semconv.ClientAddress(remoteAddr)}
+	}
+	attrs := []attribute.KeyValue{semconv.ClientAddress(host)}
+	if p, err := strconv.Atoi(port); err == nil {
+		attrs = append(attrs, semconv.ClientPort(p))
+	}
+	return attrs
+}
+
+func (t *httpProxyTracing) startClientSpan(req *http.Request) {
+	ctx, span := t.tracer.Start(req.Context(), req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.Redacted()),
+			semconv.ServerAddress(req.URL.Hostname()),
+		),
+	)
+	contextClientSpan(req.Context()).start(span)
+
+	if t.inject && req.Method != http.MethodConnect {
+		t.prop.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	}
+}
+
+func (t *httpProxyTracing) endClientSpan(req *http.Request, res *http.Response, err error, errorLabel string) {
+	span := contextClientSpan(req.Context()).end()
+	if span == nil {
+		return
+	}
+
+	if res != nil {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(res.StatusCode))
+		if res.StatusCode >= 400 {
+			span.SetStatus(codes.Error, "")
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	if errorLabel != "" {
+		span.SetAttributes(errorLabelKey.String(errorLabel))
+	}
+	span.End()
+}
+
+func (t *httpProxyTracing) proxySelected(req *http.Request, proxy string) {
+	trace.SpanFromContext(req.Context()).SetAttributes(upstreamProxyKey.String(proxy))
+	if span := contextClientSpan(req.Context()).get(); span != nil {
+		span.SetAttributes(upstreamProxyKey.String(proxy))
+	}
+}
+
+func (t *httpProxyTracing) mitm(req *http.Request, err error) {
+	span := trace.SpanFromContext(req.Context())
+	span.SetAttributes(mitmKey.Bool(true))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (t *httpProxyTracing) error(req *http.Request, err error, label string) {
+	span := trace.SpanFromContext(req.Context())
+	span.RecordError(err)
+	span.SetAttributes(errorLabelKey.String(label))
+}
+
+// switchesProtocols returns true if the response starts a tunnel or a MITM session,
+// the server span is ended when the tunnel is closed or the MITM handshake is done.
+func switchesProtocols(res *http.Response) bool {
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	return res.Request.Method == http.MethodConnect && res.StatusCode/100 == 2
+}
+
+// endServerSpan ends the client span if it is still open and the server span.
+func (t *httpProxyTracing) endServerSpan(res *http.Response) {
+	ctx := res.Request.Context()
+
+	if span := contextClientSpan(ctx).end(); span != nil {
+		span.End()
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(semconv.HTTPResponseStatusCode(res.StatusCode))
+	if res.StatusCode >= 500 {
+		span.SetStatus(codes.Error, "")
+	}
+	span.End()
+}
+
+func (t *httpProxyTracing) configureTrace(pt *martian.ProxyTrace, hp *HTTPProxy) {
+	pt.RoundTripStart = func(info martian.RoundTripStartInfo) {
+		t.startClientSpan(info.Req)
+	}
+	pt.RoundTripDone = func(info martian.RoundTripDoneInfo) {
+		var label string
+		if info.Err != nil {
+			_, _, label = hp.errorStatus(info.Req, info.Err)
+		}
+		t.endClientSpan(info.Req, info.Res, info.Err, label)
+	}
+
+	pt.ConnectRequest = func(info martian.ConnectRequestInfo) {
+		t.startClientSpan(info.Req)
+	}
+	pt.TunnelOpened = chainTrace(pt.TunnelOpened, func(info martian.TunnelOpenedInfo) {
+		t.endClientSpan(info.Res.Request, info.Res, nil, "")
+	})
+	pt.ConnectFailed = chainTrace(pt.ConnectFailed, func(info martian.ConnectFailedInfo) {
+		t.endClientSpan(info.Req, info.Res, info.Err, hp.connectFailedLabel(info))
+	})
+
+	pt.ProxySelected = chainTrace(pt.ProxySelected, func(info martian.ProxySelectedInfo) {
+		if info.Err == nil {
+			t.proxySelected(info.Req, connectUpstreamLabel(info.ProxyURL))
+		}
+	})
+	pt.TLSHandshakeDone = chainTrace(pt.TLSHandshakeDone, func(info martian.TLSHandshakeDoneInfo) {
+		if info.Phase == martian.PhaseTLSMITM {
+			t.mitm(info.Req, info.Err)
+		}
+	})
+
+	pt.WroteResponse = chainTrace(pt.WroteResponse, func(info martian.WroteResponseInfo) {
+		if info.Res == nil {
+			return
+		}
+		// If writing the response or draining the client buffer fails, no tunnel follows.
+		if info.Err != nil {
+			trace.SpanFromContext(info.Res.Request.Context()).RecordError(info.Err)
+			t.endServerSpan(info.Res)
+		} else if !switchesProtocols(info.Res) {
+			t.endServerSpan(info.Res)
+		}
+	})
+	pt.TunnelClosed = chainTrace(pt.TunnelClosed, func(info martian.TunnelClosedInfo) {
+		t.endServerSpan(info.Res)
+	})
+}
+
+// chainTrace returns a hook that calls a and b in order, a may be nil.
+func chainTrace[T any](a, b func(T)) func(T) {
+	if a == nil {
+		return b
+	}
+	return func(info T) {
+		a(info)
+		b(info)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHTTPProxyTracing(t *testing.T) {
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID = "00f067aa0ba902b7"
+	)
+
+	var (
+		mu    sync.Mutex
+		spans []*tracepb.Span
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var req collectortrace.ExportTraceServiceRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		for _, rs := range req.GetResourceSpans() {
+			for _, ss := range rs.GetScopeSpans() {
+				spans = append(spans, ss.GetSpans()...)
+			}
+		}
+		mu.Unlock()
+
+		res, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(res)
+	}))
+	defer collector.Close()
+
+	var traceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer backend.Close()
+
+	tcfg := DefaultTracingConfig()
+	tcfg.Endpoint, _ = url.Parse(collector.URL)
+	tp, err := NewTracerProvider(tcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.TracerProvider = tp
+	cfg.TracingInject = true
+
+	p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	s := httptest.NewServer(p.handler())
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	c := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	req, err := http.NewRequest(http.MethodGet, backend.URL, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, res.StatusCode)
+	}
+
+	if !strings.HasPrefix(traceparent, "00-"+traceID+"-") {
+		t.Fatalf("expected traceparent with trace ID %s, got %q", traceID, traceparent)
+	}
+	if strings.Contains(traceparent, parentSpanID) {
+		t.Fatalf("expected traceparent with proxy span ID, got %q", traceparent)
+	}
+
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+
+	byKind := make(map[tracepb.Span_SpanKind]*tracepb.Span)
+	for _, s := range spans {
+		if got := hex.EncodeToString(s.GetTraceId()); got != traceID {
+			t.Errorf("expected trace ID %s, got %s", traceID, got)
+		}
+		byKind[s.GetKind()] = s
+	}
+
+	server, client := byKind[tracepb.Span_SPAN_KIND_SERVER], byKind[tracepb.Span_SPAN_KIND_CLIENT]
+	if server == nil || client == nil {
+		t.Fatalf("expected server and client spans, got %v", spans)
+	}
+	if got := hex.EncodeToString(server.GetParentSpanId()); got != parentSpanID {
+		t.Errorf("expected server span parent %s, got %s", parentSpanID, got)
+	}
+	if got, want := hex.EncodeToString(client.GetParentSpanId()), hex.EncodeToString(server.GetSpanId()); got != want {
+		t.Errorf("expected client span parent %s, got %s", want, got)
+	}
+	if got, want := traceparent, "00-"+traceID+"-"+hex.EncodeToString(client.GetSpanId())+"-01"; got != want {
+		t.Errorf("expected traceparent %s, got %s", want, got)
+	}
+
+	for _, s := range []*tracepb.Span{server, client} {
+		attrs := make(map[string]string)
+		for _, kv := range s.GetAttributes() {
+			attrs[kv.GetKey()] = kv.GetValue().String()
+		}
+		if !strings.Contains(attrs["forwarder.upstream_proxy"], "direct") {
+			t.Errorf("%s span: expected upstream proxy direct, got %q", s.GetKind(), attrs["forwarder.upstream_proxy"])
+		}
+		if !strings.Contains(attrs["http.response.status_code"], "200") {
+			t.Errorf("%s span: expected status code 200, got %q", s.GetKind(), attrs["http.response.status_code"])
+		}
+	}
+
+	attrs := make(map[string]string)
+	for _, kv := range server.GetAttributes() {
+		attrs[kv.GetKey()] = kv.GetValue().String()
+	}
+	if got := attrs["client.address"]; !strings.Contains(got, `"127.0.0.1"`) {
+		t.Errorf("expected client address without port, got %q", got)
+	}
+	if got := attrs["client.port"]; !strings.Contains(got, "int_value") {
+		t.Errorf("expected client port, got %q", got)
+	}
+}
+
+func TestHTTPProxyTracingMITMWithoutHandshake(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Address = "localhost:0"
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.MITM = DefaultMITMConfig()
+	cfg.TracerProvider = tp
+
+	p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+	addrs, _ := p.Addr()
+
+	connectSpansEnded := func() int {
+		n := 0
+		for _, s := range sr.Ended() {
+			if s.SpanKind() == trace.SpanKindServer && s.Name() == http.MethodConnect {
+				n++
+			}
+		}
+		return n
+	}
+
+	tests := []struct {
+		name  string
+		after func(conn net.Conn)
+	}{
+		{
+			name:  "client closed",
+			after: func(conn net.Conn) { conn.Close() },
+		},
+		{
+			name: "plain HTTP",
+			after: func(conn net.Conn) {
+				io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			},
+		},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addrs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+			br := bufio.NewReader(conn)
+			res, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected %d, got %d", http.StatusOK, res.StatusCode)
+			}
+			tc.after(conn)
+
+			deadline := time.Now().Add(5 * time.Second)
+			for connectSpansEnded() != i+1 {
+				if time.Now().After(deadline) {
+					t.Fatal("CONNECT server span not ended")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"sync"
 	"time"
@@ -82,6 +83,10 @@ type HTTPServerConfig struct {
 	shutdownConfig
 	LogHTTPMode httplog.Mode
 	BasicAuth   *url.Userinfo
+	// DigestAuth enables Digest authentication with the BasicAuth credentials instead of basic authentication.
+	DigestAuth bool
+	// TrustedClients are client address ranges that are not required to authenticate.
+	TrustedClients []IPRange
 	PromConfig
 }
 
@@ -95,10 +100,25 @@ func DefaultHTTPServerConfig() *HTTPServerConfig {
 	}
 }
 
+// trustedClient returns true if the request remote address is in TrustedClients.
+func (c *HTTPServerConfig) trustedClient(req *http.Request) bool {
+	if len(c.TrustedClients) == 0 {
+		return false
+	}
+	ap, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	return ipRangesContain(c.TrustedClients, ap.Addr())
+}
+
 func (c *HTTPServerConfig) Validate() error {
 	if err := validatedUserInfo(c.BasicAuth); err != nil {
 		return fmt.Errorf("basic_auth: %w", err)
 	}
+	if c.DigestAuth && c.BasicAuth == nil {
+		return errors.New("digest_auth requires basic_auth credentials")
+	}
 	return nil
 }
 
@@ -156,7 +176,11 @@ func withMiddleware(cfg *HTTPServerConfig, log log.Logger, h http.Handler) http.
 	// Note that the order of execution is reversed.
 	if cfg.BasicAuth != nil {
 		p, _ := cfg.BasicAuth.Password()
-		h = middleware.NewBasicAuth().Wrap(h, cfg.BasicAuth.Username(), p)
+		if cfg.DigestAuth {
+			h = skipTrustedClients(cfg, h, middleware.NewDigestAuth("Sauce Labs Forwarder").Wrap(h, cfg.BasicAuth.Username(), p))
+		} else {
+			h = skipTrustedClients(cfg, h, middleware.NewBasicAuth().Wrap(h, cfg.BasicAuth.Username(), p))
+		}
 	}
 
 	// Logger middleware must immediately follow the Prometheus middleware because it uses the Prometheus delegator.
@@ -170,6 +194,20 @@ func withMiddleware(cfg *HTTPServerConfig, log log.Logger, h http.Handler) http.
 	return h
 }
 
+// skipTrustedClients returns a handler that calls h for trusted clients and auth for others.
+func skipTrustedClients(cfg *HTTPServerConfig, h, auth http.Handler) http.Handler {
+	if len(cfg.TrustedClients) == 0 {
+		return auth
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.trustedClient(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		auth.ServeHTTP(w, r)
+	})
+}
+
 func (hs *HTTPServer) configureHTTPS() error {
 	if hs.config.CertFile == "" && hs.config.KeyFile == "" {
 		hs.log.Infof("no TLS certificate provided, using self-signed certificate")
@@ -141,12 +141,13 @@ func (w *logWriter) String() string {
 
 func (w *logWriter) URLLine(e middleware.LogEntry) {
 	w.trace(e)
-	fmt.Fprintf(&w.b, "%s %s status=%v duration=%s\n",
+	fmt.Fprintf(&w.b, "%s %s status=%v duration=%s",
 		e.Request.Method,
 		e.Request.URL.Redacted(),
 		e.Status,
 		e.Duration,
 	)
+	w.phases(e)
 }
 
 func (w *logWriter) ShortURLLine(e middleware.LogEntry) {
@@ -161,12 +162,21 @@ func (w *logWriter) ShortURLLine(e middleware.LogEntry) {
 		path = "/" + path
 	}
 
-	fmt.Fprintf(&w.b, "%s %s status=%v duration=%s\n",
+	fmt.Fprintf(&w.b, "%s %s status=%v duration=%s",
 		e.Request.Method,
 		scheme+host+path,
 		e.Status,
 		e.Duration,
 	)
+	w.phases(e)
+}
+
+// phases writes the request phase timings recorded by the proxy, and terminates the line.
+func (w *logWriter) phases(e middleware.LogEntry) {
+	for _, pt := range martian.ContextPhaseTimings(e.Request.Context()) {
+		fmt.Fprintf(&w.b, " %s=%s", pt.Phase, pt.Duration)
+	}
+	w.b.WriteByte('\n')
 }
 
 func (w *logWriter) trace(e middleware.LogEntry) {
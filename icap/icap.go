@@ -0,0 +1,407 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package icap implements an ICAP (RFC 3507) client for REQMOD and RESPMOD requests.
+// It supports message previews and 204 No Content responses for unmodified messages.
+// A new connection is opened for each request.
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ICAP methods.
+const (
+	MethodReqMod  = "REQMOD"
+	MethodRespMod = "RESPMOD"
+)
+
+// DefaultPort is the ICAP port used if the service URL has none.
+const DefaultPort = "1344"
+
+// Request is an ICAP request encapsulating an HTTP request, and for RESPMOD an HTTP response.
+type Request struct {
+	Method string
+	URL    *url.URL
+	Header http.Header
+
+	// HTTPRequest is the encapsulated HTTP request, its body is ignored, see Body.
+	HTTPRequest *http.Request
+	// HTTPResponse is the encapsulated HTTP response for RESPMOD, its body is ignored, see Body.
+	HTTPResponse *http.Response
+	// Body is the body of the encapsulated HTTP request for REQMOD, or HTTP response for RESPMOD.
+	// Nil means the message has no body.
+	Body []byte
+
+	// Preview is the number of body bytes sent before the server decides if it needs the rest of the body.
+	// Negative value disables preview.
+	Preview int
+}
+
+// Response is an ICAP response.
+// For status 204 No Content the encapsulated message is not modified and all the fields but StatusCode, Status and Header are nil.
+type Response struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+
+	// HTTPRequest is the modified HTTP request returned for REQMOD, its body is Body.
+	HTTPRequest *http.Request
+	// HTTPResponse is the modified HTTP response returned for RESPMOD,
+	// or for REQMOD the response that should be sent to the client instead of forwarding the request.
+	// Its body is Body.
+	HTTPResponse *http.Response
+	// Body is the body of the encapsulated message, nil if the message has no body.
+	Body []byte
+}
+
+// Error is returned for ICAP responses with status other than 200 OK and 204 No Content.
+type Error struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *Error) Error() string {
+	return "icap: unexpected status " + e.Status
+}
+
+// Client sends ICAP requests.
+type Client struct {
+	// Timeout limits the time of a single request including connecting to the server.
+	// Zero means no timeout.
+	Timeout time.Duration
+
+	// DialContext is used to connect to the server, if nil net.Dialer is used.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Do sends the request and returns the response.
+func (c *Client) Do(ctx context.Context, req *Request) (*Response, error) {
+	if req.URL == nil {
+		return nil, errors.New("icap: missing URL")
+	}
+	if req.HTTPRequest == nil {
+		return nil, errors.New("icap: missing HTTP request")
+	}
+	if req.Method == MethodRespMod && req.HTTPResponse == nil {
+		return nil, errors.New("icap: missing HTTP response")
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), DefaultPort)
+	}
+	dial := c.DialContext
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	res, err := roundTrip(conn, req)
+	if err != nil {
+		// The connection deadline may fire before the context is done.
+		if cerr := ctx.Err(); cerr != nil {
+			err = cerr
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = context.DeadlineExceeded
+		}
+	}
+	return res, err
+}
+
+func roundTrip(conn net.Conn, req *Request) (*Response, error) {
+	bw := bufio.NewWriter(conn)
+	br := bufio.NewReader(conn)
+
+	if err := writeHead(bw, req); err != nil {
+		return nil, err
+	}
+
+	body := req.Body
+	if body == nil {
+		if err := bw.Flush(); err != nil {
+			return nil, err
+		}
+		return readResponse(br)
+	}
+
+	if req.Preview >= 0 {
+		n := min(req.Preview, len(body))
+		if err := writeChunk(bw, body[:n]); err != nil {
+			return nil, err
+		}
+		if n == len(body) {
+			if _, err := bw.WriteString("0; ieof\r\n\r\n"); err != nil {
+				return nil, err
+			}
+			if err := bw.Flush(); err != nil {
+				return nil, err
+			}
+			return readResponse(br)
+		}
+
+		if _, err := bw.WriteString("0\r\n\r\n"); err != nil {
+			return nil, err
+		}
+		if err := bw.Flush(); err != nil {
+			return nil, err
+		}
+		res, err := readResponse(br)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusContinue {
+			return res, nil
+		}
+		body = body[n:]
+	}
+
+	if err := writeChunk(bw, body); err != nil {
+		return nil, err
+	}
+	if _, err := bw.WriteString("0\r\n\r\n"); err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	res, err := readResponse(br)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusContinue {
+		return nil, errors.New("icap: unexpected 100 Continue")
+	}
+	return res, nil
+}
+
+func writeHead(w *bufio.Writer, req *Request) error {
+	var hdr bytes.Buffer
+	var enc []string
+
+	enc = append(enc, "req-hdr=0")
+	writeHTTPRequestHeader(&hdr, req.HTTPRequest)
+	if req.Method == MethodRespMod {
+		enc = append(enc, "res-hdr="+strconv.Itoa(hdr.Len()))
+		writeHTTPResponseHeader(&hdr, req.HTTPResponse)
+	}
+	switch {
+	case req.Body == nil:
+		enc = append(enc, "null-body="+strconv.Itoa(hdr.Len()))
+	case req.Method == MethodRespMod:
+		enc = append(enc, "res-body="+strconv.Itoa(hdr.Len()))
+	default:
+		enc = append(enc, "req-body="+strconv.Itoa(hdr.Len()))
+	}
+
+	h := req.Header.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	h.Set("Host", req.URL.Host)
+	h.Set("Allow", "204")
+	h.Set("Connection", "close")
+	h.Set("Encapsulated", strings.Join(enc, ", "))
+	if req.Preview >= 0 && req.Body != nil {
+		h.Set("Preview", strconv.Itoa(min(req.Preview, len(req.Body))))
+	}
+
+	fmt.Fprintf(w, "%s %s ICAP/1.0\r\n", req.Method, req.URL)
+	if err := h.Write(w); err != nil {
+		return err
+	}
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	_, err := hdr.WriteTo(w)
+	return err
+}
+
+func writeHTTPRequestHeader(w *bytes.Buffer, req *http.Request) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	u := *req.URL
+	u.User = nil
+	if u.Host == "" {
+		u.Host = host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if req.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", req.Method, u.String())
+	fmt.Fprintf(w, "Host: %s\r\n", host)
+	req.Header.Write(w)
+	w.WriteString("\r\n")
+}
+
+func writeHTTPResponseHeader(w *bytes.Buffer, res *http.Response) {
+	status := res.Status
+	if status == "" {
+		status = strconv.Itoa(res.StatusCode) + " " + http.StatusText(res.StatusCode)
+	}
+
+	fmt.Fprintf(w, "HTTP/1.1 %s\r\n", status)
+	res.Header.Write(w)
+	w.WriteString("\r\n")
+}
+
+func writeChunk(w *bufio.Writer, b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "%x\r\n", len(b))
+	w.Write(b)
+	_, err := w.WriteString("\r\n")
+	return err
+}
+
+func readResponse(br *bufio.Reader) (*Response, error) {
+	tp := textproto.NewReader(br)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("icap: read status line: %w", err)
+	}
+	proto, status, ok := strings.Cut(line, " ")
+	if !ok || !strings.HasPrefix(proto, "ICAP/") {
+		return nil, fmt.Errorf("icap: malformed status line %q", line)
+	}
+	code, _, _ := strings.Cut(status, " ")
+	statusCode, err := strconv.Atoi(code)
+	if err != nil || len(code) != 3 {
+		return nil, fmt.Errorf("icap: malformed status code %q", code)
+	}
+
+	mh, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("icap: read header: %w", err)
+	}
+	res := &Response{
+		StatusCode: statusCode,
+		Status:     status,
+		Header:     http.Header(mh),
+	}
+
+	switch res.StatusCode {
+	case http.StatusContinue, http.StatusNoContent:
+		return res, nil
+	case http.StatusOK:
+	default:
+		return nil, &Error{StatusCode: res.StatusCode, Status: res.Status}
+	}
+
+	if err := readEncapsulated(br, res); err != nil {
+		return nil, fmt.Errorf("icap: %w", err)
+	}
+
+	return res, nil
+}
+
+type section struct {
+	name   string
+	offset int
+}
+
+// parseEncapsulated parses the Encapsulated header value i.e. "req-hdr=0, res-hdr=45, res-body=120".
+func parseEncapsulated(v string) ([]section, error) {
+	var ss []section
+	for _, f := range strings.Split(v, ",") {
+		name, off, ok := strings.Cut(strings.TrimSpace(f), "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed Encapsulated header %q", v)
+		}
+		n, err := strconv.Atoi(off)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("malformed Encapsulated header %q", v)
+		}
+		ss = append(ss, section{name: name, offset: n})
+	}
+	sort.SliceStable(ss, func(i, j int) bool { return ss[i].offset < ss[j].offset })
+	return ss, nil
+}
+
+func readEncapsulated(br *bufio.Reader, res *Response) error {
+	ss, err := parseEncapsulated(res.Header.Get("Encapsulated"))
+	if err != nil {
+		return err
+	}
+
+	for i, s := range ss {
+		switch s.name {
+		case "req-hdr", "res-hdr":
+			if i+1 == len(ss) {
+				return fmt.Errorf("%s is not followed by a body section", s.name)
+			}
+			b := make([]byte, ss[i+1].offset-s.offset)
+			if _, err := io.ReadFull(br, b); err != nil {
+				return fmt.Errorf("read %s: %w", s.name, err)
+			}
+			hr := bufio.NewReader(bytes.NewReader(b))
+			if s.name == "req-hdr" {
+				res.HTTPRequest, err = http.ReadRequest(hr)
+			} else {
+				res.HTTPResponse, err = http.ReadResponse(hr, nil)
+			}
+			if err != nil {
+				return fmt.Errorf("parse %s: %w", s.name, err)
+			}
+		case "req-body", "res-body":
+			b, err := io.ReadAll(httputil.NewChunkedReader(br))
+			if err != nil {
+				return fmt.Errorf("read %s: %w", s.name, err)
+			}
+			if b == nil {
+				b = []byte{}
+			}
+			res.Body = b
+		case "null-body", "opt-body":
+		default:
+			return fmt.Errorf("unsupported Encapsulated section %q", s.name)
+		}
+	}
+
+	return nil
+}
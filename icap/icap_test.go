@@ -0,0 +1,197 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package icap_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/icap"
+	"github.com/saucelabs/forwarder/icap/icaptest"
+)
+
+func TestClientReqMod(t *testing.T) {
+	var got atomic.Pointer[icap.Request]
+	s := icaptest.NewServer(func(req *icap.Request) *icap.Response {
+		got.Store(req)
+		if !bytes.Contains(req.Body, []byte("secret")) {
+			return &icap.Response{StatusCode: http.StatusNoContent}
+		}
+		r := req.HTTPRequest.Clone(context.Background())
+		r.Header.Set("X-Redacted", "1")
+		return &icap.Response{
+			StatusCode:  http.StatusOK,
+			HTTPRequest: r,
+			Body:        bytes.ReplaceAll(req.Body, []byte("secret"), []byte("******")),
+		}
+	})
+	defer s.Close()
+
+	c := icap.Client{Timeout: 5 * time.Second}
+	do := func(t *testing.T, body string) *icap.Response {
+		t.Helper()
+		hr := httptest.NewRequest(http.MethodPost, "http://example.com/upload?x=1", http.NoBody)
+		hr.Header.Set("Content-Type", "text/plain")
+		res, err := c.Do(context.Background(), &icap.Request{
+			Method:      icap.MethodReqMod,
+			URL:         s.URL("/reqmod"),
+			HTTPRequest: hr,
+			Body:        []byte(body),
+			Preview:     -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	t.Run("unmodified", func(t *testing.T) {
+		res := do(t, "hello")
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected %d, got %d", http.StatusNoContent, res.StatusCode)
+		}
+		got := got.Load()
+		if got.HTTPRequest.URL.String() != "http://example.com/upload?x=1" {
+			t.Fatalf("unexpected encapsulated request URL %s", got.HTTPRequest.URL)
+		}
+		if got.HTTPRequest.Header.Get("Content-Type") != "text/plain" {
+			t.Fatalf("unexpected encapsulated request header %v", got.HTTPRequest.Header)
+		}
+		if got.Header.Get("Allow") != "204" {
+			t.Fatalf("expected Allow: 204, got %v", got.Header)
+		}
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		res := do(t, "my secret")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, res.StatusCode)
+		}
+		if res.HTTPRequest == nil || res.HTTPRequest.Header.Get("X-Redacted") != "1" {
+			t.Fatalf("expected modified request, got %+v", res.HTTPRequest)
+		}
+		if string(res.Body) != "my ******" {
+			t.Fatalf("unexpected body %q", res.Body)
+		}
+	})
+}
+
+func TestClientRespModPreview(t *testing.T) {
+	var calls atomic.Int32
+	s := icaptest.NewServer(func(req *icap.Request) *icap.Response {
+		calls.Add(1)
+		return &icap.Response{
+			StatusCode:   http.StatusOK,
+			HTTPResponse: &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{"Content-Type": {"text/plain"}}},
+			Body:         []byte("blocked " + strings.ToUpper(string(req.Body[:4]))),
+		}
+	})
+	defer s.Close()
+	s.PreviewHandler = func(req *icap.Request) *icap.Response {
+		if bytes.HasPrefix(req.Body, []byte("GIF8")) {
+			return &icap.Response{StatusCode: http.StatusNoContent}
+		}
+		return nil
+	}
+
+	c := icap.Client{Timeout: 5 * time.Second}
+	do := func(t *testing.T, body string) *icap.Response {
+		t.Helper()
+		calls.Store(0)
+		res, err := c.Do(context.Background(), &icap.Request{
+			Method:       icap.MethodRespMod,
+			URL:          s.URL("/respmod"),
+			HTTPRequest:  httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody),
+			HTTPResponse: &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"image/gif"}}},
+			Body:         []byte(body),
+			Preview:      4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	t.Run("204 after preview", func(t *testing.T) {
+		res := do(t, "GIF89a....")
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected %d, got %d", http.StatusNoContent, res.StatusCode)
+		}
+		if n := calls.Load(); n != 0 {
+			t.Fatalf("expected handler not to be called, got %d calls", n)
+		}
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		res := do(t, "evil payload")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, res.StatusCode)
+		}
+		if res.HTTPResponse == nil || res.HTTPResponse.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected modified response, got %+v", res.HTTPResponse)
+		}
+		if string(res.Body) != "blocked EVIL" {
+			t.Fatalf("unexpected body %q", res.Body)
+		}
+	})
+
+	t.Run("ieof", func(t *testing.T) {
+		res := do(t, "tiny")
+		if n := calls.Load(); res.StatusCode != http.StatusOK || n != 1 {
+			t.Fatalf("expected complete body in preview to be handled, got status %d, %d calls", res.StatusCode, n)
+		}
+	})
+
+	t.Run("short body", func(t *testing.T) {
+		var preview atomic.Value
+		s.PreviewHandler = nil
+		s.Handler = func(req *icap.Request) *icap.Response {
+			preview.Store(req.Header.Get("Preview"))
+			return &icap.Response{StatusCode: http.StatusNoContent}
+		}
+		do(t, "ab")
+		if got := preview.Load(); got != "2" {
+			t.Fatalf("expected Preview: 2, got %v", got)
+		}
+	})
+}
+
+func TestClientErrors(t *testing.T) {
+	s := icaptest.NewServer(func(req *icap.Request) *icap.Response {
+		if req.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return &icap.Response{StatusCode: http.StatusNotFound}
+	})
+	defer s.Close()
+
+	c := icap.Client{Timeout: 100 * time.Millisecond}
+	do := func(path string) error {
+		_, err := c.Do(context.Background(), &icap.Request{
+			Method:      icap.MethodReqMod,
+			URL:         s.URL(path),
+			HTTPRequest: httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody),
+			Preview:     -1,
+		})
+		return err
+	}
+
+	var icapErr *icap.Error
+	if err := do("/unknown"); !errors.As(err, &icapErr) || icapErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 error, got %v", err)
+	}
+	if err := do("/slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
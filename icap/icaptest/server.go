@@ -0,0 +1,266 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package icaptest provides an in-process ICAP server for testing.
+package icaptest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/saucelabs/forwarder/icap"
+)
+
+// Handler returns the response to the ICAP request.
+// The request Preview is the number of body bytes received in the preview, or -1 if there was no preview.
+type Handler func(req *icap.Request) *icap.Response
+
+// Server is an ICAP server listening on a loopback address.
+// It handles one request per connection.
+type Server struct {
+	// PreviewHandler is called after the preview is received if the body was not complete in the preview.
+	// If it returns a response, the response is sent without reading the rest of the body.
+	PreviewHandler Handler
+	// Handler is called with the complete request.
+	Handler Handler
+
+	l  net.Listener
+	wg sync.WaitGroup
+}
+
+// NewServer starts a server, the caller must call Close.
+func NewServer(h Handler) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("icaptest: failed to listen: %v", err))
+	}
+	s := &Server{
+		Handler: h,
+		l:       l,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// URL returns the service URL with the path.
+func (s *Server) URL(path string) *url.URL {
+	return &url.URL{Scheme: "icap", Host: s.l.Addr().String(), Path: path}
+}
+
+// Close stops the server and waits for the connections to be handled.
+func (s *Server) Close() {
+	s.l.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	tp := textproto.NewReader(br)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return
+	}
+	f := strings.Fields(line)
+	if len(f) != 3 {
+		return
+	}
+	u, err := url.Parse(f[1])
+	if err != nil {
+		return
+	}
+	mh, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+
+	req := &icap.Request{
+		Method:  f[0],
+		URL:     u,
+		Header:  http.Header(mh),
+		Preview: -1,
+	}
+	hasBody, err := readEncapsulated(br, req)
+	if err != nil {
+		return
+	}
+
+	if hasBody {
+		body, ieof, err := readChunked(tp)
+		if err != nil {
+			return
+		}
+		req.Body = body
+
+		if req.Header.Get("Preview") != "" {
+			req.Preview = len(body)
+			if !ieof {
+				if s.PreviewHandler != nil {
+					if res := s.PreviewHandler(req); res != nil {
+						writeResponse(conn, res)
+						return
+					}
+				}
+				if _, err := io.WriteString(conn, "ICAP/1.0 100 Continue\r\n\r\n"); err != nil {
+					return
+				}
+				rest, _, err := readChunked(tp)
+				if err != nil {
+					return
+				}
+				req.Body = append(req.Body, rest...)
+			}
+		}
+	}
+
+	writeResponse(conn, s.Handler(req))
+}
+
+func readEncapsulated(br *bufio.Reader, req *icap.Request) (hasBody bool, err error) {
+	var (
+		names   []string
+		offsets []int
+	)
+	for _, f := range strings.Split(req.Header.Get("Encapsulated"), ",") {
+		name, off, _ := strings.Cut(strings.TrimSpace(f), "=")
+		n, err := strconv.Atoi(off)
+		if err != nil {
+			return false, err
+		}
+		names = append(names, name)
+		offsets = append(offsets, n)
+	}
+
+	for i, name := range names {
+		switch name {
+		case "req-hdr", "res-hdr":
+			b := make([]byte, offsets[i+1]-offsets[i])
+			if _, err := io.ReadFull(br, b); err != nil {
+				return false, err
+			}
+			hr := bufio.NewReader(bytes.NewReader(b))
+			if name == "req-hdr" {
+				req.HTTPRequest, err = http.ReadRequest(hr)
+			} else {
+				req.HTTPResponse, err = http.ReadResponse(hr, nil)
+			}
+			if err != nil {
+				return false, err
+			}
+		case "req-body", "res-body":
+			hasBody = true
+		}
+	}
+
+	return hasBody, nil
+}
+
+// readChunked reads chunks until the last chunk, and reports if it had the ieof extension.
+func readChunked(tp *textproto.Reader) (body []byte, ieof bool, err error) {
+	body = []byte{}
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return nil, false, err
+		}
+		size, ext, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		if n == 0 {
+			// Skip the empty line after the last chunk.
+			if _, err := tp.ReadLine(); err != nil {
+				return nil, false, err
+			}
+			return body, strings.TrimSpace(ext) == "ieof", nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(tp.R, b); err != nil {
+			return nil, false, err
+		}
+		body = append(body, b[:n]...)
+	}
+}
+
+func writeResponse(w io.Writer, res *icap.Response) {
+	var (
+		hdr bytes.Buffer
+		enc []string
+	)
+	if res.HTTPRequest != nil {
+		enc = append(enc, "req-hdr=0")
+		fmt.Fprintf(&hdr, "%s %s HTTP/1.1\r\n", res.HTTPRequest.Method, res.HTTPRequest.URL)
+		fmt.Fprintf(&hdr, "Host: %s\r\n", res.HTTPRequest.Host)
+		res.HTTPRequest.Header.Write(&hdr)
+		hdr.WriteString("\r\n")
+	}
+	if res.HTTPResponse != nil {
+		enc = append(enc, "res-hdr="+strconv.Itoa(hdr.Len()))
+		fmt.Fprintf(&hdr, "HTTP/1.1 %d %s\r\n", res.HTTPResponse.StatusCode, http.StatusText(res.HTTPResponse.StatusCode))
+		res.HTTPResponse.Header.Write(&hdr)
+		hdr.WriteString("\r\n")
+	}
+	switch {
+	case res.StatusCode != http.StatusOK:
+	case res.Body == nil:
+		enc = append(enc, "null-body="+strconv.Itoa(hdr.Len()))
+	case res.HTTPResponse != nil:
+		enc = append(enc, "res-body="+strconv.Itoa(hdr.Len()))
+	default:
+		enc = append(enc, "req-body="+strconv.Itoa(hdr.Len()))
+	}
+
+	h := res.Header.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	h.Set("ISTag", `"icaptest"`)
+	if len(enc) > 0 {
+		h.Set("Encapsulated", strings.Join(enc, ", "))
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "ICAP/1.0 %d %s\r\n", res.StatusCode, http.StatusText(res.StatusCode))
+	h.Write(bw)
+	bw.WriteString("\r\n")
+	hdr.WriteTo(bw)
+	if res.StatusCode == http.StatusOK && res.Body != nil {
+		if len(res.Body) > 0 {
+			fmt.Fprintf(bw, "%x\r\n", len(res.Body))
+			bw.Write(res.Body)
+			bw.WriteString("\r\n")
+		}
+		bw.WriteString("0\r\n\r\n")
+	}
+	bw.Flush()
+}
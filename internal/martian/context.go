@@ -16,6 +16,7 @@ package martian
 
 import (
 	"context"
+	"net/url"
 	"time"
 )
 
@@ -23,6 +24,7 @@ type contextKey int
 
 const (
 	traceIDContextKey contextKey = iota
+	proxyChainContextKey
 )
 
 func withTraceID(ctx context.Context, id traceID) context.Context {
@@ -36,9 +38,28 @@ func ContextTraceID(ctx context.Context) string {
 	return ""
 }
 
+// WithTraceIDPrefix returns a copy of ctx with the trace ID prefixed with prefix and a slash.
+func WithTraceIDPrefix(ctx context.Context, prefix string) context.Context {
+	if v, ok := ctx.Value(traceIDContextKey).(traceID); ok {
+		v.id = prefix + "/" + v.id
+		return withTraceID(ctx, v)
+	}
+	return ctx
+}
+
 func ContextDuration(ctx context.Context) time.Duration {
 	if v := ctx.Value(traceIDContextKey); v != nil {
 		return v.(traceID).Duration()
 	}
 	return 0
 }
+
+// withProxyChain stores the upstream proxy chain selected for the request, the chain is empty for direct connections.
+func withProxyChain(ctx context.Context, chain []*url.URL) context.Context {
+	return context.WithValue(ctx, proxyChainContextKey, chain)
+}
+
+func contextProxyChain(ctx context.Context) ([]*url.URL, bool) {
+	chain, ok := ctx.Value(proxyChainContextKey).([]*url.URL)
+	return chain, ok
+}
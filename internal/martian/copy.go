@@ -19,9 +19,15 @@ package martian
 import (
 	"bufio"
 	"context"
+	"errors"
 	"io"
+	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/saucelabs/forwarder/conntrack"
 	"github.com/saucelabs/forwarder/internal/martian/log"
 )
 
@@ -43,14 +49,203 @@ var copyBufPool = sync.Pool{
 	},
 }
 
-func bicopy(ctx context.Context, cc ...copier) {
-	donec := make(chan struct{}, len(cc))
+// TunnelCloseReason describes why a CONNECT or upgrade tunnel was closed.
+type TunnelCloseReason string
+
+const (
+	// TunnelClosed indicates that either side closed the connection.
+	TunnelClosed TunnelCloseReason = "closed"
+	// TunnelError indicates that copying data failed with an unexpected error.
+	TunnelError TunnelCloseReason = "error"
+	// TunnelIdleTimeout indicates that no data was read in either direction for TunnelIdleTimeout.
+	TunnelIdleTimeout TunnelCloseReason = "idle_timeout"
+	// TunnelWriteTimeout indicates that a write to either side blocked for longer than TunnelWriteTimeout.
+	TunnelWriteTimeout TunnelCloseReason = "write_timeout"
+	// TunnelMaxLifetime indicates that the tunnel was open for longer than TunnelMaxLifetime.
+	TunnelMaxLifetime TunnelCloseReason = "max_lifetime"
+)
+
+func (r TunnelCloseReason) String() string {
+	return string(r)
+}
+
+// tunnel copies data between the copiers and enforces the tunnel timeouts.
+type tunnel struct {
+	name         string
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+	maxLifetime  time.Duration
+
+	start    time.Time
+	lastRead atomic.Int64
+	aborted  atomic.Pointer[TunnelCloseReason]
+}
+
+func (p *Proxy) newTunnel(name string) *tunnel {
+	return &tunnel{
+		name:         name,
+		idleTimeout:  p.TunnelIdleTimeout,
+		writeTimeout: p.TunnelWriteTimeout,
+		maxLifetime:  p.TunnelMaxLifetime,
+	}
+}
+
+// trackTraffic wraps crw to count bytes sent and received if it is a net.Conn.
+// Otherwise, it returns crw unchanged and a nil observer.
+func trackTraffic(crw io.ReadWriteCloser) (io.ReadWriteCloser, *conntrack.Observer) {
+	conn, ok := crw.(net.Conn)
+	if !ok {
+		return crw, nil
+	}
+	return conntrack.Builder{TrackTraffic: true}.BuildWithObserver(conn)
+}
+
+// bicopy copies data in both directions until both copiers are done,
+// and returns the reason the tunnel was closed.
+// If any of the timeouts is exceeded, the sources that implement io.Closer are closed to stop copying.
+func (t *tunnel) bicopy(ctx context.Context, cc ...copier) TunnelCloseReason {
+	t.start = time.Now()
+	t.touch()
+
+	errc := make(chan error, len(cc))
 	for i := range cc {
-		go cc[i].copy(ctx, donec)
+		go cc[i].copy(ctx, t, errc)
+	}
+
+	stop := make(chan struct{})
+	if t.idleTimeout > 0 || t.maxLifetime > 0 {
+		go t.watch(ctx, stop, cc)
 	}
+
+	var errs []error
 	for range cc {
-		<-donec
+		if err := <-errc; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	close(stop)
+
+	if r := t.aborted.Load(); r != nil {
+		return *r
+	}
+	for _, err := range errs {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return TunnelWriteTimeout
+		}
+	}
+	if len(errs) > 0 {
+		return TunnelError
+	}
+	return TunnelClosed
+}
+
+func (t *tunnel) touch() {
+	t.lastRead.Store(time.Now().UnixNano())
+}
+
+func (t *tunnel) watch(ctx context.Context, stop <-chan struct{}, cc []copier) {
+	timer := time.NewTimer(t.next(time.Now()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-timer.C:
+			if r := t.check(now); r != "" {
+				t.abort(ctx, r, cc)
+				return
+			}
+			timer.Reset(t.next(now))
+		}
+	}
+}
+
+// check returns the reason to close the tunnel at the given time, or empty string.
+func (t *tunnel) check(now time.Time) TunnelCloseReason {
+	if t.maxLifetime > 0 && now.Sub(t.start) >= t.maxLifetime {
+		return TunnelMaxLifetime
+	}
+	if t.idleTimeout > 0 && now.Sub(time.Unix(0, t.lastRead.Load())) >= t.idleTimeout {
+		return TunnelIdleTimeout
+	}
+	return ""
+}
+
+// next returns the duration until the next timeout check.
+func (t *tunnel) next(now time.Time) time.Duration {
+	var d time.Duration
+	if t.maxLifetime > 0 {
+		d = t.maxLifetime - now.Sub(t.start)
+	}
+	if t.idleTimeout > 0 {
+		if v := t.idleTimeout - now.Sub(time.Unix(0, t.lastRead.Load())); d == 0 || v < d {
+			d = v
+		}
+	}
+	return max(d, time.Millisecond)
+}
+
+func (t *tunnel) abort(ctx context.Context, r TunnelCloseReason, cc []copier) {
+	t.aborted.Store(&r)
+
+	log.Infof(ctx, "closing %s tunnel reason=%s duration=%s", t.name, r, time.Since(t.start))
+	for _, c := range cc {
+		if cl, ok := c.src.(io.Closer); ok {
+			if err := cl.Close(); err != nil {
+				log.Debugf(ctx, "failed to close %s tunnel: %v", c.name, err)
+			}
+		}
+	}
+}
+
+// wrap returns the writer and reader to use for copying data.
+// The original values are returned if the tunnel has no timeouts configured
+// so that optimizations like io.ReaderFrom are preserved.
+func (t *tunnel) wrap(c copier) (io.Writer, io.Reader) {
+	dst, src := c.dst, c.src
+	if t == nil {
+		return dst, src
 	}
+	if t.idleTimeout > 0 {
+		src = &activityReader{Reader: src, t: t}
+	}
+	if t.writeTimeout > 0 {
+		if d, ok := dst.(writeDeadliner); ok {
+			dst = &deadlineWriter{Writer: dst, d: d, timeout: t.writeTimeout}
+		}
+	}
+	return dst, src
+}
+
+type activityReader struct {
+	io.Reader
+	t *tunnel
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.t.touch()
+	}
+	return n, err
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+type deadlineWriter struct {
+	io.Writer
+	d       writeDeadliner
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	if err := w.d.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil {
+		return 0, err
+	}
+	return w.Writer.Write(p)
 }
 
 type copier struct {
@@ -59,14 +254,22 @@ type copier struct {
 	src  io.Reader
 }
 
-func (c copier) copy(ctx context.Context, donec chan<- struct{}) {
+func (c copier) copy(ctx context.Context, t *tunnel, errc chan<- error) {
 	bufp := copyBufPool.Get().(*[]byte) //nolint:forcetypeassert // It's *[]byte.
 	buf := *bufp
 	defer copyBufPool.Put(bufp)
 
-	if _, err := io.CopyBuffer(c.dst, c.src, buf); err != nil && !isClosedConnError(err) {
+	dst, src := t.wrap(c)
+	_, err := io.CopyBuffer(dst, src, buf)
+	switch {
+	case err == nil || isClosedConnError(err):
+		err = nil
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		log.Debugf(ctx, "failed to copy %s tunnel: %v", c.name, err)
+	default:
 		log.Errorf(ctx, "failed to copy %s tunnel: %v", c.name, err)
 	}
+
 	var closeErr error
 	if cw, ok := asCloseWriter(c.dst); ok {
 		closeErr = cw.CloseWrite()
@@ -80,5 +283,5 @@ func (c copier) copy(ctx context.Context, donec chan<- struct{}) {
 	}
 
 	log.Debugf(ctx, "%s tunnel finished copying", c.name)
-	donec <- struct{}{}
+	errc <- err
 }
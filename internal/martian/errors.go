@@ -30,6 +30,10 @@ import (
 
 var errClose = errors.New("closing connection")
 
+// errMITMNotTLS is reported as the MITM handshake error if the client does not start TLS after CONNECT,
+// the connection is then handled as plain HTTP.
+var errMITMNotTLS = errors.New("mitm: client did not start TLS handshake")
+
 func errno(v error) uintptr {
 	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Uintptr {
 		return uintptr(rv.Uint())
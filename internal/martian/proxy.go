@@ -27,10 +27,13 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/saucelabs/forwarder/dialvia"
+	"github.com/saucelabs/forwarder/digest"
 	"github.com/saucelabs/forwarder/internal/martian/log"
 	"github.com/saucelabs/forwarder/internal/martian/mitm"
 	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
 	"go.uber.org/multierr"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/http/httpguts"
 )
 
@@ -51,6 +54,33 @@ type Proxy struct {
 	// If not set and the RoundTripper is an *http.Transport, the Transport's ProxyURL is used.
 	ProxyURL func(*http.Request) (*url.URL, error)
 
+	// ProxyChain optionally specifies the chain of upstream proxies to use for requests, it takes precedence over ProxyURL.
+	// Requests are sent to the last proxy of the chain, each proxy is reached through the previous one.
+	// An empty chain means the request is sent directly.
+	ProxyChain func(*http.Request) ([]*url.URL, error)
+
+	// ProxyAuthScheme optionally specifies the scheme used to authenticate with the upstream HTTP proxy.
+	// If not set, credentials are sent using basic authentication,
+	// and Digest authentication is used once the upstream proxy sends a Digest challenge.
+	// Connections authenticated with a connection oriented scheme are pooled per upstream proxy and credentials.
+	// The Digest challenge is cached per upstream proxy and credentials, and credentials are sent up front
+	// with an increasing nonce count until the proxy challenges again.
+	ProxyAuthScheme func(*url.URL) dialvia.AuthScheme
+
+	// SSHClientConfig returns the SSH client config for an ssh:// upstream proxy URL.
+	// It is required to use SSH upstream proxies.
+	// The SSH connection to each upstream proxy is shared by all requests and tunnels.
+	SSHClientConfig func(*url.URL) (*ssh.ClientConfig, error)
+
+	// SSHKeepAlive is the interval of keep-alive requests sent to upstream SSH proxies.
+	// Zero disables keep-alive.
+	SSHKeepAlive time.Duration
+
+	// UpstreamHTTP2 optionally enables HTTP/2 CONNECT to HTTPS upstream proxies.
+	// Tunnels to each upstream proxy are multiplexed as streams over a pool of shared connections,
+	// HTTP/1.1 CONNECT is used if the proxy does not negotiate h2.
+	UpstreamHTTP2 *dialvia.HTTP2Options
+
 	// AllowHTTP disables automatic HTTP to HTTPS upgrades when the listener is TLS.
 	AllowHTTP bool
 
@@ -64,6 +94,7 @@ type Proxy struct {
 	ConnectFunc ConnectFunc
 
 	// ConnectTimeout specifies the maximum amount of time to connect to upstream before cancelling request.
+	// The timeout query parameter of a proxy URL overrides it for that proxy.
 	ConnectTimeout time.Duration
 
 	// MITMConfig is config to use for MITMing of CONNECT requests.
@@ -117,20 +148,52 @@ type Proxy struct {
 	// A zero or negative value means there will be no timeout.
 	WriteTimeout time.Duration
 
+	// TunnelIdleTimeout is the maximum amount of time a CONNECT or upgrade tunnel
+	// is kept open when no data is read in either direction.
+	// Zero means no timeout.
+	TunnelIdleTimeout time.Duration
+
+	// TunnelWriteTimeout is the maximum amount of time a single write
+	// to either side of a CONNECT or upgrade tunnel may block.
+	// It is only enforced for connections that support write deadlines.
+	// Zero means no timeout.
+	TunnelWriteTimeout time.Duration
+
+	// TunnelMaxLifetime is the maximum amount of time a CONNECT or upgrade tunnel
+	// is kept open regardless of activity.
+	// Zero means no limit.
+	TunnelMaxLifetime time.Duration
+
 	// BaseContext is the base context for all requests.
 	BaseContext context.Context //nolint:containedctx // It's intended to be used as a base context.
 
+	// RequestContext optionally specifies a function that modifies the context used for a request.
+	// It is called after the request is read and before the request modifiers are applied.
+	// The provided ctx is derived from BaseContext and has the trace ID set.
+	RequestContext func(ctx context.Context, req *http.Request) context.Context
+
+	// ConnContext optionally specifies a function that modifies the context used for requests
+	// read from a connection accepted by Serve from listener l.
+	// The provided ctx is BaseContext.
+	ConnContext func(ctx context.Context, l net.Listener, conn net.Conn) context.Context
+
 	// TestingSkipRoundTrip skips the round trip for requests and returns a 200 OK response.
 	TestingSkipRoundTrip bool
 
 	initOnce sync.Once
 
-	rt        http.RoundTripper
-	conns     map[net.Conn]struct{}
-	connsWg   atomic.Int32
-	connsMu   sync.Mutex // protects connsWg.Add/Wait and conns from concurrent access
-	closeCh   chan bool
-	closeOnce sync.Once
+	rt             http.RoundTripper
+	digestProxies  sync.Map
+	digestSessions *upstreamPool[*dialvia.DigestSession]
+	sshUpstreams   *upstreamPool[*sshUpstream]
+	viaTransports  *upstreamPool[*http.Transport]
+	authDialers    *upstreamPool[*dialvia.HTTPProxyDialer]
+	http2Upstreams *upstreamPool[*http2Upstream]
+	conns          map[net.Conn]struct{}
+	connsWg        atomic.Int32
+	connsMu        sync.Mutex // protects connsWg.Add/Wait and conns from concurrent access
+	closeCh        chan bool
+	closeOnce      sync.Once
 }
 
 func (p *Proxy) init() {
@@ -157,9 +220,8 @@ func (p *Proxy) init() {
 			}
 			if p.ProxyURL == nil {
 				p.ProxyURL = t.Proxy
-			} else {
-				t.Proxy = p.ProxyURL
 			}
+			t.Proxy = p.proxyURL
 			t.OnProxyConnectResponse = OnProxyConnectResponse
 
 			p.rt = t
@@ -172,6 +234,25 @@ func (p *Proxy) init() {
 			}).DialContext
 		}
 
+		p.digestSessions = newUpstreamPool[*dialvia.DigestSession](nil)
+		p.sshUpstreams = newUpstreamPool(func(s *sshUpstream) error {
+			if s.t != nil {
+				s.t.CloseIdleConnections()
+			}
+			return s.d.Close()
+		})
+		p.viaTransports = newUpstreamPool(func(t *http.Transport) error {
+			t.CloseIdleConnections()
+			return nil
+		})
+		p.authDialers = newUpstreamPool(func(d *dialvia.HTTPProxyDialer) error {
+			d.CloseIdleConnections()
+			return nil
+		})
+		p.http2Upstreams = newUpstreamPool(func(u *http2Upstream) error {
+			return u.pool.Close()
+		})
+
 		if p.BaseContext == nil {
 			p.BaseContext = context.Background()
 		}
@@ -216,7 +297,8 @@ func (p *Proxy) Shutdown(ctx context.Context) error {
 	for {
 		if n := p.connsWg.Load(); n == 0 {
 			log.Infof(context.TODO(), "all connections closed")
-			return nil
+			p.closeViaTransports()
+			return multierr.Combine(p.closeHTTP2Pools(), p.closeSSHUpstreams())
 		}
 		select {
 		case <-ctx.Done():
@@ -244,6 +326,9 @@ func (p *Proxy) Close() error {
 			err = multierr.Append(err, e)
 		}
 	}
+	p.closeViaTransports()
+	err = multierr.Append(err, p.closeHTTP2Pools())
+	err = multierr.Append(err, p.closeSSHUpstreams())
 
 	return err
 }
@@ -299,11 +384,11 @@ func (p *Proxy) Serve(l net.Listener) error {
 		delay = 0
 		log.Debugf(context.TODO(), "accepted connection from %s", conn.RemoteAddr())
 
-		go p.handleLoop(conn)
+		go p.handleLoop(l, conn)
 	}
 }
 
-func (p *Proxy) handleLoop(conn net.Conn) {
+func (p *Proxy) handleLoop(l net.Listener, conn net.Conn) {
 	start := time.Now()
 
 	p.connsMu.Lock()
@@ -323,6 +408,9 @@ func (p *Proxy) handleLoop(conn net.Conn) {
 	}
 
 	pc := newProxyConn(p, conn)
+	if p.ConnContext != nil {
+		pc.ctx = p.ConnContext(pc.ctx, l, conn)
+	}
 
 	if err := pc.maybeHandshakeTLS(); err != nil {
 		log.Errorf(context.TODO(), "failed to do TLS handshake: %v", err)
@@ -415,10 +503,19 @@ func (p *Proxy) roundTrip(req *http.Request) (*http.Response, error) {
 		return proxyutil.NewResponse(200, http.NoBody, req), nil
 	}
 
-	res, err := p.rt.RoundTrip(req)
+	rtreq := req
+	if p.Trace != nil {
+		rtreq = req.WithContext(p.withClientTrace(req.Context(), req))
+	}
+
+	p.traceRoundTripStart(req)
+	res, err := p.upstreamRoundTrip(rtreq)
 	if err != nil {
+		p.traceRoundTripDone(req, nil, err)
 		return nil, err
 	}
+	res.Request = req
+	p.traceRoundTripDone(req, res, nil)
 
 	if isHeaderOnlySpec(res) && res.StatusCode != http.StatusSwitchingProtocols && res.Body != http.NoBody {
 		log.Infof(req.Context(), "unexpected body in header-only response: %d, closing body", res.StatusCode)
@@ -429,6 +526,169 @@ func (p *Proxy) roundTrip(req *http.Request) (*http.Response, error) {
 	return res, err
 }
 
+// upstreamRoundTrip sends the request with the round tripper,
+// or over pooled authenticated connections if the upstream proxy requires a connection oriented or Digest authentication scheme.
+// Requests to SSH upstream proxies are sent over the pooled SSH connection.
+// If the upstream proxy is reached through a chain of proxies, connections to it are dialed through the chain.
+func (p *Proxy) upstreamRoundTrip(req *http.Request) (*http.Response, error) {
+	t, ok := p.rt.(*http.Transport)
+	if !ok {
+		return p.rt.RoundTrip(req)
+	}
+
+	chain, err := p.proxyChain(req)
+	if err != nil {
+		return nil, err
+	}
+	u, via := lastProxy(chain), viaProxies(chain)
+	if u != nil {
+		switch u.Scheme {
+		case "ssh":
+			return p.sshRoundTrip(req, u, via)
+		case "socks4", "socks4a":
+			return p.tunnelTransport(chain).RoundTrip(req)
+		}
+	}
+	if len(via) > 0 {
+		t = p.viaTransport(via)
+	}
+	if u == nil || u.User == nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return t.RoundTrip(req.WithContext(withProxyChain(req.Context(), chain)))
+	}
+
+	scheme := p.proxyAuthScheme(u)
+	if scheme == dialvia.BasicAuth {
+		res, err := t.RoundTrip(req.WithContext(withProxyChain(req.Context(), chain)))
+		if !p.digestChallenged(u, res, err) {
+			return res, err
+		}
+		// The request body was sent to the proxy and cannot be sent again.
+		if res != nil {
+			if req.Body != nil && req.Body != http.NoBody {
+				return res, nil
+			}
+			res.Body.Close()
+		}
+		scheme = dialvia.DigestAuth
+	}
+
+	d := p.authDialer(u, via, scheme)
+	if req.URL.Scheme == "http" {
+		return d.RoundTrip(req)
+	}
+
+	// Tunnel the request through authenticated CONNECTs, TLS is handled by the transport.
+	// Tunnels are kept alive and reused for requests to the same destination.
+	t = p.pooledTransport(string(scheme)+" auth "+proxyChainKey(append(via[:len(via):len(via)], u)), func(t *http.Transport) {
+		t.Proxy = nil
+		t.OnProxyConnectResponse = nil
+		t.DialContext = d.DialContext
+	})
+	return t.RoundTrip(req)
+}
+
+// authDialer returns the pooled dialer for the upstream HTTP proxy with credentials reached through the via proxies,
+// it is created on first use. Dialers are keyed by the URLs including credentials and by the authentication scheme,
+// so that connections authenticated for one user are never used for another.
+func (p *Proxy) authDialer(u *url.URL, via []*url.URL, scheme dialvia.AuthScheme) *dialvia.HTTPProxyDialer {
+	key := string(scheme) + " " + proxyChainKey(append(via[:len(via):len(via)], u))
+
+	d, _ := p.authDialers.get(key, func() (*dialvia.HTTPProxyDialer, error) {
+		d := p.httpProxyDialer(u, via, p.viaDialer(via))
+		d.AuthScheme = scheme
+		if t, ok := p.rt.(*http.Transport); ok && !t.DisableKeepAlives {
+			d.MaxIdleConns = t.MaxIdleConnsPerHost
+			if d.MaxIdleConns <= 0 {
+				d.MaxIdleConns = http.DefaultMaxIdleConnsPerHost
+			}
+			d.IdleConnTimeout = t.IdleConnTimeout
+		}
+		return d, nil
+	})
+
+	return d
+}
+
+// proxyAuthScheme returns the scheme used to authenticate with the upstream proxy,
+// Digest is used instead of basic authentication if the proxy sent a Digest challenge before.
+func (p *Proxy) proxyAuthScheme(u *url.URL) dialvia.AuthScheme {
+	s := dialvia.BasicAuth
+	if p.ProxyAuthScheme != nil {
+		s = p.ProxyAuthScheme(u)
+	}
+	if s == dialvia.BasicAuth {
+		if _, ok := p.digestProxies.Load(u.Host); ok {
+			s = dialvia.DigestAuth
+		}
+	}
+	return s
+}
+
+// digestSession returns the Digest session shared by all connections to the upstream proxy with the URL credentials.
+func (p *Proxy) digestSession(u *url.URL) *dialvia.DigestSession {
+	s, _ := p.digestSessions.get(u.String(), func() (*dialvia.DigestSession, error) {
+		return new(dialvia.DigestSession), nil
+	})
+	return s
+}
+
+// digestChallenged returns true if the upstream proxy responded to the request or CONNECT with a Digest challenge,
+// and remembers that the proxy requires Digest authentication.
+func (p *Proxy) digestChallenged(u *url.URL, res *http.Response, err error) bool {
+	if err != nil {
+		var ce *connectError
+		if !errors.As(err, &ce) {
+			return false
+		}
+		res = ce.res
+	}
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		return false
+	}
+	if _, ok := digest.SelectChallenge(res.Header.Values("Proxy-Authenticate")); !ok {
+		return false
+	}
+	p.digestProxies.Store(u.Host, struct{}{})
+	return true
+}
+
+// requestContext returns the context for a request that was just read, ctx is the connection context.
+func (p *Proxy) requestContext(ctx context.Context, req *http.Request) context.Context {
+	ctx = withTraceID(ctx, newTraceID(req.Header.Get(p.RequestIDHeader)))
+	if p.RequestContext != nil {
+		ctx = p.RequestContext(ctx, req)
+	}
+	return ctx
+}
+
+// proxyChain returns the upstream proxy chain for the request using ProxyChain or ProxyURL,
+// and reports the selection to the trace.
+func (p *Proxy) proxyChain(req *http.Request) (chain []*url.URL, err error) {
+	if chain, ok := contextProxyChain(req.Context()); ok {
+		return chain, nil
+	}
+
+	start := time.Now()
+	switch {
+	case p.ProxyChain != nil:
+		chain, err = p.ProxyChain(req)
+	case p.ProxyURL != nil:
+		var u *url.URL
+		if u, err = p.ProxyURL(req); u != nil {
+			chain = []*url.URL{u}
+		}
+	}
+	p.traceProxySelected(req, lastProxy(chain), err, time.Since(start))
+
+	return chain, err
+}
+
+// proxyURL returns the upstream proxy URL for the request, it is the last proxy of the chain.
+func (p *Proxy) proxyURL(req *http.Request) (*url.URL, error) {
+	chain, err := p.proxyChain(req)
+	return lastProxy(chain), err
+}
+
 func (p *Proxy) errorResponse(req *http.Request, err error) *http.Response {
 	var res *http.Response
 	if p.ErrorResponse != nil {
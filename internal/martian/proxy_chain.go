@@ -0,0 +1,168 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+
+package martian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/saucelabs/forwarder/dialvia"
+)
+
+// ProxyChainError is returned when a connection cannot be established through a proxy of the upstream proxy chain.
+type ProxyChainError struct {
+	// Hop is the position of the proxy in the chain starting from 1.
+	Hop int
+	// URL is the proxy URL.
+	URL *url.URL
+	Err error
+}
+
+func (e *ProxyChainError) Error() string {
+	return fmt.Sprintf("upstream proxy chain hop %d %s: %v", e.Hop, e.URL.Redacted(), e.Err)
+}
+
+func (e *ProxyChainError) Unwrap() error {
+	return e.Err
+}
+
+// lastProxy returns the proxy requests are sent to, or nil if the chain is empty.
+func lastProxy(chain []*url.URL) *url.URL {
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain[len(chain)-1]
+}
+
+// viaProxies returns the proxies used to reach the last proxy of the chain.
+func viaProxies(chain []*url.URL) []*url.URL {
+	if len(chain) <= 1 {
+		return nil
+	}
+	return chain[:len(chain)-1]
+}
+
+func proxyChainKey(chain []*url.URL) string {
+	s := make([]string, len(chain))
+	for i, u := range chain {
+		s[i] = u.String()
+	}
+	return strings.Join(s, " -> ")
+}
+
+// redactProxyChain returns the proxy chain with passwords redacted.
+func redactProxyChain(chain []*url.URL) string {
+	s := make([]string, len(chain))
+	for i, u := range chain {
+		s[i] = u.Redacted()
+	}
+	return strings.Join(s, " -> ")
+}
+
+// viaDialer returns a dial function that dials connections through the via proxies,
+// each proxy is dialed through the previous one, and the first proxy is dialed with DialContext.
+// Errors identify the proxy that failed with ProxyChainError.
+func (p *Proxy) viaDialer(via []*url.URL) dialvia.ContextDialerFunc {
+	dial := dialvia.ContextDialerFunc(p.DialContext)
+	for i, u := range via {
+		dial = chainHop(i+1, u, p.hopDialer(u, via[:i], dial))
+	}
+	return dial
+}
+
+// hopDialer returns a dial function that dials connections through the proxy u, the proxy is dialed with dial.
+func (p *Proxy) hopDialer(u *url.URL, via []*url.URL, dial dialvia.ContextDialerFunc) dialvia.ContextDialerFunc {
+	switch u.Scheme {
+	case "http", "https":
+		d := p.httpProxyDialer(u, via, dial)
+		d.AuthScheme = p.proxyAuthScheme(u)
+		return d.DialContext
+	case "socks4", "socks4a":
+		d := dialvia.SOCKS4Proxy(dial, u)
+		d.Timeout = p.connectTimeout(u)
+		return d.DialContext
+	case "socks5":
+		d := dialvia.SOCKS5Proxy(dial, u)
+		d.Timeout = p.connectTimeout(u)
+		return d.DialContext
+	case "ssh":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			s, err := p.sshUpstream(u, via)
+			if err != nil {
+				return nil, err
+			}
+			return s.d.DialContext(ctx, network, addr)
+		}
+	default:
+		return func(context.Context, string, string) (net.Conn, error) {
+			return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+		}
+	}
+}
+
+// connectTimeout returns the timeout to connect through the proxy u,
+// it is the timeout query parameter of the proxy URL if set, or ConnectTimeout.
+func (p *Proxy) connectTimeout(u *url.URL) time.Duration {
+	if v := u.Query().Get("timeout"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return p.ConnectTimeout
+}
+
+// chainHop wraps errors of dial in ProxyChainError, unless the error comes from a previous hop.
+func chainHop(hop int, u *url.URL, dial dialvia.ContextDialerFunc) dialvia.ContextDialerFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			var ce *ProxyChainError
+			if !errors.As(err, &ce) {
+				err = &ProxyChainError{Hop: hop, URL: u, Err: err}
+			}
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// viaTransport returns a clone of the round tripper that dials upstream proxies through the via proxies.
+// Transports are pooled by the via proxies, so that connections to the upstream proxy are reused.
+func (p *Proxy) viaTransport(via []*url.URL) *http.Transport {
+	return p.pooledTransport(proxyChainKey(via), func(t *http.Transport) {
+		t.DialContext = p.viaDialer(via)
+	})
+}
+
+// tunnelTransport returns a clone of the round tripper that dials destinations through all proxies of the chain.
+// It is used for upstream proxies that are not supported by http.Transport i.e. SOCKS4.
+func (p *Proxy) tunnelTransport(chain []*url.URL) *http.Transport {
+	u, via := lastProxy(chain), viaProxies(chain)
+	return p.pooledTransport("tunnel "+proxyChainKey(chain), func(t *http.Transport) {
+		t.Proxy = nil
+		t.OnProxyConnectResponse = nil
+		t.DialContext = p.hopDialer(u, via, p.viaDialer(via))
+	})
+}
+
+func (p *Proxy) pooledTransport(key string, configure func(t *http.Transport)) *http.Transport {
+	t, _ := p.viaTransports.get(key, func() (*http.Transport, error) {
+		t := p.rt.(*http.Transport).Clone() //nolint:forcetypeassert // checked by the caller
+		configure(t)
+		return t, nil
+	})
+	return t
+}
+
+// closeViaTransports closes idle connections of the pooled transports and dialers, it is called when the proxy is closed.
+func (p *Proxy) closeViaTransports() {
+	p.viaTransports.purge()  //nolint:errcheck // closing transports does not fail
+	p.authDialers.purge()    //nolint:errcheck // closing dialers does not fail
+	p.digestSessions.purge() //nolint:errcheck // nothing to close
+}
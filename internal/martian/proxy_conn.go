@@ -37,6 +37,7 @@ import (
 
 type proxyConn struct {
 	*Proxy
+	ctx    context.Context //nolint:containedctx // It's the base context for requests read from the connection.
 	brw    *bufio.ReadWriter
 	conn   net.Conn
 	secure bool
@@ -46,6 +47,7 @@ type proxyConn struct {
 func newProxyConn(p *Proxy, conn net.Conn) *proxyConn {
 	return &proxyConn{
 		Proxy: p,
+		ctx:   p.BaseContext,
 		brw:   bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
 		conn:  conn,
 	}
@@ -63,7 +65,10 @@ func (p *proxyConn) maybeHandshakeTLS() error {
 		ctx, cancel = context.WithTimeout(context.Background(), p.TLSHandshakeTimeout)
 		defer cancel()
 	}
-	if err := tconn.HandshakeContext(ctx); err != nil {
+	start := time.Now()
+	err := tconn.HandshakeContext(ctx)
+	p.traceTLSHandshakeDone(nil, PhaseTLSClient, tconn.ConnectionState(), err, time.Since(start))
+	if err != nil {
 		return err
 	}
 
@@ -114,7 +119,7 @@ func (p *proxyConn) readRequest() (*http.Request, error) {
 	if p.secure {
 		req.TLS = &p.cs
 	}
-	req = req.WithContext(withTraceID(p.BaseContext, newTraceID(req.Header.Get(p.RequestIDHeader))))
+	req = req.WithContext(p.requestContext(p.ctx, req))
 
 	// Adjust the read deadline if necessary.
 	if !hdrDeadline.Equal(wholeReqDeadline) {
@@ -144,6 +149,7 @@ func (p *proxyConn) handleMITM(req *http.Request) error {
 
 	b, err := p.brw.Peek(1)
 	if err != nil {
+		p.traceTLSHandshakeDone(req, PhaseTLSMITM, tls.ConnectionState{}, err, 0)
 		if isClosedConnError(err) {
 			log.Debugf(ctx, "mitm: connection closed prematurely: %v", err)
 		} else {
@@ -155,6 +161,7 @@ func (p *proxyConn) handleMITM(req *http.Request) error {
 	// Drain the rest of the buffered data.
 	buf := make([]byte, p.brw.Reader.Buffered())
 	if _, err := p.brw.Read(buf); err != nil {
+		p.traceTLSHandshakeDone(req, PhaseTLSMITM, tls.ConnectionState{}, err, 0)
 		log.Errorf(ctx, "mitm: failed to drain buffer: %v", err)
 		return errClose
 	}
@@ -176,7 +183,10 @@ func (p *proxyConn) handleMITM(req *http.Request) error {
 		} else {
 			hctx = ctx
 		}
-		if err = tlsconn.HandshakeContext(hctx); err != nil {
+		start := time.Now()
+		err = tlsconn.HandshakeContext(hctx)
+		p.traceTLSHandshakeDone(req, PhaseTLSMITM, tlsconn.ConnectionState(), err, time.Since(start))
+		if err != nil {
 			p.MITMConfig.HandshakeErrorCallback(req, err)
 			if isClosedConnError(err) {
 				log.Debugf(ctx, "mitm: connection closed prematurely: %v", err)
@@ -203,6 +213,8 @@ func (p *proxyConn) handleMITM(req *http.Request) error {
 		return p.handle()
 	}
 
+	p.traceTLSHandshakeDone(req, PhaseTLSMITM, tls.ConnectionState{}, errMITMNotTLS, 0)
+
 	// Prepend the previously read data to be read again by http.ReadRequest.
 	p.brw.Reader.Reset(io.MultiReader(bytes.NewReader(buf), p.conn))
 	return p.handle()
@@ -275,6 +287,7 @@ func (p *proxyConn) tunnel(name string, res *http.Response, crw io.ReadWriteClos
 	if err := p.writeResponse(res); err != nil {
 		return err
 	}
+	crw, o := trackTraffic(crw)
 	if err := drainBuffer(crw, p.brw.Reader); err != nil {
 		err := fmt.Errorf("got error while draining read buffer: %w", err)
 		p.traceWroteResponse(res, err)
@@ -284,13 +297,16 @@ func (p *proxyConn) tunnel(name string, res *http.Response, crw io.ReadWriteClos
 	ctx := res.Request.Context()
 
 	log.Debugf(ctx, "switched protocols, proxying %s traffic", name)
-	bicopy(ctx,
+	t := p.newTunnel(name)
+	p.traceTunnelOpened(res, name)
+	reason := t.bicopy(ctx,
 		copier{"upstream " + name, crw, p.conn},
 		copier{"downstream " + name, p.conn, crw},
 	)
-	log.Debugf(ctx, "closed %s tunnel duration=%s", name, ContextDuration(ctx))
+	log.Debugf(ctx, "closed %s tunnel reason=%s duration=%s", name, reason, ContextDuration(ctx))
 
 	p.traceWroteResponse(res, nil)
+	p.traceTunnelClosed(res, name, reason, time.Since(t.start), o)
 
 	return nil
 }
@@ -390,9 +406,13 @@ func (p *proxyConn) handle() error {
 }
 
 func (p *proxyConn) writeErrorResponse(req *http.Request, err error) error {
+	var challenge []string
 	res := maybeConnectErrorResponse(err)
 	if res == nil {
 		res = p.errorResponse(req, err)
+		// Proxy-Authenticate is a hop-by-hop header removed by the response modifiers,
+		// but the challenge in the proxy's own error response is meant for the client.
+		challenge = res.Header.Values("Proxy-Authenticate")
 	}
 	if err := p.modifyResponse(res); err != nil {
 		log.Errorf(req.Context(), "error modifying error response: %v", err)
@@ -400,6 +420,9 @@ func (p *proxyConn) writeErrorResponse(req *http.Request, err error) error {
 			proxyutil.Warning(res.Header, err)
 		}
 	}
+	if len(challenge) > 0 {
+		res.Header["Proxy-Authenticate"] = challenge
+	}
 	return p.writeResponse(res)
 }
 
@@ -55,12 +55,33 @@ var ErrConnectFallback = errors.New("martian: connect fallback")
 type ConnectFunc func(req *http.Request) (*http.Response, io.ReadWriteCloser, error)
 
 func (p *Proxy) Connect(ctx context.Context, req *http.Request, terminateTLS bool) (res *http.Response, crw io.ReadWriteCloser, cerr error) {
+	p.traceConnectRequest(req)
+
+	var (
+		proxyURL    *url.URL
+		connectFunc bool
+	)
+	defer func() {
+		if cerr != nil || res.StatusCode/100 != 2 {
+			p.traceConnectFailed(req, res, proxyURL, connectFunc, cerr)
+		}
+	}()
+
 	if p.ConnectFunc != nil {
 		res, crw, cerr = p.ConnectFunc(req)
+		connectFunc = !errors.Is(cerr, ErrConnectFallback)
 	}
 	if p.ConnectFunc == nil || errors.Is(cerr, ErrConnectFallback) {
+		creq := req
+		if p.Trace != nil {
+			creq = req.WithContext(p.withClientTrace(req.Context(), req))
+		}
+
 		var cconn net.Conn
-		res, cconn, cerr = p.connect(req)
+		res, cconn, proxyURL, cerr = p.connect(creq)
+		if res != nil {
+			res.Request = req
+		}
 
 		if cconn != nil {
 			crw = cconn
@@ -68,7 +89,7 @@ func (p *Proxy) Connect(ctx context.Context, req *http.Request, terminateTLS boo
 			if terminateTLS {
 				log.Debugf(ctx, "attempting to terminate TLS on CONNECT tunnel: %s", req.URL.Host)
 				tconn := tls.Client(cconn, p.clientTLSConfig())
-				if err := tconn.Handshake(); err == nil {
+				if err := dialvia.TLSHandshake(creq.Context(), tconn); err == nil {
 					crw = tconn
 				} else {
 					log.Errorf(ctx, "failed to terminate TLS on CONNECT tunnel: %v", err)
@@ -81,52 +102,54 @@ func (p *Proxy) Connect(ctx context.Context, req *http.Request, terminateTLS boo
 	return
 }
 
-func (p *Proxy) connect(req *http.Request) (*http.Response, net.Conn, error) {
+func (p *Proxy) connect(req *http.Request) (*http.Response, net.Conn, *url.URL, error) {
 	ctx := req.Context()
 
-	var proxyURL *url.URL
-	if p.ProxyURL != nil {
-		u, err := p.ProxyURL(req)
-		if err != nil {
-			return nil, nil, err
-		}
-		proxyURL = u
+	chain, err := p.proxyChain(req)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	proxyURL, via := lastProxy(chain), viaProxies(chain)
 
 	if proxyURL == nil {
 		log.Debugf(ctx, "CONNECT to host directly: %s", req.URL.Host)
 
 		conn, err := p.DialContext(ctx, "tcp", req.URL.Host)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 
-		return newConnectResponse(req), conn, nil
+		return newConnectResponse(req), conn, nil, nil
 	}
 
+	var (
+		res  *http.Response
+		conn net.Conn
+	)
 	switch proxyURL.Scheme {
 	case "http", "https":
-		return p.connectHTTP(req, proxyURL)
+		res, conn, err = p.connectHTTP(req, proxyURL, via)
+	case "socks4", "socks4a":
+		res, conn, err = p.connectSOCKS4(req, proxyURL, p.viaDialer(via))
 	case "socks5":
-		return p.connectSOCKS5(req, proxyURL)
+		res, conn, err = p.connectSOCKS5(req, proxyURL, p.viaDialer(via))
+	case "ssh":
+		res, conn, err = p.connectSSH(req, proxyURL, via)
 	default:
-		return nil, nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+		err = fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
 	}
+
+	return res, conn, proxyURL, err
 }
 
-func (p *Proxy) connectHTTP(req *http.Request, proxyURL *url.URL) (res *http.Response, conn net.Conn, err error) {
+func (p *Proxy) connectHTTP(req *http.Request, proxyURL *url.URL, via []*url.URL) (res *http.Response, conn net.Conn, err error) {
 	ctx := req.Context()
 
 	log.Debugf(ctx, "CONNECT with upstream HTTP proxy: %s", proxyURL.Host)
 
-	var d *dialvia.HTTPProxyDialer
-	if proxyURL.Scheme == "https" {
-		d = dialvia.HTTPSProxy(p.DialContext, proxyURL, p.clientTLSConfig())
-	} else {
-		d = dialvia.HTTPProxy(p.DialContext, proxyURL)
-	}
-	d.Timeout = p.ConnectTimeout
+	d := p.httpProxyDialer(proxyURL, via, p.viaDialer(via))
 	d.ProxyConnectHeader = req.Header.Clone()
+	d.AuthScheme = p.proxyAuthScheme(proxyURL)
 
 	res, conn, err = d.DialContextR(ctx, "tcp", req.URL.Host)
 
@@ -144,6 +167,24 @@ func (p *Proxy) connectHTTP(req *http.Request, proxyURL *url.URL) (res *http.Res
 	return res, conn, err
 }
 
+// httpProxyDialer returns a dialer for the HTTP proxy reached through the via proxies, the proxy is dialed with dial.
+func (p *Proxy) httpProxyDialer(proxyURL *url.URL, via []*url.URL, dial dialvia.ContextDialerFunc) *dialvia.HTTPProxyDialer {
+	var d *dialvia.HTTPProxyDialer
+	if proxyURL.Scheme == "https" {
+		d = dialvia.HTTPSProxy(dial, proxyURL, p.clientTLSConfig())
+		if p.UpstreamHTTP2 != nil {
+			d.HTTP2 = p.http2Pool(proxyURL, via, dial)
+		}
+	} else {
+		d = dialvia.HTTPProxy(dial, proxyURL)
+	}
+	d.Timeout = p.connectTimeout(proxyURL)
+	if proxyURL.User != nil {
+		d.Digest = p.digestSession(proxyURL)
+	}
+	return d
+}
+
 func (p *Proxy) clientTLSConfig() *tls.Config {
 	if tr, ok := p.rt.(*http.Transport); ok && tr.TLSClientConfig != nil {
 		return tr.TLSClientConfig.Clone()
@@ -154,13 +195,29 @@ func (p *Proxy) clientTLSConfig() *tls.Config {
 	}
 }
 
-func (p *Proxy) connectSOCKS5(req *http.Request, proxyURL *url.URL) (*http.Response, net.Conn, error) {
+func (p *Proxy) connectSOCKS4(req *http.Request, proxyURL *url.URL, dial dialvia.ContextDialerFunc) (*http.Response, net.Conn, error) {
+	ctx := req.Context()
+
+	log.Debugf(ctx, "CONNECT with upstream SOCKS4 proxy: %s", proxyURL.Host)
+
+	d := dialvia.SOCKS4Proxy(dial, proxyURL)
+	d.Timeout = p.connectTimeout(proxyURL)
+
+	conn, err := d.DialContext(ctx, "tcp", req.URL.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newConnectResponse(req), conn, nil
+}
+
+func (p *Proxy) connectSOCKS5(req *http.Request, proxyURL *url.URL, dial dialvia.ContextDialerFunc) (*http.Response, net.Conn, error) {
 	ctx := req.Context()
 
 	log.Debugf(ctx, "CONNECT with upstream SOCKS5 proxy: %s", proxyURL.Host)
 
-	d := dialvia.SOCKS5Proxy(p.DialContext, proxyURL)
-	d.Timeout = p.ConnectTimeout
+	d := dialvia.SOCKS5Proxy(dial, proxyURL)
+	d.Timeout = p.connectTimeout(proxyURL)
 
 	conn, err := d.DialContext(ctx, "tcp", req.URL.Host)
 	if err != nil {
@@ -21,6 +21,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/saucelabs/forwarder/internal/martian/log"
 	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
@@ -82,7 +83,7 @@ func (p *Proxy) Handler() http.Handler {
 }
 
 func (p proxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	outreq := req.Clone(withTraceID(p.BaseContext, newTraceID(req.Header.Get(p.RequestIDHeader))))
+	outreq := req.Clone(p.requestContext(p.BaseContext, req))
 	if req.ContentLength == 0 {
 		outreq.Body = http.NoBody
 	}
@@ -164,6 +165,8 @@ func (p proxyHandler) tunnel(name string, rw http.ResponseWriter, req *http.Requ
 		p.traceWroteResponse(res, ferr)
 	}()
 
+	crw, o := trackTraffic(crw)
+
 	var cc []copier
 	switch req.ProtoMajor {
 	case 1:
@@ -209,8 +212,12 @@ func (p proxyHandler) tunnel(name string, rw http.ResponseWriter, req *http.Requ
 	ctx := req.Context()
 
 	log.Debugf(ctx, "established %s tunnel, proxying traffic", name)
-	bicopy(ctx, cc...)
-	log.Debugf(ctx, "closed %s tunnel duration=%s", name, ContextDuration(ctx))
+	t := p.newTunnel(name)
+	p.traceTunnelOpened(res, name)
+	reason := t.bicopy(ctx, cc...)
+	log.Debugf(ctx, "closed %s tunnel reason=%s duration=%s", name, reason, ContextDuration(ctx))
+
+	p.traceTunnelClosed(res, name, reason, time.Since(t.start), o)
 
 	return nil
 }
@@ -336,9 +343,13 @@ func (w h2Writer) CloseWrite() error {
 }
 
 func (p proxyHandler) writeErrorResponse(rw http.ResponseWriter, req *http.Request, err error) {
+	var challenge []string
 	res := maybeConnectErrorResponse(err)
 	if res == nil {
 		res = p.errorResponse(req, err)
+		// Proxy-Authenticate is a hop-by-hop header removed by the response modifiers,
+		// but the challenge in the proxy's own error response is meant for the client.
+		challenge = res.Header.Values("Proxy-Authenticate")
 	}
 	if err := p.modifyResponse(res); err != nil {
 		log.Errorf(req.Context(), "error modifying error response: %v", err)
@@ -346,6 +357,9 @@ func (p proxyHandler) writeErrorResponse(rw http.ResponseWriter, req *http.Reque
 			proxyutil.Warning(res.Header, err)
 		}
 	}
+	if len(challenge) > 0 {
+		res.Header["Proxy-Authenticate"] = challenge
+	}
 	p.writeResponse(rw, res)
 }
 
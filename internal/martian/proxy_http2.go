@@ -0,0 +1,55 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+
+package martian
+
+import (
+	"net/url"
+
+	"github.com/saucelabs/forwarder/dialvia"
+)
+
+// http2Upstream is a pool of HTTP/2 connections to an upstream HTTPS proxy shared by all tunnels.
+type http2Upstream struct {
+	pool *dialvia.HTTP2ProxyPool
+	name string
+}
+
+// http2Pool returns the pooled HTTP/2 connections to the HTTPS proxy URL reached through the via proxies,
+// it is created on first use.
+// Pools are keyed by the URLs including credentials, so that different users get different connections.
+func (p *Proxy) http2Pool(proxyURL *url.URL, via []*url.URL, dial dialvia.ContextDialerFunc) *dialvia.HTTP2ProxyPool {
+	chain := append(via[:len(via):len(via)], proxyURL)
+	key := proxyChainKey(chain)
+
+	u, _ := p.http2Upstreams.get(key, func() (*http2Upstream, error) {
+		return &http2Upstream{
+			pool: dialvia.NewHTTP2ProxyPool(dial, proxyURL, p.clientTLSConfig(), *p.UpstreamHTTP2),
+			name: redactProxyChain(chain),
+		}, nil
+	})
+
+	return u.pool
+}
+
+// UpstreamHTTP2Stats returns statistics of HTTP/2 connections to upstream proxies by proxy URL.
+// Proxy chains are formatted as "a -> b", passwords are redacted.
+func (p *Proxy) UpstreamHTTP2Stats() map[string]dialvia.HTTP2Stats {
+	p.init()
+
+	upstreams := p.http2Upstreams.values()
+	stats := make(map[string]dialvia.HTTP2Stats, len(upstreams))
+	for _, u := range upstreams {
+		s, us := stats[u.name], u.pool.Stats()
+		s.Conns += us.Conns
+		s.ActiveStreams += us.ActiveStreams
+		s.Streams += us.Streams
+		s.Fallbacks += us.Fallbacks
+		stats[u.name] = s
+	}
+	return stats
+}
+
+// closeHTTP2Pools closes the HTTP/2 connections, it is called when the proxy is closed.
+func (p *Proxy) closeHTTP2Pools() error {
+	return p.http2Upstreams.purge()
+}
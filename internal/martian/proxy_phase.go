@@ -0,0 +1,137 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+
+package martian
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Phase is a stage of proxying a request that is timed by the proxy.
+type Phase string
+
+const (
+	PhaseProxySelect Phase = "proxy_select"
+	PhaseDNS         Phase = "dns"
+	PhaseConnect     Phase = "connect"
+	PhaseTLSClient   Phase = "tls_client"
+	PhaseTLSMITM     Phase = "tls_mitm"
+	PhaseTLSUpstream Phase = "tls_upstream"
+	PhaseFirstByte   Phase = "first_byte"
+)
+
+func (p Phase) String() string {
+	return string(p)
+}
+
+// PhaseTiming is the amount of time a phase took.
+type PhaseTiming struct {
+	Phase    Phase
+	Duration time.Duration
+}
+
+type phaseTimings struct {
+	mu sync.Mutex
+	t  []PhaseTiming
+}
+
+func (pt *phaseTimings) add(phase Phase, d time.Duration) {
+	pt.mu.Lock()
+	pt.t = append(pt.t, PhaseTiming{Phase: phase, Duration: d})
+	pt.mu.Unlock()
+}
+
+func (pt *phaseTimings) list() []PhaseTiming {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return append([]PhaseTiming(nil), pt.t...)
+}
+
+// ContextPhaseTimings returns the phase timings recorded for the request in the order of completion.
+// The client TLS handshake is not included as it is not bound to a request.
+func ContextPhaseTimings(ctx context.Context) []PhaseTiming {
+	if v := ctx.Value(traceIDContextKey); v != nil {
+		if pt := v.(traceID).phases; pt != nil {
+			return pt.list()
+		}
+	}
+	return nil
+}
+
+func recordPhase(req *http.Request, phase Phase, d time.Duration) {
+	if req == nil {
+		return
+	}
+	if v := req.Context().Value(traceIDContextKey); v != nil {
+		if pt := v.(traceID).phases; pt != nil {
+			pt.add(phase, d)
+		}
+	}
+}
+
+// withClientTrace returns a copy of ctx with httptrace.ClientTrace that reports
+// DNS, dial, upstream TLS handshake and first response byte events for req.
+// The trace is picked up by http.Transport and by net.Dialer used to dial CONNECT tunnels.
+func (p *Proxy) withClientTrace(ctx context.Context, req *http.Request) context.Context {
+	var (
+		mu        sync.Mutex
+		start     = time.Now()
+		dnsStart  time.Time
+		dnsHost   string
+		tlsStart  time.Time
+		connStart = make(map[string]time.Time)
+	)
+
+	since := func(t time.Time) time.Duration {
+		if t.IsZero() {
+			return 0
+		}
+		return time.Since(t)
+	}
+
+	ct := &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart, dnsHost = time.Now(), info.Host
+			mu.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			d, host := since(dnsStart), dnsHost
+			mu.Unlock()
+			p.traceDNSDone(req, host, info.Addrs, info.Err, d)
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connStart[network+"/"+addr] = time.Now()
+			mu.Unlock()
+			p.traceConnectStart(req, network, addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			d := since(connStart[network+"/"+addr])
+			mu.Unlock()
+			p.traceConnectDone(req, network, addr, err, d)
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			d := since(tlsStart)
+			mu.Unlock()
+			p.traceTLSHandshakeDone(req, PhaseTLSUpstream, state, err, d)
+		},
+		GotFirstResponseByte: func() {
+			p.traceGotFirstResponseByte(req, time.Since(start))
+		},
+	}
+
+	return httptrace.WithClientTrace(ctx, ct)
+}
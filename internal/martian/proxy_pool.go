@@ -0,0 +1,105 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+
+package martian
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/elastic/go-freelru"
+	"github.com/saucelabs/forwarder/internal/martian/log"
+	"go.uber.org/multierr"
+)
+
+// maxPooledUpstreams is the maximum number of pooled upstreams of each kind e.g. transports or SSH connections.
+// Pools are keyed by the upstream URLs including credentials that may come from clients i.e. PAC or JWT claims,
+// the least recently used upstream is closed when the limit is reached.
+const maxPooledUpstreams = 1024
+
+// upstreamPool is a bounded pool of upstream values keyed by the proxy chain, values are created on first use.
+type upstreamPool[V any] struct {
+	mu       sync.Mutex
+	lru      *freelru.LRU[string, V]
+	close    func(v V) error
+	purging  bool
+	purgeErr error
+}
+
+func newUpstreamPool[V any](closeFunc func(v V) error) *upstreamPool[V] {
+	lru, err := freelru.New[string, V](maxPooledUpstreams, func(k string) uint32 {
+		return uint32(xxhash.Sum64String(k)) //nolint:gosec // no overflow
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	p := &upstreamPool[V]{
+		lru:   lru,
+		close: closeFunc,
+	}
+	lru.SetOnEvict(p.onEvict)
+
+	return p
+}
+
+func (p *upstreamPool[V]) onEvict(_ string, v V) {
+	if p.close == nil {
+		return
+	}
+	err := p.close(v)
+	if err == nil {
+		return
+	}
+	if p.purging {
+		p.purgeErr = multierr.Append(p.purgeErr, err)
+	} else {
+		log.Errorf(context.TODO(), "failed to close evicted upstream: %v", err)
+	}
+}
+
+// get returns the value for the key, it calls create if there is no value.
+func (p *upstreamPool[V]) get(key string, create func() (V, error)) (V, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if v, ok := p.lru.Get(key); ok {
+		return v, nil
+	}
+
+	v, err := create()
+	if err != nil {
+		return v, err
+	}
+	p.lru.Add(key, v)
+
+	return v, nil
+}
+
+// values returns the pooled values from the oldest to the newest.
+func (p *upstreamPool[V]) values() []V {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keys := p.lru.Keys()
+	vals := make([]V, 0, len(keys))
+	for _, k := range keys {
+		if v, ok := p.lru.Peek(k); ok {
+			vals = append(vals, v)
+		}
+	}
+	return vals
+}
+
+// purge closes and removes all values.
+func (p *upstreamPool[V]) purge() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.purging = true
+	p.lru.Purge()
+	err := p.purgeErr
+	p.purging, p.purgeErr = false, nil
+
+	return err
+}
@@ -0,0 +1,53 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+
+package martian
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestUpstreamPoolEviction(t *testing.T) {
+	var closed []int
+	p := newUpstreamPool(func(v int) error {
+		closed = append(closed, v)
+		if v == maxPooledUpstreams {
+			return errors.New("close failed")
+		}
+		return nil
+	})
+
+	for i := range maxPooledUpstreams + 1 {
+		v, err := p.get(strconv.Itoa(i), func() (int, error) { return i, nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != i {
+			t.Fatalf("expected %d, got %d", i, v)
+		}
+	}
+	if len(closed) != 1 || closed[0] != 0 {
+		t.Fatalf("expected the least recently used upstream to be closed, got %v", closed)
+	}
+	if n := len(p.values()); n != maxPooledUpstreams {
+		t.Fatalf("expected %d upstreams, got %d", maxPooledUpstreams, n)
+	}
+
+	if v, _ := p.get("1", func() (int, error) { return -1, nil }); v != 1 {
+		t.Fatalf("expected pooled value, got %d", v)
+	}
+	if _, err := p.get("new", func() (int, error) { return 0, errors.New("create failed") }); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if err := p.purge(); err == nil {
+		t.Fatal("expected close error")
+	}
+	if len(closed) != maxPooledUpstreams+1 {
+		t.Fatalf("expected all upstreams to be closed, got %d", len(closed))
+	}
+	if n := len(p.values()); n != 0 {
+		t.Fatalf("expected no upstreams, got %d", n)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+
+package martian
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/saucelabs/forwarder/dialvia"
+	"github.com/saucelabs/forwarder/internal/martian/log"
+)
+
+// sshUpstream is an SSH connection shared by all requests and tunnels to an upstream SSH proxy.
+type sshUpstream struct {
+	d *dialvia.SSHProxyDialer
+	t *http.Transport
+}
+
+// sshUpstream returns the pooled SSH upstream for the proxy URL reached through the via proxies, it is created on first use.
+// Upstreams are keyed by the URLs including credentials, so that different users get different connections.
+func (p *Proxy) sshUpstream(proxyURL *url.URL, via []*url.URL) (*sshUpstream, error) {
+	if p.SSHClientConfig == nil {
+		return nil, errors.New("SSH upstream proxy is not configured")
+	}
+
+	key := proxyChainKey(append(via[:len(via):len(via)], proxyURL))
+
+	return p.sshUpstreams.get(key, func() (*sshUpstream, error) {
+		cfg, err := p.SSHClientConfig(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		d := dialvia.SSHProxy(p.viaDialer(via), proxyURL, cfg)
+		d.Timeout = p.connectTimeout(proxyURL)
+		d.KeepAlive = p.SSHKeepAlive
+
+		s := &sshUpstream{d: d}
+		if t, ok := p.rt.(*http.Transport); ok {
+			s.t = t.Clone()
+			s.t.Proxy = nil
+			s.t.OnProxyConnectResponse = nil
+			s.t.DialContext = d.DialContext
+		}
+		return s, nil
+	})
+}
+
+func (p *Proxy) connectSSH(req *http.Request, proxyURL *url.URL, via []*url.URL) (*http.Response, net.Conn, error) {
+	ctx := req.Context()
+
+	log.Debugf(ctx, "CONNECT with upstream SSH proxy: %s", proxyURL.Host)
+
+	s, err := p.sshUpstream(proxyURL, via)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := s.d.DialContext(ctx, "tcp", req.URL.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newConnectResponse(req), conn, nil
+}
+
+// sshRoundTrip sends the request over a direct-tcpip channel of the pooled SSH connection.
+func (p *Proxy) sshRoundTrip(req *http.Request, proxyURL *url.URL, via []*url.URL) (*http.Response, error) {
+	s, err := p.sshUpstream(proxyURL, via)
+	if err != nil {
+		return nil, err
+	}
+	if s.t == nil {
+		return nil, errors.New("SSH upstream proxy requires *http.Transport round tripper")
+	}
+	return s.t.RoundTrip(req)
+}
+
+// closeSSHUpstreams closes the SSH connections, it is called when the proxy is closed.
+func (p *Proxy) closeSSHUpstreams() error {
+	return p.sshUpstreams.purge()
+}
@@ -29,9 +29,11 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/saucelabs/forwarder/internal/martian/log"
 	"github.com/saucelabs/forwarder/internal/martian/martiantest"
 	"github.com/saucelabs/forwarder/internal/martian/mitm"
@@ -708,6 +710,106 @@ func TestIntegrationHTTPUpstreamProxy(t *testing.T) {
 	}
 }
 
+func TestIntegrationHTTPUpstreamProxyTrace(t *testing.T) {
+	t.Parallel()
+
+	ul, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+
+	upstream := testHelper{
+		Listener: ul,
+		Proxy: func(p *Proxy) {
+			utr := martiantest.NewTransport()
+			utr.Respond(299)
+			p.RoundTripper = utr
+			p.ReadTimeout = 600 * time.Millisecond
+			p.WriteTimeout = 600 * time.Millisecond
+		},
+	}
+
+	uc, ucancel := upstream.proxyClient(t)
+	defer ucancel()
+
+	var (
+		mu     sync.Mutex
+		traced []Phase
+		logged []Phase
+	)
+	addPhase := func(p Phase) {
+		mu.Lock()
+		traced = append(traced, p)
+		mu.Unlock()
+	}
+
+	proxy := testHelper{
+		Proxy: func(p *Proxy) {
+			p.AllowHTTP = true
+			p.ProxyURL = http.ProxyURL(&url.URL{Host: uc.Addr})
+			p.ReadTimeout = 600 * time.Millisecond
+			p.WriteTimeout = 600 * time.Millisecond
+			p.Trace = &ProxyTrace{
+				ProxySelected: func(info ProxySelectedInfo) {
+					if info.ProxyURL == nil || info.ProxyURL.Host != uc.Addr {
+						t.Errorf("info.ProxyURL: got %v, want %s", info.ProxyURL, uc.Addr)
+					}
+					addPhase(PhaseProxySelect)
+				},
+				ConnectDone: func(info ConnectDoneInfo) {
+					if info.Err != nil {
+						t.Errorf("info.Err: got %v, want no error", info.Err)
+					}
+					addPhase(PhaseConnect)
+				},
+				GotFirstResponseByte: func(info GotFirstResponseByteInfo) {
+					addPhase(PhaseFirstByte)
+				},
+			}
+			tm := martiantest.NewModifier()
+			tm.ResponseFunc(func(res *http.Response) {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, pt := range ContextPhaseTimings(res.Request.Context()) {
+					logged = append(logged, pt.Phase)
+				}
+			})
+			p.ResponseModifier = tm
+		},
+	}
+
+	conn, cancel := proxy.proxyConn(t)
+	defer cancel()
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.StatusCode, 299; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	want := []Phase{PhaseProxySelect, PhaseConnect, PhaseFirstByte}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(want, traced); diff != "" {
+		t.Errorf("traced phases mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want, logged); diff != "" {
+		t.Errorf("context phases mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func TestIntegrationHTTPUpstreamProxyError(t *testing.T) {
 	t.Parallel()
 
@@ -1179,6 +1281,224 @@ func TestIntegrationConnectFunc(t *testing.T) {
 	}
 }
 
+func TestIntegrationConnectTunnelTimeouts(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		proxy  func(p *Proxy)
+		reason TunnelCloseReason
+	}{
+		{
+			name: "idle timeout",
+			proxy: func(p *Proxy) {
+				p.TunnelIdleTimeout = 100 * time.Millisecond
+			},
+			reason: TunnelIdleTimeout,
+		},
+		{
+			name: "max lifetime",
+			proxy: func(p *Proxy) {
+				p.TunnelMaxLifetime = 100 * time.Millisecond
+			},
+			reason: TunnelMaxLifetime,
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			closed := make(chan TunnelClosedInfo, 1)
+
+			h := testHelper{
+				Proxy: func(p *Proxy) {
+					p.ConnectFunc = func(req *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+						pr, pw := io.Pipe()
+						return newConnectResponse(req), pipeConn{pr, pw}, nil
+					}
+					p.Trace = &ProxyTrace{
+						TunnelClosed: func(info TunnelClosedInfo) {
+							closed <- info
+						},
+					}
+					tc.proxy(p)
+				},
+			}
+
+			conn, cancel := h.proxyConn(t)
+			defer cancel()
+			defer conn.Close()
+
+			req, err := http.NewRequest(http.MethodConnect, "//example.com:80", http.NoBody)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): got %v, want no error", err)
+			}
+			if err := req.WriteProxy(conn); err != nil {
+				t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+			}
+			res, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+			}
+			defer res.Body.Close()
+
+			if got, want := res.StatusCode, 200; got != want {
+				t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+			}
+
+			select {
+			case info := <-closed:
+				if info.Reason != tc.reason {
+					t.Errorf("info.Reason: got %s, want %s", info.Reason, tc.reason)
+				}
+				if info.Name != "CONNECT" {
+					t.Errorf("info.Name: got %s, want CONNECT", info.Name)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("tunnel was not closed")
+			}
+		})
+	}
+}
+
+// writeTimeoutConn signals when a write fails with a deadline error.
+type writeTimeoutConn struct {
+	net.Conn
+	timedOut chan struct{}
+	once     sync.Once
+}
+
+func (c *writeTimeoutConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		c.once.Do(func() { close(c.timedOut) })
+	}
+	return n, err
+}
+
+func TestIntegrationConnectTunnelWriteTimeout(t *testing.T) {
+	t.Parallel()
+
+	closed := make(chan TunnelClosedInfo, 1)
+	done := make(chan struct{})
+
+	h := testHelper{
+		Proxy: func(p *Proxy) {
+			p.ConnectFunc = func(req *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+				// The upstream never reads, writes to it block until the write timeout.
+				upstream, peer := net.Pipe()
+				c := &writeTimeoutConn{Conn: upstream, timedOut: make(chan struct{})}
+				go func() {
+					select {
+					case <-c.timedOut:
+					case <-done:
+					}
+					peer.Close()
+				}()
+				return newConnectResponse(req), c, nil
+			}
+			p.TunnelWriteTimeout = 100 * time.Millisecond
+			p.Trace = &ProxyTrace{
+				TunnelClosed: func(info TunnelClosedInfo) {
+					closed <- info
+				},
+			}
+		},
+	}
+
+	conn, cancel := h.proxyConn(t)
+	defer cancel()
+	defer conn.Close()
+	defer close(done)
+
+	req, err := http.NewRequest(http.MethodConnect, "//example.com:80", http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+
+	select {
+	case info := <-closed:
+		if got, want := info.Reason, TunnelWriteTimeout; got != want {
+			t.Errorf("info.Reason: got %s, want %s", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel was not closed")
+	}
+}
+
+func TestIntegrationConnectFailedTrace(t *testing.T) {
+	t.Parallel()
+
+	failed := make(chan ConnectFailedInfo, 1)
+
+	h := testHelper{
+		Proxy: func(p *Proxy) {
+			p.ConnectFunc = func(req *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+				return nil, nil, errors.New("connect error")
+			}
+			p.Trace = &ProxyTrace{
+				ConnectFailed: func(info ConnectFailedInfo) {
+					failed <- info
+				},
+			}
+		},
+	}
+
+	conn, cancel := h.proxyConn(t)
+	defer cancel()
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodConnect, "//example.com:80", http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	defer res.Body.Close()
+
+	if got, want := res.StatusCode, 502; got != want {
+		t.Errorf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	select {
+	case info := <-failed:
+		if info.Err == nil || info.Err.Error() != "connect error" {
+			t.Errorf("info.Err: got %v, want connect error", info.Err)
+		}
+		if info.ProxyURL != nil {
+			t.Errorf("info.ProxyURL: got %v, want nil", info.ProxyURL)
+		}
+		if !info.ConnectFunc {
+			t.Error("info.ConnectFunc: got false, want true")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnectFailed was not called")
+	}
+}
+
 func TestIntegrationConnectTerminateTLS(t *testing.T) {
 	t.Parallel()
 
@@ -3,7 +3,13 @@
 package martian
 
 import (
+	"crypto/tls"
+	"net"
 	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/saucelabs/forwarder/conntrack"
 )
 
 // ProxyTrace is a set of hooks to run at various stages of a request.
@@ -18,6 +24,54 @@ type ProxyTrace struct {
 	// WroteResponse is called with the result of writing the response.
 	// It is called after the response has been written.
 	WroteResponse func(WroteResponseInfo)
+
+	// RoundTripStart is called before the request is sent upstream,
+	// after the request modifiers are applied.
+	// The hook may modify the request headers i.e. to propagate the trace context.
+	RoundTripStart func(RoundTripStartInfo)
+
+	// RoundTripDone is called with the result of the upstream round trip.
+	RoundTripDone func(RoundTripDoneInfo)
+
+	// ProxySelected is called when the upstream proxy for a request is selected.
+	// It is called for plain HTTP requests and CONNECT requests.
+	ProxySelected func(ProxySelectedInfo)
+
+	// DNSDone is called when a DNS lookup for the upstream host ends.
+	DNSDone func(DNSDoneInfo)
+
+	// ConnectStart is called when a new connection's Dial begins.
+	// If net.Dialer.DualStack (IPv6 "Happy Eyeballs") support is enabled,
+	// this may be called multiple times.
+	ConnectStart func(ConnectStartInfo)
+
+	// ConnectDone is called when a new connection's Dial completes.
+	ConnectDone func(ConnectDoneInfo)
+
+	// TLSHandshakeDone is called after a TLS handshake with the client,
+	// the MITMed client or the upstream server completes.
+	// For the client handshake Req is nil as it happens before the request is read.
+	// For the MITM handshake it is also called with an error if the client
+	// closes the connection or does not start TLS after CONNECT.
+	TLSHandshakeDone func(TLSHandshakeDoneInfo)
+
+	// GotFirstResponseByte is called when the first byte of the upstream response is available.
+	GotFirstResponseByte func(GotFirstResponseByteInfo)
+
+	// ConnectRequest is called before establishing a CONNECT tunnel,
+	// after the request modifiers are applied.
+	ConnectRequest func(ConnectRequestInfo)
+
+	// ConnectFailed is called when a CONNECT request could not be established,
+	// either because of an error or a non-2xx response from the upstream proxy.
+	ConnectFailed func(ConnectFailedInfo)
+
+	// TunnelOpened is called when a CONNECT or upgrade tunnel is established,
+	// and the proxy starts copying data in both directions.
+	TunnelOpened func(TunnelOpenedInfo)
+
+	// TunnelClosed is called when a CONNECT or upgrade tunnel is closed.
+	TunnelClosed func(TunnelClosedInfo)
 }
 
 type ReadRequestInfo struct {
@@ -51,3 +105,268 @@ func (p *Proxy) traceWroteResponse(res *http.Response, err error) {
 		})
 	}
 }
+
+type RoundTripStartInfo struct {
+	// Req is the request that is about to be sent upstream.
+	Req *http.Request
+}
+
+func (p *Proxy) traceRoundTripStart(req *http.Request) {
+	if p.Trace != nil && p.Trace.RoundTripStart != nil {
+		p.Trace.RoundTripStart(RoundTripStartInfo{
+			Req: req,
+		})
+	}
+}
+
+type RoundTripDoneInfo struct {
+	// Req is the request that was sent upstream.
+	Req *http.Request
+	// Res is the upstream response, it is nil if Err is not nil.
+	Res *http.Response
+	// Err is any error encountered during the round trip.
+	Err error
+}
+
+func (p *Proxy) traceRoundTripDone(req *http.Request, res *http.Response, err error) {
+	if p.Trace != nil && p.Trace.RoundTripDone != nil {
+		p.Trace.RoundTripDone(RoundTripDoneInfo{
+			Req: req,
+			Res: res,
+			Err: err,
+		})
+	}
+}
+
+type ProxySelectedInfo struct {
+	// Req is the request for which the proxy was selected.
+	Req *http.Request
+	// ProxyURL is the selected upstream proxy URL, it is nil if the connection is direct.
+	ProxyURL *url.URL
+	// Err is any error encountered while selecting the proxy.
+	Err error
+	// Duration is the amount of time it took to select the proxy.
+	Duration time.Duration
+}
+
+func (p *Proxy) traceProxySelected(req *http.Request, proxyURL *url.URL, err error, d time.Duration) {
+	if err == nil {
+		recordPhase(req, PhaseProxySelect, d)
+	}
+	if p.Trace != nil && p.Trace.ProxySelected != nil {
+		p.Trace.ProxySelected(ProxySelectedInfo{
+			Req:      req,
+			ProxyURL: proxyURL,
+			Err:      err,
+			Duration: d,
+		})
+	}
+}
+
+type DNSDoneInfo struct {
+	// Req is the request for which the lookup was made.
+	Req *http.Request
+	// Host is the host name that was looked up.
+	Host string
+	// Addrs are the IPv4 and/or IPv6 addresses found in the DNS lookup.
+	Addrs []net.IPAddr
+	// Err is any error that occurred during the DNS lookup.
+	Err error
+	// Duration is the amount of time the lookup took.
+	Duration time.Duration
+}
+
+func (p *Proxy) traceDNSDone(req *http.Request, host string, addrs []net.IPAddr, err error, d time.Duration) {
+	if err == nil {
+		recordPhase(req, PhaseDNS, d)
+	}
+	if p.Trace != nil && p.Trace.DNSDone != nil {
+		p.Trace.DNSDone(DNSDoneInfo{
+			Req:      req,
+			Host:     host,
+			Addrs:    addrs,
+			Err:      err,
+			Duration: d,
+		})
+	}
+}
+
+type ConnectStartInfo struct {
+	// Req is the request for which the connection is dialed.
+	Req *http.Request
+	// Network is the network i.e. tcp.
+	Network string
+	// Addr is the address being dialed.
+	Addr string
+}
+
+func (p *Proxy) traceConnectStart(req *http.Request, network, addr string) {
+	if p.Trace != nil && p.Trace.ConnectStart != nil {
+		p.Trace.ConnectStart(ConnectStartInfo{
+			Req:     req,
+			Network: network,
+			Addr:    addr,
+		})
+	}
+}
+
+type ConnectDoneInfo struct {
+	// Req is the request for which the connection was dialed.
+	Req *http.Request
+	// Network is the network i.e. tcp.
+	Network string
+	// Addr is the address that was dialed.
+	Addr string
+	// Err is any error encountered while dialing.
+	Err error
+	// Duration is the amount of time the dial took.
+	Duration time.Duration
+}
+
+func (p *Proxy) traceConnectDone(req *http.Request, network, addr string, err error, d time.Duration) {
+	if err == nil {
+		recordPhase(req, PhaseConnect, d)
+	}
+	if p.Trace != nil && p.Trace.ConnectDone != nil {
+		p.Trace.ConnectDone(ConnectDoneInfo{
+			Req:      req,
+			Network:  network,
+			Addr:     addr,
+			Err:      err,
+			Duration: d,
+		})
+	}
+}
+
+type TLSHandshakeDoneInfo struct {
+	// Req is the request for which the handshake was made, it is nil for the client handshake.
+	Req *http.Request
+	// Phase is one of PhaseTLSClient, PhaseTLSMITM or PhaseTLSUpstream.
+	Phase Phase
+	// State is the connection state after the handshake.
+	State tls.ConnectionState
+	// Err is any error encountered during the handshake.
+	Err error
+	// Duration is the amount of time the handshake took.
+	Duration time.Duration
+}
+
+func (p *Proxy) traceTLSHandshakeDone(req *http.Request, phase Phase, state tls.ConnectionState, err error, d time.Duration) {
+	if err == nil {
+		recordPhase(req, phase, d)
+	}
+	if p.Trace != nil && p.Trace.TLSHandshakeDone != nil {
+		p.Trace.TLSHandshakeDone(TLSHandshakeDoneInfo{
+			Req:      req,
+			Phase:    phase,
+			State:    state,
+			Err:      err,
+			Duration: d,
+		})
+	}
+}
+
+type GotFirstResponseByteInfo struct {
+	// Req is the request that was sent upstream.
+	Req *http.Request
+	// Duration is the amount of time since the round trip started.
+	Duration time.Duration
+}
+
+func (p *Proxy) traceGotFirstResponseByte(req *http.Request, d time.Duration) {
+	recordPhase(req, PhaseFirstByte, d)
+	if p.Trace != nil && p.Trace.GotFirstResponseByte != nil {
+		p.Trace.GotFirstResponseByte(GotFirstResponseByteInfo{
+			Req:      req,
+			Duration: d,
+		})
+	}
+}
+
+type ConnectRequestInfo struct {
+	// Req is the CONNECT request.
+	Req *http.Request
+}
+
+func (p *Proxy) traceConnectRequest(req *http.Request) {
+	if p.Trace != nil && p.Trace.ConnectRequest != nil {
+		p.Trace.ConnectRequest(ConnectRequestInfo{
+			Req: req,
+		})
+	}
+}
+
+type ConnectFailedInfo struct {
+	// Req is the CONNECT request.
+	Req *http.Request
+	// Res is the response from the upstream proxy if any.
+	Res *http.Response
+	// ProxyURL is the upstream proxy URL, it is nil if the connection was direct or made by ConnectFunc.
+	ProxyURL *url.URL
+	// ConnectFunc is true if the connection was made by Proxy.ConnectFunc.
+	ConnectFunc bool
+	// Err is the error encountered while establishing the connection, it is nil if Res is not nil.
+	Err error
+}
+
+func (p *Proxy) traceConnectFailed(req *http.Request, res *http.Response, proxyURL *url.URL, connectFunc bool, err error) {
+	if p.Trace != nil && p.Trace.ConnectFailed != nil {
+		p.Trace.ConnectFailed(ConnectFailedInfo{
+			Req:         req,
+			Res:         res,
+			ProxyURL:    proxyURL,
+			ConnectFunc: connectFunc,
+			Err:         err,
+		})
+	}
+}
+
+type TunnelOpenedInfo struct {
+	// Res is the response that established the tunnel.
+	Res *http.Response
+	// Name is the tunnel name i.e. CONNECT or the upgrade protocol.
+	Name string
+	// Duration is the amount of time it took to establish the tunnel since the request was read.
+	Duration time.Duration
+}
+
+func (p *Proxy) traceTunnelOpened(res *http.Response, name string) {
+	if p.Trace != nil && p.Trace.TunnelOpened != nil {
+		p.Trace.TunnelOpened(TunnelOpenedInfo{
+			Res:      res,
+			Name:     name,
+			Duration: ContextDuration(res.Request.Context()),
+		})
+	}
+}
+
+type TunnelClosedInfo struct {
+	// Res is the response that established the tunnel.
+	Res *http.Response
+	// Name is the tunnel name i.e. CONNECT or the upgrade protocol.
+	Name string
+	// Reason is the reason the tunnel was closed.
+	Reason TunnelCloseReason
+	// Duration is the amount of time the tunnel was open.
+	Duration time.Duration
+	// BytesSent is the number of bytes sent to the upstream, it is 0 if the traffic was not tracked.
+	BytesSent uint64
+	// BytesReceived is the number of bytes received from the upstream, it is 0 if the traffic was not tracked.
+	BytesReceived uint64
+}
+
+func (p *Proxy) traceTunnelClosed(res *http.Response, name string, reason TunnelCloseReason, d time.Duration, o *conntrack.Observer) {
+	if p.Trace != nil && p.Trace.TunnelClosed != nil {
+		info := TunnelClosedInfo{
+			Res:      res,
+			Name:     name,
+			Reason:   reason,
+			Duration: d,
+		}
+		if o != nil {
+			info.BytesSent = o.Tx()
+			info.BytesReceived = o.Rx()
+		}
+		p.Trace.TunnelClosed(info)
+	}
+}
@@ -15,6 +15,7 @@ import (
 type traceID struct {
 	id        string
 	createdAt time.Time
+	phases    *phaseTimings
 }
 
 var idSeq atomic.Uint64
@@ -30,6 +31,7 @@ func newTraceID(id string) traceID {
 	return traceID{
 		id:        id,
 		createdAt: t,
+		phases:    new(phaseTimings),
 	}
 }
 
@@ -0,0 +1,196 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// IPRange is a named list of IP address prefixes.
+type IPRange struct {
+	Name     string
+	Prefixes []netip.Prefix
+}
+
+func (r IPRange) String() string {
+	return r.Name
+}
+
+func mustPrefixes(s ...string) []netip.Prefix {
+	p := make([]netip.Prefix, len(s))
+	for i := range s {
+		p[i] = netip.MustParsePrefix(s[i])
+	}
+	return p
+}
+
+// IPRangePresets are the predefined IP ranges that can be used by name.
+var IPRangePresets = []IPRange{
+	{
+		Name:     "loopback",
+		Prefixes: mustPrefixes("127.0.0.0/8", "0.0.0.0/32", "::1/128", "::/128"),
+	},
+	{
+		Name:     "link-local",
+		Prefixes: mustPrefixes("169.254.0.0/16", "fe80::/10"),
+	},
+	{
+		Name:     "private",
+		Prefixes: mustPrefixes("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"),
+	},
+	{
+		Name:     "metadata",
+		Prefixes: mustPrefixes("169.254.169.254/32", "169.254.170.2/32", "100.100.100.200/32", "fd00:ec2::254/128"),
+	},
+}
+
+// DefaultDenyIPs returns the IP ranges denied by default: link-local addresses and cloud metadata services.
+// Loopback addresses are not included so that they follow the ProxyLocalhost setting.
+func DefaultDenyIPs() []IPRange {
+	var ranges []IPRange
+	for _, r := range IPRangePresets {
+		if r.Name == "link-local" || r.Name == "metadata" {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// ParseIPRange parses a CIDR, an IP address or a name of one of the IPRangePresets.
+func ParseIPRange(val string) (IPRange, error) {
+	for _, r := range IPRangePresets {
+		if r.Name == val {
+			return r, nil
+		}
+	}
+
+	if strings.Contains(val, "/") {
+		p, err := netip.ParsePrefix(val)
+		if err != nil {
+			return IPRange{}, err
+		}
+		// Addresses are unmapped before filtering, so IPv4-mapped prefixes must be IPv4 prefixes to match.
+		if p.Addr().Is4In6() {
+			if p.Bits() < 96 {
+				return IPRange{}, fmt.Errorf("invalid IP range %q, IPv4-mapped prefix must be at least /96", val)
+			}
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		return IPRange{Name: val, Prefixes: []netip.Prefix{p.Masked()}}, nil
+	}
+
+	a, err := netip.ParseAddr(val)
+	if err != nil {
+		return IPRange{}, fmt.Errorf("invalid IP range %q, expected CIDR, IP address or one of the presets", val)
+	}
+	a = a.Unmap()
+	return IPRange{Name: val, Prefixes: []netip.Prefix{netip.PrefixFrom(a, a.BitLen())}}, nil
+}
+
+// IPFilter denies IP addresses that are in the deny ranges unless they are in the allow ranges.
+type IPFilter struct {
+	deny  []netip.Prefix
+	allow []netip.Prefix
+}
+
+// NewIPFilter returns an IPFilter, or nil if deny is empty.
+func NewIPFilter(deny, allow []IPRange) *IPFilter {
+	if len(deny) == 0 {
+		return nil
+	}
+
+	f := new(IPFilter)
+	for _, r := range deny {
+		f.deny = append(f.deny, r.Prefixes...)
+	}
+	for _, r := range allow {
+		f.allow = append(f.allow, r.Prefixes...)
+	}
+	return f
+}
+
+// Denied returns true if the IP address is denied.
+func (f *IPFilter) Denied(a netip.Addr) bool {
+	a = a.Unmap().WithZone("")
+	for _, p := range f.allow {
+		if p.Contains(a) {
+			return false
+		}
+	}
+	for _, p := range f.deny {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipRangesContain(ranges []IPRange, a netip.Addr) bool {
+	a = a.Unmap().WithZone("")
+	for _, r := range ranges {
+		for _, p := range r.Prefixes {
+			if p.Contains(a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP address of a TCP or UDP address.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	if addr == nil {
+		return netip.Addr{}, false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr(), true
+}
+
+// ErrDestinationDenied is returned when dialing a proxied destination that resolves to a denied IP address.
+var ErrDestinationDenied = denyError{errors.New("destination IP address is denied")}
+
+type dialTargetKey struct{}
+
+// WithDialTarget marks dials to host as dials to a proxied destination.
+// Dialer applies IP filtering only to such dials,
+// so that connections to upstream proxies are not affected.
+func WithDialTarget(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, dialTargetKey{}, host)
+}
+
+func isDialTarget(ctx context.Context, address string) bool {
+	target, ok := ctx.Value(dialTargetKey{}).(string)
+	if !ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return strings.EqualFold(strings.Trim(host, "[]"), strings.Trim(target, "[]"))
+}
+
+// control is used as net.Dialer.ControlContext, it is called after DNS resolution with the IP address to connect to.
+func (f *IPFilter) control(_ context.Context, _, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if f.Denied(ap.Addr()) {
+		return fmt.Errorf("%w: %s", ErrDestinationDenied, ap.Addr())
+	}
+	return nil
+}
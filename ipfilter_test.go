@@ -0,0 +1,198 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestParseIPRange(t *testing.T) {
+	for _, v := range []string{"loopback", "private", "10.0.0.0/8", "10.1.2.3/8", "192.168.0.1", "::1", "fd00::/8"} {
+		if _, err := ParseIPRange(v); err != nil {
+			t.Errorf("%q: unexpected error: %v", v, err)
+		}
+	}
+	for _, v := range []string{"", "foo", "10.0.0.0/33", "300.0.0.1", "::ffff:0.0.0.0/80"} {
+		if _, err := ParseIPRange(v); err == nil {
+			t.Errorf("%q: expected error", v)
+		}
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	parse := func(vals ...string) []IPRange {
+		var res []IPRange
+		for _, v := range vals {
+			r, err := ParseIPRange(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, r)
+		}
+		return res
+	}
+
+	f := NewIPFilter(parse("loopback", "link-local", "private", "metadata", "::ffff:100.64.0.0/106"), parse("10.1.0.0/16"))
+
+	denied := []string{"127.0.0.1", "127.1.2.3", "0.0.0.0", "::1", "::", "::ffff:127.0.0.1", "169.254.169.254", "10.0.0.1", "192.168.1.1", "fe80::1", "fd00::1", "100.64.0.1"}
+	for _, v := range denied {
+		if !f.Denied(netip.MustParseAddr(v)) {
+			t.Errorf("expected %s to be denied", v)
+		}
+	}
+	allowed := []string{"8.8.8.8", "10.1.2.3", "2001:4860:4860::8888", "172.32.0.1"}
+	for _, v := range allowed {
+		if f.Denied(netip.MustParseAddr(v)) {
+			t.Errorf("expected %s to be allowed", v)
+		}
+	}
+
+	if NewIPFilter(nil, parse("loopback")) != nil {
+		t.Error("expected nil filter without deny ranges")
+	}
+}
+
+func TestDefaultDenyIPs(t *testing.T) {
+	f := NewIPFilter(DefaultDialConfig().DenyIPs, nil)
+	for _, v := range []string{"169.254.169.254", "169.254.1.1", "100.100.100.200", "fe80::1"} {
+		if !f.Denied(netip.MustParseAddr(v)) {
+			t.Errorf("expected %s to be denied", v)
+		}
+	}
+	for _, v := range []string{"127.0.0.1", "10.0.0.1", "8.8.8.8"} {
+		if f.Denied(netip.MustParseAddr(v)) {
+			t.Errorf("expected %s to be allowed", v)
+		}
+	}
+
+	md, _ := ParseIPRange("metadata")
+	if NewIPFilter(DefaultDialConfig().DenyIPs, []IPRange{md}).Denied(netip.MustParseAddr("169.254.169.254")) {
+		t.Error("expected allow list to override the defaults")
+	}
+
+	cfg := DefaultDialConfig()
+	cfg.Retry.Attempts = 1
+	conn, err := NewDialer(cfg).DialContext(WithDialTarget(context.Background(), "169.254.169.254"), "tcp", "169.254.169.254:80")
+	if err == nil {
+		conn.Close()
+	}
+	if !errors.Is(err, ErrDestinationDenied) {
+		t.Fatalf("expected %v, got %v", ErrDestinationDenied, err)
+	}
+}
+
+func TestDialerIPFilter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addr := l.Addr().String()
+
+	lo, _ := ParseIPRange("loopback")
+	d := NewDialer(&DialConfig{
+		DenyIPs: []IPRange{lo},
+		RedirectFunc: func(network, address string) (string, string) {
+			if address == "redirect.example.com:80" {
+				return network, addr
+			}
+			return network, address
+		},
+	})
+
+	dial := func(ctx context.Context, address string) error {
+		conn, err := d.DialContext(ctx, "tcp", address)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	t.Run("target", func(t *testing.T) {
+		if err := dial(WithDialTarget(context.Background(), "127.0.0.1"), addr); !errors.Is(err, ErrDestinationDenied) {
+			t.Fatalf("expected %v, got %v", ErrDestinationDenied, err)
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		ctx := WithDialTarget(context.Background(), "redirect.example.com")
+		if err := dial(ctx, "redirect.example.com:80"); !errors.Is(err, ErrDestinationDenied) {
+			t.Fatalf("expected %v, got %v", ErrDestinationDenied, err)
+		}
+	})
+
+	t.Run("upstream proxy", func(t *testing.T) {
+		if err := dial(WithDialTarget(context.Background(), "example.com"), addr); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("not marked", func(t *testing.T) {
+		if err := dial(context.Background(), addr); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestHTTPProxyIPFilter(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	lo, _ := ParseIPRange("loopback")
+	tcfg := DefaultHTTPTransportConfig()
+	tcfg.DenyIPs = []IPRange{lo}
+	rt, err := NewHTTPTransport(tcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	h, err := NewHTTPProxyHandler(cfg, nil, nil, rt, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodConnect} {
+		t.Run(method, func(t *testing.T) {
+			target := s.URL
+			if method == http.MethodConnect {
+				target = s.Listener.Addr().String()
+			}
+			req := httptest.NewRequest(method, target, http.NoBody)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			res := rw.Result()
+			if res.StatusCode != http.StatusForbidden {
+				t.Fatalf("expected %d, got %d", http.StatusForbidden, res.StatusCode)
+			}
+			if got := res.Header.Get(ErrorLabelHeader); got != deniedLabel {
+				t.Fatalf("expected label %q, got %q", deniedLabel, got)
+			}
+		})
+	}
+}
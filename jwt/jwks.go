@@ -0,0 +1,170 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Key is a public key from a key set.
+type Key struct {
+	ID string
+	// Alg is the algorithm the key is restricted to, if empty the algorithm is derived from the key type.
+	Alg    string
+	Public crypto.PublicKey
+}
+
+// KeySet is a set of public keys used to verify tokens.
+type KeySet struct {
+	Keys []*Key
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseKeySet parses a JSON Web Key Set.
+// Keys of unsupported types or with use other than sig are skipped,
+// it is an error if the set contains no supported keys.
+func ParseKeySet(b []byte) (*KeySet, error) {
+	var v struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	ks := new(KeySet)
+	for i, k := range v.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %d: %w", i, err)
+		}
+		if pub == nil {
+			continue
+		}
+		ks.Keys = append(ks.Keys, &Key{ID: k.Kid, Alg: k.Alg, Public: pub})
+	}
+	if len(ks.Keys) == 0 {
+		return nil, errors.New("jwks: no supported keys")
+	}
+
+	return ks, nil
+}
+
+// publicKey returns the public key or nil if the key type is not supported.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %w", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("e: out of range")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil //nolint:nilnil // unsupported curve
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if _, err := pub.ECDH(); err != nil {
+			return nil, fmt.Errorf("invalid P-256 point: %w", err)
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil //nolint:nilnil // unsupported curve
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("x: invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, nil //nolint:nilnil // unsupported key type
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// lookup returns the keys that can verify tokens with the kid and alg header values.
+// If kid is empty, all keys usable with alg are returned.
+func (ks *KeySet) lookup(kid, alg string) []*Key {
+	var keys []*Key
+	for _, k := range ks.Keys {
+		if kid != "" && k.ID != kid {
+			continue
+		}
+		if k.Alg != "" && k.Alg != alg {
+			continue
+		}
+		if keyAlg(k.Public) != alg {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func keyAlg(pub crypto.PublicKey) string {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return RS256
+	case *ecdsa.PublicKey:
+		return ES256
+	case ed25519.PublicKey:
+		return EdDSA
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package jwt implements verification of JSON Web Tokens (RFC 7519) in the JWS compact serialization
+// signed with RS256, ES256 or EdDSA, using keys from a JSON Web Key Set (RFC 7517).
+// Encrypted tokens and other algorithms are not supported.
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Supported signature algorithms.
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+var (
+	ErrMalformed        = errors.New("jwt: malformed token")
+	ErrUnsupportedAlg   = errors.New("jwt: unsupported algorithm")
+	ErrUnknownKey       = errors.New("jwt: unknown signing key")
+	ErrInvalidSignature = errors.New("jwt: invalid signature")
+	ErrExpired          = errors.New("jwt: token is expired")
+	ErrMissingExpiry    = errors.New("jwt: token has no exp claim")
+	ErrNotValidYet      = errors.New("jwt: token is not valid yet")
+	ErrInvalidAudience  = errors.New("jwt: invalid audience")
+)
+
+// Header is the JOSE header of a token.
+type Header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Claims are the token claims, the values are decoded with encoding/json.
+type Claims map[string]any
+
+// String returns the claim as a string, numbers are formatted without exponent.
+func (c Claims) String(name string) string {
+	switch v := c[name].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		return ""
+	}
+}
+
+// Strings returns the claim as a list of strings, a single string is returned as a list of one element.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		ss := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	default:
+		return nil
+	}
+}
+
+// Time returns a NumericDate claim.
+func (c Claims) Time(name string) (time.Time, bool) {
+	n, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+}
+
+// Validate checks the exp and nbf claims at now, allowing leeway for clock skew,
+// and if audience is not empty, that the aud claim contains one of the audiences.
+// Tokens without the exp claim are rejected.
+func (c Claims) Validate(now time.Time, leeway time.Duration, audience []string) error {
+	exp, ok := c.Time("exp")
+	if !ok {
+		return ErrMissingExpiry
+	}
+	if !now.Before(exp.Add(leeway)) {
+		return ErrExpired
+	}
+	if nbf, ok := c.Time("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return ErrNotValidYet
+	}
+	if len(audience) > 0 && !slices.ContainsFunc(c.Strings("aud"), func(aud string) bool {
+		return slices.Contains(audience, aud)
+	}) {
+		return ErrInvalidAudience
+	}
+	return nil
+}
+
+// Parse verifies the token signature with a key from the key set and returns the claims.
+// The claims are not validated, see Claims.Validate.
+func Parse(token string, ks *KeySet) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var h Header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return nil, err
+	}
+	switch h.Alg {
+	case RS256, ES256, EdDSA:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlg, h.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	signed := token[:len(parts[0])+1+len(parts[1])]
+
+	keys := ks.lookup(h.Kid, h.Alg)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: kid %q", ErrUnknownKey, h.Kid)
+	}
+	if !slices.ContainsFunc(keys, func(k *Key) bool { return verify(k.Public, h.Alg, signed, sig) }) {
+		return nil, ErrInvalidSignature
+	}
+
+	var c Claims
+	if err := decodeJSON(parts[1], &c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func decodeJSON(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ErrMalformed
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	return nil
+}
+
+func verify(pub crypto.PublicKey, alg, signed string, sig []byte) bool {
+	switch alg {
+	case RS256:
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		h := sha256.Sum256([]byte(signed))
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil
+	case ES256:
+		k, ok := pub.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		h := sha256.Sum256([]byte(signed))
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, h[:], r, s)
+	case EdDSA:
+		k, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(k, []byte(signed), sig)
+	default:
+		return false
+	}
+}
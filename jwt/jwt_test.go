@@ -0,0 +1,187 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package jwt_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/jwt"
+	"github.com/saucelabs/forwarder/jwt/jwttest"
+)
+
+func TestParse(t *testing.T) {
+	iss, err := jwttest.NewIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := jwt.ParseKeySet(iss.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ks.Keys) != 3 {
+		t.Fatalf("expected 3 keys, got %d", len(ks.Keys))
+	}
+
+	for _, alg := range []string{jwt.RS256, jwt.ES256, jwt.EdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			c, err := jwt.Parse(iss.Token(alg, map[string]any{"sub": "alice", "n": 12345678901}), ks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.String("sub") != "alice" {
+				t.Fatalf("unexpected sub %q", c.String("sub"))
+			}
+			if c.String("n") != "12345678901" {
+				t.Fatalf("unexpected n %q", c.String("n"))
+			}
+		})
+	}
+
+	t.Run("invalid signature", func(t *testing.T) {
+		tok := iss.Token(jwt.ES256, map[string]any{"sub": "alice"})
+		other := iss.Token(jwt.ES256, map[string]any{"sub": "bob"})
+		tok = tok[:strings.LastIndexByte(tok, '.')] + other[strings.LastIndexByte(other, '.'):]
+		if _, err := jwt.Parse(tok, ks); !errors.Is(err, jwt.ErrInvalidSignature) {
+			t.Fatalf("expected %v, got %v", jwt.ErrInvalidSignature, err)
+		}
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		other, err := jwttest.NewIssuer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := jwt.Parse(other.Token(jwt.EdDSA, map[string]any{}), ks); !errors.Is(err, jwt.ErrInvalidSignature) {
+			t.Fatalf("expected %v, got %v", jwt.ErrInvalidSignature, err)
+		}
+	})
+
+	t.Run("alg none", func(t *testing.T) {
+		// {"alg":"none"}.{"sub":"alice"}.
+		if _, err := jwt.Parse("eyJhbGciOiJub25lIn0.eyJzdWIiOiJhbGljZSJ9.", ks); !errors.Is(err, jwt.ErrUnsupportedAlg) {
+			t.Fatalf("expected %v, got %v", jwt.ErrUnsupportedAlg, err)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		if _, err := jwt.Parse("foo.bar", ks); !errors.Is(err, jwt.ErrMalformed) {
+			t.Fatalf("expected %v, got %v", jwt.ErrMalformed, err)
+		}
+	})
+}
+
+func TestClaimsValidate(t *testing.T) {
+	iss, err := jwttest.NewIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := jwt.ParseKeySet(iss.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	exp := now.Add(time.Minute).Unix()
+	tests := []struct {
+		name     string
+		claims   map[string]any
+		audience []string
+		err      error
+	}{
+		{
+			name:   "valid",
+			claims: map[string]any{"exp": now.Add(time.Minute).Unix(), "nbf": now.Unix()},
+		},
+		{
+			name:   "expired",
+			claims: map[string]any{"exp": now.Add(-time.Minute).Unix()},
+			err:    jwt.ErrExpired,
+		},
+		{
+			name:   "expired within leeway",
+			claims: map[string]any{"exp": now.Add(-time.Second).Unix()},
+		},
+		{
+			name:   "not valid yet",
+			claims: map[string]any{"exp": exp, "nbf": now.Add(time.Minute).Unix()},
+			err:    jwt.ErrNotValidYet,
+		},
+		{
+			name:     "audience",
+			claims:   map[string]any{"exp": exp, "aud": []string{"a", "forwarder"}},
+			audience: []string{"forwarder"},
+		},
+		{
+			name:     "audience string",
+			claims:   map[string]any{"exp": exp, "aud": "forwarder"},
+			audience: []string{"forwarder"},
+		},
+		{
+			name:     "invalid audience",
+			claims:   map[string]any{"exp": exp, "aud": "other"},
+			audience: []string{"forwarder"},
+			err:      jwt.ErrInvalidAudience,
+		},
+		{
+			name:   "no expiry",
+			claims: map[string]any{},
+			err:    jwt.ErrMissingExpiry,
+		},
+		{
+			name:     "no audience",
+			claims:   map[string]any{"exp": exp},
+			audience: []string{"forwarder"},
+			err:      jwt.ErrInvalidAudience,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := jwt.Parse(iss.Token(jwt.RS256, tc.claims), ks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Validate(now, 5*time.Second, tc.audience); !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestParseKeySet(t *testing.T) {
+	tests := []struct {
+		name string
+		jwks string
+		keys int
+	}{
+		{"skip unsupported", `{"keys":[{"kty":"oct","k":"AAAA"},{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}]}`, 1},
+		{"skip encryption", `{"keys":[{"kty":"OKP","use":"enc","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}]}`, 0},
+		{"invalid EC point", `{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`, 0},
+		{"invalid json", `{`, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ks, err := jwt.ParseKeySet([]byte(tc.jwks))
+			if tc.keys == 0 {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ks.Keys) != tc.keys {
+				t.Fatalf("expected %d keys, got %d", tc.keys, len(ks.Keys))
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package jwttest provides a token issuer with RS256, ES256 and EdDSA keys for testing.
+package jwttest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+
+	"github.com/saucelabs/forwarder/jwt"
+)
+
+// Issuer signs tokens with one key per algorithm, the key ID is the algorithm name.
+type Issuer struct {
+	rsa     *rsa.PrivateKey
+	ecdsa   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+// NewIssuer generates the issuer keys.
+func NewIssuer() (*Issuer, error) {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	_, dk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{rsa: rk, ecdsa: ek, ed25519: dk}, nil
+}
+
+// JWKS returns the JSON Web Key Set with the issuer public keys.
+func (i *Issuer) JWKS() []byte {
+	enc := base64.RawURLEncoding.EncodeToString
+	keys := []map[string]string{
+		{
+			"kty": "RSA",
+			"kid": jwt.RS256,
+			"alg": jwt.RS256,
+			"n":   enc(i.rsa.N.Bytes()),
+			"e":   enc(big.NewInt(int64(i.rsa.E)).Bytes()),
+		},
+		{
+			"kty": "EC",
+			"kid": jwt.ES256,
+			"crv": "P-256",
+			"x":   enc(i.ecdsa.X.FillBytes(make([]byte, 32))),
+			"y":   enc(i.ecdsa.Y.FillBytes(make([]byte, 32))),
+		},
+		{
+			"kty": "OKP",
+			"kid": jwt.EdDSA,
+			"crv": "Ed25519",
+			"x":   enc(i.ed25519.Public().(ed25519.PublicKey)),
+		},
+	}
+	b, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Token returns a token with the claims signed with the key for alg.
+func (i *Issuer) Token(alg string, claims map[string]any) string {
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			panic(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	signed := enc(jwt.Header{Alg: alg, Kid: alg, Typ: "JWT"}) + "." + enc(claims)
+	h := sha256.Sum256([]byte(signed))
+
+	var (
+		sig []byte
+		err error
+	)
+	switch alg {
+	case jwt.RS256:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, i.rsa, crypto.SHA256, h[:])
+	case jwt.ES256:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, i.ecdsa, h[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case jwt.EdDSA:
+		sig = ed25519.Sign(i.ed25519, []byte(signed))
+	default:
+		panic("unsupported algorithm " + alg)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
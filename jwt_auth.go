@@ -0,0 +1,249 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/elastic/go-freelru"
+	"github.com/saucelabs/forwarder/jwt"
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+// JWTAuthConfig configures authentication of proxy clients with JWTs
+// sent in the Proxy-Authorization header with the Bearer scheme.
+type JWTAuthConfig struct {
+	// JWKS is the location of the JSON Web Key Set used to verify token signatures,
+	// it can be a local file, http or https URL or base64 encoded data.
+	JWKS *url.URL
+
+	// JWKSRefreshInterval is the interval between refreshes of the key set.
+	// Zero disables refreshing.
+	JWKSRefreshInterval time.Duration
+
+	// Audience if not empty, the token aud claim must contain one of the values.
+	Audience []string
+
+	// Leeway is the allowed clock skew when checking the exp and nbf claims.
+	Leeway time.Duration
+
+	// MaxLifetime if positive, rejects tokens that expire later than MaxLifetime from now.
+	MaxLifetime time.Duration
+
+	// CacheSize is the maximum number of verified tokens cached until they expire, zero disables caching.
+	CacheSize uint32
+
+	// UserClaim is the claim used as the authenticated user name.
+	UserClaim string
+
+	// SessionClaim is the claim with the session ID, it is prepended to the request trace ID.
+	SessionClaim string
+
+	// DomainsClaim is the claim with the list of domains the client can access, in the --deny-domains syntax.
+	// If the token does not have the claim, all domains are allowed.
+	DomainsClaim string
+
+	// UpstreamClaim is the claim with the upstream proxy URL or proxy chain for the client requests.
+	// If the token does not have the claim, the upstream proxy is selected as usual.
+	UpstreamClaim string
+}
+
+func DefaultJWTAuthConfig() *JWTAuthConfig {
+	return &JWTAuthConfig{
+		JWKSRefreshInterval: 10 * time.Minute,
+		Leeway:              30 * time.Second,
+		CacheSize:           10000,
+		UserClaim:           "sub",
+		SessionClaim:        "sid",
+		DomainsClaim:        "allowed_domains",
+		UpstreamClaim:       "upstream",
+	}
+}
+
+// JWTAuth verifies JWTs with keys loaded from JWTAuthConfig.JWKS.
+// The key set is periodically refreshed by Run, if it cannot be fetched or parsed the last good key set is used.
+// Sessions of verified tokens are cached until the tokens expire or the key set changes.
+type JWTAuth struct {
+	config  JWTAuthConfig
+	fetcher urlFetcher
+	log     log.Logger
+	now     func() time.Time
+
+	keys  atomic.Pointer[jwt.KeySet]
+	cache *freelru.SyncedLRU[string, *jwtSession]
+}
+
+// NewJWTAuth loads the key set and returns a JWTAuth.
+func NewJWTAuth(cfg *JWTAuthConfig, rt http.RoundTripper, log log.Logger) (*JWTAuth, error) {
+	if cfg.JWKS == nil {
+		return nil, errors.New("JWKS URL is required")
+	}
+	if cfg.UserClaim == "" {
+		return nil, errors.New("user claim is required")
+	}
+
+	a := &JWTAuth{
+		config:  *cfg,
+		fetcher: urlFetcher{url: cfg.JWKS, rt: rt},
+		log:     log,
+		now:     time.Now,
+	}
+	if cfg.CacheSize > 0 {
+		c, err := freelru.NewSynced[string, *jwtSession](cfg.CacheSize, func(k string) uint32 {
+			return uint32(xxhash.Sum64String(k)) //nolint:gosec // no overflow
+		})
+		if err != nil {
+			return nil, err
+		}
+		a.cache = c
+	}
+
+	if _, err := a.Refresh(context.Background()); err != nil {
+		return nil, fmt.Errorf("load JWKS: %w", err)
+	}
+
+	return a, nil
+}
+
+// Run refreshes the key set every JWKSRefreshInterval until the context is canceled.
+// Refresh errors are logged and the last good key set is kept.
+func (a *JWTAuth) Run(ctx context.Context) error {
+	return a.fetcher.runRefresh(ctx, a.config.JWKSRefreshInterval, "JWKS", a.Refresh, a.log)
+}
+
+// Refresh fetches and parses the key set, and swaps it in if it has changed.
+// It returns true if the key set was updated.
+// On error the current key set is kept.
+func (a *JWTAuth) Refresh(ctx context.Context) (bool, error) {
+	b, v, err := a.fetcher.fetch(ctx)
+	if err != nil {
+		return false, err
+	}
+	if b == nil {
+		a.fetcher.commit(v)
+		return false, nil
+	}
+
+	ks, err := jwt.ParseKeySet(b)
+	if err != nil {
+		return false, err
+	}
+	a.fetcher.commit(v)
+	a.keys.Store(ks)
+	// Tokens signed with removed keys must be verified again.
+	if a.cache != nil {
+		a.cache.Purge()
+	}
+
+	return true, nil
+}
+
+// jwtSession is the client session described by a verified token.
+type jwtSession struct {
+	User string
+	ID   string
+	// Domains if not nil, are the domains the client can access.
+	Domains Matcher
+	// Upstream if not nil, is the proxy chain for the client requests.
+	Upstream []*url.URL
+
+	expires time.Time
+}
+
+// bearerToken returns the token from the Proxy-Authorization header if the scheme is Bearer.
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// authenticate returns the session of the token, from the cache if possible.
+func (a *JWTAuth) authenticate(token string) (*jwtSession, error) {
+	now := a.now()
+	if a.cache != nil {
+		if s, ok := a.cache.Get(token); ok {
+			if now.Before(s.expires) {
+				return s, nil
+			}
+			a.cache.Remove(token)
+			return nil, jwt.ErrExpired
+		}
+	}
+
+	s, err := a.verify(token, now)
+	if err != nil {
+		return nil, err
+	}
+	if a.cache != nil {
+		a.cache.AddWithLifetime(token, s, s.expires.Sub(now))
+	}
+	return s, nil
+}
+
+// verify verifies the token and maps its claims to the session.
+func (a *JWTAuth) verify(token string, now time.Time) (*jwtSession, error) {
+	c, err := jwt.Parse(token, a.keys.Load())
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Validate(now, a.config.Leeway, a.config.Audience); err != nil {
+		return nil, err
+	}
+	exp, _ := c.Time("exp")
+	if a.config.MaxLifetime > 0 && exp.Sub(now) > a.config.MaxLifetime+a.config.Leeway {
+		return nil, fmt.Errorf("jwt: token lifetime exceeds %s", a.config.MaxLifetime)
+	}
+
+	s := &jwtSession{
+		User:    c.String(a.config.UserClaim),
+		expires: exp.Add(a.config.Leeway),
+	}
+	if s.User == "" {
+		return nil, fmt.Errorf("jwt: missing %s claim", a.config.UserClaim)
+	}
+	if a.config.SessionClaim != "" {
+		s.ID = c.String(a.config.SessionClaim)
+	}
+
+	if _, ok := c[a.config.DomainsClaim]; ok && a.config.DomainsClaim != "" {
+		var items []ruleset.ListItem
+		for _, d := range c.Strings(a.config.DomainsClaim) {
+			li, err := ruleset.ParseListItem(d)
+			if err != nil {
+				return nil, fmt.Errorf("jwt: %s claim: %w", a.config.DomainsClaim, err)
+			}
+			items = append(items, li)
+		}
+		m, err := ruleset.NewMatcherFromList(items)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %s claim: %w", a.config.DomainsClaim, err)
+		}
+		s.Domains = m
+	}
+
+	if v := c.String(a.config.UpstreamClaim); v != "" && a.config.UpstreamClaim != "" {
+		chain, err := ParseProxyChain(v)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %s claim: %w", a.config.UpstreamClaim, err)
+		}
+		s.Upstream = chain
+	}
+
+	return s, nil
+}
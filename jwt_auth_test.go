@@ -0,0 +1,285 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/jwt"
+	"github.com/saucelabs/forwarder/jwt/jwttest"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestJWTAuthRefresh(t *testing.T) {
+	iss, err := jwttest.NewIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwks atomic.Pointer[[]byte]
+	b := iss.JWKS()
+	jwks.Store(&b)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(*jwks.Load())
+	}))
+	defer s.Close()
+
+	cfg := DefaultJWTAuthConfig()
+	cfg.JWKS, _ = url.Parse(s.URL)
+	a, err := NewJWTAuth(cfg, http.DefaultTransport, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := jwttest.NewIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := other.Token(jwt.EdDSA, map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := a.authenticate(tok); err == nil {
+		t.Fatal("expected error")
+	}
+
+	b = other.JWKS()
+	jwks.Store(&b)
+	if _, err := a.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.authenticate(tok); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := []byte("{")
+	jwks.Store(&bad)
+	if _, err := a.Refresh(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := a.authenticate(tok); err != nil {
+		t.Fatalf("expected last good key set to be used, got %v", err)
+	}
+}
+
+func TestJWTAuthCache(t *testing.T) {
+	iss, err := jwttest.NewIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, iss.JWKS(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultJWTAuthConfig()
+	cfg.JWKS = &url.URL{Scheme: "file", Path: jwksFile}
+	cfg.Leeway = 0
+	cfg.MaxLifetime = time.Hour
+	a, err := NewJWTAuth(cfg, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	t.Run("no expiry", func(t *testing.T) {
+		if _, err := a.authenticate(iss.Token(jwt.ES256, map[string]any{"sub": "alice"})); !errors.Is(err, jwt.ErrMissingExpiry) {
+			t.Fatalf("expected %v, got %v", jwt.ErrMissingExpiry, err)
+		}
+	})
+
+	t.Run("max lifetime", func(t *testing.T) {
+		if _, err := a.authenticate(iss.Token(jwt.ES256, map[string]any{"sub": "alice", "exp": now.Add(2 * time.Hour).Unix()})); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("cached until expiry", func(t *testing.T) {
+		tok := iss.Token(jwt.ES256, map[string]any{"sub": "alice", "exp": now.Add(time.Minute).Unix()})
+		s1, err := a.authenticate(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s2, err := a.authenticate(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s1 != s2 {
+			t.Fatal("expected cached session")
+		}
+
+		now = now.Add(2 * time.Minute)
+		defer func() { now = now.Add(-2 * time.Minute) }()
+		if _, err := a.authenticate(tok); !errors.Is(err, jwt.ErrExpired) {
+			t.Fatalf("expected %v, got %v", jwt.ErrExpired, err)
+		}
+	})
+
+	t.Run("purged on key set change", func(t *testing.T) {
+		tok := iss.Token(jwt.ES256, map[string]any{"sub": "alice", "exp": now.Add(time.Minute).Unix()})
+		if _, err := a.authenticate(tok); err != nil {
+			t.Fatal(err)
+		}
+
+		other, err := jwttest.NewIssuer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(jwksFile, other.JWKS(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(time.Second)
+		if err := os.Chtimes(jwksFile, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.authenticate(tok); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestHTTPProxyJWTAuth(t *testing.T) {
+	iss, err := jwttest.NewIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "corp")
+	}))
+	defer upstream.Close()
+
+	jcfg := DefaultJWTAuthConfig()
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, iss.JWKS(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	jcfg.JWKS = &url.URL{Scheme: "file", Path: jwksFile}
+	jcfg.Audience = []string{"forwarder"}
+	a, err := NewJWTAuth(jcfg, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Address = "localhost:0"
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.JWTAuth = a
+
+	p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	addrs, _ := p.Addr()
+	proxyURL := &url.URL{Scheme: "http", Host: addrs[0]}
+
+	get := func(t *testing.T, claims map[string]any) (*http.Response, string) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, backend.URL, http.NoBody)
+		req.RequestURI = ""
+		req.Header.Set("Accept", "application/json")
+		if claims != nil {
+			req.Header.Set("Proxy-Authorization", "Bearer "+iss.Token(jwt.ES256, claims))
+		}
+
+		tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+		defer tr.CloseIdleConnections()
+
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+
+	t.Run("valid", func(t *testing.T) {
+		res, _ := get(t, map[string]any{"sub": "alice", "aud": "forwarder", "exp": exp})
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, res.StatusCode)
+		}
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		res, _ := get(t, nil)
+		if res.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("expected %d, got %d", http.StatusProxyAuthRequired, res.StatusCode)
+		}
+		if got := res.Header.Get("Proxy-Authenticate"); !strings.HasPrefix(got, "Bearer ") {
+			t.Fatalf("expected Bearer challenge, got %q", got)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		res, _ := get(t, map[string]any{"sub": "alice", "aud": "forwarder", "exp": time.Now().Add(-time.Hour).Unix()})
+		if res.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("expected %d, got %d", http.StatusProxyAuthRequired, res.StatusCode)
+		}
+	})
+
+	t.Run("invalid audience", func(t *testing.T) {
+		res, _ := get(t, map[string]any{"sub": "alice", "aud": "other", "exp": exp})
+		if res.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("expected %d, got %d", http.StatusProxyAuthRequired, res.StatusCode)
+		}
+	})
+
+	t.Run("domains", func(t *testing.T) {
+		res, _ := get(t, map[string]any{"sub": "alice", "aud": "forwarder", "exp": exp, "allowed_domains": []string{"127.0.0.1"}})
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, res.StatusCode)
+		}
+	})
+
+	t.Run("domains denied", func(t *testing.T) {
+		res, body := get(t, map[string]any{
+			"sub":             "alice",
+			"sid":             "sess-1",
+			"aud":             "forwarder",
+			"exp":             exp,
+			"allowed_domains": []string{"example.com"},
+		})
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected %d, got %d", http.StatusForbidden, res.StatusCode)
+		}
+		if !strings.Contains(body, `"trace_id": "sess-1/`) {
+			t.Fatalf("expected session ID in trace ID, got %q", body)
+		}
+	})
+
+	t.Run("upstream", func(t *testing.T) {
+		res, _ := get(t, map[string]any{"sub": "alice", "aud": "forwarder", "exp": exp, "upstream": upstream.URL})
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, res.StatusCode)
+		}
+		if got := res.Header.Get("X-Upstream"); got != "corp" {
+			t.Fatalf("expected request to be routed to upstream, got %q", got)
+		}
+	})
+}
@@ -6,6 +6,8 @@
 
 package forwarder
 
+import "net/url"
+
 type Matcher interface {
 	Match(string) bool
 }
@@ -15,3 +17,32 @@ type MatchFunc func(string) bool
 func (m MatchFunc) Match(s string) bool {
 	return m(s)
 }
+
+// HostPortMatcher is implemented by matchers that take the port into account, i.e. ruleset.Matcher.
+// The proxy uses it instead of Match if available, port is empty if it is not known.
+type HostPortMatcher interface {
+	MatchHostPort(host, port string) bool
+}
+
+// matchURL matches the URL host name with m, and port if m implements HostPortMatcher.
+func matchURL(m Matcher, u *url.URL) bool {
+	if hpm, ok := m.(HostPortMatcher); ok {
+		return hpm.MatchHostPort(u.Hostname(), urlPort(u))
+	}
+	return m.Match(u.Hostname())
+}
+
+// urlPort returns the URL port or the default port for the scheme, or empty string if unknown.
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		return "80"
+	case "https", "wss":
+		return "443"
+	default:
+		return ""
+	}
+}
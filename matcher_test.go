@@ -0,0 +1,52 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+func TestMatchURL(t *testing.T) {
+	item, err := ruleset.ParseListItem("host:example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ruleset.NewMatcherFromList([]ruleset.ListItem{item})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url   string
+		match bool
+	}{
+		{"https://example.com", true},
+		{"https://example.com:443", true},
+		{"wss://foo.example.com/ws", true},
+		{"http://example.com", false},
+		{"https://example.com:8443", false},
+	}
+	for _, tc := range tests {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := matchURL(m, u); got != tc.match {
+			t.Errorf("%s: expected %v, got %v", tc.url, tc.match, got)
+		}
+	}
+
+	// Matchers that do not implement HostPortMatcher get the host name only.
+	var got string
+	matchURL(MatchFunc(func(s string) bool { got = s; return true }), &url.URL{Scheme: "https", Host: "example.com:443"})
+	if got != "example.com" {
+		t.Errorf("expected host name, got %q", got)
+	}
+}
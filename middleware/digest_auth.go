@@ -0,0 +1,224 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/elastic/go-freelru"
+	"github.com/saucelabs/forwarder/digest"
+)
+
+// DigestAuth implements HTTP Digest Access Authentication (RFC 7616) with server side nonce management.
+// Nonces are valid for NonceTTL, and the nonce count sent by the client must increase with every request
+// to protect against replay attacks.
+// When a nonce expires, the client is challenged with stale=true and can retry without prompting the user.
+type DigestAuth struct {
+	header          string
+	challengeHeader string
+
+	Realm string
+	// NonceTTL is the maximum amount of time a nonce can be used.
+	NonceTTL time.Duration
+	// MaxNonces is the maximum number of active nonces, the oldest nonces are evicted when the limit is reached.
+	// It must be set before the first challenge.
+	MaxNonces int
+
+	key    [32]byte
+	opaque string
+
+	mu     sync.Mutex
+	nonces *freelru.LRU[string, *digestNonce]
+}
+
+type digestNonce struct {
+	created time.Time
+	nc      uint64
+}
+
+func NewDigestAuth(realm string) *DigestAuth {
+	return newDigestAuth(AuthorizationHeader, "WWW-Authenticate", realm)
+}
+
+func NewProxyDigestAuth(realm string) *DigestAuth {
+	return newDigestAuth(ProxyAuthorizationHeader, "Proxy-Authenticate", realm)
+}
+
+func newDigestAuth(header, challengeHeader, realm string) *DigestAuth {
+	da := &DigestAuth{
+		header:          header,
+		challengeHeader: challengeHeader,
+		Realm:           realm,
+		NonceTTL:        5 * time.Minute,
+		MaxNonces:       100000,
+	}
+	rand.Read(da.key[:])
+	var opaque [16]byte
+	rand.Read(opaque[:])
+	da.opaque = base64.RawURLEncoding.EncodeToString(opaque[:])
+	return da
+}
+
+// AuthenticatedRequest parses the provided HTTP request for Digest Authentication credentials
+// and returns true if the credentials match the expected username and password.
+// If the credentials are valid but the nonce is expired, stale is true.
+func (da *DigestAuth) AuthenticatedRequest(r *http.Request, expectedUser, expectedPass string) (ok, stale bool) {
+	cr, err := digest.ParseCredentials(r.Header.Get(da.header))
+	if err != nil {
+		return false, false
+	}
+	if subtle.ConstantTimeCompare([]byte(cr.Username), []byte(expectedUser)) != 1 ||
+		cr.Realm != da.Realm || cr.Opaque != da.opaque || !digestURIMatches(r, cr.URI) {
+		return false, false
+	}
+	if !cr.Verify(r.Method, expectedPass) {
+		return false, false
+	}
+
+	return da.useNonce(cr)
+}
+
+// digestURIMatches returns true if uri is the request target in any of the forms sent by clients.
+func digestURIMatches(r *http.Request, uri string) bool {
+	switch uri {
+	case r.RequestURI, r.URL.RequestURI(), r.URL.String():
+		return uri != ""
+	}
+	return r.Method == http.MethodConnect && (uri == r.Host || uri == r.URL.Host)
+}
+
+// useNonce checks the nonce and the nonce count, and records the nonce count.
+func (da *DigestAuth) useNonce(cr *digest.Credentials) (ok, stale bool) {
+	created, valid := da.verifyNonce(cr.Nonce)
+	if !valid {
+		return false, false
+	}
+	now := time.Now()
+	if now.Sub(created) > da.NonceTTL {
+		return false, true
+	}
+
+	// RFC 2069 clients do not send nonce count, the nonce can be used once.
+	var nc uint64 = 1
+	if cr.QOP != "" {
+		var err error
+		if nc, err = strconv.ParseUint(cr.NC, 16, 32); err != nil {
+			return false, false
+		}
+	}
+
+	da.mu.Lock()
+	defer da.mu.Unlock()
+
+	if da.nonces == nil {
+		return false, true
+	}
+	n, found := da.nonces.Get(cr.Nonce)
+	if !found {
+		// The nonce was evicted, or issued before the restart.
+		return false, true
+	}
+	if nc <= n.nc {
+		return false, false
+	}
+	n.nc = nc
+	return true, false
+}
+
+// Challenge sets the challenge headers on h, SHA-256 is offered first and MD5 for legacy clients.
+func (da *DigestAuth) Challenge(h http.Header, stale bool) {
+	nonce := da.newNonce()
+	for _, alg := range []digest.Algorithm{digest.SHA256, digest.MD5} {
+		c := digest.Challenge{
+			Realm:     da.Realm,
+			Nonce:     nonce,
+			Opaque:    da.opaque,
+			Algorithm: alg,
+			QOP:       []string{"auth"},
+			Stale:     stale,
+		}
+		h.Add(da.challengeHeader, c.String())
+	}
+}
+
+// newNonce returns a new nonce, it consists of the creation time, random bytes and HMAC of both.
+func (da *DigestAuth) newNonce() string {
+	now := time.Now()
+
+	b := make([]byte, 16, 48)
+	binary.BigEndian.PutUint64(b, uint64(now.UnixNano())) //nolint:gosec // time after 1970
+	rand.Read(b[8:])
+	b = da.nonceMAC(b)
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+
+	da.mu.Lock()
+	defer da.mu.Unlock()
+
+	if da.nonces == nil {
+		c, err := freelru.New[string, *digestNonce](uint32(max(da.MaxNonces, 1)), hashNonce) //nolint:gosec // no overflow
+		if err != nil {
+			panic(err)
+		}
+		da.nonces = c
+	}
+	// Expired nonces are evicted by the cache, or replaced by the new ones.
+	da.nonces.AddWithLifetime(nonce, &digestNonce{created: now}, da.NonceTTL)
+
+	return nonce
+}
+
+func (da *DigestAuth) nonceMAC(b []byte) []byte {
+	m := hmac.New(sha256.New, da.key[:])
+	m.Write(b[:16])
+	return m.Sum(b[:16])
+}
+
+// verifyNonce checks that the nonce was issued by this server and returns its creation time.
+func (da *DigestAuth) verifyNonce(nonce string) (time.Time, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 48 {
+		return time.Time{}, false
+	}
+	if !hmac.Equal(da.nonceMAC(append([]byte(nil), b[:16]...)), b) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b))), true //nolint:gosec // verified by HMAC
+}
+
+func hashNonce(nonce string) uint32 {
+	return uint32(xxhash.Sum64String(nonce)) //nolint:gosec // no overflow
+}
+
+// Wrap wraps the handler with Digest Authentication.
+func (da *DigestAuth) Wrap(h http.Handler, expectedUser, expectedPass string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, stale := da.AuthenticatedRequest(r, expectedUser, expectedPass)
+		if !ok {
+			da.Challenge(w.Header(), stale)
+			if da.header == ProxyAuthorizationHeader {
+				w.WriteHeader(http.StatusProxyAuthRequired)
+			} else {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+			return
+		}
+
+		// Do not expose the authentication header to the upstream servers.
+		r.Header.Del(da.header)
+		h.ServeHTTP(w, r)
+	})
+}
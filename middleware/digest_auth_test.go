@@ -0,0 +1,121 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/digest"
+)
+
+func TestDigestAuthWrap(t *testing.T) {
+	da := NewProxyDigestAuth("test")
+
+	h := da.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ProxyAuthorizationHeader) != "" {
+			t.Errorf("auth header should not be forwarded")
+		}
+		w.WriteHeader(http.StatusOK)
+	}), "user", "pass")
+
+	do := func(t *testing.T, auth string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/path?q=1", http.NoBody)
+		if auth != "" {
+			r.Header.Set(ProxyAuthorizationHeader, auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(t, "")
+	if w.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("got %v", w.Code)
+	}
+	values := w.Header().Values("Proxy-Authenticate")
+	if len(values) != 2 {
+		t.Fatalf("expected 2 challenges, got %v", values)
+	}
+	c, ok := digest.SelectChallenge(values)
+	if !ok || c.Algorithm != digest.SHA256 {
+		t.Fatalf("unexpected challenge %v", values)
+	}
+
+	authorize := func(t *testing.T, password string, nc uint32) string {
+		t.Helper()
+		cr, err := digest.Authorize(c, http.MethodGet, "http://example.com/path?q=1", "user", password, nc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cr.String()
+	}
+
+	t.Run("Authenticated", func(t *testing.T) {
+		for nc := uint32(1); nc <= 3; nc++ {
+			if w := do(t, authorize(t, "pass", nc)); w.Code != http.StatusOK {
+				t.Fatalf("nc=%d: got %v", nc, w.Code)
+			}
+		}
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		if w := do(t, authorize(t, "pass", 2)); w.Code != http.StatusProxyAuthRequired {
+			t.Fatalf("got %v", w.Code)
+		}
+	})
+
+	t.Run("Wrong password", func(t *testing.T) {
+		if w := do(t, authorize(t, "wrong", 10)); w.Code != http.StatusProxyAuthRequired {
+			t.Fatalf("got %v", w.Code)
+		}
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		da.NonceTTL = time.Nanosecond
+		defer func() { da.NonceTTL = 5 * time.Minute }()
+		time.Sleep(time.Millisecond)
+
+		w := do(t, authorize(t, "pass", 11))
+		if w.Code != http.StatusProxyAuthRequired {
+			t.Fatalf("got %v", w.Code)
+		}
+		if c, ok := digest.SelectChallenge(w.Header().Values("Proxy-Authenticate")); !ok || !c.Stale {
+			t.Fatalf("expected stale challenge, got %v", w.Header().Values("Proxy-Authenticate"))
+		}
+	})
+
+	t.Run("Forged nonce", func(t *testing.T) {
+		fc := *c
+		fc.Nonce = "AAAA" + c.Nonce[4:]
+		cr, err := digest.Authorize(&fc, http.MethodGet, "http://example.com/path?q=1", "user", "pass", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := do(t, cr.String())
+		if w.Code != http.StatusProxyAuthRequired {
+			t.Fatalf("got %v", w.Code)
+		}
+		if c, _ := digest.SelectChallenge(w.Header().Values("Proxy-Authenticate")); c.Stale {
+			t.Fatal("forged nonce must not be stale")
+		}
+	})
+}
+
+func TestDigestAuthMaxNonces(t *testing.T) {
+	da := NewDigestAuth("test")
+	da.MaxNonces = 2
+	for range 5 {
+		da.Challenge(http.Header{}, false)
+	}
+	if n := da.nonces.Len(); n != 2 {
+		t.Fatalf("expected 2 nonces, got %d", n)
+	}
+}
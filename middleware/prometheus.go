@@ -40,6 +40,7 @@ type Prometheus struct {
 	requestsInFlight *prometheus.GaugeVec
 	requestsTotal    *prometheus.CounterVec
 	requestDuration  *prometheus.SummaryVec
+	phaseDuration    *prometheus.HistogramVec
 	// The following metrics are now removed, revert if needed.
 	// requestSize      *prometheus.SummaryVec
 	// responseSize     *prometheus.SummaryVec
@@ -84,6 +85,13 @@ func NewPrometheus(r prometheus.Registerer, namespace string, opts ...Prometheus
 		Objectives: objectives,
 	}, labelsWithStatus)
 
+	p.phaseDuration = f.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_phase_duration_seconds",
+		Help:      "The duration of HTTP request processing phases in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"phase"})
+
 	return p
 }
 
@@ -127,6 +135,11 @@ func (p *Prometheus) WroteResponse(res *http.Response) {
 	p.requestDuration.WithLabelValues(labelsWithStatus...).Observe(elapsed)
 }
 
+// ObservePhase records the duration of a request processing phase i.e. DNS lookup or TLS handshake.
+func (p *Prometheus) ObservePhase(phase martian.Phase, d time.Duration) {
+	p.phaseDuration.WithLabelValues(phase.String()).Observe(d.Seconds())
+}
+
 func (p *Prometheus) labels(req *http.Request) []string {
 	labels := []string{req.Method}
 	if p.label != "" {
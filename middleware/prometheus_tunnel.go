@@ -0,0 +1,132 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+var tunnelDurationBuckets = []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600}
+
+type TunnelPrometheusOpt func(*TunnelPrometheus)
+
+// WithTunnelHostLabel partitions the tunnel metrics by the destination host name.
+// Use it with care, as the number of hosts may be unbounded.
+func WithTunnelHostLabel() TunnelPrometheusOpt {
+	return func(p *TunnelPrometheus) {
+		p.hostLabel = true
+	}
+}
+
+// TunnelPrometheus collects metrics about CONNECT and upgrade tunnels.
+// It partitions the metrics by tunnel type i.e. CONNECT or the upgrade protocol,
+// and optionally by the destination host name.
+type TunnelPrometheus struct {
+	tunnelsActive   *prometheus.GaugeVec
+	tunnelDuration  *prometheus.HistogramVec
+	tunnelEstablish *prometheus.HistogramVec
+	tunnelBytes     *prometheus.CounterVec
+	connectFailures *prometheus.CounterVec
+
+	hostLabel bool
+}
+
+func NewTunnelPrometheus(r prometheus.Registerer, namespace string, opts ...TunnelPrometheusOpt) *TunnelPrometheus {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+
+	p := &TunnelPrometheus{}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	labels := []string{"type"}
+	if p.hostLabel {
+		labels = append(labels, "host")
+	}
+	labelsWithDirection := append([]string{"direction"}, labels...)
+
+	p.tunnelsActive = f.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "proxy_tunnels_active",
+		Help:      "Current number of open CONNECT and upgrade tunnels.",
+	}, labels)
+
+	p.tunnelDuration = f.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "proxy_tunnel_duration_seconds",
+		Help:      "The amount of time CONNECT and upgrade tunnels were open in seconds.",
+		Buckets:   tunnelDurationBuckets,
+	}, labels)
+
+	p.tunnelEstablish = f.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "proxy_tunnel_establish_duration_seconds",
+		Help:      "The amount of time it took to establish CONNECT and upgrade tunnels in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	}, labels)
+
+	p.tunnelBytes = f.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proxy_tunnel_bytes_total",
+		Help:      "Total number of bytes transferred through CONNECT and upgrade tunnels.",
+	}, labelsWithDirection)
+
+	connectLabels := []string{"reason", "upstream"}
+	if p.hostLabel {
+		connectLabels = append(connectLabels, "host")
+	}
+
+	p.connectFailures = f.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proxy_connect_failures_total",
+		Help:      "Total number of CONNECT requests that failed to establish a tunnel.",
+	}, connectLabels)
+
+	return p
+}
+
+// ConnectFailed records a CONNECT failure with the given reason and upstream proxy host.
+// The upstream should be "direct" if no upstream proxy was used, or "custom" if the connection was made by a custom dialer.
+func (p *TunnelPrometheus) ConnectFailed(req *http.Request, reason, upstream string) {
+	labels := []string{reason, upstream}
+	if p.hostLabel {
+		labels = append(labels, req.URL.Hostname())
+	}
+
+	p.connectFailures.WithLabelValues(labels...).Inc()
+}
+
+func (p *TunnelPrometheus) TunnelOpened(info martian.TunnelOpenedInfo) {
+	labels := p.labels(info.Res.Request, info.Name)
+
+	p.tunnelsActive.WithLabelValues(labels...).Inc()
+	p.tunnelEstablish.WithLabelValues(labels...).Observe(info.Duration.Seconds())
+}
+
+func (p *TunnelPrometheus) TunnelClosed(info martian.TunnelClosedInfo) {
+	labels := p.labels(info.Res.Request, info.Name)
+
+	p.tunnelsActive.WithLabelValues(labels...).Dec()
+	p.tunnelDuration.WithLabelValues(labels...).Observe(info.Duration.Seconds())
+	p.tunnelBytes.WithLabelValues(append([]string{"sent"}, labels...)...).Add(float64(info.BytesSent))
+	p.tunnelBytes.WithLabelValues(append([]string{"received"}, labels...)...).Add(float64(info.BytesReceived))
+}
+
+func (p *TunnelPrometheus) labels(req *http.Request, name string) []string {
+	labels := []string{name}
+	if p.hostLabel {
+		labels = append(labels, req.URL.Hostname())
+	}
+	return labels
+}
@@ -0,0 +1,70 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/utils/golden"
+)
+
+func TestTunnelPrometheus(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []TunnelPrometheusOpt
+	}{
+		{
+			name: "default",
+		},
+		{
+			name: "host",
+			opts: []TunnelPrometheusOpt{WithTunnelHostLabel()},
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			r := prometheus.NewPedanticRegistry()
+			p := NewTunnelPrometheus(r, "test", tc.opts...)
+
+			for _, host := range []string{"saucelabs.com", "example.com"} {
+				req := httptest.NewRequest(http.MethodConnect, host+":443", http.NoBody)
+				res := &http.Response{StatusCode: http.StatusOK, Request: req}
+
+				p.TunnelOpened(martian.TunnelOpenedInfo{
+					Res:      res,
+					Name:     "CONNECT",
+					Duration: 50 * time.Millisecond,
+				})
+				p.TunnelOpened(martian.TunnelOpenedInfo{
+					Res:      res,
+					Name:     "CONNECT",
+					Duration: 200 * time.Millisecond,
+				})
+				p.TunnelClosed(martian.TunnelClosedInfo{
+					Res:           res,
+					Name:          "CONNECT",
+					Reason:        martian.TunnelClosed,
+					Duration:      10 * time.Second,
+					BytesSent:     100,
+					BytesReceived: 1000,
+				})
+
+				p.ConnectFailed(req, "net_dial", "direct")
+				p.ConnectFailed(req, "upstream_status_407", "proxy:3128")
+			}
+
+			golden.DiffPrometheusMetrics(t, r)
+		})
+	}
+}
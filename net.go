@@ -9,8 +9,10 @@ package forwarder
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"slices"
 	"time"
 
@@ -70,6 +72,13 @@ type DialConfig struct {
 	// Retry specifies the number of attempts and backoff duration between them.
 	Retry DialRetryConfig
 
+	// DenyIPs denies connections to proxied destinations that resolve to IP addresses in the ranges.
+	// It is checked after DNS resolution and redirection, dials not marked with WithDialTarget are not affected.
+	DenyIPs []IPRange
+
+	// AllowIPs allows connections to IP addresses in the ranges even if they are in DenyIPs.
+	AllowIPs []IPRange
+
 	PromConfig
 }
 
@@ -81,6 +90,7 @@ func DefaultDialConfig() *DialConfig {
 			Attempts: 3,
 			Backoff:  1 * time.Second,
 		},
+		DenyIPs: DefaultDenyIPs(),
 	}
 }
 
@@ -98,6 +108,8 @@ type dialContextFunc func(ctx context.Context, network, address string) (net.Con
 
 type Dialer struct {
 	nd      net.Dialer
+	fnd     *net.Dialer
+	f       *IPFilter
 	rd      DialRedirectFunc
 	rt      DialRetryConfig
 	metrics *dialerMetrics
@@ -115,12 +127,21 @@ func NewDialer(cfg *DialConfig) *Dialer {
 		},
 	}
 
-	return &Dialer{
+	d := &Dialer{
 		nd:      nd,
 		rd:      cfg.RedirectFunc,
 		rt:      cfg.Retry,
 		metrics: newDialerMetrics(cfg.PromRegistry, cfg.PromNamespace),
 	}
+
+	if f := NewIPFilter(cfg.DenyIPs, cfg.AllowIPs); f != nil {
+		fnd := nd
+		fnd.ControlContext = f.control
+		d.fnd = &fnd
+		d.f = f
+	}
+
+	return d
 }
 
 // DialConnTrack specifies the connection tracking mode for connections dialed by Dialer.
@@ -141,16 +162,19 @@ func WithDialConnTrack(ctx context.Context, track DialConnTrack) context.Context
 
 // DialContext dials the provided network and address and configures OS-specific keep-alive parameters.
 // It tracks dialed and closed connections by default, the behavior can be changed with WithDialConnTrack.
+// If the address is marked with WithDialTarget, the resolved IP address is checked against DenyIPs and AllowIPs.
 func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	var dct DialConnTrack
 	if v, ok := ctx.Value(dialConnTrackKey{}).(DialConnTrack); ok {
 		dct = v
 	}
 
+	filter := d.fnd != nil && isDialTarget(ctx, address)
+
 	if d.rd != nil {
 		network, address = d.rd(network, address)
 	}
-	conn, err := d.dialContext(ctx, network, address)
+	conn, err := d.dialContext(ctx, network, address, filter)
 
 	if dct == DialConnTrackDisabled {
 		return conn, err
@@ -171,10 +195,53 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 	}.Build(conn), nil
 }
 
-func (d *Dialer) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+// CheckDestination returns ErrDestinationDenied if DialContext would deny the address marked with WithDialTarget.
+// The address is redirected and resolved the same way as in DialContext, no connection is made.
+func (d *Dialer) CheckDestination(ctx context.Context, network, address string) error {
+	if d.f == nil {
+		return nil
+	}
+
+	if d.rd != nil {
+		network, address = d.rd(network, address)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	var addrs []netip.Addr
+	if a, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{a}
+	} else {
+		ipNetwork := "ip"
+		switch network {
+		case "tcp4":
+			ipNetwork = "ip4"
+		case "tcp6":
+			ipNetwork = "ip6"
+		}
+		if addrs, err = d.nd.Resolver.LookupNetIP(ctx, ipNetwork, host); err != nil {
+			return err
+		}
+	}
+
+	// The dialer tries the next address if one is denied.
+	for _, a := range addrs {
+		if !d.f.Denied(a) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrDestinationDenied, addrs[0])
+}
+
+func (d *Dialer) dialContext(ctx context.Context, network, address string, filter bool) (net.Conn, error) {
 	var lastErr error
 
 	dial := d.nd.DialContext
+	if filter {
+		dial = d.fnd.DialContext
+	}
 	if d.testingDialContext != nil {
 		dial = d.testingDialContext
 	}
@@ -198,6 +265,10 @@ func (d *Dialer) dialContext(ctx context.Context, network, address string) (net.
 		if conn != nil {
 			conn.Close()
 		}
+
+		if errors.Is(err, ErrDestinationDenied) {
+			break
+		}
 	}
 
 	return nil, lastErr
@@ -220,6 +291,27 @@ type ListenerConfig struct {
 	ReadLimit           SizeSuffix
 	WriteLimit          SizeSuffix
 	TrackTraffic        bool
+
+	// AllowClients if not empty, only clients with addresses in the ranges can connect.
+	AllowClients []IPRange
+	// DenyClients are client address ranges that cannot connect, it takes precedence over AllowClients.
+	DenyClients []IPRange
+}
+
+func (c *ListenerConfig) hasClientFilter() bool {
+	return len(c.AllowClients) > 0 || len(c.DenyClients) > 0
+}
+
+// clientDenied returns true if the client with the given address is not allowed to connect.
+func (c *ListenerConfig) clientDenied(addr net.Addr) bool {
+	a, ok := addrIP(addr)
+	if !ok {
+		return true
+	}
+	if len(c.AllowClients) > 0 && !ipRangesContain(c.AllowClients, a) {
+		return true
+	}
+	return ipRangesContain(c.DenyClients, a)
 }
 
 func DefaultListenerConfig(addr string) *ListenerConfig {
@@ -232,6 +324,10 @@ func DefaultListenerConfig(addr string) *ListenerConfig {
 type NamedListenerConfig struct {
 	Name string
 	ListenerConfig
+
+	// ClientAuth overrides the HTTP proxy TLS client certificate authentication for this listener.
+	// If nil, the proxy ClientAuth is used.
+	ClientAuth *TLSClientAuthConfig
 }
 
 // MultiListener is a builder for multiple listeners sharing the same prometheus configuration.
@@ -256,6 +352,7 @@ func (ml MultiListener) Listen() (_ []net.Listener, ferr error) {
 
 	for _, lc := range ml.ListenerConfigs {
 		l := new(Listener)
+		l.Name = lc.Name
 		l.ListenerConfig = lc.ListenerConfig
 		if ml.TLSConfig != nil {
 			l.TLSConfig = ml.TLSConfig(lc)
@@ -271,6 +368,8 @@ func (ml MultiListener) Listen() (_ []net.Listener, ferr error) {
 }
 
 type Listener struct {
+	// Name is the listener name, it is set by MultiListener.
+	Name string
 	ListenerConfig
 	TLSConfig *tls.Config
 	PromConfig
@@ -290,10 +389,16 @@ func (l *Listener) Listen() error {
 	}
 
 	if l.ProxyProtocolConfig != nil {
-		ll = &proxyproto.Listener{
+		pl := &proxyproto.Listener{
 			Listener:          ll,
 			ReadHeaderTimeout: l.ProxyProtocolConfig.ReadHeaderTimeout,
 		}
+		// The source address is known only after the header is read,
+		// checking it in Accept would block accepting other connections.
+		if l.hasClientFilter() {
+			pl.CheckSource = l.checkClient
+		}
+		ll = pl
 	}
 
 	if rl, wl := l.ReadLimit, l.WriteLimit; rl > 0 || wl > 0 {
@@ -319,8 +424,21 @@ func (l *Listener) listen() (net.Listener, error) {
 	return lc.Listen(context.Background(), "tcp", l.Address)
 }
 
+// ErrClientDenied is returned when a client address is denied by the listener.
+var ErrClientDenied = errors.New("client address is denied")
+
+func (l *Listener) checkClient(addr net.Addr) error {
+	if l.clientDenied(addr) {
+		l.metrics.deny()
+		return fmt.Errorf("%w: %s", ErrClientDenied, addr)
+	}
+	return nil
+}
+
 // Accept returns tls.Conn if TLSConfig is set, as martian expects it to be on top.
 // Otherwise, it returns forwarder.TrackedConn.
+// Connections from denied client addresses are closed and not returned.
+// With proxy protocol, the client address is checked when the header is read.
 func (l *Listener) Accept() (net.Conn, error) {
 	conn, err := l.listener.Accept()
 	if err != nil {
@@ -328,6 +446,17 @@ func (l *Listener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
+	if l.ProxyProtocolConfig == nil && l.hasClientFilter() {
+		for l.checkClient(conn.RemoteAddr()) != nil {
+			conn.Close()
+			conn, err = l.listener.Accept()
+			if err != nil {
+				l.metrics.error()
+				return nil, err
+			}
+		}
+	}
+
 	l.metrics.accept()
 	conn = conntrack.Builder{
 		TrackTraffic: l.TrackTraffic,
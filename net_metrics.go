@@ -95,6 +95,7 @@ func addr2Host(addr string) string {
 
 type listenerMetrics struct {
 	errors   prometheus.Counter
+	denied   prometheus.Counter
 	accepted prometheus.Counter
 	active   prometheus.Gauge
 }
@@ -111,6 +112,11 @@ func newListenerMetrics(r prometheus.Registerer, namespace string) *listenerMetr
 			Namespace: namespace,
 			Help:      "Number of listener errors when accepting connections",
 		}),
+		denied: f.NewCounter(prometheus.CounterOpts{
+			Name:      "listener_denied_total",
+			Namespace: namespace,
+			Help:      "Number of connections rejected because the client address is denied",
+		}),
 		accepted: f.NewCounter(prometheus.CounterOpts{
 			Name:      "listener_cx_total",
 			Namespace: namespace,
@@ -128,6 +134,10 @@ func (m *listenerMetrics) error() {
 	m.errors.Inc()
 }
 
+func (m *listenerMetrics) deny() {
+	m.denied.Inc()
+}
+
 func (m *listenerMetrics) accept() {
 	m.accepted.Inc()
 	m.active.Inc()
@@ -148,6 +158,11 @@ func newListenerMetricsWithNameFunc(r prometheus.Registerer, namespace string) f
 		Namespace: namespace,
 		Help:      "Number of listener errors when accepting connections",
 	}, []string{"name"})
+	denied := f.NewCounterVec(prometheus.CounterOpts{
+		Name:      "listener_denied_total",
+		Namespace: namespace,
+		Help:      "Number of connections rejected because the client address is denied",
+	}, []string{"name"})
 	accepted := f.NewCounterVec(prometheus.CounterOpts{
 		Name:      "listener_cx_total",
 		Namespace: namespace,
@@ -162,6 +177,7 @@ func newListenerMetricsWithNameFunc(r prometheus.Registerer, namespace string) f
 	return func(name string) *listenerMetrics {
 		return &listenerMetrics{
 			errors:   errors.WithLabelValues(name),
+			denied:   denied.WithLabelValues(name),
 			accepted: accepted.WithLabelValues(name),
 			active:   active.WithLabelValues(name),
 		}
@@ -484,3 +484,95 @@ func TestMultiListenerMetrics(t *testing.T) {
 
 	golden.DiffPrometheusMetrics(t, r)
 }
+
+func TestListenerClientFilter(t *testing.T) {
+	echo := func(t *testing.T, l *Listener, header string) error {
+		t.Helper()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("net.Dial(): got %v, want no error", err)
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "%sHello, World!\n", header)
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+
+	loopback, _ := ParseIPRange("loopback")
+	other, _ := ParseIPRange("1.1.1.1")
+
+	tests := []struct {
+		name    string
+		config  ListenerConfig
+		header  string
+		allowed bool
+	}{
+		{
+			name:    "allow",
+			config:  ListenerConfig{AllowClients: []IPRange{loopback}},
+			allowed: true,
+		},
+		{
+			name:   "not allowed",
+			config: ListenerConfig{AllowClients: []IPRange{other}},
+		},
+		{
+			name:   "deny",
+			config: ListenerConfig{DenyClients: []IPRange{loopback}},
+		},
+		{
+			name:   "deny takes precedence",
+			config: ListenerConfig{AllowClients: []IPRange{loopback}, DenyClients: []IPRange{loopback}},
+		},
+		{
+			name: "proxy protocol allow",
+			config: ListenerConfig{
+				ProxyProtocolConfig: DefaultProxyProtocolConfig(),
+				AllowClients:        []IPRange{other},
+			},
+			header:  "PROXY TCP4 1.1.1.1 2.2.2.2 1000 2000\r\n",
+			allowed: true,
+		},
+		{
+			name: "proxy protocol deny",
+			config: ListenerConfig{
+				ProxyProtocolConfig: DefaultProxyProtocolConfig(),
+				DenyClients:         []IPRange{other},
+			},
+			header: "PROXY TCP4 1.1.1.1 2.2.2.2 1000 2000\r\n",
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.Address = testListenerConfig.Address
+
+			l := Listener{
+				ListenerConfig: tc.config,
+			}
+			defer l.Close()
+
+			l.listenAndWait(t)
+			go l.acceptAndCopy()
+
+			err := echo(t, &l, tc.header)
+			if tc.allowed && err != nil {
+				t.Fatalf("expected connection to be allowed, got %v", err)
+			}
+			if !tc.allowed && err == nil {
+				t.Fatal("expected connection to be rejected")
+			}
+
+			var want float64
+			if !tc.allowed {
+				want = 1
+			}
+			if v := metricValue(t, l.metrics.denied); v != want {
+				t.Fatalf("expected %v denied connections, got %v", want, v)
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package ntlm implements the NTLMv2 challenge/response authentication messages as specified in MS-NLMP.
+// It supports connection oriented authentication as used by HTTP proxies,
+// message signing and sealing are not supported.
+package ntlm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5" //nolint:gosec // required by the protocol
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4" //nolint:gosec // required by the protocol
+)
+
+const (
+	negotiateUnicode                 = 0x00000001
+	negotiateOEM                     = 0x00000002
+	requestTarget                    = 0x00000004
+	negotiateNTLM                    = 0x00000200
+	negotiateAlwaysSign              = 0x00008000
+	negotiateExtendedSessionSecurity = 0x00080000
+	negotiateTargetInfo              = 0x00800000
+	negotiate128                     = 0x20000000
+	negotiate56                      = 0x80000000
+
+	defaultFlags = negotiateUnicode | negotiateOEM | requestTarget | negotiateNTLM | negotiateAlwaysSign |
+		negotiateExtendedSessionSecurity | negotiate128 | negotiate56
+)
+
+const (
+	negotiateMessageType    = 1
+	challengeMessageType    = 2
+	authenticateMessageType = 3
+)
+
+const (
+	avEOL       = 0
+	avTimestamp = 7
+)
+
+var signature = []byte("NTLMSSP\x00")
+
+// Test hooks.
+var (
+	now      = time.Now
+	randRead = rand.Read
+)
+
+var errInvalidMessage = errors.New("ntlm: invalid message")
+
+// NegotiateMessage returns the NEGOTIATE_MESSAGE that starts the handshake.
+func NegotiateMessage() []byte {
+	b := newMessage(negotiateMessageType, 32)
+	binary.LittleEndian.PutUint32(b[12:], defaultFlags)
+	return b
+}
+
+// Challenge is the CHALLENGE_MESSAGE sent by the server.
+type Challenge struct {
+	Flags           uint32
+	ServerChallenge [8]byte
+	TargetName      string
+	// TargetInfo is the raw AV_PAIR list.
+	TargetInfo []byte
+}
+
+// ParseChallenge parses the CHALLENGE_MESSAGE.
+func ParseChallenge(b []byte) (*Challenge, error) {
+	if err := checkHeader(b, challengeMessageType, 32); err != nil {
+		return nil, err
+	}
+
+	c := &Challenge{
+		Flags: binary.LittleEndian.Uint32(b[20:]),
+	}
+	copy(c.ServerChallenge[:], b[24:32])
+
+	tn, err := field(b, 12)
+	if err != nil {
+		return nil, err
+	}
+	c.TargetName = decodeString(tn, c.Flags&negotiateUnicode != 0)
+
+	if len(b) >= 48 && c.Flags&negotiateTargetInfo != 0 {
+		if c.TargetInfo, err = field(b, 40); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Marshal returns the CHALLENGE_MESSAGE.
+func (c *Challenge) Marshal() []byte {
+	flags := c.Flags | negotiateUnicode
+	if len(c.TargetInfo) > 0 {
+		flags |= negotiateTargetInfo
+	}
+
+	b := newMessage(challengeMessageType, 48)
+	binary.LittleEndian.PutUint32(b[20:], flags)
+	copy(b[24:], c.ServerChallenge[:])
+	return appendPayload(b,
+		payloadField{12, encodeString(c.TargetName)},
+		payloadField{40, c.TargetInfo},
+	)
+}
+
+// timestamp returns the MsvAvTimestamp value from the target info if present.
+func (c *Challenge) timestamp() ([]byte, bool) {
+	ti := c.TargetInfo
+	for len(ti) >= 4 {
+		id := binary.LittleEndian.Uint16(ti)
+		n := int(binary.LittleEndian.Uint16(ti[2:]))
+		if id == avEOL || len(ti) < 4+n {
+			break
+		}
+		if id == avTimestamp && n == 8 {
+			return ti[4 : 4+n], true
+		}
+		ti = ti[4+n:]
+	}
+	return nil, false
+}
+
+// SplitUsername splits a DOMAIN\user username into the domain and user name.
+// Other usernames, including user@domain, are returned as is with an empty domain.
+func SplitUsername(username string) (domain, user string) {
+	if d, u, ok := strings.Cut(username, `\`); ok {
+		return d, u
+	}
+	return "", username
+}
+
+// AuthenticateMessage returns the AUTHENTICATE_MESSAGE with the NTLMv2 response to the challenge.
+func AuthenticateMessage(c *Challenge, domain, user, password string) ([]byte, error) {
+	var clientChallenge [8]byte
+	if _, err := randRead(clientChallenge[:]); err != nil {
+		return nil, err
+	}
+
+	ts, hasTimestamp := c.timestamp()
+	if !hasTimestamp {
+		ts = binary.LittleEndian.AppendUint64(nil, fileTime(now()))
+	}
+
+	key := ntowfv2(domain, user, password)
+	nt := ntlmv2Response(key, c.ServerChallenge[:], clientChallenge[:], ts, c.TargetInfo)
+
+	// If the server provides a timestamp the LMv2 response must be zeroed.
+	lm := make([]byte, 24)
+	if !hasTimestamp {
+		lm = lmv2Response(key, c.ServerChallenge[:], clientChallenge[:])
+	}
+
+	a := Authenticate{
+		Flags:      c.Flags&defaultFlags | negotiateUnicode | negotiateNTLM,
+		LMResponse: lm,
+		NTResponse: nt,
+		Domain:     domain,
+		User:       user,
+	}
+	return a.Marshal(), nil
+}
+
+// Authenticate is the AUTHENTICATE_MESSAGE sent by the client.
+type Authenticate struct {
+	Flags       uint32
+	LMResponse  []byte
+	NTResponse  []byte
+	Domain      string
+	User        string
+	Workstation string
+}
+
+// ParseAuthenticate parses the AUTHENTICATE_MESSAGE.
+func ParseAuthenticate(b []byte) (*Authenticate, error) {
+	if err := checkHeader(b, authenticateMessageType, 64); err != nil {
+		return nil, err
+	}
+
+	a := &Authenticate{
+		Flags: binary.LittleEndian.Uint32(b[60:]),
+	}
+	unicode := a.Flags&negotiateUnicode != 0
+
+	var err error
+	if a.LMResponse, err = field(b, 12); err != nil {
+		return nil, err
+	}
+	if a.NTResponse, err = field(b, 20); err != nil {
+		return nil, err
+	}
+	for _, f := range []struct {
+		off int
+		s   *string
+	}{{28, &a.Domain}, {36, &a.User}, {44, &a.Workstation}} {
+		v, err := field(b, f.off)
+		if err != nil {
+			return nil, err
+		}
+		*f.s = decodeString(v, unicode)
+	}
+
+	return a, nil
+}
+
+// Marshal returns the AUTHENTICATE_MESSAGE.
+func (a *Authenticate) Marshal() []byte {
+	b := newMessage(authenticateMessageType, 64)
+	binary.LittleEndian.PutUint32(b[60:], a.Flags|negotiateUnicode)
+	return appendPayload(b,
+		payloadField{12, a.LMResponse},
+		payloadField{20, a.NTResponse},
+		payloadField{28, encodeString(a.Domain)},
+		payloadField{36, encodeString(a.User)},
+		payloadField{44, encodeString(a.Workstation)},
+	)
+}
+
+// Verify checks the NTLMv2 response against the server challenge and the password.
+func (a *Authenticate) Verify(serverChallenge [8]byte, password string) error {
+	if len(a.NTResponse) < 16+28 {
+		return errors.New("ntlm: NTLMv2 response required")
+	}
+	key := ntowfv2(a.Domain, a.User, password)
+	proof := ntProofStr(key, serverChallenge[:], a.NTResponse[16:])
+	if !hmac.Equal(proof, a.NTResponse[:16]) {
+		return errors.New("ntlm: invalid credentials")
+	}
+	return nil
+}
+
+// ntowfv2 returns the NTLMv2 response key.
+func ntowfv2(domain, user, password string) []byte {
+	h := md4.New()
+	h.Write(encodeString(password))
+	return hmacMD5(h.Sum(nil), encodeString(strings.ToUpper(user)+domain))
+}
+
+func ntProofStr(key, serverChallenge, blob []byte) []byte {
+	return hmacMD5(key, serverChallenge, blob)
+}
+
+// ntlmv2Response returns NTProofStr followed by the NTLMv2 client challenge structure.
+func ntlmv2Response(key, serverChallenge, clientChallenge, timestamp, targetInfo []byte) []byte {
+	blob := make([]byte, 0, 32+len(targetInfo))
+	blob = append(blob, 1, 1, 0, 0, 0, 0, 0, 0)
+	blob = append(blob, timestamp...)
+	blob = append(blob, clientChallenge...)
+	blob = append(blob, 0, 0, 0, 0)
+	blob = append(blob, targetInfo...)
+	blob = append(blob, 0, 0, 0, 0)
+
+	return append(ntProofStr(key, serverChallenge, blob), blob...)
+}
+
+func lmv2Response(key, serverChallenge, clientChallenge []byte) []byte {
+	return append(hmacMD5(key, serverChallenge, clientChallenge), clientChallenge...)
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	m := hmac.New(md5.New, key)
+	for _, d := range data {
+		m.Write(d)
+	}
+	return m.Sum(nil)
+}
+
+// fileTime returns t as the number of 100 nanosecond intervals since January 1, 1601 UTC.
+func fileTime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100) + 116444736000000000 //nolint:gosec // time after 1601
+}
+
+func encodeString(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+func decodeString(b []byte, unicode bool) string {
+	if !unicode {
+		return string(b)
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+func checkHeader(b []byte, typ uint32, minLen int) error {
+	if len(b) < minLen || !bytes.Equal(b[:8], signature) {
+		return errInvalidMessage
+	}
+	if t := binary.LittleEndian.Uint32(b[8:]); t != typ {
+		return fmt.Errorf("ntlm: unexpected message type %d, expected %d", t, typ)
+	}
+	return nil
+}
+
+// field returns the payload referenced by the len, max len, offset fields at off.
+func field(b []byte, off int) ([]byte, error) {
+	n := int(binary.LittleEndian.Uint16(b[off:]))
+	o := int(binary.LittleEndian.Uint32(b[off+4:]))
+	if n == 0 {
+		return nil, nil
+	}
+	if o < 0 || o+n > len(b) {
+		return nil, errInvalidMessage
+	}
+	return b[o : o+n], nil
+}
+
+func newMessage(typ uint32, headerLen int) []byte {
+	b := make([]byte, headerLen)
+	copy(b, signature)
+	binary.LittleEndian.PutUint32(b[8:], typ)
+	return b
+}
+
+// payloadField is the data of the len, max len, offset fields at off.
+type payloadField struct {
+	off  int
+	data []byte
+}
+
+// appendPayload appends the fields data after the header and sets the fields.
+func appendPayload(b []byte, fields ...payloadField) []byte {
+	for _, f := range fields {
+		binary.LittleEndian.PutUint16(b[f.off:], uint16(len(f.data)))   //nolint:gosec // messages are small
+		binary.LittleEndian.PutUint16(b[f.off+2:], uint16(len(f.data))) //nolint:gosec // messages are small
+		binary.LittleEndian.PutUint32(b[f.off+4:], uint32(len(b)))      //nolint:gosec // messages are small
+		b = append(b, f.data...)
+	}
+	return b
+}
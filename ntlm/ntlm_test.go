@@ -0,0 +1,137 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ntlm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestNTLMv2 uses the NTLMv2 authentication example from MS-NLMP section 4.2.4.
+func TestNTLMv2(t *testing.T) {
+	var (
+		serverChallenge = mustDecodeHex(t, "0123456789abcdef")
+		clientChallenge = mustDecodeHex(t, "aaaaaaaaaaaaaaaa")
+		timestamp       = make([]byte, 8)
+		targetInfo      = mustDecodeHex(t, "02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+	)
+
+	key := ntowfv2("Domain", "User", "Password")
+	if got, want := hex.EncodeToString(key), "0c868a403bfd7a93a3001ef22ef02e3f"; got != want {
+		t.Fatalf("NTOWFv2 = %s, want %s", got, want)
+	}
+
+	lm := lmv2Response(key, serverChallenge, clientChallenge)
+	if got, want := hex.EncodeToString(lm), "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"; got != want {
+		t.Fatalf("LMv2 = %s, want %s", got, want)
+	}
+
+	nt := ntlmv2Response(key, serverChallenge, clientChallenge, timestamp, targetInfo)
+	if got, want := hex.EncodeToString(nt[:16]), "68cd0ab851e51c96aabc927bebef6a1c"; got != want {
+		t.Fatalf("NTProofStr = %s, want %s", got, want)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	origNow, origRandRead := now, randRead
+	t.Cleanup(func() { now, randRead = origNow, origRandRead })
+	now = func() time.Time { return time.Unix(1700000000, 0) }
+	randRead = func(b []byte) (int, error) {
+		for i := range b {
+			b[i] = 0xaa
+		}
+		return len(b), nil
+	}
+
+	if _, err := ParseChallenge(NegotiateMessage()); err == nil {
+		t.Fatal("expected error parsing negotiate message as challenge")
+	}
+
+	sc := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ch := &Challenge{
+		ServerChallenge: sc,
+		TargetName:      "CORP",
+		TargetInfo:      mustDecodeHex(t, "0200080043004f005200500000000000"),
+	}
+	c, err := ParseChallenge(ch.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerChallenge != sc || c.TargetName != "CORP" || !bytes.Equal(c.TargetInfo, ch.TargetInfo) {
+		t.Fatalf("unexpected challenge %+v", c)
+	}
+
+	domain, user := SplitUsername(`CORP\alice`)
+	b, err := AuthenticateMessage(c, domain, user, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := ParseAuthenticate(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Domain != "CORP" || a.User != "alice" {
+		t.Fatalf("unexpected domain or user: %+v", a)
+	}
+	if err := a.Verify(sc, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(sc, "wrong"); err == nil {
+		t.Fatal("expected error for wrong password")
+	}
+	if err := a.Verify([8]byte{}, "secret"); err == nil {
+		t.Fatal("expected error for wrong server challenge")
+	}
+}
+
+func TestAuthenticateMessageServerTimestamp(t *testing.T) {
+	ts := mustDecodeHex(t, "0102030405060708")
+	c := &Challenge{
+		TargetInfo: append(append(mustDecodeHex(t, "07000800"), ts...), 0, 0, 0, 0),
+	}
+	b, err := AuthenticateMessage(c, "", "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := ParseAuthenticate(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.LMResponse, make([]byte, 24)) {
+		t.Fatalf("expected zero LMv2 response, got %x", a.LMResponse)
+	}
+	if got := a.NTResponse[16+8 : 16+16]; !bytes.Equal(got, ts) {
+		t.Fatalf("expected server timestamp, got %x", got)
+	}
+}
+
+func TestSplitUsername(t *testing.T) {
+	tests := []struct {
+		in, domain, user string
+	}{
+		{`CORP\alice`, "CORP", "alice"},
+		{"alice@corp.example.com", "", "alice@corp.example.com"},
+		{"alice", "", "alice"},
+	}
+	for _, tc := range tests {
+		d, u := SplitUsername(tc.in)
+		if d != tc.domain || u != tc.user {
+			t.Errorf("SplitUsername(%q) = %q, %q, want %q, %q", tc.in, d, u, tc.domain, tc.user)
+		}
+	}
+}
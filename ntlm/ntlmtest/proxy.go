@@ -0,0 +1,192 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package ntlmtest provides an in-process HTTP proxy that requires NTLM authentication.
+package ntlmtest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+
+	"github.com/saucelabs/forwarder/ntlm"
+)
+
+// Proxy is an HTTP proxy that requires connection oriented NTLM authentication.
+// Once a connection is authenticated, subsequent requests on the connection are not challenged.
+type Proxy struct {
+	// Scheme is the authentication scheme name, NTLM or Negotiate, the default is NTLM.
+	Scheme   string
+	Domain   string
+	User     string
+	Password string
+
+	// Handler handles authenticated requests, if nil CONNECT requests are tunneled and other requests are forwarded.
+	Handler http.Handler
+
+	handshakes atomic.Int32
+}
+
+// NewServer starts a server running the proxy.
+func NewServer(p *Proxy) *httptest.Server {
+	s := httptest.NewUnstartedServer(p)
+	s.Config.ConnContext = func(ctx context.Context, _ net.Conn) context.Context {
+		return context.WithValue(ctx, connStateKey{}, new(connState))
+	}
+	s.Start()
+	return s
+}
+
+// Handshakes returns the number of successful handshakes.
+func (p *Proxy) Handshakes() int {
+	return int(p.handshakes.Load())
+}
+
+type connStateKey struct{}
+
+type connState struct {
+	challenge     *[8]byte
+	authenticated bool
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st, ok := r.Context().Value(connStateKey{}).(*connState)
+	if !ok {
+		panic("ntlmtest: server not started with NewServer")
+	}
+	if !st.authenticated && !p.authenticate(w, r, st) {
+		return
+	}
+	r.Header.Del("Proxy-Authorization")
+
+	if p.Handler != nil {
+		p.Handler.ServeHTTP(w, r)
+	} else if r.Method == http.MethodConnect {
+		tunnel(w, r)
+	} else {
+		forward(w, r)
+	}
+}
+
+func (p *Proxy) scheme() string {
+	if p.Scheme == "" {
+		return "NTLM"
+	}
+	return p.Scheme
+}
+
+// authenticate runs a step of the handshake and returns true if the connection is authenticated.
+func (p *Proxy) authenticate(w http.ResponseWriter, r *http.Request, st *connState) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), p.scheme()+" ")
+	if !ok {
+		p.challenge(w, "")
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(token)
+	if err != nil || len(b) < 12 {
+		http.Error(w, "invalid token", http.StatusBadRequest)
+		return false
+	}
+
+	switch binary.LittleEndian.Uint32(b[8:]) {
+	case 1:
+		var sc [8]byte
+		rand.Read(sc[:])
+		st.challenge = &sc
+		c := ntlm.Challenge{
+			ServerChallenge: sc,
+			TargetName:      p.Domain,
+		}
+		p.challenge(w, base64.StdEncoding.EncodeToString(c.Marshal()))
+		return false
+	case 3:
+		a, err := ntlm.ParseAuthenticate(b)
+		if err != nil || st.challenge == nil {
+			p.challenge(w, "")
+			return false
+		}
+		sc := *st.challenge
+		st.challenge = nil
+		if !strings.EqualFold(a.Domain, p.Domain) || !strings.EqualFold(a.User, p.User) || a.Verify(sc, p.Password) != nil {
+			p.challenge(w, "")
+			return false
+		}
+		st.authenticated = true
+		p.handshakes.Add(1)
+		return true
+	default:
+		p.challenge(w, "")
+		return false
+	}
+}
+
+func (p *Proxy) challenge(w http.ResponseWriter, token string) {
+	v := p.scheme()
+	if token != "" {
+		v += " " + token
+	}
+	w.Header().Set("Proxy-Authenticate", v)
+	http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+}
+
+func tunnel(w http.ResponseWriter, r *http.Request) {
+	conn, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	cconn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer cconn.Close()
+
+	if _, err := cconn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		return
+	}
+
+	if n := brw.Reader.Buffered(); n > 0 {
+		b, _ := brw.Reader.Peek(n)
+		conn.Write(b)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(conn, cconn)
+		close(done)
+	}()
+	io.Copy(cconn, conn)
+	cconn.Close()
+	<-done
+}
+
+var transport = new(http.Transport)
+
+func forward(w http.ResponseWriter, r *http.Request) {
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
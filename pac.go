@@ -7,9 +7,17 @@
 package forwarder
 
 import (
+	"errors"
+	"fmt"
 	"net/url"
+	"time"
 
+	"github.com/cespare/xxhash/v2"
+	"github.com/elastic/go-freelru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/pac"
 )
 
 type PACResolver interface {
@@ -32,3 +40,215 @@ func (r *LoggingPACResolver) FindProxyForURL(u *url.URL, hostname string) (strin
 	}
 	return s, err
 }
+
+// PACCacheKey specifies which parts of the URL are used as the PAC result cache key.
+type PACCacheKey string
+
+const (
+	PACCacheKeyHost       PACCacheKey = "host"
+	PACCacheKeySchemeHost PACCacheKey = "scheme-host"
+	PACCacheKeyURL        PACCacheKey = "url"
+)
+
+func (k *PACCacheKey) UnmarshalText(text []byte) error {
+	switch PACCacheKey(text) {
+	case PACCacheKeyHost, PACCacheKeySchemeHost, PACCacheKeyURL:
+		*k = PACCacheKey(text)
+		return nil
+	default:
+		return fmt.Errorf("invalid PAC cache key: %s", text)
+	}
+}
+
+func (k PACCacheKey) String() string {
+	return string(k)
+}
+
+type PACConfig struct {
+	// RefreshInterval is the interval between refreshes of the PAC script, zero disables refreshing.
+	RefreshInterval time.Duration
+
+	// Timeout limits the time of a single PAC script evaluation including DNS lookups.
+	// Zero means no timeout.
+	Timeout time.Duration
+
+	// CacheSize is the maximum number of cached PAC results, zero disables caching.
+	CacheSize uint32
+	// CacheTTL is the time after which a cached PAC result expires.
+	CacheTTL time.Duration
+	// CacheKey specifies which parts of the URL are used as the cache key.
+	CacheKey PACCacheKey
+
+	PromConfig
+}
+
+func DefaultPACConfig() *PACConfig {
+	return &PACConfig{
+		Timeout:  5 * time.Second,
+		CacheTTL: 5 * time.Minute,
+		CacheKey: PACCacheKeySchemeHost,
+	}
+}
+
+func (c *PACConfig) Validate() error {
+	if c.RefreshInterval < 0 {
+		return errors.New("refresh interval must be non-negative")
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout must be non-negative")
+	}
+	if c.CacheSize > 0 && c.CacheTTL <= 0 {
+		return errors.New("cache TTL must be positive")
+	}
+	var k PACCacheKey
+	if err := k.UnmarshalText([]byte(c.CacheKey)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CachingPACResolver caches PAC script results and records PAC metrics.
+// Errors are not cached.
+type CachingPACResolver struct {
+	resolver PACResolver
+	config   PACConfig
+	cache    *freelru.SyncedLRU[string, string]
+	metrics  *pacMetrics
+}
+
+func NewCachingPACResolver(r PACResolver, cfg *PACConfig) (*CachingPACResolver, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	cr := &CachingPACResolver{
+		resolver: r,
+		config:   *cfg,
+		metrics:  newPACMetrics(cfg.PromRegistry, cfg.PromNamespace),
+	}
+	if cfg.CacheSize > 0 {
+		c, err := freelru.NewSynced[string, string](cfg.CacheSize, func(k string) uint32 {
+			return uint32(xxhash.Sum64String(k)) //nolint:gosec // no overflow
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.SetLifetime(cfg.CacheTTL)
+		cr.cache = c
+	}
+
+	return cr, nil
+}
+
+func (r *CachingPACResolver) FindProxyForURL(u *url.URL, hostname string) (string, error) {
+	var key string
+	if r.cache != nil {
+		key = r.cacheKey(u, hostname)
+		if s, ok := r.cache.Get(key); ok {
+			r.metrics.cacheHits.Inc()
+			return s, nil
+		}
+		r.metrics.cacheMisses.Inc()
+	}
+
+	start := time.Now()
+	s, err := r.resolver.FindProxyForURL(u, hostname)
+	r.metrics.duration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		if errors.Is(err, pac.ErrTimeout) {
+			r.metrics.errors.WithLabelValues("timeout").Inc()
+		} else {
+			r.metrics.errors.WithLabelValues("error").Inc()
+		}
+		return "", err
+	}
+
+	if r.cache != nil {
+		r.cache.Add(key, s)
+	}
+
+	return s, nil
+}
+
+// peekProxyForURL is like FindProxyForURL but it does not update the cache and metrics.
+func (r *CachingPACResolver) peekProxyForURL(u *url.URL, hostname string) (string, error) {
+	if r.cache != nil {
+		if s, ok := r.cache.Peek(r.cacheKey(u, hostname)); ok {
+			return s, nil
+		}
+	}
+	return r.resolver.FindProxyForURL(u, hostname)
+}
+
+// pacPeeker is implemented by resolvers that can find the proxy without side effects such as caching or metrics.
+type pacPeeker interface {
+	peekProxyForURL(u *url.URL, hostname string) (string, error)
+}
+
+// peekProxyForURL calls peekProxyForURL if the resolver implements it, and FindProxyForURL otherwise.
+func peekProxyForURL(r PACResolver, u *url.URL, hostname string) (string, error) {
+	if p, ok := r.(pacPeeker); ok {
+		return p.peekProxyForURL(u, hostname)
+	}
+	return r.FindProxyForURL(u, hostname)
+}
+
+// Purge removes all cached results.
+func (r *CachingPACResolver) Purge() {
+	if r.cache != nil {
+		r.cache.Purge()
+	}
+}
+
+func (r *CachingPACResolver) cacheKey(u *url.URL, hostname string) string {
+	if hostname == "" {
+		hostname = u.Hostname()
+	}
+
+	switch r.config.CacheKey {
+	case PACCacheKeyHost:
+		return hostname
+	case PACCacheKeySchemeHost:
+		return u.Scheme + "://" + hostname + ":" + urlPort(u)
+	default:
+		return u.String() + " " + hostname
+	}
+}
+
+type pacMetrics struct {
+	duration    prometheus.Histogram
+	cacheHits   prometheus.Counter
+	cacheMisses prometheus.Counter
+	errors      *prometheus.CounterVec
+}
+
+func newPACMetrics(r prometheus.Registerer, namespace string) *pacMetrics {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+
+	return &pacMetrics{
+		duration: f.NewHistogram(prometheus.HistogramOpts{
+			Name:      "pac_eval_duration_seconds",
+			Namespace: namespace,
+			Help:      "PAC script evaluation latency, cache hits are not included",
+			Buckets:   []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 5, 10},
+		}),
+		cacheHits: f.NewCounter(prometheus.CounterOpts{
+			Name:      "pac_cache_hits_total",
+			Namespace: namespace,
+			Help:      "Number of PAC results served from cache",
+		}),
+		cacheMisses: f.NewCounter(prometheus.CounterOpts{
+			Name:      "pac_cache_misses_total",
+			Namespace: namespace,
+			Help:      "Number of PAC results not found in cache",
+		}),
+		errors: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "pac_errors_total",
+			Namespace: namespace,
+			Help:      "Number of PAC script evaluation errors by reason, timeout or error",
+		}, []string{"reason"}),
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package pac
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/parser"
+	"golang.org/x/exp/utf8string"
+)
+
+// LintIssue is a problem found in a PAC script by Lint.
+type LintIssue struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("%d:%d: %s", i.Line, i.Column, i.Message)
+}
+
+// Lint checks the PAC script for:
+//   - unreachable code after return and throw statements,
+//   - constant conditions that make a branch unreachable,
+//   - non-ASCII string literals in return values,
+//   - calls to functions that are neither defined in the script nor supported PAC helper functions.
+//
+// It returns an error if the script cannot be parsed.
+func Lint(script string) ([]LintIssue, error) {
+	prog, err := parser.ParseFile(nil, "", script, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// The runtime is used to check if called functions are defined.
+	pr := &ProxyResolver{vm: goja.New()}
+	if err := pr.registerFunctions(); err != nil {
+		return nil, err
+	}
+	if _, err := pr.vm.RunString(asciiPacUtilsScript); err != nil {
+		return nil, err
+	}
+
+	l := &linter{
+		prog:    prog,
+		defined: make(map[string]bool),
+	}
+	walkAST(prog, l.collectDefined)
+	walkAST(prog, l.check)
+
+	for _, name := range l.called {
+		if l.defined[name.name] {
+			continue
+		}
+		if v := pr.vm.Get(name.name); v != nil && !goja.IsUndefined(v) {
+			continue
+		}
+		l.report(name.node, "call to unsupported function %s", name.name)
+	}
+
+	slices.SortStableFunc(l.issues, func(a, b LintIssue) int {
+		if a.Line != b.Line {
+			return a.Line - b.Line
+		}
+		return a.Column - b.Column
+	})
+
+	return l.issues, nil
+}
+
+type calledFunction struct {
+	name string
+	node ast.Node
+}
+
+type linter struct {
+	prog    *ast.Program
+	defined map[string]bool
+	called  []calledFunction
+	issues  []LintIssue
+}
+
+func (l *linter) report(n ast.Node, format string, args ...any) {
+	p := l.prog.File.Position(int(n.Idx0()) - l.prog.File.Base())
+	l.issues = append(l.issues, LintIssue{
+		Line:    p.Line,
+		Column:  p.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// collectDefined collects names of functions, variables and parameters defined in the script.
+func (l *linter) collectDefined(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.FunctionLiteral:
+		if n.Name != nil {
+			l.defined[n.Name.Name.String()] = true
+		}
+		if n.ParameterList != nil {
+			for _, b := range n.ParameterList.List {
+				if id, ok := b.Target.(*ast.Identifier); ok {
+					l.defined[id.Name.String()] = true
+				}
+			}
+		}
+	case *ast.Binding:
+		if id, ok := n.Target.(*ast.Identifier); ok {
+			l.defined[id.Name.String()] = true
+		}
+	}
+}
+
+func (l *linter) check(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.Program:
+		l.checkUnreachable(n.Body)
+	case *ast.BlockStatement:
+		l.checkUnreachable(n.List)
+	case *ast.CaseStatement:
+		l.checkUnreachable(n.Consequent)
+	case *ast.IfStatement:
+		l.checkConstantCondition(n.Test)
+	case *ast.ConditionalExpression:
+		l.checkConstantCondition(n.Test)
+	case *ast.ReturnStatement:
+		if n.Argument != nil {
+			walkAST(n.Argument, func(n ast.Node) {
+				if s, ok := n.(*ast.StringLiteral); ok && !utf8string.NewString(s.Value.String()).IsASCII() {
+					l.report(s, "non-ASCII characters in return value %s", s.Literal)
+				}
+			})
+		}
+	case *ast.CallExpression:
+		if id, ok := n.Callee.(*ast.Identifier); ok {
+			l.called = append(l.called, calledFunction{name: id.Name.String(), node: id})
+		}
+	}
+}
+
+func (l *linter) checkUnreachable(list []ast.Statement) {
+	for i, s := range list {
+		switch s.(type) {
+		case *ast.ReturnStatement, *ast.ThrowStatement:
+		default:
+			continue
+		}
+		for _, next := range list[i+1:] {
+			if _, ok := next.(*ast.FunctionDeclaration); ok {
+				continue
+			}
+			if _, ok := next.(*ast.EmptyStatement); ok {
+				continue
+			}
+			l.report(next, "unreachable code")
+			break
+		}
+		return
+	}
+}
+
+func (l *linter) checkConstantCondition(test ast.Expression) {
+	switch test.(type) {
+	case *ast.BooleanLiteral, *ast.NumberLiteral, *ast.StringLiteral, *ast.NullLiteral:
+		l.report(test, "constant condition, one of the branches is unreachable")
+	}
+}
+
+var astPkgPath = reflect.TypeOf(ast.Program{}).PkgPath()
+
+// walkAST calls visit for n and every node reachable from it, each node is visited once.
+func walkAST(n ast.Node, visit func(ast.Node)) {
+	walkValue(reflect.ValueOf(n), make(map[any]bool), visit)
+}
+
+func walkValue(v reflect.Value, seen map[any]bool, visit func(ast.Node)) {
+	switch v.Kind() {
+	case reflect.Interface:
+		if !v.IsNil() {
+			walkValue(v.Elem(), seen, visit)
+		}
+	case reflect.Pointer:
+		if v.IsNil() || v.Type().Elem().PkgPath() != astPkgPath {
+			return
+		}
+		if seen[v.Interface()] {
+			return
+		}
+		seen[v.Interface()] = true
+		if n, ok := v.Interface().(ast.Node); ok {
+			visit(n)
+		}
+		walkValue(v.Elem(), seen, visit)
+	case reflect.Struct:
+		if v.Type().PkgPath() != astPkgPath {
+			return
+		}
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				walkValue(v.Field(i), seen, visit)
+			}
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			walkValue(v.Index(i), seen, visit)
+		}
+	default:
+	}
+}
@@ -15,11 +15,12 @@ func _() {
 	_ = x[SOCKS-4]
 	_ = x[SOCKS4-5]
 	_ = x[SOCKS5-6]
+	_ = x[SSH-7]
 }
 
-const _Mode_name = "DIRECTPROXYHTTPHTTPSSOCKSSOCKS4SOCKS5"
+const _Mode_name = "DIRECTPROXYHTTPHTTPSSOCKSSOCKS4SOCKS5SSH"
 
-var _Mode_index = [...]uint8{0, 6, 11, 15, 20, 25, 31, 37}
+var _Mode_index = [...]uint8{0, 6, 11, 15, 20, 25, 31, 37, 40}
 
 func (i Mode) String() string {
 	if i < 0 || i >= Mode(len(_Mode_index)-1) {
@@ -13,6 +13,7 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"time"
 
 	"github.com/dop251/goja"
 	"golang.org/x/exp/utf8string"
@@ -22,9 +23,20 @@ type ProxyResolverConfig struct {
 	Script    string
 	AlertSink io.Writer
 
-	testingLookupIP      func(ctx context.Context, network, host string) ([]net.IP, error)
-	testingMyIPAddress   []net.IP
-	testingMyIPAddressEx []net.IP
+	// Timeout limits the time of a single FindProxyForURL call including DNS lookups.
+	// Zero means no timeout.
+	Timeout time.Duration
+
+	// The following fields replace the environment of the script, they are mainly used for testing PAC scripts.
+
+	// LookupIP is used by the DNS functions instead of the resolver.
+	LookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+	// MyIPAddress is returned by myIpAddress.
+	MyIPAddress []net.IP
+	// MyIPAddressEx is returned by myIpAddressEx.
+	MyIPAddressEx []net.IP
+	// Now is the time source for the Date object used by date and time functions.
+	Now func() time.Time
 }
 
 func (c *ProxyResolverConfig) Validate() error {
@@ -34,6 +46,9 @@ func (c *ProxyResolverConfig) Validate() error {
 	return nil
 }
 
+// ErrTimeout is returned when FindProxyForURL does not finish within ProxyResolverConfig.Timeout.
+var ErrTimeout = errors.New("PAC script: evaluation timeout")
+
 // ProxyResolver is a PAC resolver.
 // It can be used to resolve a proxy for a given URL.
 // It supports both FindProxyForURL and FindProxyForURLEx functions.
@@ -43,6 +58,9 @@ type ProxyResolver struct {
 	vm       *goja.Runtime
 	fn       goja.Callable
 	resolver *net.Resolver
+
+	// ctx is the context of the current FindProxyForURL call, it is used for DNS lookups.
+	ctx context.Context
 }
 
 // Option allows to set additional options before evaluating the PAC script.
@@ -60,6 +78,7 @@ func NewProxyResolver(cfg *ProxyResolverConfig, r *net.Resolver, opts ...Option)
 		config:   *cfg,
 		vm:       goja.New(),
 		resolver: r,
+		ctx:      context.Background(),
 	}
 
 	// Set helper functions.
@@ -70,6 +89,10 @@ func NewProxyResolver(cfg *ProxyResolverConfig, r *net.Resolver, opts ...Option)
 		panic(err)
 	}
 
+	if pr.config.Now != nil {
+		pr.vm.SetTimeSource(pr.config.Now)
+	}
+
 	// Set additional options before evaluating the PAC script.
 	for _, opt := range opts {
 		(opt)(pr.vm)
@@ -144,8 +167,20 @@ func (pr *ProxyResolver) FindProxyForURL(u *url.URL, hostname string) (string, e
 		hostname = u.Hostname()
 	}
 
+	if pr.config.Timeout > 0 {
+		defer pr.startTimeout()()
+	}
+
 	v, err := pr.fn(goja.Undefined(), pr.vm.ToValue(u.String()), pr.vm.ToValue(hostname))
+	if pr.ctx.Err() != nil {
+		// DNS lookups may have failed due to the timeout, do not trust the result.
+		return "", ErrTimeout
+	}
 	if err != nil {
+		var ie *goja.InterruptedError
+		if errors.As(err, &ie) && ie.Value() == ErrTimeout {
+			return "", ErrTimeout
+		}
 		return "", fmt.Errorf("PAC script: %w", err)
 	}
 
@@ -159,3 +194,26 @@ func (pr *ProxyResolver) FindProxyForURL(u *url.URL, hostname string) (string, e
 
 	return s, nil
 }
+
+// startTimeout interrupts the script and cancels DNS lookups after the timeout.
+// The returned function must be called when the call is finished,
+// it makes sure the runtime is not interrupted afterwards.
+func (pr *ProxyResolver) startTimeout() func() {
+	ctx, cancel := context.WithTimeout(context.Background(), pr.config.Timeout)
+	pr.ctx = ctx
+
+	fired := make(chan struct{})
+	t := time.AfterFunc(pr.config.Timeout, func() {
+		pr.vm.Interrupt(ErrTimeout)
+		close(fired)
+	})
+
+	return func() {
+		if !t.Stop() {
+			<-fired
+		}
+		pr.vm.ClearInterrupt()
+		cancel()
+		pr.ctx = context.Background()
+	}
+}
@@ -7,7 +7,6 @@
 package pac
 
 import (
-	"context"
 	"net"
 
 	"github.com/dop251/goja"
@@ -22,11 +21,11 @@ func (pr *ProxyResolver) dnsResolve(call goja.FunctionCall) goja.Value {
 		return goja.Undefined()
 	}
 
-	lookupIP := pr.config.testingLookupIP
+	lookupIP := pr.config.LookupIP
 	if lookupIP == nil {
 		lookupIP = pr.resolver.LookupIP
 	}
-	ips, err := lookupIP(context.Background(), "ip4", host)
+	ips, err := lookupIP(pr.ctx, "ip4", host)
 	if err != nil {
 		return goja.Null()
 	}
@@ -39,8 +38,8 @@ func (pr *ProxyResolver) dnsResolve(call goja.FunctionCall) goja.Value {
 // See https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file#myipaddress
 func (pr *ProxyResolver) myIPAddress(_ goja.FunctionCall) goja.Value {
 	var ips []net.IP
-	if pr.config.testingMyIPAddress != nil {
-		ips = pr.config.testingMyIPAddress
+	if pr.config.MyIPAddress != nil {
+		ips = pr.config.MyIPAddress
 	} else {
 		ips = myIPAddress(false)
 	}
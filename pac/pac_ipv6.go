@@ -8,7 +8,6 @@ package pac
 
 import (
 	"bytes"
-	"context"
 	"errors"
 	"net"
 	"sort"
@@ -70,11 +69,11 @@ func (pr *ProxyResolver) dnsResolveEx(call goja.FunctionCall) goja.Value {
 		return pr.vm.ToValue(false)
 	}
 
-	lookupIP := pr.config.testingLookupIP
+	lookupIP := pr.config.LookupIP
 	if lookupIP == nil {
 		lookupIP = pr.resolver.LookupIP
 	}
-	ips, err := lookupIP(context.Background(), "ip", host)
+	ips, err := lookupIP(pr.ctx, "ip", host)
 	if err != nil {
 		return pr.vm.ToValue("")
 	}
@@ -87,8 +86,8 @@ func (pr *ProxyResolver) dnsResolveEx(call goja.FunctionCall) goja.Value {
 // See https://learn.microsoft.com/en-us/windows/win32/winhttp/myipaddressex
 func (pr *ProxyResolver) myIPAddressEx(_ goja.FunctionCall) goja.Value {
 	var ips []net.IP
-	if pr.config.testingMyIPAddressEx != nil {
-		ips = pr.config.testingMyIPAddressEx
+	if pr.config.MyIPAddressEx != nil {
+		ips = pr.config.MyIPAddressEx
 	} else {
 		ips = myIPAddress(true)
 	}
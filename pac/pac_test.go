@@ -18,6 +18,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -55,14 +56,14 @@ func TestProxyResolverChromium(t *testing.T) { //nolint:maintidx // long table
 		{
 			fileName: "binding_from_global.js",
 			configure: func(t *testing.T, cfg *ProxyResolverConfig) {
-				cfg.testingMyIPAddress = []net.IP{net.ParseIP("1.2.3.4")}
+				cfg.MyIPAddress = []net.IP{net.ParseIP("1.2.3.4")}
 			},
 			want: []Proxy{{Mode: PROXY, Host: "1.2.3.4", Port: "80"}},
 		},
 		{
 			fileName: "bindings.js",
 			configure: func(t *testing.T, cfg *ProxyResolverConfig) {
-				cfg.testingLookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+				cfg.LookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
 					return []net.IP{net.ParseIP("127.0.0.1")}, nil
 				}
 			},
@@ -79,11 +80,11 @@ func TestProxyResolverChromium(t *testing.T) { //nolint:maintidx // long table
 		{
 			fileName: "dns_fail.js",
 			configure: func(t *testing.T, cfg *ProxyResolverConfig) {
-				cfg.testingLookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+				cfg.LookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
 					return nil, errors.New("test")
 				}
-				cfg.testingMyIPAddress = []net.IP{}
-				cfg.testingMyIPAddressEx = []net.IP{}
+				cfg.MyIPAddress = []net.IP{}
+				cfg.MyIPAddressEx = []net.IP{}
 			},
 			want: []Proxy{{Mode: PROXY, Host: "success", Port: "80"}},
 		},
@@ -152,7 +153,7 @@ func TestProxyResolverChromium(t *testing.T) { //nolint:maintidx // long table
 		{
 			fileName: "simple.js",
 			configure: func(t *testing.T, cfg *ProxyResolverConfig) {
-				cfg.testingMyIPAddress = []net.IP{net.ParseIP("172.16.3.4")}
+				cfg.MyIPAddress = []net.IP{net.ParseIP("172.16.3.4")}
 			},
 			want: []Proxy{{Mode: PROXY, Host: "a", Port: "80"}},
 		},
@@ -322,6 +323,57 @@ func TestProxyResolverLibpac(t *testing.T) {
 	}
 }
 
+func TestProxyResolverTimeout(t *testing.T) {
+	u := &url.URL{Scheme: "https", Host: "example.com"}
+
+	t.Run("loop", func(t *testing.T) {
+		cfg := &ProxyResolverConfig{
+			Script: `function FindProxyForURL(url, host) {
+  if (host == "loop.com") { while (true) {} }
+  return "DIRECT";
+}`,
+			Timeout: 50 * time.Millisecond,
+		}
+		pr, err := NewProxyResolver(cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := pr.FindProxyForURL(u, "loop.com"); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected timeout error, got %v", err)
+		}
+		// The runtime must be usable after the timeout.
+		if p, err := pr.FindProxyForURL(u, ""); err != nil || p != "DIRECT" {
+			t.Fatalf("FindProxyForURL() = %q, %v", p, err)
+		}
+	})
+
+	t.Run("dns", func(t *testing.T) {
+		cfg := &ProxyResolverConfig{
+			Script: `function FindProxyForURL(url, host) {
+  return dnsResolve(host) == null ? "DIRECT" : "PROXY " + dnsResolve(host) + ":8080";
+}`,
+			Timeout: 50 * time.Millisecond,
+		}
+		cfg.LookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		pr, err := NewProxyResolver(cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		if _, err := pr.FindProxyForURL(u, ""); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected timeout error, got %v", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("timeout took %s", d)
+		}
+	})
+}
+
 type libpacTestCall struct {
 	url      *url.URL
 	hostname string
@@ -18,10 +18,14 @@ import (
 // If the string is empty, no proxies should be used.
 // The string can contain any number of the following building blocks, separated by a semicolon:
 // <type> <host>:<port> where
-// <type> = "DIRECT" | "PROXY" | "SOCKS" | "HTTP" | "HTTPS" | "SOCKS4"
+// <type> = "DIRECT" | "PROXY" | "SOCKS" | "HTTP" | "HTTPS" | "SOCKS4" | "SOCKS5" | "SSH"
 // <host> = a valid DNS hostname or IP address
 // <port> = a valid port number.
 //
+// The SSH type is an extension that tunnels connections through an SSH server.
+// Proxy chains are an extension, blocks of a chain are separated by "->" e.g. "SOCKS5 a:1080 -> PROXY b:3128",
+// requests are sent to the last proxy of the chain and each proxy is reached through the previous one.
+//
 // See https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file#return_value_format
 type Proxies string
 
@@ -38,6 +42,7 @@ const (
 	SOCKS
 	SOCKS4
 	SOCKS5
+	SSH
 )
 
 var noProxy = Proxy{ //nolint:gochecknoglobals // it's a constant
@@ -50,17 +55,24 @@ type Proxy struct {
 	Mode Mode
 	Host string
 	Port string
+	// Via are the proxies used to reach this proxy if it is the last proxy of a chain.
+	Via []Proxy
 }
 
 // URL returns proxy URL as used in http.Transport.Proxy() (it returns nil if proxy is DIRECT).
+// PROXY is mapped to http, and SOCKS is mapped to socks4 like browsers do.
+// SOCKS4 proxies resolve host names locally, use the socks4a scheme to resolve them by the proxy.
 func (p Proxy) URL() *url.URL {
 	if p.Mode == DIRECT {
 		return nil
 	}
 
 	m := p.Mode
-	if m == PROXY {
+	switch m {
+	case PROXY:
 		m = HTTP
+	case SOCKS:
+		m = SOCKS4
 	}
 	return &url.URL{
 		Scheme: strings.ToLower(m.String()),
@@ -68,6 +80,19 @@ func (p Proxy) URL() *url.URL {
 	}
 }
 
+// Chain returns URLs of the proxies of the chain, the last URL is the proxy URL (it returns nil if proxy is DIRECT).
+func (p Proxy) Chain() []*url.URL {
+	if p.Mode == DIRECT {
+		return nil
+	}
+
+	chain := make([]*url.URL, 0, len(p.Via)+1)
+	for _, v := range p.Via {
+		chain = append(chain, v.URL())
+	}
+	return append(chain, p.URL())
+}
+
 func (s Proxies) String() string {
 	return string(s)
 }
@@ -107,6 +132,29 @@ func (s Proxies) All() ([]Proxy, error) {
 }
 
 func parseProxy(s string) (Proxy, error) {
+	hops := strings.Split(s, "->")
+	if len(hops) == 1 {
+		return parseProxyBlock(s)
+	}
+
+	chain := make([]Proxy, len(hops))
+	for i, h := range hops {
+		p, err := parseProxyBlock(h)
+		if err != nil {
+			return noProxy, fmt.Errorf("chain hop %d: %w", i+1, err)
+		}
+		if p.Mode == DIRECT {
+			return noProxy, fmt.Errorf("chain hop %d: DIRECT is not allowed in a chain", i+1)
+		}
+		chain[i] = p
+	}
+
+	p := chain[len(chain)-1]
+	p.Via = chain[:len(chain)-1]
+	return p, nil
+}
+
+func parseProxyBlock(s string) (Proxy, error) {
 	s = strings.TrimSpace(s)
 	if s == "" {
 		return noProxy, nil
@@ -146,6 +194,8 @@ func parseMode(s string) Mode {
 		return SOCKS4
 	case "SOCKS5":
 		return SOCKS5
+	case "SSH":
+		return SSH
 	default:
 		return DIRECT
 	}
@@ -41,6 +41,17 @@ func TestProxies(t *testing.T) {
 			{Mode: SOCKS4, Host: "socks4", Port: "1080"},
 			{Mode: SOCKS5, Host: "socks5", Port: "1080"},
 		}},
+		{"SSH jump:22; DIRECT", []Proxy{
+			{Mode: SSH, Host: "jump", Port: "22"},
+			{Mode: DIRECT},
+		}},
+		{"SOCKS5 a:1080 -> PROXY b:3128 -> HTTPS c:443; PROXY d:3128", []Proxy{
+			{Mode: HTTPS, Host: "c", Port: "443", Via: []Proxy{
+				{Mode: SOCKS5, Host: "a", Port: "1080"},
+				{Mode: PROXY, Host: "b", Port: "3128"},
+			}},
+			{Mode: PROXY, Host: "d", Port: "3128"},
+		}},
 	}
 
 	for i := range tests {
@@ -65,3 +76,56 @@ func TestProxies(t *testing.T) {
 		})
 	}
 }
+
+func TestProxiesChainErrors(t *testing.T) {
+	for _, s := range []string{
+		"PROXY a:3128 -> DIRECT",
+		"PROXY a:3128 ->",
+		"PROXY a:3128 -> PROXY b",
+	} {
+		if _, err := Proxies(s).First(); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestProxyChain(t *testing.T) {
+	p, err := Proxies("SOCKS5 a:1080 -> PROXY b:3128").First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, u := range p.Chain() {
+		got = append(got, u.String())
+	}
+	if diff := cmp.Diff([]string{"socks5://a:1080", "http://b:3128"}, got); diff != "" {
+		t.Errorf("(-want +got)\n%s", diff)
+	}
+	if p.URL().String() != "http://b:3128" {
+		t.Errorf("unexpected URL %s", p.URL())
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	tests := []struct {
+		input string
+		url   string
+	}{
+		{"PROXY a:3128", "http://a:3128"},
+		{"HTTPS a:443", "https://a:443"},
+		{"SOCKS a:1080", "socks4://a:1080"},
+		{"SOCKS4 a:1080", "socks4://a:1080"},
+		{"SOCKS5 a:1080", "socks5://a:1080"},
+		{"SSH a:22", "ssh://a:22"},
+	}
+
+	for _, tc := range tests {
+		p, err := Proxies(tc.input).First()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.URL().String(); got != tc.url {
+			t.Errorf("%s: expected %s, got %s", tc.input, tc.url, got)
+		}
+	}
+}
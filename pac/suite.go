@@ -0,0 +1,190 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package pac
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TestSuite is a list of PAC script test cases run in a mocked environment.
+// DNS lookups, myIpAddress and the current time are mocked so that the results are reproducible.
+type TestSuite struct {
+	// Now is the current time used by date and time functions, the default is the actual time.
+	Now *time.Time `yaml:"now" json:"now,omitempty"`
+	// MyIPAddress is the list of IP addresses of the host, the first IPv4 address is returned by myIpAddress.
+	MyIPAddress []string `yaml:"my_ip_address" json:"my_ip_address,omitempty"`
+	// DNS maps host names to IP addresses, hosts that are not listed do not resolve.
+	DNS map[string][]string `yaml:"dns" json:"dns,omitempty"`
+	// Tests are the test cases.
+	Tests []TestCase `yaml:"tests" json:"tests"`
+}
+
+// TestCase is a single FindProxyForURL call and the expected result.
+type TestCase struct {
+	Name string `yaml:"name" json:"name,omitempty"`
+	URL  string `yaml:"url" json:"url"`
+	// Host is the host argument of FindProxyForURL, the default is the URL host name.
+	Host string `yaml:"host" json:"host,omitempty"`
+	// Now overrides TestSuite.Now for this test case.
+	Now *time.Time `yaml:"now" json:"now,omitempty"`
+	// Expect is the expected result, whitespace around the ';' separators is ignored.
+	Expect string `yaml:"expect" json:"expect"`
+}
+
+// TestResult is the result of a test case.
+type TestResult struct {
+	Name   string `json:"name,omitempty"`
+	URL    string `json:"url"`
+	Host   string `json:"host,omitempty"`
+	Expect string `json:"expect"`
+	Got    string `json:"got"`
+	Error  string `json:"error,omitempty"`
+	Pass   bool   `json:"pass"`
+}
+
+// ParseTestSuite parses a test suite in YAML or JSON format.
+func ParseTestSuite(b []byte) (*TestSuite, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+
+	s := new(TestSuite)
+	if err := dec.Decode(s); err != nil && err != io.EOF {
+		return nil, err
+	}
+	for i, tc := range s.Tests {
+		if tc.URL == "" {
+			return nil, fmt.Errorf("test %d: url is required", i+1)
+		}
+	}
+	return s, nil
+}
+
+// Run evaluates the script for all test cases.
+// It returns an error if the suite or the script is invalid, failed test cases are reported in the results.
+func (s *TestSuite) Run(script string, alertSink io.Writer) ([]TestResult, error) {
+	dns := make(map[string][]net.IP, len(s.DNS))
+	for host, addrs := range s.DNS {
+		ips, err := parseIPs(addrs)
+		if err != nil {
+			return nil, fmt.Errorf("dns %s: %w", host, err)
+		}
+		dns[strings.ToLower(host)] = ips
+	}
+	myIPs, err := parseIPs(s.MyIPAddress)
+	if err != nil {
+		return nil, fmt.Errorf("my_ip_address: %w", err)
+	}
+
+	var now time.Time
+	cfg := &ProxyResolverConfig{
+		Script:    script,
+		AlertSink: alertSink,
+		LookupIP: func(_ context.Context, network, host string) ([]net.IP, error) {
+			var res []net.IP
+			for _, ip := range dns[strings.ToLower(host)] {
+				if network == "ip" || ip.To4() != nil {
+					res = append(res, ip)
+				}
+			}
+			if len(res) == 0 {
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+			return res, nil
+		},
+		MyIPAddress:   filterIPv4(myIPs),
+		MyIPAddressEx: myIPs,
+		Now: func() time.Time {
+			if now.IsZero() {
+				return time.Now()
+			}
+			return now
+		},
+	}
+	// Do not fall back to the actual addresses of the host.
+	if cfg.MyIPAddress == nil {
+		cfg.MyIPAddress = []net.IP{}
+	}
+	if cfg.MyIPAddressEx == nil {
+		cfg.MyIPAddressEx = []net.IP{}
+	}
+
+	pr, err := NewProxyResolver(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]TestResult, len(s.Tests))
+	for i, tc := range s.Tests {
+		now = time.Time{}
+		if s.Now != nil {
+			now = *s.Now
+		}
+		if tc.Now != nil {
+			now = *tc.Now
+		}
+
+		r := TestResult{
+			Name:   tc.Name,
+			URL:    tc.URL,
+			Host:   tc.Host,
+			Expect: tc.Expect,
+		}
+		u, err := url.Parse(tc.URL)
+		if err == nil {
+			r.Got, err = pr.FindProxyForURL(u, tc.Host)
+		}
+		if err != nil {
+			r.Error = err.Error()
+		} else {
+			r.Pass = normalizeResult(r.Got) == normalizeResult(tc.Expect)
+		}
+		res[i] = r
+	}
+
+	return res, nil
+}
+
+func parseIPs(addrs []string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", a)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func filterIPv4(ips []net.IP) []net.IP {
+	var res []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			res = append(res, ip)
+		}
+	}
+	return res
+}
+
+func normalizeResult(s string) string {
+	var parts []string
+	for _, p := range strings.Split(s, ";") {
+		if p = strings.Join(strings.Fields(p), " "); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
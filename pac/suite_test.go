@@ -0,0 +1,130 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package pac
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testSuiteScript = `function FindProxyForURL(url, host) {
+  if (dnsResolve(host) == "10.0.0.1") {
+    return "DIRECT";
+  }
+  if (isInNet(myIpAddress(), "192.168.0.0", "255.255.0.0")) {
+    return "PROXY office:3128";
+  }
+  if (weekdayRange("SAT", "SUN", "GMT")) {
+    return "PROXY weekend:3128";
+  }
+  return "PROXY default:3128;DIRECT";
+}
+`
+
+func TestTestSuiteRun(t *testing.T) {
+	s, err := ParseTestSuite([]byte(`
+now: 2024-01-03T12:00:00Z
+my_ip_address: [10.1.1.1]
+dns:
+  intranet.example.com: [10.0.0.1]
+tests:
+  - url: http://intranet.example.com/
+    expect: DIRECT
+  - name: weekday
+    url: https://www.example.com/
+    expect: PROXY default:3128; DIRECT
+  - name: weekend
+    url: https://www.example.com/
+    now: 2024-01-06T12:00:00Z
+    expect: PROXY weekend:3128
+  - name: wrong
+    url: https://www.example.com/
+    expect: DIRECT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.Run(testSuiteScript, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []bool
+	for _, r := range res {
+		got = append(got, r.Pass)
+	}
+	if diff := cmp.Diff([]bool{true, true, true, false}, got); diff != "" {
+		t.Fatalf("unexpected results (-want +got):\n%s\n%+v", diff, res)
+	}
+	if res[3].Got != "PROXY default:3128;DIRECT" {
+		t.Fatalf("unexpected result %q", res[3].Got)
+	}
+
+	t.Run("my ip address", func(t *testing.T) {
+		s.MyIPAddress = []string{"192.168.1.1"}
+		res, err := s.Run(testSuiteScript, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[1].Got != "PROXY office:3128" {
+			t.Fatalf("unexpected result %q", res[1].Got)
+		}
+	})
+}
+
+func TestParseTestSuiteJSON(t *testing.T) {
+	s, err := ParseTestSuite([]byte(`{"tests": [{"url": "http://foo.com", "expect": "DIRECT"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Tests) != 1 || s.Tests[0].URL != "http://foo.com" {
+		t.Fatalf("unexpected suite %+v", s)
+	}
+
+	if _, err := ParseTestSuite([]byte(`{"tests": [{"expect": "DIRECT"}]}`)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestLint(t *testing.T) {
+	issues, err := Lint(`function helper(x) { return x; }
+function FindProxyForURL(url, host) {
+  var h = helper(host);
+  if (false) {
+    return "DIRECT";
+  }
+  if (isPlainHostName(h)) {
+    return "PROXY prôxy:3128";
+  }
+  return isResolvableFoo(host) ? "DIRECT" : "PROXY a:1";
+  alert("never");
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, i := range issues {
+		got = append(got, i.String())
+	}
+	want := []string{
+		"4:7: constant condition, one of the branches is unreachable",
+		`8:12: non-ASCII characters in return value "PROXY prôxy:3128"`,
+		"10:10: call to unsupported function isResolvableFoo",
+		"11:3: unreachable code",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected issues (-want +got):\n%s", diff)
+	}
+
+	if _, err := Lint("function FindProxyForURL(url, host) {"); err == nil {
+		t.Fatal("expected parse error")
+	}
+}
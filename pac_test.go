@@ -0,0 +1,128 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/pac"
+)
+
+type countingPACResolver struct {
+	calls int
+	err   error
+}
+
+func (r *countingPACResolver) FindProxyForURL(u *url.URL, _ string) (string, error) {
+	r.calls++
+	if r.err != nil {
+		return "", r.err
+	}
+	return "PROXY " + u.Host, nil
+}
+
+func TestCachingPACResolver(t *testing.T) {
+	mustParse := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	tests := []struct {
+		key   PACCacheKey
+		urls  []string
+		calls int
+	}{
+		{
+			key:   PACCacheKeyHost,
+			urls:  []string{"http://foo.com/a", "https://foo.com/b", "https://bar.com"},
+			calls: 2,
+		},
+		{
+			key:   PACCacheKeySchemeHost,
+			urls:  []string{"http://foo.com/a", "http://foo.com:80/b", "https://foo.com/a"},
+			calls: 2,
+		},
+		{
+			key:   PACCacheKeyURL,
+			urls:  []string{"http://foo.com/a", "http://foo.com/a", "http://foo.com/b"},
+			calls: 2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.key.String(), func(t *testing.T) {
+			cfg := DefaultPACConfig()
+			cfg.CacheSize = 10
+			cfg.CacheKey = tc.key
+
+			cr := new(countingPACResolver)
+			r, err := NewCachingPACResolver(cr, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tc.urls {
+				if _, err := r.FindProxyForURL(mustParse(s), ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if cr.calls != tc.calls {
+				t.Fatalf("expected %d calls, got %d", tc.calls, cr.calls)
+			}
+			if v := metricValue(t, r.metrics.cacheHits); v != float64(len(tc.urls)-tc.calls) {
+				t.Fatalf("expected %d cache hits, got %v", len(tc.urls)-tc.calls, v)
+			}
+		})
+	}
+
+	t.Run("ttl", func(t *testing.T) {
+		cfg := DefaultPACConfig()
+		cfg.CacheSize = 10
+		cfg.CacheTTL = 10 * time.Millisecond
+
+		cr := new(countingPACResolver)
+		r, err := NewCachingPACResolver(cr, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := mustParse("http://foo.com")
+		r.FindProxyForURL(u, "")
+		time.Sleep(20 * time.Millisecond)
+		r.FindProxyForURL(u, "")
+		if cr.calls != 2 {
+			t.Fatalf("expected 2 calls, got %d", cr.calls)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cfg := DefaultPACConfig()
+		cfg.CacheSize = 10
+
+		cr := &countingPACResolver{err: pac.ErrTimeout}
+		r, err := NewCachingPACResolver(cr, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := mustParse("http://foo.com")
+		for range 2 {
+			if _, err := r.FindProxyForURL(u, ""); !errors.Is(err, pac.ErrTimeout) {
+				t.Fatalf("expected timeout error, got %v", err)
+			}
+		}
+		if cr.calls != 2 {
+			t.Fatalf("expected errors not to be cached, got %d calls", cr.calls)
+		}
+		if v := metricValue(t, r.metrics.errors.WithLabelValues("timeout")); v != 2 {
+			t.Fatalf("expected 2 timeout errors, got %v", v)
+		}
+	})
+}
@@ -0,0 +1,215 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+// PACGeneratorConfig is the proxy configuration a PAC script is generated from.
+// It uses the same settings as HTTPProxyConfig so that clients using the script and the proxy agree on which requests go through the proxy.
+type PACGeneratorConfig struct {
+	// Proxy is the proxy clients should use, typically the address of the Forwarder instance.
+	Proxy *url.URL
+	// DenyDomains are sent to the proxy, which denies them, so that clients cannot bypass the deny list.
+	DenyDomains []ruleset.ListItem
+	// DirectDomains are connected to directly.
+	DirectDomains []ruleset.ListItem
+	// ProxyLocalhost specifies how requests to localhost are handled, see HTTPProxyConfig.ProxyLocalhost.
+	ProxyLocalhost ProxyLocalhostMode
+}
+
+func DefaultPACGeneratorConfig() *PACGeneratorConfig {
+	return &PACGeneratorConfig{
+		ProxyLocalhost: DenyProxyLocalhost,
+	}
+}
+
+func (c *PACGeneratorConfig) Validate() error {
+	if c.Proxy == nil {
+		return errors.New("proxy is required")
+	}
+	if c.Proxy.User != nil {
+		return errors.New("proxy credentials are not supported in PAC scripts")
+	}
+	if _, err := pacProxyDirective(c.Proxy); err != nil {
+		return err
+	}
+	if !c.ProxyLocalhost.isValid() {
+		return fmt.Errorf("unsupported proxy_localhost: %s", c.ProxyLocalhost)
+	}
+	return nil
+}
+
+func pacProxyDirective(u *url.URL) (string, error) {
+	switch u.Scheme {
+	case "http":
+		return "PROXY " + u.Host, nil
+	case "https":
+		return "HTTPS " + u.Host, nil
+	case "socks4":
+		return "SOCKS4 " + u.Host, nil
+	case "socks5":
+		return "SOCKS5 " + u.Host, nil
+	default:
+		return "", fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+}
+
+// GeneratePAC returns a PAC script that mirrors the proxy decision chain:
+// localhost requests are handled according to ProxyLocalhost,
+// denied domains are sent to the proxy, direct domains are connected to directly,
+// and all other requests are sent to the proxy.
+func GeneratePAC(cfg *PACGeneratorConfig) (string, error) {
+	if err := cfg.Validate(); err != nil {
+		return "", err
+	}
+
+	proxy, _ := pacProxyDirective(cfg.Proxy)
+
+	var g pacGenerator
+	g.printf("// Generated by Forwarder from the proxy configuration.\n")
+	g.printf("\n")
+	g.printf("var proxy = %s;\n", strconv.Quote(proxy))
+	g.printf("\n")
+	g.printf("function FindProxyForURL(url, host) {\n")
+	g.printf("\thost = host.toLowerCase().replace(/^\\[|\\]$/g, \"\");\n")
+	g.printf("\tvar port = urlPort(url);\n")
+	if cfg.ProxyLocalhost == DenyProxyLocalhost {
+		g.printf("\tif (isLocalhost(host)) return proxy;\n")
+	}
+	if len(cfg.DenyDomains) > 0 {
+		g.printf("\tif (isDenied(host, port)) return proxy;\n")
+	}
+	if cfg.ProxyLocalhost == DirectProxyLocalhost {
+		g.printf("\tif (isLocalhost(host)) return \"DIRECT\";\n")
+	}
+	if len(cfg.DirectDomains) > 0 {
+		g.printf("\tif (isDirect(host, port)) return \"DIRECT\";\n")
+	}
+	g.printf("\treturn proxy;\n")
+	g.printf("}\n")
+
+	if len(cfg.DenyDomains) > 0 {
+		g.list("isDenied", cfg.DenyDomains)
+	}
+	if len(cfg.DirectDomains) > 0 {
+		g.list("isDirect", cfg.DirectDomains)
+	}
+
+	g.printf("%s", pacGeneratorHelpers)
+
+	return g.String(), nil
+}
+
+type pacGenerator struct {
+	strings.Builder
+}
+
+func (g *pacGenerator) printf(format string, args ...any) {
+	fmt.Fprintf(g, format, args...)
+}
+
+// list writes a function that returns true if the host and port match one of the include items and none of the exclude items.
+func (g *pacGenerator) list(name string, items []ruleset.ListItem) {
+	var include, exclude []string
+	for _, li := range items {
+		if li.Exclude {
+			exclude = append(exclude, pacListItemCondition(li))
+		} else {
+			include = append(include, pacListItemCondition(li))
+		}
+	}
+	if len(include) == 0 {
+		include = append(include, "false")
+	}
+
+	g.printf("\n")
+	g.printf("function %s(host, port) {\n", name)
+	if len(exclude) > 0 {
+		g.printf("\tif (%s) return false;\n", strings.Join(exclude, " ||\n\t\t"))
+	}
+	g.printf("\treturn %s;\n", strings.Join(include, " ||\n\t\t"))
+	g.printf("}\n")
+}
+
+// pacListItemCondition returns a JavaScript expression that matches the list item.
+// Like ruleset.Matcher, regular expressions are matched against the host name,
+// and host patterns are matched against the host name and port.
+func pacListItemCondition(li ruleset.ListItem) string {
+	if li.Host == nil {
+		expr, flags := li.Regexp.String(), ""
+		if s, ok := strings.CutPrefix(expr, "(?i)"); ok {
+			expr, flags = s, "i"
+		}
+		return fmt.Sprintf("new RegExp(%s, %q).test(host)", strconv.Quote(expr), flags)
+	}
+
+	hp := li.Host
+	var cond string
+	switch {
+	case hp.Domain != "" && hp.Subdomains:
+		cond = fmt.Sprintf("dnsDomainIs(host, %q)", "."+hp.Domain)
+	case hp.Domain != "":
+		cond = fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", hp.Domain, "."+hp.Domain)
+	case hp.Prefix.Addr().Is4():
+		mask := net.CIDRMask(hp.Prefix.Bits(), 32)
+		cond = fmt.Sprintf("isIPv4InNet(host, %q, %q)", hp.Prefix.Addr().String(), net.IP(mask).String())
+	case hp.Prefix.IsValid():
+		cond = fmt.Sprintf("isIPv6InNet(host, %q)", hp.Prefix.String())
+	default:
+		cond = "true"
+	}
+	if hp.Port != "" {
+		if strings.Contains(cond, "||") {
+			cond = "(" + cond + ")"
+		}
+		cond = fmt.Sprintf("(%s && port == %q)", cond, hp.Port)
+	}
+	return cond
+}
+
+// pacGeneratorHelpers are the helper functions used by the generated script.
+// The localhost aliases are the defaults used by HTTPProxy, host specific aliases are not known to the clients.
+const pacGeneratorHelpers = `
+function isLocalhost(host) {
+	return host == "localhost" || host == "0.0.0.0" || host == "::" ||
+		isIPv4InNet(host, "127.0.0.0", "255.0.0.0") || isIPv6InNet(host, "::1/128");
+}
+
+// isIPv4InNet and isIPv6InNet return true if host is an IP address in the range, host names are not resolved.
+function isIPv4InNet(host, pattern, mask) {
+	return /^\d+\.\d+\.\d+\.\d+$/.test(host) && isInNet(host, pattern, mask);
+}
+
+function isIPv6InNet(host, cidr) {
+	return host.indexOf(":") >= 0 && isInNetEx(host, cidr);
+}
+
+// urlPort returns the URL port or the default port for the URL scheme.
+function urlPort(url) {
+	var m = /^([a-z][a-z0-9+.-]*):\/\/(?:[^\/?#@]*@)?(?:\[[^\]]*\]|[^\/?#:]*)(?::(\d+))?/i.exec(url);
+	if (m == null) return "";
+	if (m[2]) return m[2];
+	switch (m[1].toLowerCase()) {
+	case "http":
+	case "ws":
+		return "80";
+	case "https":
+	case "wss":
+		return "443";
+	}
+	return "";
+}
+`
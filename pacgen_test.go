@@ -0,0 +1,109 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/saucelabs/forwarder/pac"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+func TestGeneratePAC(t *testing.T) {
+	items := func(vals ...string) []ruleset.ListItem {
+		var l []ruleset.ListItem
+		for _, v := range vals {
+			li, err := ruleset.ParseListItem(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l = append(l, li)
+		}
+		return l
+	}
+
+	cfg := DefaultPACGeneratorConfig()
+	cfg.Proxy = &url.URL{Scheme: "http", Host: "proxy:3128"}
+	cfg.DenyDomains = items("host:10.0.0.0/8", "host:denied.com:443", "host:fd00::/8")
+	cfg.DirectDomains = items("host:.internal", "-host:proxied.internal", `(?i)^foo\d+$`, "host:10.1.1.1")
+
+	const proxy = "PROXY proxy:3128"
+
+	tests := []struct {
+		mode ProxyLocalhostMode
+		url  string
+		want string
+	}{
+		{DenyProxyLocalhost, "http://localhost/", proxy},
+		{DenyProxyLocalhost, "http://127.0.0.2:8080/", proxy},
+		{AllowProxyLocalhost, "http://localhost/", proxy},
+		{DirectProxyLocalhost, "http://localhost/", "DIRECT"},
+		{DirectProxyLocalhost, "http://[::1]:8080/", "DIRECT"},
+
+		{DirectProxyLocalhost, "https://denied.com/", proxy},
+		{DirectProxyLocalhost, "http://denied.com/", proxy},
+		{DirectProxyLocalhost, "http://denied.com:443/", proxy},
+		{DirectProxyLocalhost, "http://10.1.1.1/", proxy},
+		{DirectProxyLocalhost, "http://[fd00::1]/", proxy},
+
+		{DirectProxyLocalhost, "http://a.internal/", "DIRECT"},
+		{DirectProxyLocalhost, "http://internal/", proxy},
+		{DirectProxyLocalhost, "http://proxied.internal/", proxy},
+		{DirectProxyLocalhost, "http://sub.proxied.internal/", proxy},
+		{DirectProxyLocalhost, "http://FOO12/", "DIRECT"},
+		{DirectProxyLocalhost, "http://foo12.com/", proxy},
+		{DirectProxyLocalhost, "https://saucelabs.com/", proxy},
+	}
+
+	for _, tc := range tests {
+		t.Run(string(tc.mode)+" "+tc.url, func(t *testing.T) {
+			c := *cfg
+			c.ProxyLocalhost = tc.mode
+			script, err := GeneratePAC(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pr, err := pac.NewProxyResolver(&pac.ProxyResolverConfig{Script: script}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := pr.FindProxyForURL(u, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGeneratePACErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		proxy *url.URL
+	}{
+		{"no proxy", nil},
+		{"credentials", &url.URL{Scheme: "http", Host: "proxy:3128", User: url.UserPassword("user", "pass")}},
+		{"unsupported scheme", &url.URL{Scheme: "ssh", Host: "proxy:22"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultPACGeneratorConfig()
+			cfg.Proxy = tc.proxy
+			if _, err := GeneratePAC(cfg); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
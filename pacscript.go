@@ -0,0 +1,184 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/pac"
+)
+
+// PACScript is a PACResolver that evaluates a PAC script loaded from a URL.
+// The script is periodically refreshed by Run, a new script is compiled and tested before it replaces the current one.
+// If the script cannot be fetched or compiled the current script is used.
+type PACScript struct {
+	url     *url.URL
+	config  PACConfig
+	fetcher urlFetcher
+	log     log.Logger
+	metrics *pacScriptMetrics
+
+	current atomic.Pointer[pacScriptVersion]
+
+	mu       sync.Mutex
+	onUpdate []func()
+}
+
+type pacScriptVersion struct {
+	script    string
+	fetchTime time.Time
+	resolver  PACResolver
+}
+
+// NewPACScript loads and compiles the PAC script from the URL.
+func NewPACScript(u *url.URL, cfg *PACConfig, rt http.RoundTripper, log log.Logger) (*PACScript, error) {
+	if u == nil {
+		return nil, errors.New("PAC URL is required")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &PACScript{
+		url:     u,
+		config:  *cfg,
+		fetcher: urlFetcher{url: u, rt: rt},
+		log:     log,
+		metrics: newPACScriptMetrics(cfg.PromRegistry, cfg.PromNamespace),
+	}
+
+	if _, err := s.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// FindProxyForURL implements PACResolver.
+func (s *PACScript) FindProxyForURL(u *url.URL, hostname string) (string, error) {
+	return s.current.Load().resolver.FindProxyForURL(u, hostname)
+}
+
+// OnUpdate registers a function that is called after the script is replaced.
+func (s *PACScript) OnUpdate(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onUpdate = append(s.onUpdate, fn)
+}
+
+// Run refreshes the script every PACConfig.RefreshInterval until the context is canceled.
+// Refresh errors are logged and the current script is kept.
+func (s *PACScript) Run(ctx context.Context) error {
+	return s.fetcher.runRefresh(ctx, s.config.RefreshInterval, "PAC script", s.Refresh, s.log)
+}
+
+// Refresh fetches and compiles the script, and swaps it in if it has changed.
+// It returns true if the script was updated.
+// On error the current script is kept.
+func (s *PACScript) Refresh(ctx context.Context) (bool, error) {
+	b, v, err := s.fetcher.fetch(ctx)
+	if err != nil {
+		s.metrics.refreshErrors.Inc()
+		return false, err
+	}
+	if b == nil {
+		s.fetcher.commit(v)
+		return false, nil
+	}
+
+	script := string(b)
+	if cur := s.current.Load(); cur != nil && cur.script == script {
+		s.fetcher.commit(v)
+		return false, nil
+	}
+
+	pr, err := s.compile(script)
+	if err != nil {
+		s.metrics.refreshErrors.Inc()
+		return false, err
+	}
+	s.fetcher.commit(v)
+	s.current.Store(&pacScriptVersion{
+		script:    script,
+		fetchTime: time.Now(),
+		resolver:  pr,
+	})
+	s.metrics.lastUpdate.SetToCurrentTime()
+
+	s.mu.Lock()
+	for _, fn := range s.onUpdate {
+		fn()
+	}
+	s.mu.Unlock()
+
+	return true, nil
+}
+
+func (s *PACScript) compile(script string) (PACResolver, error) {
+	pr, err := pac.NewProxyResolverPool(&pac.ProxyResolverConfig{
+		Script:  script,
+		Timeout: s.config.Timeout,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pr.FindProxyForURL(&url.URL{Scheme: "https", Host: "saucelabs.com"}, ""); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+// Script returns the current script and the time it was fetched.
+func (s *PACScript) Script() (script string, fetchTime time.Time) {
+	cur := s.current.Load()
+	return cur.script, cur.fetchTime
+}
+
+// PACScriptFetchTimeHeader is the header with the fetch time of the script served by PACScript.ServeHTTP.
+const PACScriptFetchTimeHeader = "X-Forwarder-PAC-Fetch-Time"
+
+// ServeHTTP serves the current script.
+func (s *PACScript) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	script, fetchTime := s.Script()
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set(PACScriptFetchTimeHeader, fetchTime.UTC().Format(http.TimeFormat))
+	w.Write([]byte(script))
+}
+
+type pacScriptMetrics struct {
+	lastUpdate    prometheus.Gauge
+	refreshErrors prometheus.Counter
+}
+
+func newPACScriptMetrics(r prometheus.Registerer, namespace string) *pacScriptMetrics {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+
+	return &pacScriptMetrics{
+		lastUpdate: f.NewGauge(prometheus.GaugeOpts{
+			Name:      "pac_script_last_update_timestamp_seconds",
+			Namespace: namespace,
+			Help:      "Unix timestamp of the last update of the PAC script",
+		}),
+		refreshErrors: f.NewCounter(prometheus.CounterOpts{
+			Name:      "pac_script_refresh_errors_total",
+			Namespace: namespace,
+			Help:      "Number of errors fetching or compiling the PAC script",
+		}),
+	}
+}
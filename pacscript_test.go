@@ -0,0 +1,139 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestPACScriptRefresh(t *testing.T) {
+	const (
+		direct = `function FindProxyForURL(url, host) { return "DIRECT"; }`
+		proxy  = `function FindProxyForURL(url, host) { return "PROXY proxy:3128"; }`
+	)
+
+	var (
+		mu           sync.Mutex
+		script       = direct
+		cacheControl string
+		requests     int
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.Write([]byte(script))
+	}))
+	defer s.Close()
+
+	u, _ := url.Parse(s.URL)
+	ps, err := NewPACScript(u, DefaultPACConfig(), http.DefaultTransport, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var updates int
+	ps.OnUpdate(func() { updates++ })
+
+	find := func(t *testing.T) string {
+		t.Helper()
+		p, err := ps.FindProxyForURL(&url.URL{Scheme: "http", Host: "example.com"}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	refresh := func(t *testing.T, updated bool) {
+		t.Helper()
+		got, err := ps.Refresh(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != updated {
+			t.Fatalf("expected updated=%v, got %v", updated, got)
+		}
+	}
+
+	if p := find(t); p != "DIRECT" {
+		t.Fatalf("expected DIRECT, got %s", p)
+	}
+
+	t.Run("unchanged", func(t *testing.T) {
+		refresh(t, false)
+		if updates != 0 {
+			t.Fatalf("expected no updates, got %d", updates)
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		mu.Lock()
+		script = proxy
+		mu.Unlock()
+
+		refresh(t, true)
+		if p := find(t); p != "PROXY proxy:3128" {
+			t.Fatalf("expected proxy, got %s", p)
+		}
+		if updates != 1 {
+			t.Fatalf("expected 1 update, got %d", updates)
+		}
+	})
+
+	t.Run("invalid script keeps current", func(t *testing.T) {
+		mu.Lock()
+		script = "function FindProxyForURL(url, host) {"
+		mu.Unlock()
+
+		if _, err := ps.Refresh(context.Background()); err == nil {
+			t.Fatal("expected error")
+		}
+		if p := find(t); p != "PROXY proxy:3128" {
+			t.Fatalf("expected proxy, got %s", p)
+		}
+	})
+
+	t.Run("max-age", func(t *testing.T) {
+		mu.Lock()
+		script, cacheControl = direct, "max-age=3600"
+		mu.Unlock()
+
+		refresh(t, true)
+
+		mu.Lock()
+		n := requests
+		mu.Unlock()
+
+		refresh(t, false)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if requests != n {
+			t.Fatal("expected no request before max-age expires")
+		}
+	})
+
+	t.Run("serve", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		ps.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/pac", http.NoBody))
+		if rw.Body.String() != direct {
+			t.Fatalf("unexpected script %q", rw.Body.String())
+		}
+		if rw.Header().Get(PACScriptFetchTimeHeader) == "" {
+			t.Fatal("expected fetch time header")
+		}
+	})
+}
@@ -0,0 +1,212 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/pac"
+)
+
+// PACServerConfig is the configuration of PACServer.
+type PACServerConfig struct {
+	// MaxAge is the Cache-Control max-age of the served script, zero disables caching by clients.
+	MaxAge time.Duration
+	// Template enables executing the script as a Go text/template for every request, see PACTemplateData.
+	Template bool
+	PromConfig
+}
+
+func DefaultPACServerConfig() *PACServerConfig {
+	return &PACServerConfig{
+		MaxAge: 5 * time.Minute,
+	}
+}
+
+func (c *PACServerConfig) Validate() error {
+	if c.MaxAge < 0 {
+		return errors.New("max age must be non-negative")
+	}
+	return nil
+}
+
+// PACTemplateData is the data passed to the PAC script template.
+type PACTemplateData struct {
+	// ClientIP is the IP address of the client.
+	ClientIP string
+	// UserAgent is the User-Agent header of the request.
+	UserAgent string
+	// Query are the query parameters of the request.
+	Query url.Values
+}
+
+// PACServer serves a PAC script over HTTP.
+// The script is served with ETag, Last-Modified and Cache-Control headers, conditional requests are supported.
+type PACServer struct {
+	config  PACServerConfig
+	script  []byte
+	tmpl    *template.Template
+	modTime time.Time
+	etag    string
+	log     log.Logger
+	metrics *pacServerMetrics
+}
+
+// NewPACServer returns a PACServer for the script.
+// If templating is enabled, the template is executed with empty data and the result is validated.
+func NewPACServer(script string, cfg *PACServerConfig, log log.Logger) (*PACServer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &PACServer{
+		config:  *cfg,
+		modTime: time.Now(),
+		log:     log,
+		metrics: newPACServerMetrics(cfg.PromRegistry, cfg.PromNamespace),
+	}
+
+	if cfg.Template {
+		t, err := template.New("pac").Option("missingkey=zero").Parse(script)
+		if err != nil {
+			return nil, fmt.Errorf("parse PAC template: %w", err)
+		}
+		s.tmpl = t
+
+		b, err := s.execute(&PACTemplateData{})
+		if err != nil {
+			return nil, fmt.Errorf("execute PAC template: %w", err)
+		}
+		script = string(b)
+	} else {
+		s.script = []byte(script)
+		s.etag = pacETag(s.script)
+	}
+
+	if err := ValidatePACScript(script); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ValidatePACScript compiles the script and evaluates it for a sample URL.
+func ValidatePACScript(script string) error {
+	pr, err := pac.NewProxyResolver(&pac.ProxyResolverConfig{Script: script}, nil)
+	if err != nil {
+		return err
+	}
+	_, err = pr.FindProxyForURL(&url.URL{Scheme: "https", Host: "saucelabs.com"}, "")
+	return err
+}
+
+func (s *PACServer) execute(data *PACTemplateData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := s.tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func pacETag(b []byte) string {
+	return `"` + strconv.FormatUint(xxhash.Sum64(b), 16) + `"`
+}
+
+func (s *PACServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		s.error(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	script, etag := s.script, s.etag
+	if s.tmpl != nil {
+		b, err := s.execute(pacTemplateData(r))
+		if err != nil {
+			s.log.Errorf("execute PAC template: %s", err)
+			s.error(w, http.StatusInternalServerError)
+			return
+		}
+		script, etag = b, pacETag(b)
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	h.Set("ETag", etag)
+	switch {
+	case s.config.MaxAge == 0:
+		h.Set("Cache-Control", "no-cache")
+	case s.tmpl != nil:
+		// Templated scripts depend on the client, they must not be stored by shared caches.
+		h.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(s.config.MaxAge.Seconds())))
+	default:
+		h.Set("Cache-Control", fmt.Sprintf("max-age=%d", int(s.config.MaxAge.Seconds())))
+	}
+
+	rw := &statusCodeWriter{ResponseWriter: w, code: http.StatusOK}
+	http.ServeContent(rw, r, "", s.modTime, bytes.NewReader(script))
+	s.metrics.fetches.WithLabelValues(strconv.Itoa(rw.code)).Inc()
+}
+
+func (s *PACServer) error(w http.ResponseWriter, code int) {
+	http.Error(w, http.StatusText(code), code)
+	s.metrics.fetches.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+func pacTemplateData(r *http.Request) *PACTemplateData {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return &PACTemplateData{
+		ClientIP:  strings.Trim(ip, "[]"),
+		UserAgent: r.UserAgent(),
+		Query:     r.URL.Query(),
+	}
+}
+
+type statusCodeWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusCodeWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+type pacServerMetrics struct {
+	fetches *prometheus.CounterVec
+}
+
+func newPACServerMetrics(r prometheus.Registerer, namespace string) *pacServerMetrics {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+
+	return &pacServerMetrics{
+		fetches: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "pac_server_fetches_total",
+			Namespace: namespace,
+			Help:      "Number of PAC script fetches by HTTP status code",
+		}, []string{"code"}),
+	}
+}
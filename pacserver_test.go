@@ -0,0 +1,105 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestPACServerCaching(t *testing.T) {
+	const script = `function FindProxyForURL(url, host) { return "DIRECT"; }`
+
+	cfg := DefaultPACServerConfig()
+	cfg.PromRegistry = prometheus.NewRegistry()
+	s, err := NewPACServer(script, cfg, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/wpad.dat", http.NoBody))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rw.Code)
+	}
+	if rw.Body.String() != script {
+		t.Fatalf("unexpected body %q", rw.Body.String())
+	}
+	if cc := rw.Header().Get("Cache-Control"); cc != "max-age=300" {
+		t.Fatalf("unexpected Cache-Control %q", cc)
+	}
+	etag := rw.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected ETag")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/proxy.pac", http.NoBody)
+	req.Header.Set("If-None-Match", etag)
+	rw = httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	if rw.Code != http.StatusNotModified {
+		t.Fatalf("expected %d, got %d", http.StatusNotModified, rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", http.NoBody))
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected %d, got %d", http.StatusMethodNotAllowed, rw.Code)
+	}
+
+	for code, want := range map[string]float64{"200": 1, "304": 1, "405": 1} {
+		if got := metricValue(t, s.metrics.fetches.WithLabelValues(code)); got != want {
+			t.Errorf("fetches %s: got %v, want %v", code, got, want)
+		}
+	}
+}
+
+func TestPACServerTemplate(t *testing.T) {
+	const script = `function FindProxyForURL(url, host) {
+	if ("{{ .ClientIP }}" == "192.0.2.1") return "DIRECT";
+	return "PROXY {{ or (.Query.Get "env") "prod" | js }}:3128; {{ .UserAgent | js }}";
+}`
+
+	cfg := DefaultPACServerConfig()
+	cfg.Template = true
+	s, err := NewPACServer(script, cfg, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/proxy.pac?env=staging", http.NoBody)
+	req.RemoteAddr = "198.51.100.1:1234"
+	req.Header.Set("User-Agent", `test"agent`)
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	const want = `function FindProxyForURL(url, host) {
+	if ("198.51.100.1" == "192.0.2.1") return "DIRECT";
+	return "PROXY staging:3128; test\"agent";
+}`
+	if rw.Body.String() != want {
+		t.Fatalf("unexpected body:\n%s", rw.Body.String())
+	}
+	if cc := rw.Header().Get("Cache-Control"); cc != "private, max-age=300" {
+		t.Fatalf("unexpected Cache-Control %q", cc)
+	}
+}
+
+func TestPACServerInvalidTemplate(t *testing.T) {
+	cfg := DefaultPACServerConfig()
+	cfg.Template = true
+	if _, err := NewPACServer(`function FindProxyForURL(url, host) { return "{{ .Foo }}"; }`, cfg, stdlog.Default()); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyChainSeparator separates proxies of a proxy chain e.g. socks5://a:1080 -> http://b:3128.
+const ProxyChainSeparator = "->"
+
+// ParseProxyChain parses proxy URLs separated by ProxyChainSeparator, see ParseProxyURL for the URL format.
+// Requests are sent to the last proxy of the chain, each proxy is reached through the previous one.
+func ParseProxyChain(val string) ([]*url.URL, error) {
+	hops := strings.Split(val, ProxyChainSeparator)
+
+	chain := make([]*url.URL, 0, len(hops))
+	for i, s := range hops {
+		u, err := ParseProxyURL(strings.TrimSpace(s))
+		if err != nil {
+			if len(hops) > 1 {
+				err = fmt.Errorf("hop %d: %w", i+1, err)
+			}
+			return nil, err
+		}
+		chain = append(chain, u)
+	}
+
+	return chain, nil
+}
+
+// RedactProxyChain returns the proxy chain in the ParseProxyChain format with passwords redacted.
+func RedactProxyChain(chain []*url.URL) string {
+	s := make([]string, len(chain))
+	for i, u := range chain {
+		s[i] = u.Redacted()
+	}
+	return strings.Join(s, " "+ProxyChainSeparator+" ")
+}
+
+// proxyChainFunc returns the upstream proxy chain for the request, empty chain means the request goes direct.
+type proxyChainFunc func(*http.Request) ([]*url.URL, error)
+
+// chain returns a proxyChainFunc that returns the proxy selected by fn as a single hop chain.
+func (fn ProxyFunc) chain() proxyChainFunc {
+	if fn == nil {
+		return nil
+	}
+
+	return func(req *http.Request) ([]*url.URL, error) {
+		u, err := fn(req)
+		if u == nil {
+			return nil, err
+		}
+		return []*url.URL{u}, err
+	}
+}
+
+// last returns a ProxyFunc that returns the last proxy of the chain selected by fn.
+func (fn proxyChainFunc) last() ProxyFunc {
+	if fn == nil {
+		return nil
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		chain, err := fn(req)
+		if len(chain) == 0 {
+			return nil, err
+		}
+		return chain[len(chain)-1], err
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestParseProxyChain(t *testing.T) {
+	tests := []struct {
+		input string
+		chain string
+		err   string
+	}{
+		{input: "http://a:3128", chain: "http://a:3128"},
+		{input: "socks5://a:1080->http://b:3128", chain: "socks5://a:1080 -> http://b:3128"},
+		{input: "socks5://u:p@a:1080 -> http://b:3128 -> https://c:443", chain: "socks5://u:xxxxx@a:1080 -> http://b:3128 -> https://c:443"},
+		{input: "socks5://a:1080?timeout=5s -> http://b:3128", chain: "socks5://a:1080?timeout=5s -> http://b:3128"},
+		{input: "http://a:3128 -> ftp://b:21", err: "hop 2: unsupported scheme"},
+		{input: "http://a:3128 -> ", err: "hop 2:"},
+	}
+
+	for _, tc := range tests {
+		chain, err := ParseProxyChain(tc.input)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error %q, got %v", tc.input, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.input, err)
+			continue
+		}
+		if got := RedactProxyChain(chain); got != tc.chain {
+			t.Errorf("%s: expected %s, got %s", tc.input, tc.chain, got)
+		}
+	}
+}
+
+func TestHTTPProxyUpstreamChain(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(handler)
+	defer tlsBackend.Close()
+
+	tr := func() *http.Transport {
+		return &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server certificate
+		}
+	}
+
+	newProxy := func(t *testing.T, upstream *url.URL, via []*url.URL, requests *atomic.Int32) *httptest.Server {
+		t.Helper()
+
+		cfg := DefaultHTTPProxyConfig()
+		cfg.ProxyLocalhost = AllowProxyLocalhost
+		cfg.UpstreamProxy = upstream
+		cfg.UpstreamProxyVia = via
+
+		h, err := NewHTTPProxyHandler(cfg, nil, nil, tr(), stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests != nil {
+				requests.Add(1)
+			}
+			h.ServeHTTP(w, r)
+		}))
+	}
+
+	get := func(proxy *httptest.Server, u string) (*http.Response, string, error) {
+		proxyURL, _ := url.Parse(proxy.URL)
+		c := http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyURL),
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server certificate
+			DisableKeepAlives: true,
+		}}
+		res, err := c.Get(u)
+		if err != nil {
+			return nil, "", err
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		return res, string(b), err
+	}
+
+	t.Run("http", func(t *testing.T) {
+		var first, last atomic.Int32
+
+		p1 := newProxy(t, nil, nil, &first)
+		defer p1.Close()
+		p2 := newProxy(t, nil, nil, &last)
+		defer p2.Close()
+
+		chain, err := ParseProxyChain(p1.URL + " -> " + p2.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy := newProxy(t, chain[1], chain[:1], nil)
+		defer proxy.Close()
+
+		for _, u := range []string{backend.URL, tlsBackend.URL} {
+			res, body, err := get(proxy, u)
+			if err != nil {
+				t.Fatalf("%s: %v", u, err)
+			}
+			if res.StatusCode != http.StatusOK || body != "hello" {
+				t.Fatalf("%s: unexpected response %d %q", u, res.StatusCode, body)
+			}
+		}
+
+		// The first proxy only tunnels connections to the last one.
+		if first.Load() == 0 {
+			t.Fatal("expected requests to the first proxy")
+		}
+		if got := last.Load(); got != 2 {
+			t.Fatalf("expected 2 requests to the last proxy, got %d", got)
+		}
+	})
+
+	t.Run("hop failed", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := &url.URL{Scheme: "http", Host: l.Addr().String()}
+		l.Close()
+
+		p2 := newProxy(t, nil, nil, nil)
+		defer p2.Close()
+		last, _ := url.Parse(p2.URL)
+
+		proxy := newProxy(t, last, []*url.URL{closed}, nil)
+		defer proxy.Close()
+
+		res, _, err := get(proxy, backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusBadGateway {
+			t.Fatalf("expected %d, got %d", http.StatusBadGateway, res.StatusCode)
+		}
+		if got := res.Header.Get(ErrorLabelHeader); got != "proxy_chain" {
+			t.Fatalf("expected proxy_chain error label, got %q", got)
+		}
+		if got := res.Header.Get(ErrorHeader); !strings.Contains(got, "hop 1 "+closed.String()) {
+			t.Fatalf("expected error to identify hop 1, got %q", got)
+		}
+	})
+	t.Run("hop timeout", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			var conns []net.Conn
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					for _, c := range conns {
+						c.Close()
+					}
+					return
+				}
+				conns = append(conns, conn)
+			}
+		}()
+
+		stalled, err := ParseProxyURL(l.Addr().String() + "?timeout=100ms")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p2 := newProxy(t, nil, nil, nil)
+		defer p2.Close()
+		last, _ := url.Parse(p2.URL)
+
+		proxy := newProxy(t, last, []*url.URL{stalled}, nil)
+		defer proxy.Close()
+
+		start := time.Now()
+		res, _, err := get(proxy, backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusBadGateway {
+			t.Fatalf("expected %d, got %d", http.StatusBadGateway, res.StatusCode)
+		}
+		if got := res.Header.Get(ErrorLabelHeader); got != "proxy_chain" {
+			t.Fatalf("expected proxy_chain error label, got %q", got)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Fatalf("expected hop timeout to apply, took %s", d)
+		}
+	})
+}
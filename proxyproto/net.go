@@ -25,6 +25,7 @@ type Conn struct {
 	net.Conn
 
 	readHeaderTimeout time.Duration
+	checkSource       func(net.Addr) error
 	isHeaderRead      atomic.Bool
 	headerMu          sync.Mutex
 	header            Header
@@ -48,6 +49,10 @@ func (c *Conn) RemoteAddr() net.Addr {
 		return c.Conn.RemoteAddr()
 	}
 
+	return c.sourceAddr()
+}
+
+func (c *Conn) sourceAddr() net.Addr {
 	if c.headerErr != nil || c.header.IsLocal {
 		return c.Conn.RemoteAddr()
 	}
@@ -140,6 +145,13 @@ func (c *Conn) readHeaderContext(ctx context.Context) error {
 			c.header = *r.header
 		}
 		c.headerErr = r.err
+
+		if c.headerErr == nil && c.checkSource != nil {
+			if err := c.checkSource(c.sourceAddr()); err != nil {
+				c.Conn.Close()
+				c.headerErr = err
+			}
+		}
 	}
 
 	c.isHeaderRead.Store(true)
@@ -150,6 +162,11 @@ func (c *Conn) readHeaderContext(ctx context.Context) error {
 type Listener struct {
 	net.Listener
 	ReadHeaderTimeout time.Duration
+
+	// CheckSource is called with the source address from the header after it is read.
+	// If it returns an error, the connection is closed and the error is returned from Read and Write.
+	CheckSource func(net.Addr) error
+
 	TestingSkipConnfu bool
 }
 
@@ -162,6 +179,7 @@ func (l *Listener) Accept() (net.Conn, error) {
 	pc := &Conn{
 		Conn:              c,
 		readHeaderTimeout: l.ReadHeaderTimeout,
+		checkSource:       l.CheckSource,
 	}
 
 	if l.TestingSkipConnfu {
@@ -176,3 +176,53 @@ func TestConnReadHeaderTimeout(t *testing.T) {
 
 	(<-connCh).Close()
 }
+
+func TestConnCheckSource(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	errDenied := errors.New("denied")
+	var source net.Addr
+	l = &Listener{
+		Listener: l,
+		CheckSource: func(addr net.Addr) error {
+			source = addr
+			return errDenied
+		},
+	}
+
+	connCh := make(chan net.Conn)
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := conn.Write([]byte("PROXY TCP4 1.1.1.1 2.2.2.2 1000 2000\r\n")); err != nil {
+			t.Error(err)
+			return
+		}
+
+		connCh <- conn
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = io.ReadAll(conn); !errors.Is(err, errDenied) {
+		t.Errorf("expected denied error, got %v", err)
+	}
+	if source.String() != "1.1.1.1:1000" {
+		t.Errorf("expected source 1.1.1.1:1000, got %s", source)
+	}
+
+	(<-connCh).Close()
+}
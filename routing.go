@@ -0,0 +1,325 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/saucelabs/forwarder/ruleset"
+	"gopkg.in/yaml.v3"
+)
+
+// DirectUpstream is the RouteRule.Upstream value that sends requests directly to the destination.
+const DirectUpstream = "DIRECT"
+
+// RouteRule is a rule of the routing table.
+// A request matches the rule if it matches all the non-empty match fields.
+type RouteRule struct {
+	// Name is used in logs and routing explanations, it is optional.
+	Name string `yaml:"name"`
+	// Hosts are NO_PROXY-style host patterns, see ruleset.HostPattern for the syntax.
+	Hosts []string `yaml:"hosts"`
+	// Ports are destination ports, if the URL has no port the default port for the scheme is used.
+	Ports []string `yaml:"ports"`
+	// Schemes are URL schemes i.e. http or https, CONNECT requests have the https scheme.
+	Schemes []string `yaml:"schemes"`
+	// Listeners are names of the listeners the request was received on, the main listener is named main.
+	Listeners []string `yaml:"listeners"`
+	// Users are names of authenticated users.
+	Users []string `yaml:"users"`
+	// Upstream is DIRECT, an upstream proxy URL or chain, or a name of an upstream group.
+	// See ParseProxyChain for the chain format.
+	Upstream string `yaml:"upstream"`
+}
+
+func (r *RouteRule) String() string {
+	return r.Name
+}
+
+// RoutingTableConfig is an ordered list of routing rules and named upstream groups.
+type RoutingTableConfig struct {
+	// Upstreams are named groups of upstream proxy URLs or chains, requests routed to a group are distributed round-robin.
+	Upstreams map[string][]string `yaml:"upstreams"`
+	// Routes are evaluated in order, the first matching rule wins.
+	Routes []RouteRule `yaml:"routes"`
+}
+
+// ParseRoutingTableConfig parses routing table config in YAML format.
+func ParseRoutingTableConfig(b []byte) (*RoutingTableConfig, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+
+	cfg := new(RoutingTableConfig)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// RouteRequest holds the request attributes used for routing.
+type RouteRequest struct {
+	URL      *url.URL
+	Listener string
+	User     string
+}
+
+func routeRequestFromHTTP(req *http.Request) RouteRequest {
+	u := req.URL
+	if req.Method == http.MethodConnect {
+		uu := *u
+		uu.Scheme = "https"
+		u = &uu
+	}
+
+	rr := RouteRequest{
+		URL: u,
+	}
+	if ci := clientInfoFromContext(req.Context()); ci != nil {
+		rr.Listener = ci.Listener
+		rr.User = ci.User
+	}
+	return rr
+}
+
+// RouteMatch is the result of routing a request.
+type RouteMatch struct {
+	// Index is the index of the matched rule.
+	Index int
+	// Rule is the matched rule.
+	Rule *RouteRule
+	// Upstream is the selected upstream proxy URL with credentials, or nil if the request goes direct.
+	Upstream *url.URL
+	// Via are the proxies used to reach Upstream if it is the last proxy of a chain.
+	Via []*url.URL
+}
+
+// RoutingTable routes requests to upstream proxies based on an ordered list of rules.
+type RoutingTable struct {
+	routes []*route
+}
+
+type route struct {
+	RouteRule
+
+	hosts    *ruleset.HostMatcher
+	schemes  []string
+	upstream *upstreamGroup
+}
+
+// upstreamGroup selects upstream proxy chains round-robin, nil group means direct.
+type upstreamGroup struct {
+	chains [][]*url.URL
+	next   atomic.Uint64
+}
+
+func (g *upstreamGroup) pick() []*url.URL {
+	if g == nil {
+		return nil
+	}
+	if len(g.chains) == 1 {
+		return g.chains[0]
+	}
+	return g.chains[(g.next.Add(1)-1)%uint64(len(g.chains))]
+}
+
+// peek returns the chain that the next pick returns, without advancing the round-robin.
+func (g *upstreamGroup) peek() []*url.URL {
+	if g == nil {
+		return nil
+	}
+	return g.chains[g.next.Load()%uint64(len(g.chains))]
+}
+
+// NewRoutingTable returns a RoutingTable for the config.
+// Upstream URLs without credentials get credentials from cm if it has a match.
+func NewRoutingTable(cfg *RoutingTableConfig, cm *CredentialsMatcher) (*RoutingTable, error) {
+	parseUpstream := func(s string) ([]*url.URL, error) {
+		chain, err := ParseProxyChain(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range chain {
+			if u.User == nil {
+				u.User = cm.MatchURL(u)
+			}
+		}
+		return chain, nil
+	}
+
+	groups := make(map[string]*upstreamGroup, len(cfg.Upstreams))
+	for name, urls := range cfg.Upstreams {
+		if strings.EqualFold(name, DirectUpstream) || strings.Contains(name, "://") {
+			return nil, fmt.Errorf("upstream group %q: invalid name", name)
+		}
+		if len(urls) == 0 {
+			return nil, fmt.Errorf("upstream group %q: no upstreams", name)
+		}
+		g := new(upstreamGroup)
+		for _, s := range urls {
+			chain, err := parseUpstream(s)
+			if err != nil {
+				return nil, fmt.Errorf("upstream group %q: %w", name, err)
+			}
+			g.chains = append(g.chains, chain)
+		}
+		groups[name] = g
+	}
+
+	rt := &RoutingTable{
+		routes: make([]*route, 0, len(cfg.Routes)),
+	}
+	for i := range cfg.Routes {
+		r, err := newRoute(cfg.Routes[i], groups, parseUpstream)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %w", i+1, err)
+		}
+		if r.Name == "" {
+			r.Name = "#" + strconv.Itoa(i+1)
+		}
+		rt.routes = append(rt.routes, r)
+	}
+
+	return rt, nil
+}
+
+func newRoute(rule RouteRule, groups map[string]*upstreamGroup, parseUpstream func(string) ([]*url.URL, error)) (*route, error) {
+	r := &route{
+		RouteRule: rule,
+	}
+
+	if len(rule.Hosts) > 0 {
+		patterns := make([]ruleset.HostPattern, 0, len(rule.Hosts))
+		for _, h := range rule.Hosts {
+			hp, err := ruleset.ParseHostPattern(h)
+			if err != nil {
+				return nil, err
+			}
+			patterns = append(patterns, hp)
+		}
+		m, err := ruleset.NewHostMatcher(patterns, nil)
+		if err != nil {
+			return nil, err
+		}
+		r.hosts = m
+	}
+
+	for _, l := range rule.Listeners {
+		if l == "" {
+			return nil, fmt.Errorf("invalid listener %q, the main listener is named %q", l, MainListenerName)
+		}
+	}
+
+	for _, p := range rule.Ports {
+		if n, err := strconv.ParseUint(p, 10, 16); err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+	}
+
+	for _, s := range rule.Schemes {
+		r.schemes = append(r.schemes, strings.ToLower(s))
+	}
+
+	switch {
+	case rule.Upstream == "":
+		return nil, errors.New("upstream is required")
+	case strings.EqualFold(rule.Upstream, DirectUpstream):
+	case strings.Contains(rule.Upstream, "://"):
+		chain, err := parseUpstream(rule.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		r.upstream = &upstreamGroup{chains: [][]*url.URL{chain}}
+	default:
+		g, ok := groups[rule.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("unknown upstream group %q", rule.Upstream)
+		}
+		r.upstream = g
+	}
+
+	return r, nil
+}
+
+func (r *route) match(rr RouteRequest) bool {
+	if len(r.schemes) > 0 && !slices.Contains(r.schemes, rr.URL.Scheme) {
+		return false
+	}
+	port := urlPort(rr.URL)
+	if len(r.Ports) > 0 && !slices.Contains(r.Ports, port) {
+		return false
+	}
+	if r.hosts != nil && !r.hosts.MatchHostPort(rr.URL.Hostname(), port) {
+		return false
+	}
+	if len(r.Listeners) > 0 && !slices.Contains(r.Listeners, rr.Listener) {
+		return false
+	}
+	if len(r.Users) > 0 && (rr.User == "" || !slices.Contains(r.Users, rr.User)) {
+		return false
+	}
+	return true
+}
+
+// Route returns the first rule that matches the request, or nil if no rule matches.
+func (rt *RoutingTable) Route(rr RouteRequest) *RouteMatch {
+	return rt.route(rr, false)
+}
+
+// route is like Route, if peek is true the upstream group round-robin is not advanced.
+func (rt *RoutingTable) route(rr RouteRequest, peek bool) *RouteMatch {
+	for i, r := range rt.routes {
+		if r.match(rr) {
+			m := &RouteMatch{
+				Index: i,
+				Rule:  &r.RouteRule,
+			}
+			pick := r.upstream.pick
+			if peek {
+				pick = r.upstream.peek
+			}
+			if chain := pick(); len(chain) > 0 {
+				m.Upstream = chain[len(chain)-1]
+				m.Via = chain[:len(chain)-1]
+			}
+			return m
+		}
+	}
+	return nil
+}
+
+// ProxyFunc returns a ProxyFunc that routes requests with the table, and calls fn if no rule matches.
+// If fn is nil, requests that do not match any rule go direct.
+// If a rule routes requests to a proxy chain, the last proxy of the chain is returned.
+func (rt *RoutingTable) ProxyFunc(fn ProxyFunc) ProxyFunc {
+	return rt.proxyChainFunc(fn.chain()).last()
+}
+
+func (rt *RoutingTable) proxyChainFunc(fn proxyChainFunc) proxyChainFunc {
+	return func(req *http.Request) ([]*url.URL, error) {
+		if m := rt.route(routeRequestFromHTTP(req), explaining(req)); m != nil {
+			if e := explainDecision(req, DecisionRoute); e != nil {
+				e.Route = m.Rule.Name
+			}
+			if m.Upstream == nil {
+				return nil, nil
+			}
+			return append(m.Via[:len(m.Via):len(m.Via)], m.Upstream), nil
+		}
+		if fn == nil {
+			return nil, nil
+		}
+		return fn(req)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+// RuleListConfig configures loading rules from a file or URL.
+type RuleListConfig struct {
+	// URL is the location of the rule list, it can be a local file, http or https URL or base64 encoded data.
+	// The list contains one rule per line, empty lines and lines starting with '#' are ignored.
+	URL *url.URL
+
+	// RefreshInterval is the interval between refreshes of the rule list.
+	// Zero disables refreshing.
+	RefreshInterval time.Duration
+
+	PromConfig
+}
+
+func DefaultRuleListConfig() *RuleListConfig {
+	return &RuleListConfig{
+		RefreshInterval: 5 * time.Minute,
+	}
+}
+
+// RuleList is a Matcher that combines static rules with rules loaded from RuleListConfig.URL.
+// The rules are periodically refreshed by Run, if the list cannot be fetched or parsed the last good list is used.
+type RuleList struct {
+	name    string
+	config  RuleListConfig
+	static  []ruleset.ListItem
+	fetcher urlFetcher
+	log     log.Logger
+	metrics *ruleListMetrics
+
+	matcher atomic.Pointer[ruleset.Matcher]
+}
+
+// NewRuleList loads the rule list and returns a RuleList with static rules and the loaded ones.
+// The name is used in logs and metrics to identify the list.
+func NewRuleList(name string, cfg *RuleListConfig, static []ruleset.ListItem, rt http.RoundTripper, log log.Logger) (*RuleList, error) {
+	if cfg.URL == nil {
+		return nil, errors.New("rule list URL is required")
+	}
+
+	l := &RuleList{
+		name:    name,
+		config:  *cfg,
+		static:  static,
+		fetcher: urlFetcher{url: cfg.URL, rt: rt},
+		log:     log,
+		metrics: newRuleListMetrics(cfg.PromRegistry, cfg.PromNamespace, name),
+	}
+
+	if _, err := l.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Match implements Matcher.
+func (l *RuleList) Match(host string) bool {
+	m := l.matcher.Load()
+	return m != nil && m.Match(host)
+}
+
+// MatchHostPort implements HostPortMatcher.
+func (l *RuleList) MatchHostPort(host, port string) bool {
+	m := l.matcher.Load()
+	return m != nil && m.MatchHostPort(host, port)
+}
+
+// Run refreshes the rule list every RefreshInterval until the context is canceled.
+// Refresh errors are logged and the last good list is kept.
+func (l *RuleList) Run(ctx context.Context) error {
+	return l.fetcher.runRefresh(ctx, l.config.RefreshInterval, l.name+" list", l.Refresh, l.log)
+}
+
+// Refresh fetches and parses the rule list, and swaps it in if it has changed.
+// It returns true if the list was updated.
+// On error the current list is kept.
+func (l *RuleList) Refresh(ctx context.Context) (bool, error) {
+	b, v, err := l.fetcher.fetch(ctx)
+	if err != nil {
+		l.metrics.refreshError()
+		return false, err
+	}
+	if b == nil {
+		// The fetcher reports no change only for the content that was successfully parsed.
+		l.fetcher.commit(v)
+		l.metrics.lastRefresh.SetToCurrentTime()
+		return false, nil
+	}
+
+	items, err := parseRuleList(b)
+	if err != nil {
+		l.metrics.refreshError()
+		return false, err
+	}
+	items = append(append([]ruleset.ListItem(nil), l.static...), items...)
+
+	var m *ruleset.Matcher
+	if len(items) > 0 {
+		m, err = ruleset.NewMatcherFromList(items)
+		if err != nil {
+			l.metrics.refreshError()
+			return false, err
+		}
+	}
+	l.fetcher.commit(v)
+	l.matcher.Store(m)
+
+	l.metrics.rules.Set(float64(len(items)))
+	l.metrics.lastRefresh.SetToCurrentTime()
+
+	return true, nil
+}
+
+// ReadRuleList reads the rule list from the URL once, see RuleListConfig.URL for the supported locations.
+func ReadRuleList(u *url.URL, rt http.RoundTripper) ([]ruleset.ListItem, error) {
+	b, err := ReadURL(u, rt)
+	if err != nil {
+		return nil, err
+	}
+	items, err := parseRuleList(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", u.Redacted(), err)
+	}
+	return items, nil
+}
+
+// parseRuleList parses one rule per line, see ruleset.ParseListItem for the syntax.
+// Empty lines and lines starting with '#' are ignored.
+func parseRuleList(b []byte) ([]ruleset.ListItem, error) {
+	var items []ruleset.ListItem
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		item, err := ruleset.ParseListItem(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		items = append(items, item)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+type ruleListMetrics struct {
+	rules         prometheus.Gauge
+	lastRefresh   prometheus.Gauge
+	lastError     prometheus.Gauge
+	refreshErrors prometheus.Counter
+}
+
+func newRuleListMetrics(r prometheus.Registerer, namespace, name string) *ruleListMetrics {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+	l := prometheus.Labels{"list": name}
+
+	return &ruleListMetrics{
+		rules: f.NewGauge(prometheus.GaugeOpts{
+			Name:        "rule_list_rules",
+			Namespace:   namespace,
+			Help:        "Number of rules in the rule list",
+			ConstLabels: l,
+		}),
+		lastRefresh: f.NewGauge(prometheus.GaugeOpts{
+			Name:        "rule_list_last_refresh_timestamp_seconds",
+			Namespace:   namespace,
+			Help:        "Unix timestamp of the last successful refresh of the rule list",
+			ConstLabels: l,
+		}),
+		lastError: f.NewGauge(prometheus.GaugeOpts{
+			Name:        "rule_list_last_error_timestamp_seconds",
+			Namespace:   namespace,
+			Help:        "Unix timestamp of the last failed refresh of the rule list",
+			ConstLabels: l,
+		}),
+		refreshErrors: f.NewCounter(prometheus.CounterOpts{
+			Name:        "rule_list_refresh_errors_total",
+			Namespace:   namespace,
+			Help:        "Number of errors fetching or parsing the rule list",
+			ConstLabels: l,
+		}),
+	}
+}
+
+func (m *ruleListMetrics) refreshError() {
+	m.refreshErrors.Inc()
+	m.lastError.SetToCurrentTime()
+}
@@ -0,0 +1,250 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+func metricValue(t *testing.T, m prometheus.Metric) float64 {
+	t.Helper()
+
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	if pb.GetGauge() != nil {
+		return pb.GetGauge().GetValue()
+	}
+	return pb.GetCounter().GetValue()
+}
+
+func TestParseRuleList(t *testing.T) {
+	items, err := parseRuleList([]byte("# comment\n\nfoo\n  host:.example.com  \n-bar\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, i := range items {
+		got = append(got, i.String())
+	}
+	if s := strings.Join(got, ","); s != "foo,host:.example.com,-bar" {
+		t.Fatalf("unexpected items: %s", s)
+	}
+
+	if _, err := parseRuleList([]byte("foo\n(bar\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected error on line 2, got %v", err)
+	}
+}
+
+func TestReadRuleList(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(name, []byte("foo\nhost:.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := ReadRuleList(&url.URL{Scheme: "file", Path: name}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[1].String() != "host:.example.com" {
+		t.Fatalf("unexpected items: %v", items)
+	}
+
+	if err := os.WriteFile(name, []byte("(foo\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadRuleList(&url.URL{Scheme: "file", Path: name}, nil); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("expected error on line 1, got %v", err)
+	}
+}
+
+func TestRuleListHTTP(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		body     = "host:foo.com\n"
+		etag     = `"1"`
+		status   = http.StatusOK
+		requests []*http.Request
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests = append(requests, r)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer s.Close()
+
+	u, _ := url.Parse(s.URL)
+	static, _ := ruleset.ParseListItem("host:static.com")
+	l, err := NewRuleList("test", &RuleListConfig{URL: u}, []ruleset.ListItem{static}, http.DefaultTransport, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, match, dontMatch string) {
+		t.Helper()
+		if !l.Match("static.com") {
+			t.Error("expected static.com to match")
+		}
+		if !l.Match(match) {
+			t.Errorf("expected %s to match", match)
+		}
+		if l.Match(dontMatch) {
+			t.Errorf("expected %s not to match", dontMatch)
+		}
+	}
+	refresh := func(t *testing.T, updated bool) {
+		t.Helper()
+		got, err := l.Refresh(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != updated {
+			t.Fatalf("expected updated=%v, got %v", updated, got)
+		}
+	}
+
+	check(t, "foo.com", "bar.com")
+	if v := metricValue(t, l.metrics.rules); v != 2 {
+		t.Fatalf("expected 2 rules, got %v", v)
+	}
+
+	t.Run("not modified", func(t *testing.T) {
+		refresh(t, false)
+		check(t, "foo.com", "bar.com")
+
+		mu.Lock()
+		defer mu.Unlock()
+		if got := requests[len(requests)-1].Header.Get("If-None-Match"); got != etag {
+			t.Fatalf("expected If-None-Match %s, got %q", etag, got)
+		}
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		mu.Lock()
+		body, etag = "host:bar.com\n# comment\nhost:baz.com\n", `"2"`
+		mu.Unlock()
+
+		refresh(t, true)
+		check(t, "bar.com", "foo.com")
+		if v := metricValue(t, l.metrics.rules); v != 3 {
+			t.Fatalf("expected 3 rules, got %v", v)
+		}
+	})
+
+	t.Run("error keeps last good list", func(t *testing.T) {
+		mu.Lock()
+		status = http.StatusInternalServerError
+		mu.Unlock()
+
+		if _, err := l.Refresh(context.Background()); err == nil {
+			t.Fatal("expected error")
+		}
+		check(t, "bar.com", "foo.com")
+
+		mu.Lock()
+		status, body, etag = http.StatusOK, "(invalid\n", `"3"`
+		mu.Unlock()
+
+		if _, err := l.Refresh(context.Background()); err == nil {
+			t.Fatal("expected error")
+		}
+		check(t, "bar.com", "foo.com")
+
+		if v := metricValue(t, l.metrics.refreshErrors); v != 2 {
+			t.Fatalf("expected 2 refresh errors, got %v", v)
+		}
+		if last, failed := metricValue(t, l.metrics.lastRefresh), metricValue(t, l.metrics.lastError); failed < last {
+			t.Fatalf("expected last error %v after last refresh %v", failed, last)
+		}
+	})
+
+	t.Run("failed content is fetched again", func(t *testing.T) {
+		if _, err := l.Refresh(context.Background()); err == nil {
+			t.Fatal("expected error")
+		}
+
+		mu.Lock()
+		got := requests[len(requests)-1].Header.Get("If-None-Match")
+		mu.Unlock()
+		if got != `"2"` {
+			t.Fatalf("expected If-None-Match of the last good list, got %q", got)
+		}
+	})
+}
+
+func TestRuleListFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "domains.txt")
+	write := func(t *testing.T, data string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(name, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	write(t, "", now)
+
+	l, err := NewRuleList("test", &RuleListConfig{
+		URL:             &url.URL{Scheme: "file", Path: name},
+		RefreshInterval: 10 * time.Millisecond,
+	}, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Match("foo.com") {
+		t.Fatal("expected empty list not to match")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- l.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	write(t, "host:foo.com\n", now.Add(time.Second))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !l.Match("foo.com") {
+		if time.Now().After(deadline) {
+			t.Fatal("list not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// HostPattern is a NO_PROXY-style host pattern.
+// The supported forms are:
+//
+//   - "*" matches all hosts,
+//   - "example.com" matches example.com and all its subdomains,
+//   - ".example.com" or "*.example.com" matches subdomains of example.com only,
+//   - "192.168.1.1" or "::1" matches the IP address,
+//   - "10.0.0.0/8" or "fd00::/8" matches IP addresses in the CIDR range.
+//
+// Host names and IP addresses can be followed by a port i.e. "example.com:443" or "[::1]:8080",
+// in that case only the given port matches.
+type HostPattern struct {
+	// Domain is the lowercase domain name without the leading "*." or ".".
+	Domain string
+	// Subdomains is true if the pattern matches subdomains of Domain only.
+	Subdomains bool
+	// Prefix is the IP address range, it is valid if the pattern is an IP address or CIDR.
+	Prefix netip.Prefix
+	// Port is the port number or empty if the pattern matches all ports.
+	Port string
+
+	s string
+}
+
+// ParseHostPattern parses a NO_PROXY-style host pattern, see HostPattern for the supported forms.
+func ParseHostPattern(val string) (HostPattern, error) {
+	hp := HostPattern{s: val}
+
+	val = strings.ToLower(strings.TrimSpace(val))
+	if val == "" {
+		return hp, errors.New("empty host pattern")
+	}
+	if val == "*" {
+		return hp, nil
+	}
+
+	if strings.Contains(val, "/") {
+		p, err := netip.ParsePrefix(val)
+		if err != nil {
+			return hp, err
+		}
+		// Addresses are unmapped before matching, so IPv4-mapped prefixes must be IPv4 prefixes to match.
+		if p.Addr().Is4In6() {
+			if p.Bits() < 96 {
+				return hp, fmt.Errorf("invalid host pattern %q, IPv4-mapped prefix must be at least /96", hp.s)
+			}
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		hp.Prefix = p.Masked()
+		return hp, nil
+	}
+
+	host := val
+	if h, p, err := net.SplitHostPort(val); err == nil {
+		if n, err := strconv.ParseUint(p, 10, 16); err != nil || n == 0 {
+			return hp, fmt.Errorf("invalid port %q", p)
+		}
+		host, hp.Port = h, p
+	}
+
+	if a, err := netip.ParseAddr(host); err == nil {
+		hp.Prefix = netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen())
+		return hp, nil
+	}
+
+	switch {
+	case strings.HasPrefix(host, "*."):
+		host, hp.Subdomains = host[2:], true
+	case strings.HasPrefix(host, "."):
+		host, hp.Subdomains = host[1:], true
+	}
+	host = strings.TrimSuffix(host, ".")
+
+	if host == "" {
+		return hp, fmt.Errorf("invalid host pattern %q", hp.s)
+	}
+	for _, l := range strings.Split(host, ".") {
+		if l == "" || strings.ContainsAny(l, "*:[]") {
+			return hp, fmt.Errorf("invalid host pattern %q", hp.s)
+		}
+	}
+	hp.Domain = host
+
+	return hp, nil
+}
+
+func (hp HostPattern) String() string {
+	return hp.s
+}
+
+func (hp HostPattern) matchAll() bool {
+	return hp.Domain == "" && !hp.Prefix.IsValid()
+}
+
+// ports is a set of ports, nil set means any port.
+type ports map[string]struct{}
+
+// add adds port to the set, empty port means any port.
+func (ps *ports) add(port string) {
+	if port == "" {
+		*ps = ports{}
+		(*ps)[""] = struct{}{}
+		return
+	}
+	if _, ok := (*ps)[""]; ok {
+		return
+	}
+	if *ps == nil {
+		*ps = ports{}
+	}
+	(*ps)[port] = struct{}{}
+}
+
+func (ps ports) match(port string) bool {
+	if ps == nil {
+		return false
+	}
+	if _, ok := ps[""]; ok {
+		return true
+	}
+	_, ok := ps[port]
+	return ok
+}
+
+// domainNode is a node of a suffix trie of domain labels, the root node is the top-level domain.
+type domainNode struct {
+	children map[string]*domainNode
+	self     ports
+	sub      ports
+}
+
+func (n *domainNode) insert(hp HostPattern) {
+	labels := strings.Split(hp.Domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = make(map[string]*domainNode)
+		}
+		c, ok := n.children[labels[i]]
+		if !ok {
+			c = new(domainNode)
+			n.children[labels[i]] = c
+		}
+		n = c
+	}
+
+	if !hp.Subdomains {
+		n.self.add(hp.Port)
+	}
+	n.sub.add(hp.Port)
+}
+
+func (n *domainNode) match(host, port string) bool {
+	for host != "" {
+		var l string
+		if i := strings.LastIndexByte(host, '.'); i >= 0 {
+			host, l = host[:i], host[i+1:]
+		} else {
+			host, l = "", host
+		}
+
+		n = n.children[l]
+		if n == nil {
+			return false
+		}
+		if host != "" && n.sub.match(port) {
+			return true
+		}
+	}
+	return n.self.match(port)
+}
+
+// prefixNode is a node of a binary prefix tree of IP address bits.
+type prefixNode struct {
+	children [2]*prefixNode
+	ports    ports
+}
+
+func (n *prefixNode) insert(p netip.Prefix, port string) {
+	b := p.Addr().AsSlice()
+	for i := range p.Bits() {
+		bit := b[i/8] >> (7 - i%8) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = new(prefixNode)
+		}
+		n = n.children[bit]
+	}
+	n.ports.add(port)
+}
+
+func (n *prefixNode) match(a netip.Addr, port string) bool {
+	b := a.AsSlice()
+	for i := range a.BitLen() {
+		if n.ports.match(port) {
+			return true
+		}
+		n = n.children[b[i/8]>>(7-i%8)&1]
+		if n == nil {
+			return false
+		}
+	}
+	return n.ports.match(port)
+}
+
+// hostSet is a set of host patterns backed by a suffix trie for domains and prefix trees for IP addresses.
+type hostSet struct {
+	all     ports
+	domains domainNode
+	ipv4    prefixNode
+	ipv6    prefixNode
+}
+
+func newHostSet(patterns []HostPattern) *hostSet {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	hs := new(hostSet)
+	for _, hp := range patterns {
+		switch {
+		case hp.matchAll():
+			hs.all.add(hp.Port)
+		case hp.Prefix.IsValid():
+			if hp.Prefix.Addr().Is4() {
+				hs.ipv4.insert(hp.Prefix, hp.Port)
+			} else {
+				hs.ipv6.insert(hp.Prefix, hp.Port)
+			}
+		default:
+			hs.domains.insert(hp)
+		}
+	}
+	return hs
+}
+
+// match returns true if host matches any of the patterns.
+// Patterns with a port only match hosts with the same port.
+func (hs *hostSet) match(host, port string) bool {
+	if hs == nil {
+		return false
+	}
+
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+
+	if hs.all.match(port) {
+		return true
+	}
+
+	if a, err := netip.ParseAddr(host); err == nil {
+		a = a.Unmap().WithZone("")
+		if a.Is4() {
+			return hs.ipv4.match(a, port)
+		}
+		return hs.ipv6.match(a, port)
+	}
+
+	return hs.domains.match(strings.ToLower(host), port)
+}
+
+// HostMatcher matches hosts against NO_PROXY-style host patterns.
+// Matching is done in time proportional to the number of labels in the host name,
+// or the number of bits in the IP address, regardless of the number of patterns.
+type HostMatcher struct {
+	include *hostSet
+	exclude *hostSet
+	inverse bool
+}
+
+// NewHostMatcher returns the HostMatcher with given include and exclude patterns.
+func NewHostMatcher(include, exclude []HostPattern) (*HostMatcher, error) {
+	if len(include) == 0 {
+		return nil, ErrNoIncludeRules
+	}
+
+	return &HostMatcher{
+		include: newHostSet(include),
+		exclude: newHostSet(exclude),
+	}, nil
+}
+
+// Inverse returns a new HostMatcher that inverts the match result.
+func (m *HostMatcher) Inverse() *HostMatcher {
+	return &HostMatcher{
+		include: m.include,
+		exclude: m.exclude,
+		inverse: !m.inverse,
+	}
+}
+
+// Match returns true if the given host matches at least one of the include patterns
+// and does not match the exclude patterns.
+// The host may include a port i.e. "example.com:443".
+func (m *HostMatcher) Match(host string) bool {
+	return m.MatchHostPort(splitHostPort(host))
+}
+
+// MatchHostPort is like Match but takes the host and port separately, port may be empty.
+func (m *HostMatcher) MatchHostPort(host, port string) bool {
+	v := !m.exclude.match(host, port) && m.include.match(host, port)
+	if m.inverse {
+		v = !v
+	}
+	return v
+}
+
+func splitHostPort(hostport string) (host, port string) {
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		return h, p
+	}
+	return hostport, ""
+}
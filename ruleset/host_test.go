@@ -0,0 +1,204 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestParseHostPattern(t *testing.T) {
+	valid := []string{
+		"*",
+		"example.com",
+		"Example.COM.",
+		".example.com",
+		"*.example.com",
+		"example.com:443",
+		"*.example.com:8080",
+		"localhost",
+		"192.168.0.1",
+		"192.168.0.1:80",
+		"::1",
+		"[::1]:8080",
+		"10.0.0.0/8",
+		"fd00::/8",
+	}
+	for _, v := range valid {
+		if _, err := ParseHostPattern(v); err != nil {
+			t.Errorf("%q: unexpected error: %v", v, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		".",
+		"*.",
+		"foo..com",
+		"foo.*.com",
+		"example.com:0",
+		"example.com:99999",
+		"example.com:http",
+		"10.0.0.0/33",
+		"::ffff:0.0.0.0/80",
+		"example.com/8",
+	}
+	for _, v := range invalid {
+		if _, err := ParseHostPattern(v); err == nil {
+			t.Errorf("%q: expected error", v)
+		}
+	}
+}
+
+func TestHostMatcher(t *testing.T) {
+	tests := []struct {
+		name          string
+		include       []string
+		exclude       []string
+		match         []string
+		dontMatch     []string
+		expectedError error
+	}{
+		{
+			name:    "all",
+			include: []string{"*"},
+			match:   []string{"foo", "example.com", "10.0.0.1", "[::1]:80"},
+		},
+		{
+			name:      "domain",
+			include:   []string{"example.com"},
+			match:     []string{"example.com", "EXAMPLE.com", "example.com.", "foo.example.com", "a.b.example.com:443"},
+			dontMatch: []string{"com", "fooexample.com", "example.org", "example.com.org"},
+		},
+		{
+			name:      "subdomains",
+			include:   []string{".example.com", "*.example.org"},
+			match:     []string{"foo.example.com", "foo.example.org"},
+			dontMatch: []string{"example.com", "example.org"},
+		},
+		{
+			name:      "port",
+			include:   []string{"example.com:443", "10.0.0.1:80", "[::1]:8080"},
+			match:     []string{"example.com:443", "foo.example.com:443", "10.0.0.1:80", "[::1]:8080"},
+			dontMatch: []string{"example.com", "example.com:80", "10.0.0.1", "10.0.0.1:443", "[::1]:80"},
+		},
+		{
+			name:      "port and any port",
+			include:   []string{"example.com:443", "example.com"},
+			match:     []string{"example.com:443", "example.com:80", "example.com"},
+			dontMatch: []string{"example.org:443"},
+		},
+		{
+			name:      "ip",
+			include:   []string{"192.168.0.1", "::1"},
+			match:     []string{"192.168.0.1", "192.168.0.1:80", "::1", "[::1]:443", "::ffff:192.168.0.1"},
+			dontMatch: []string{"192.168.0.2", "::2", "foo"},
+		},
+		{
+			name:      "cidr",
+			include:   []string{"10.0.0.0/8", "192.168.1.0/24", "fd00::/8"},
+			match:     []string{"10.1.2.3", "10.255.255.255:80", "192.168.1.100", "fd12::1", "[fdff::1]:443"},
+			dontMatch: []string{"11.0.0.1", "192.168.2.1", "fe80::1", "::1"},
+		},
+		{
+			name:      "ipv4-mapped cidr",
+			include:   []string{"::ffff:10.0.0.0/104"},
+			match:     []string{"10.1.2.3", "::ffff:10.1.2.3", "[::ffff:10.1.2.3]:80"},
+			dontMatch: []string{"11.0.0.1", "::1"},
+		},
+		{
+			name:      "cidr all",
+			include:   []string{"0.0.0.0/0"},
+			match:     []string{"1.1.1.1", "255.255.255.255"},
+			dontMatch: []string{"::1", "example.com"},
+		},
+		{
+			name:      "exclude",
+			include:   []string{"example.com", "10.0.0.0/8"},
+			exclude:   []string{"foo.example.com", "10.0.0.0/16"},
+			match:     []string{"example.com", "bar.example.com", "10.1.0.1"},
+			dontMatch: []string{"foo.example.com", "a.foo.example.com", "10.0.1.1"},
+		},
+		{
+			name:          "no includes",
+			exclude:       []string{"*"},
+			expectedError: ErrNoIncludeRules,
+		},
+	}
+
+	parse := func(t *testing.T, l []string) []HostPattern {
+		t.Helper()
+		var res []HostPattern
+		for _, v := range l {
+			hp, err := ParseHostPattern(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, hp)
+		}
+		return res
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := NewHostMatcher(parse(t, tc.include), parse(t, tc.exclude))
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("expected error %v, got %v", tc.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+
+			for _, h := range tc.match {
+				if !m.Match(h) {
+					t.Errorf("expected %q to match", h)
+				}
+			}
+			for _, h := range tc.dontMatch {
+				if m.Match(h) {
+					t.Errorf("expected %q not to match", h)
+				}
+			}
+
+			mi := m.Inverse()
+			for _, h := range tc.match {
+				if mi.Match(h) {
+					t.Errorf("expected %q not to match", h)
+				}
+			}
+			for _, h := range tc.dontMatch {
+				if !mi.Match(h) {
+					t.Errorf("expected %q to match", h)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkHostMatcher(b *testing.B) {
+	const n = 80000
+
+	include := make([]HostPattern, 0, n)
+	for i := range n {
+		hp, err := ParseHostPattern(fmt.Sprintf(".domain%d.example.com", i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		include = append(include, hp)
+	}
+	m, err := NewHostMatcher(include, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := range b.N {
+		m.Match(fmt.Sprintf("www.domain%d.example.com", i%(2*n)))
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"regexp"
+	"strings"
+)
+
+// HostPrefix is the prefix of list items that are host patterns, other items are regular expressions.
+const HostPrefix = "host:"
+
+// ListItem is either a regular expression or a host pattern.
+type ListItem struct {
+	Regexp  *regexp.Regexp
+	Host    *HostPattern
+	Exclude bool
+}
+
+// ParseListItem parses a list item, items prefixed with '-' are exclude items.
+// Items prefixed with HostPrefix are parsed as host patterns, see HostPattern for the syntax,
+// other items are parsed as regular expressions.
+func ParseListItem(val string) (ListItem, error) {
+	val, exclude := strings.CutPrefix(val, "-")
+	if h, ok := strings.CutPrefix(val, HostPrefix); ok {
+		hp, err := ParseHostPattern(h)
+		if err != nil {
+			return ListItem{}, err
+		}
+		return ListItem{Host: &hp, Exclude: exclude}, nil
+	}
+
+	r, err := regexp.Compile(val)
+	if err != nil {
+		return ListItem{}, err
+	}
+	return ListItem{Regexp: r, Exclude: exclude}, nil
+}
+
+func (l ListItem) String() string {
+	var s string
+	if l.Host != nil {
+		s = HostPrefix + l.Host.String()
+	} else {
+		s = l.Regexp.String()
+	}
+	if l.Exclude {
+		s = "-" + s
+	}
+	return s
+}
+
+// Matcher combines regular expressions and host patterns.
+// Regular expressions are matched against the host name without port,
+// host patterns are matched against the host name and port if any.
+type Matcher struct {
+	includeRegexp *regexp.Regexp
+	excludeRegexp *regexp.Regexp
+	includeHosts  *hostSet
+	excludeHosts  *hostSet
+}
+
+// NewMatcherFromList returns the Matcher for the given list items.
+func NewMatcherFromList(l []ListItem) (*Matcher, error) {
+	var (
+		includeRegexp, excludeRegexp []*regexp.Regexp
+		includeHosts, excludeHosts   []HostPattern
+	)
+	for i := range l {
+		switch {
+		case l[i].Host != nil && l[i].Exclude:
+			excludeHosts = append(excludeHosts, *l[i].Host)
+		case l[i].Host != nil:
+			includeHosts = append(includeHosts, *l[i].Host)
+		case l[i].Exclude:
+			excludeRegexp = append(excludeRegexp, l[i].Regexp)
+		default:
+			includeRegexp = append(includeRegexp, l[i].Regexp)
+		}
+	}
+	if len(includeRegexp) == 0 && len(includeHosts) == 0 {
+		return nil, ErrNoIncludeRules
+	}
+
+	return &Matcher{
+		includeRegexp: joinRegexp(includeRegexp),
+		excludeRegexp: joinRegexp(excludeRegexp),
+		includeHosts:  newHostSet(includeHosts),
+		excludeHosts:  newHostSet(excludeHosts),
+	}, nil
+}
+
+// Match returns true if the given host matches at least one of the include items
+// and does not match the exclude items.
+// The host may include a port i.e. "example.com:443".
+func (m *Matcher) Match(host string) bool {
+	return m.MatchHostPort(splitHostPort(host))
+}
+
+// MatchHostPort is like Match but takes the host and port separately, port may be empty.
+func (m *Matcher) MatchHostPort(host, port string) bool {
+	if m.excludeHosts.match(host, port) || (m.excludeRegexp != nil && m.excludeRegexp.MatchString(host)) {
+		return false
+	}
+	return m.includeHosts.match(host, port) || (m.includeRegexp != nil && m.includeRegexp.MatchString(host))
+}
@@ -0,0 +1,120 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseListItem(t *testing.T) {
+	tests := []struct {
+		input   string
+		host    bool
+		exclude bool
+	}{
+		{input: "foo"},
+		{input: "-foo", exclude: true},
+		{input: "host:.example.com", host: true},
+		{input: "-host:10.0.0.0/8", host: true, exclude: true},
+	}
+
+	for _, tc := range tests {
+		l, err := ParseListItem(tc.input)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tc.input, err)
+		}
+		if (l.Host != nil) != tc.host {
+			t.Errorf("%q: expected host %v, got %v", tc.input, tc.host, l.Host != nil)
+		}
+		if l.Exclude != tc.exclude {
+			t.Errorf("%q: expected exclude %v, got %v", tc.input, tc.exclude, l.Exclude)
+		}
+		if l.String() != tc.input {
+			t.Errorf("expected %q, got %q", tc.input, l.String())
+		}
+	}
+
+	for _, v := range []string{"host:", "host:foo..com", "(foo"} {
+		if _, err := ParseListItem(v); err == nil {
+			t.Errorf("%q: expected error", v)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		name          string
+		items         []string
+		match         []string
+		dontMatch     []string
+		expectedError error
+	}{
+		{
+			name:      "regexp",
+			items:     []string{"google", "-maps"},
+			match:     []string{"google.com", "www.google.com:443"},
+			dontMatch: []string{"maps.google.com", "example.com"},
+		},
+		{
+			name:      "hosts",
+			items:     []string{"host:example.com", "host:10.0.0.0/8", "-host:foo.example.com"},
+			match:     []string{"example.com", "bar.example.com", "10.0.0.1:80"},
+			dontMatch: []string{"foo.example.com", "example.org"},
+		},
+		{
+			name:      "mixed",
+			items:     []string{"host:.example.com", "^api\\.", "-host:api.internal", "-secret"},
+			match:     []string{"www.example.com", "api.example.org"},
+			dontMatch: []string{"api.internal", "secret.example.com", "example.com"},
+		},
+		{
+			name:      "regexp does not match port",
+			items:     []string{"com$", "host:example.org:443"},
+			match:     []string{"example.com:443", "example.org:443"},
+			dontMatch: []string{"example.org:80"},
+		},
+		{
+			name:          "no includes",
+			items:         []string{"-foo", "-host:bar"},
+			expectedError: ErrNoIncludeRules,
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			var l []ListItem
+			for _, v := range tc.items {
+				li, err := ParseListItem(v)
+				if err != nil {
+					t.Fatal(err)
+				}
+				l = append(l, li)
+			}
+
+			m, err := NewMatcherFromList(l)
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("expected error %v, got %v", tc.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+
+			for _, h := range tc.match {
+				if !m.Match(h) {
+					t.Errorf("expected %q to match", h)
+				}
+			}
+			for _, h := range tc.dontMatch {
+				if m.Match(h) {
+					t.Errorf("expected %q not to match", h)
+				}
+			}
+		})
+	}
+}
@@ -26,26 +26,26 @@ func NewRegexpMatcher(include, exclude []*regexp.Regexp) (*RegexpMatcher, error)
 		return nil, ErrNoIncludeRules
 	}
 
-	build := func(rules []*regexp.Regexp) *regexp.Regexp {
-		var regex strings.Builder
-		for i := range rules {
-			if i > 0 {
-				regex.WriteString("|")
-			}
-			regex.WriteString(rules[i].String())
-		}
-		if s := regex.String(); s != "" {
-			return regexp.MustCompile(s)
-		}
-		return nil
-	}
-
 	return &RegexpMatcher{
-		include: build(include),
-		exclude: build(exclude),
+		include: joinRegexp(include),
+		exclude: joinRegexp(exclude),
 	}, nil
 }
 
+func joinRegexp(rules []*regexp.Regexp) *regexp.Regexp {
+	var regex strings.Builder
+	for i := range rules {
+		if i > 0 {
+			regex.WriteString("|")
+		}
+		regex.WriteString(rules[i].String())
+	}
+	if s := regex.String(); s != "" {
+		return regexp.MustCompile(s)
+	}
+	return nil
+}
+
 // Inverse returns a new RegexpMatcher that inverts the match result.
 func (r *RegexpMatcher) Inverse() *RegexpMatcher {
 	return &RegexpMatcher{
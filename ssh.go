@@ -0,0 +1,168 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHConfig specifies how to authenticate with upstream SSH proxies i.e. ssh://user@host:port,
+// and how to verify their host keys.
+type SSHConfig struct {
+	// KeyFiles are private key files used for public key authentication.
+	// Passphrase protected keys are not supported, use the SSH agent instead.
+	KeyFiles []string
+
+	// Agent enables public key authentication with the keys from the SSH agent listening on SSH_AUTH_SOCK.
+	Agent bool
+
+	// KnownHostsFiles are files with the trusted host keys in OpenSSH known_hosts format.
+	// If empty, ~/.ssh/known_hosts is used.
+	KnownHostsFiles []string
+
+	// KeepAlive is the interval of keep-alive requests sent to the SSH server.
+	// The connection is closed and established again if the server does not respond.
+	// Zero disables keep-alive.
+	KeepAlive time.Duration
+}
+
+func DefaultSSHConfig() *SSHConfig {
+	return &SSHConfig{
+		Agent:     true,
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+func (c *SSHConfig) Validate() error {
+	if c.KeepAlive < 0 {
+		return errors.New("keep_alive must be non-negative")
+	}
+	return nil
+}
+
+// clientConfigFunc returns a function that returns SSH client config for an upstream SSH proxy URL.
+// The username is taken from the URL, or the current user if not specified.
+// If the URL contains a password, password authentication is used after public key authentication.
+func (c *SSHConfig) clientConfigFunc() (func(*url.URL) (*ssh.ClientConfig, error), error) {
+	var signers []ssh.Signer
+	for _, name := range c.KeyFiles {
+		b, err := ReadFileOrBase64(name)
+		if err != nil {
+			return nil, fmt.Errorf("read key file: %w", err)
+		}
+		s, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("parse key file %s: %w", name, err)
+		}
+		signers = append(signers, s)
+	}
+
+	hostKeyCallback, err := c.hostKeyCallback()
+	if err != nil {
+		return nil, fmt.Errorf("known hosts: %w", err)
+	}
+
+	var sa *sshAgent
+	if sock := os.Getenv("SSH_AUTH_SOCK"); c.Agent && sock != "" {
+		sa = &sshAgent{sock: sock}
+	}
+
+	return func(u *url.URL) (*ssh.ClientConfig, error) {
+		username := u.User.Username()
+		if username == "" {
+			cu, err := user.Current()
+			if err != nil {
+				return nil, fmt.Errorf("ssh username: %w", err)
+			}
+			username = cu.Username
+		}
+
+		var auth []ssh.AuthMethod
+		if len(signers) > 0 {
+			auth = append(auth, ssh.PublicKeys(signers...))
+		}
+		if sa != nil {
+			auth = append(auth, ssh.PublicKeysCallback(sa.Signers))
+		}
+		if p, ok := u.User.Password(); ok {
+			auth = append(auth, ssh.Password(p))
+		}
+
+		return &ssh.ClientConfig{
+			User:            username,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		}, nil
+	}, nil
+}
+
+func (c *SSHConfig) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if len(c.KnownHostsFiles) > 0 {
+		return knownhosts.New(c.KnownHostsFiles...)
+	}
+
+	// The default file is loaded if it exists, so that SSH does not have to be configured when it's not used.
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return rejectHostKey(err), nil //nolint:nilerr // error is reported when verifying the host key
+	}
+	name := filepath.Join(home, ".ssh", "known_hosts")
+	if _, err := os.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		return rejectHostKey(fmt.Errorf("%s does not exist", name)), nil
+	}
+	return knownhosts.New(name)
+}
+
+func rejectHostKey(err error) ssh.HostKeyCallback {
+	return func(hostname string, _ net.Addr, _ ssh.PublicKey) error {
+		return fmt.Errorf("verify host key of %s: %w", hostname, err)
+	}
+}
+
+// sshAgent is a lazily connected SSH agent client, it reconnects if the agent connection fails.
+type sshAgent struct {
+	sock string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+func (a *sshAgent) Signers() ([]ssh.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client != nil {
+		s, err := a.client.Signers()
+		if err == nil {
+			return s, nil
+		}
+		a.conn.Close()
+		a.conn, a.client = nil, nil
+	}
+
+	conn, err := net.Dial("unix", a.sock)
+	if err != nil {
+		return nil, fmt.Errorf("ssh agent: %w", err)
+	}
+	a.conn, a.client = conn, agent.NewClient(conn)
+
+	return a.client.Signers()
+}
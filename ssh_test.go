@@ -0,0 +1,168 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/saucelabs/forwarder/dialvia/sshtest"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHTTPProxyUpstreamSSH(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(handler)
+	defer tlsBackend.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := sshtest.NewServer("user", "pass", signer.PublicKey())
+	defer s.Close()
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHostsFile, []byte(s.KnownHosts()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	newProxy := func(t *testing.T, upstream *url.URL, sshCfg SSHConfig) *httptest.Server {
+		t.Helper()
+
+		cfg := DefaultHTTPProxyConfig()
+		cfg.ProxyLocalhost = AllowProxyLocalhost
+		cfg.UpstreamProxy = upstream
+		cfg.SSH = sshCfg
+
+		h, err := NewHTTPProxyHandler(cfg, nil, nil, &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server certificate
+		}, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return httptest.NewServer(h)
+	}
+
+	get := func(proxy *httptest.Server, u string) (*http.Response, string, error) {
+		proxyURL, _ := url.Parse(proxy.URL)
+		c := http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyURL),
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server certificate
+			DisableKeepAlives: true,
+		}}
+		res, err := c.Get(u)
+		if err != nil {
+			return nil, "", err
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		return res, string(b), err
+	}
+
+	t.Run("key", func(t *testing.T) {
+		conns, channels := s.Conns(), s.Channels()
+
+		proxy := newProxy(t, &url.URL{Scheme: "ssh", User: url.User("user"), Host: s.Addr}, SSHConfig{
+			KeyFiles:        []string{keyFile},
+			KnownHostsFiles: []string{knownHostsFile},
+		})
+		defer proxy.Close()
+
+		// The plain HTTP request is sent over a channel, the HTTPS one is tunneled with CONNECT.
+		for _, u := range []string{backend.URL, tlsBackend.URL, backend.URL, tlsBackend.URL} {
+			res, body, err := get(proxy, u)
+			if err != nil {
+				t.Fatalf("%s: %v", u, err)
+			}
+			if res.StatusCode != http.StatusOK || body != "hello" {
+				t.Fatalf("%s: unexpected response %d %q", u, res.StatusCode, body)
+			}
+		}
+
+		if got := s.Conns() - conns; got != 1 {
+			t.Fatalf("expected 1 SSH connection, got %d", got)
+		}
+		if got := s.Channels() - channels; got < 3 {
+			t.Fatalf("expected at least 3 channels, got %d", got)
+		}
+	})
+
+	t.Run("password", func(t *testing.T) {
+		proxy := newProxy(t, &url.URL{Scheme: "ssh", User: url.UserPassword("user", "pass"), Host: s.Addr}, SSHConfig{
+			KnownHostsFiles: []string{knownHostsFile},
+		})
+		defer proxy.Close()
+
+		res, body, err := get(proxy, backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || body != "hello" {
+			t.Fatalf("unexpected response %d %q", res.StatusCode, body)
+		}
+	})
+
+	t.Run("unknown host key", func(t *testing.T) {
+		other := sshtest.NewServer("user", "pass")
+		defer other.Close()
+
+		proxy := newProxy(t, &url.URL{Scheme: "ssh", User: url.UserPassword("user", "pass"), Host: other.Addr}, SSHConfig{
+			KnownHostsFiles: []string{knownHostsFile},
+		})
+		defer proxy.Close()
+
+		res, _, err := get(proxy, backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusBadGateway {
+			t.Fatalf("expected %d, got %d", http.StatusBadGateway, res.StatusCode)
+		}
+		if _, _, err := get(proxy, tlsBackend.URL); err == nil {
+			t.Fatal("expected CONNECT error")
+		}
+	})
+}
+
+func TestParseProxyURLSSH(t *testing.T) {
+	u, err := ParseProxyURL("ssh://user@jump.example.com:2222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "ssh" || u.User.Username() != "user" || u.Host != "jump.example.com:2222" {
+		t.Fatalf("unexpected URL %s", u)
+	}
+}
@@ -7,8 +7,11 @@
 package forwarder
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -174,3 +177,281 @@ func loadX509KeyPair(certFile, keyFile string) (tls.Certificate, error) {
 	}
 	return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
 }
+
+// CertUserField is the client certificate field used as the authenticated user name.
+type CertUserField string
+
+const (
+	CertUserCommonName CertUserField = "cn"
+	CertUserEmail      CertUserField = "email"
+	CertUserDNSName    CertUserField = "dns"
+	CertUserURI        CertUserField = "uri"
+)
+
+func (f *CertUserField) UnmarshalText(text []byte) error {
+	*f = CertUserField(text)
+	if !f.isValid() {
+		return fmt.Errorf("unsupported certificate user field: %q", text)
+	}
+	return nil
+}
+
+func (f CertUserField) String() string {
+	return string(f)
+}
+
+func (f CertUserField) isValid() bool {
+	switch f {
+	case CertUserCommonName, CertUserEmail, CertUserDNSName, CertUserURI:
+		return true
+	default:
+		return false
+	}
+}
+
+// user returns the user name from the certificate, or empty string if the field is not set.
+// For SAN fields the first value is used.
+func (f CertUserField) user(cert *x509.Certificate) string {
+	switch f {
+	case CertUserCommonName:
+		return cert.Subject.CommonName
+	case CertUserEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case CertUserDNSName:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case CertUserURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// TLSClientAuthConfig specifies verification of TLS client certificates.
+type TLSClientAuthConfig struct {
+	// CACertFiles is a list of paths to CA certificate files used to verify client certificates.
+	// If empty, client certificates are not requested.
+	CACertFiles []string
+
+	// CRLFiles is a list of paths to PEM or DER encoded certificate revocation lists.
+	// Each list must be signed by one of the CA certificates.
+	// The lists are read once when the TLS config is configured, a restart is needed to pick up new lists.
+	// Client certificates are rejected once the list of their issuer is past its NextUpdate time.
+	CRLFiles []string
+
+	// Optional allows clients that do not send a certificate,
+	// they must authenticate with basic auth if it is enabled.
+	Optional bool
+
+	// UserField is the client certificate field used as the authenticated user name.
+	UserField CertUserField
+}
+
+func DefaultTLSClientAuthConfig() *TLSClientAuthConfig {
+	return &TLSClientAuthConfig{
+		UserField: CertUserCommonName,
+	}
+}
+
+func (c *TLSClientAuthConfig) enabled() bool {
+	return len(c.CACertFiles) > 0
+}
+
+func (c *TLSClientAuthConfig) Validate() error {
+	if !c.UserField.isValid() {
+		return fmt.Errorf("unsupported user field: %q", c.UserField)
+	}
+	if !c.enabled() && len(c.CRLFiles) > 0 {
+		return errors.New("CRL files require CA certificate files")
+	}
+	return nil
+}
+
+// ConfigureTLSConfig requests and verifies client certificates.
+// Certificates revoked by the CRLs or without the user field are rejected.
+// It is a no-op if no CA certificate files are set.
+func (c *TLSClientAuthConfig) ConfigureTLSConfig(tlsCfg *tls.Config) error {
+	if !c.enabled() {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	var cas []*x509.Certificate
+	for _, name := range c.CACertFiles {
+		b, err := ReadFileOrBase64(name)
+		if err != nil {
+			return fmt.Errorf("load client CAs: %w", err)
+		}
+		certs, err := parsePEMCertificates(b)
+		if err != nil {
+			return fmt.Errorf("load client CAs: %q: %w", name, err)
+		}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+		cas = append(cas, certs...)
+	}
+
+	crls, err := c.loadCRLs(cas, time.Now())
+	if err != nil {
+		return fmt.Errorf("load CRLs: %w", err)
+	}
+
+	tlsCfg.ClientCAs = pool
+	if c.Optional {
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	} else {
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) == 0 {
+			return nil
+		}
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain[:len(chain)-1] {
+				if err := crls.check(cert, time.Now()); err != nil {
+					return err
+				}
+			}
+		}
+		if cert := cs.VerifiedChains[0][0]; c.UserField.user(cert) == "" {
+			return fmt.Errorf("client certificate %q has no %s", cert.Subject, c.UserField)
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// User returns the user name from a verified client certificate.
+func (c *TLSClientAuthConfig) User(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		return ""
+	}
+	return c.UserField.user(cs.VerifiedChains[0][0])
+}
+
+type revokedCert struct {
+	issuer string
+	serial string
+}
+
+// clientCRLs are the revoked certificates and the NextUpdate times of the CRLs by issuer.
+type clientCRLs struct {
+	revoked    map[revokedCert]struct{}
+	nextUpdate map[string]time.Time
+}
+
+// check returns an error if the certificate is revoked, or if the CRL of its issuer is past NextUpdate at now.
+func (r *clientCRLs) check(cert *x509.Certificate, now time.Time) error {
+	if _, ok := r.revoked[revokedCert{string(cert.RawIssuer), cert.SerialNumber.String()}]; ok {
+		return fmt.Errorf("client certificate %q serial %s is revoked", cert.Subject, cert.SerialNumber)
+	}
+	if t, ok := r.nextUpdate[string(cert.RawIssuer)]; ok && now.After(t) {
+		return fmt.Errorf("client certificate %q issuer %q CRL expired at %s", cert.Subject, cert.Issuer, t.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (c *TLSClientAuthConfig) loadCRLs(cas []*x509.Certificate, now time.Time) (*clientCRLs, error) {
+	r := &clientCRLs{
+		revoked:    make(map[revokedCert]struct{}),
+		nextUpdate: make(map[string]time.Time),
+	}
+	for _, name := range c.CRLFiles {
+		b, err := ReadFileOrBase64(name)
+		if err != nil {
+			return nil, err
+		}
+		crls, err := parseCRLs(b)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", name, err)
+		}
+		for _, crl := range crls {
+			if !crlSignedBy(crl, cas) {
+				return nil, fmt.Errorf("%q: CRL issuer %q is not a client CA", name, crl.Issuer)
+			}
+			if !crl.NextUpdate.IsZero() {
+				if now.After(crl.NextUpdate) {
+					return nil, fmt.Errorf("%q: CRL expired at %s", name, crl.NextUpdate.Format(time.RFC3339))
+				}
+				// If there are multiple CRLs of the issuer, the newest one is used.
+				if t := r.nextUpdate[string(crl.RawIssuer)]; crl.NextUpdate.After(t) {
+					r.nextUpdate[string(crl.RawIssuer)] = crl.NextUpdate
+				}
+			}
+			for _, rc := range crl.RevokedCertificateEntries {
+				r.revoked[revokedCert{string(crl.RawIssuer), rc.SerialNumber.String()}] = struct{}{}
+			}
+		}
+	}
+	return r, nil
+}
+
+func crlSignedBy(crl *x509.RevocationList, cas []*x509.Certificate) bool {
+	for _, ca := range cas {
+		if bytes.Equal(crl.RawIssuer, ca.RawSubject) && crl.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePEMCertificates(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+// parseCRLs parses PEM encoded CRLs, or a single DER encoded CRL.
+func parseCRLs(b []byte) ([]*x509.RevocationList, error) {
+	if !bytes.Contains(b, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(b)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+
+	var crls []*x509.RevocationList
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, errors.New("no CRLs found")
+	}
+	return crls, nil
+}
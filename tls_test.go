@@ -7,10 +7,21 @@
 package forwarder
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/saucelabs/forwarder/utils/certutil"
 	"golang.org/x/net/netutil"
@@ -84,3 +95,246 @@ func tls12ServerTLSConfig(t *testing.T, cipherSuite uint16) *tls.Config {
 	}
 	return &tlsCfg
 }
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a client certificate signed by the CA.
+func (ca *testCA) issue(t *testing.T, serial int64, subject pkix.Name, emails ...string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        subject,
+		EmailAddresses: emails,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeFiles writes the CA certificate and a CRL revoking the serials to dir.
+func (ca *testCA) writeFiles(t *testing.T, dir string, revoked ...int64) (caFile, crlFile string) {
+	t.Helper()
+	return ca.writeFilesNextUpdate(t, dir, time.Now().Add(time.Hour), revoked...)
+}
+
+// writeFilesNextUpdate is like writeFiles but with the CRL NextUpdate time.
+func (ca *testCA) writeFilesNextUpdate(t *testing.T, dir string, nextUpdate time.Time, revoked ...int64) (caFile, crlFile string) {
+	t.Helper()
+
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: nextUpdate.Add(-2 * time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, s := range revoked {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(s),
+			RevocationTime: time.Now(),
+		})
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile = filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	crlFile = filepath.Join(dir, "ca.crl")
+	if err := os.WriteFile(crlFile, crl, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return caFile, crlFile
+}
+
+func TestTLSClientAuthConfig(t *testing.T) {
+	ca := newTestCA(t)
+	caFile, crlFile := ca.writeFiles(t, t.TempDir(), 3)
+
+	serverCert, err := certutil.ECDSASelfSignedCert().Gen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := ca.issue(t, 2, pkix.Name{CommonName: "alice"}, "alice@example.com")
+	revoked := ca.issue(t, 3, pkix.Name{CommonName: "bob"})
+	other := newTestCA(t).issue(t, 2, pkix.Name{CommonName: "alice"})
+
+	tests := []struct {
+		name     string
+		optional bool
+		field    CertUserField
+		cert     *tls.Certificate
+		user     string
+		fail     bool
+	}{
+		{name: "cn", field: CertUserCommonName, cert: &alice, user: "alice"},
+		{name: "email", field: CertUserEmail, cert: &alice, user: "alice@example.com"},
+		{name: "no dns", field: CertUserDNSName, cert: &alice, fail: true},
+		{name: "revoked", field: CertUserCommonName, cert: &revoked, fail: true},
+		{name: "unknown ca", field: CertUserCommonName, cert: &other, fail: true},
+		{name: "no cert", field: CertUserCommonName, fail: true},
+		{name: "optional no cert", optional: true, field: CertUserCommonName},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := TLSClientAuthConfig{
+				CACertFiles: []string{caFile},
+				CRLFiles:    []string{crlFile},
+				Optional:    tc.optional,
+				UserField:   tc.field,
+			}
+			if err := c.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			srvCfg := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+			if err := c.ConfigureTLSConfig(srvCfg); err != nil {
+				t.Fatal(err)
+			}
+
+			cliCfg := &tls.Config{InsecureSkipVerify: true} //nolint:gosec // test server certificate
+			if tc.cert != nil {
+				cliCfg.Certificates = []tls.Certificate{*tc.cert}
+			}
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			errc := make(chan error, 1)
+			go func() {
+				conn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					errc <- err
+					return
+				}
+				defer conn.Close()
+				cc := tls.Client(conn, cliCfg)
+				errc <- cc.Handshake()
+				// Read the server alert, if any.
+				cc.Read(make([]byte, 1))
+			}()
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			sc := tls.Server(conn, srvCfg)
+			err = sc.Handshake()
+			if tc.fail {
+				if err == nil {
+					t.Fatal("expected handshake error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			cs := sc.ConnectionState()
+			if got := c.User(&cs); got != tc.user {
+				t.Fatalf("got user %q, want %q", got, tc.user)
+			}
+		})
+	}
+}
+
+func TestTLSClientAuthConfigCRLIssuer(t *testing.T) {
+	dir := t.TempDir()
+	caFile, _ := newTestCA(t).writeFiles(t, dir)
+	_, crlFile := newTestCA(t).writeFiles(t, t.TempDir())
+
+	c := DefaultTLSClientAuthConfig()
+	c.CACertFiles = []string{caFile}
+	c.CRLFiles = []string{crlFile}
+	if err := c.ConfigureTLSConfig(&tls.Config{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestTLSClientAuthConfigCRLExpired(t *testing.T) {
+	ca := newTestCA(t)
+
+	t.Run("load", func(t *testing.T) {
+		caFile, crlFile := ca.writeFilesNextUpdate(t, t.TempDir(), time.Now().Add(-time.Minute))
+		c := DefaultTLSClientAuthConfig()
+		c.CACertFiles = []string{caFile}
+		c.CRLFiles = []string{crlFile}
+		if err := c.ConfigureTLSConfig(&tls.Config{}); err == nil || !strings.Contains(err.Error(), "expired") {
+			t.Fatalf("expected expired CRL error, got %v", err)
+		}
+	})
+
+	t.Run("check", func(t *testing.T) {
+		nextUpdate := time.Now().Add(time.Hour)
+		_, crlFile := ca.writeFilesNextUpdate(t, t.TempDir(), nextUpdate)
+		c := DefaultTLSClientAuthConfig()
+		c.CRLFiles = []string{crlFile}
+		crls, err := c.loadCRLs([]*x509.Certificate{ca.cert}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		alice := ca.issue(t, 2, pkix.Name{CommonName: "alice"})
+		cert, err := x509.ParseCertificate(alice.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := crls.check(cert, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if err := crls.check(cert, nextUpdate.Add(time.Second)); err == nil || !strings.Contains(err.Error(), "expired") {
+			t.Fatalf("expected expired CRL error, got %v", err)
+		}
+	})
+}
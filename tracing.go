@@ -0,0 +1,108 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// TracingConfig configures OpenTelemetry tracing of proxied requests.
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP collector URL, tracing is disabled if it is nil.
+	// If the URL path is empty, /v1/traces is used.
+	Endpoint *url.URL
+
+	// SampleRatio is the fraction of new traces that are sampled.
+	// Sampling decisions of the incoming traceparent header are respected.
+	SampleRatio float64
+
+	// ServiceName is the service name reported to the collector.
+	ServiceName string
+
+	// Inject enables propagating the trace context to upstream servers in the traceparent header.
+	Inject bool
+}
+
+func DefaultTracingConfig() *TracingConfig {
+	return &TracingConfig{
+		SampleRatio: 1,
+		ServiceName: "forwarder",
+	}
+}
+
+func (c *TracingConfig) Validate() error {
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return errors.New("sample ratio must be between 0 and 1")
+	}
+	if c.Endpoint != nil {
+		if err := validateOTLPEndpoint(c.Endpoint); err != nil {
+			return fmt.Errorf("endpoint: %w", err)
+		}
+	}
+	return nil
+}
+
+// ParseOTLPEndpoint parses OTLP/HTTP collector URL i.e. http://localhost:4318.
+func ParseOTLPEndpoint(val string) (*url.URL, error) {
+	u, err := url.Parse(val)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateOTLPEndpoint(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func validateOTLPEndpoint(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q, supported schemes are: http, https", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	return nil
+}
+
+// NewTracerProvider returns a tracer provider that exports spans to the OTLP/HTTP collector.
+// The caller is responsible for calling Shutdown on the provider to flush the pending spans.
+func NewTracerProvider(cfg *TracingConfig) (*sdktrace.TracerProvider, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Endpoint == nil {
+		return nil, errors.New("endpoint is required")
+	}
+
+	u := *cfg.Endpoint
+	if u.Path == "" {
+		u.Path = "/v1/traces"
+	}
+
+	exp, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, fmt.Errorf("otlp exporter: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(cfg.ServiceName),
+		)),
+	)
+
+	return tp, nil
+}
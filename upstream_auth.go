@@ -0,0 +1,91 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/saucelabs/forwarder/dialvia"
+)
+
+// UpstreamAuth specifies the authentication scheme used with an upstream proxy.
+// Empty HostPort matches all upstream proxies.
+type UpstreamAuth struct {
+	HostPort
+	Scheme dialvia.AuthScheme
+}
+
+// ParseUpstreamAuth parses a [host:port=]scheme string into UpstreamAuth.
+func ParseUpstreamAuth(val string) (UpstreamAuth, error) {
+	var ua UpstreamAuth
+
+	hp, scheme, ok := strings.Cut(val, "=")
+	if !ok {
+		scheme, hp = hp, ""
+	}
+	if hp != "" {
+		host, port, err := net.SplitHostPort(hp)
+		if err != nil {
+			return ua, err
+		}
+		ua.HostPort = HostPort{Host: host, Port: port}
+	}
+	if err := ua.Scheme.UnmarshalText([]byte(strings.ToLower(scheme))); err != nil {
+		return ua, err
+	}
+
+	return ua, ua.Validate()
+}
+
+func (ua UpstreamAuth) Validate() error {
+	if ua.Host != "" || ua.Port != "" {
+		if ua.Host == "" || ua.Port == "" {
+			return errors.New("expected host:port")
+		}
+		if err := ua.HostPort.Validate(); err != nil {
+			return err
+		}
+	}
+	switch ua.Scheme {
+	case dialvia.BasicAuth, dialvia.DigestAuth, dialvia.NTLMAuth, dialvia.NegotiateAuth:
+	default:
+		return fmt.Errorf("unsupported scheme %q", ua.Scheme)
+	}
+	return nil
+}
+
+func (ua UpstreamAuth) String() string {
+	if ua.Host == "" {
+		return ua.Scheme.String()
+	}
+	return net.JoinHostPort(ua.Host, ua.Port) + "=" + ua.Scheme.String()
+}
+
+// upstreamAuthScheme returns a function that selects the authentication scheme for the upstream proxy URL.
+// Proxy host:port matches take precedence over the default, if nothing matches basic authentication is used.
+func upstreamAuthScheme(auth []UpstreamAuth) func(*url.URL) dialvia.AuthScheme {
+	hostport := make(map[string]dialvia.AuthScheme, len(auth))
+	def := dialvia.BasicAuth
+	for _, ua := range auth {
+		if ua.Host == "" {
+			def = ua.Scheme
+		} else {
+			hostport[net.JoinHostPort(ua.Host, ua.Port)] = ua.Scheme
+		}
+	}
+
+	return func(u *url.URL) dialvia.AuthScheme {
+		if s, ok := hostport[net.JoinHostPort(u.Hostname(), urlPort(u))]; ok {
+			return s
+		}
+		return def
+	}
+}
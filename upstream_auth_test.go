@@ -0,0 +1,177 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/saucelabs/forwarder/dialvia"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/ntlm/ntlmtest"
+)
+
+func TestParseUpstreamAuth(t *testing.T) {
+	tests := []struct {
+		in   string
+		want UpstreamAuth
+		err  bool
+	}{
+		{in: "ntlm", want: UpstreamAuth{Scheme: dialvia.NTLMAuth}},
+		{in: "proxy.corp:8080=Negotiate", want: UpstreamAuth{HostPort: HostPort{Host: "proxy.corp", Port: "8080"}, Scheme: dialvia.NegotiateAuth}},
+		{in: "proxy.corp=ntlm", err: true},
+		{in: "proxy.corp:8080=kerberos", err: true},
+		{in: "", err: true},
+	}
+
+	for _, tc := range tests {
+		got, err := ParseUpstreamAuth(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestUpstreamAuthScheme(t *testing.T) {
+	f := upstreamAuthScheme([]UpstreamAuth{
+		{Scheme: dialvia.NTLMAuth},
+		{HostPort: HostPort{Host: "basic.corp", Port: "80"}, Scheme: dialvia.BasicAuth},
+	})
+
+	tests := []struct {
+		url  string
+		want dialvia.AuthScheme
+	}{
+		{"http://basic.corp", dialvia.BasicAuth},
+		{"http://basic.corp:8080", dialvia.NTLMAuth},
+		{"https://other.corp:3128", dialvia.NTLMAuth},
+	}
+	for _, tc := range tests {
+		u, _ := url.Parse(tc.url)
+		if got := f(u); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPProxyUpstreamNTLM(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(handler)
+	defer tlsBackend.Close()
+
+	p := &ntlmtest.Proxy{
+		Domain:   "CORP",
+		User:     "alice",
+		Password: "secret",
+	}
+	upstream := ntlmtest.NewServer(p)
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamURL.User = url.UserPassword(`CORP\alice`, "secret")
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.UpstreamProxy = upstreamURL
+	cfg.UpstreamAuth = []UpstreamAuth{{Scheme: dialvia.NTLMAuth}}
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server certificate
+	}
+	h, err := NewHTTPProxyHandler(cfg, nil, nil, tr, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Authenticated connections are reused, there is one handshake for plain HTTP and one for the tunnel.
+	for i, u := range []string{backend.URL, backend.URL, tlsBackend.URL, tlsBackend.URL} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, u, http.NoBody))
+
+		res := rw.Result()
+		b, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK || string(b) != "hello" {
+			t.Fatalf("%s: unexpected response %d %q", u, res.StatusCode, b)
+		}
+		if got, want := p.Handshakes(), i/2+1; got != want {
+			t.Fatalf("%s: expected %d handshakes, got %d", u, want, got)
+		}
+	}
+}
+
+func TestHTTPProxyUpstreamDigest(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(handler)
+	defer tlsBackend.Close()
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server certificate
+	}
+
+	ucfg := DefaultHTTPProxyConfig()
+	ucfg.ProxyLocalhost = AllowProxyLocalhost
+	ucfg.BasicAuth = url.UserPassword("user", "pass")
+	ucfg.DigestAuth = true
+	uh, err := NewHTTPProxyHandler(ucfg, nil, nil, tr.Clone(), stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(uh)
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamURL.User = url.UserPassword("user", "pass")
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.UpstreamProxy = upstreamURL
+	h, err := NewHTTPProxyHandler(cfg, nil, nil, tr.Clone(), stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first request is sent with basic credentials and retried with Digest,
+	// subsequent requests use Digest directly.
+	for _, u := range []string{backend.URL, tlsBackend.URL, backend.URL} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, u, http.NoBody))
+
+		res := rw.Result()
+		b, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK || string(b) != "hello" {
+			t.Fatalf("%s: unexpected response %d %q", u, res.StatusCode, b)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/saucelabs/forwarder/dialvia"
+)
+
+// UpstreamHTTP2Config specifies HTTP/2 CONNECT to HTTPS upstream proxies.
+// When enabled, CONNECT tunnels to each HTTPS upstream proxy are opened as HTTP/2 streams
+// multiplexed over a small pool of shared connections, instead of a new TCP and TLS connection per tunnel.
+// If the upstream proxy does not negotiate h2, HTTP/1.1 CONNECT is used.
+type UpstreamHTTP2Config struct {
+	Enabled bool
+
+	// MaxConns is the maximum number of HTTP/2 connections to an upstream proxy.
+	// When all connections are busy, new tunnels wait for a free stream.
+	// Zero means no limit.
+	MaxConns int
+
+	// MaxStreamsPerConn is the maximum number of tunnels multiplexed over a single connection.
+	// Zero means the limit advertised by the upstream proxy.
+	MaxStreamsPerConn int
+
+	// ConnWindow and StreamWindow are the HTTP/2 flow-control windows per connection and per tunnel.
+	// Zero means the default.
+	ConnWindow   SizeSuffix
+	StreamWindow SizeSuffix
+
+	// ReadIdleTimeout is the time after which a health check ping is sent if no frame is received on the connection.
+	// Zero disables health checks.
+	ReadIdleTimeout time.Duration
+}
+
+func DefaultUpstreamHTTP2Config() *UpstreamHTTP2Config {
+	return &UpstreamHTTP2Config{
+		MaxConns:        4,
+		ReadIdleTimeout: 30 * time.Second,
+	}
+}
+
+func (c *UpstreamHTTP2Config) Validate() error {
+	if c.MaxConns < 0 {
+		return errors.New("max_conns must be positive")
+	}
+	if c.MaxStreamsPerConn < 0 {
+		return errors.New("max_streams_per_conn must be positive")
+	}
+	const minWindow, maxWindow = 64 * Kibi, 1<<31 - 1
+	if c.ConnWindow != 0 && (c.ConnWindow < minWindow || c.ConnWindow > maxWindow) {
+		return fmt.Errorf("conn_window must be between %s and %s", minWindow, SizeSuffix(maxWindow))
+	}
+	if c.StreamWindow != 0 && (c.StreamWindow < minWindow || c.StreamWindow > maxWindow) {
+		return fmt.Errorf("stream_window must be between %s and %s", minWindow, SizeSuffix(maxWindow))
+	}
+	if c.ReadIdleTimeout < 0 {
+		return errors.New("read_idle_timeout must be positive")
+	}
+	return nil
+}
+
+func (c *UpstreamHTTP2Config) options() *dialvia.HTTP2Options {
+	if !c.Enabled {
+		return nil
+	}
+	return &dialvia.HTTP2Options{
+		MaxConns:                      c.MaxConns,
+		MaxStreamsPerConn:             c.MaxStreamsPerConn,
+		MaxReceiveBufferPerConnection: int(c.ConnWindow),
+		MaxReceiveBufferPerStream:     int(c.StreamWindow),
+		ReadIdleTimeout:               c.ReadIdleTimeout,
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+// http2ConnectProxy is an HTTPS proxy that supports HTTP/1.1 and HTTP/2 CONNECT.
+func http2ConnectProxy(t *testing.T, h2 bool) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var h2Tunnels atomic.Int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+
+		rc := http.NewResponseController(w)
+		if r.ProtoMajor == 1 {
+			conn, brw, err := rc.Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			go io.Copy(target, brw)
+			io.Copy(conn, target)
+			return
+		}
+
+		h2Tunnels.Add(1)
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+		go io.Copy(target, r.Body)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := target.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	s.EnableHTTP2 = h2
+	s.StartTLS()
+	return s, &h2Tunnels
+}
+
+func TestHTTPProxyUpstreamHTTP2(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	newProxy := func(t *testing.T, upstream string, reg *prometheus.Registry) *httptest.Server {
+		t.Helper()
+
+		cfg := DefaultHTTPProxyConfig()
+		cfg.ProxyLocalhost = AllowProxyLocalhost
+		cfg.UpstreamProxy, _ = url.Parse(upstream)
+		cfg.UpstreamHTTP2.Enabled = true
+		cfg.PromRegistry = reg
+
+		h, err := NewHTTPProxyHandler(cfg, nil, nil, &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server certificate
+		}, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return httptest.NewServer(h)
+	}
+
+	get := func(t *testing.T, proxy *httptest.Server) {
+		t.Helper()
+
+		proxyURL, _ := url.Parse(proxy.URL)
+		c := http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyURL),
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server certificate
+			DisableKeepAlives: true,
+		}}
+		res, err := c.Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || string(b) != "hello" {
+			t.Fatalf("unexpected response %d %q", res.StatusCode, b)
+		}
+	}
+
+	metric := func(t *testing.T, reg *prometheus.Registry, name string) float64 {
+		t.Helper()
+
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range mfs {
+			if mf.GetName() != name {
+				continue
+			}
+			m := mf.GetMetric()[0]
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+		t.Fatalf("metric %s not found", name)
+		return 0
+	}
+
+	t.Run("h2", func(t *testing.T) {
+		upstream, tunnels := http2ConnectProxy(t, true)
+		defer upstream.Close()
+
+		reg := prometheus.NewRegistry()
+		proxy := newProxy(t, upstream.URL, reg)
+		defer proxy.Close()
+
+		for range 3 {
+			get(t, proxy)
+		}
+
+		if n := tunnels.Load(); n != 3 {
+			t.Fatalf("expected 3 HTTP/2 tunnels, got %d", n)
+		}
+		if v := metric(t, reg, "upstream_http2_streams_total"); v != 3 {
+			t.Fatalf("expected 3 streams, got %v", v)
+		}
+		if v := metric(t, reg, "upstream_http2_connections"); v != 1 {
+			t.Fatalf("expected 1 connection, got %v", v)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		upstream, tunnels := http2ConnectProxy(t, false)
+		defer upstream.Close()
+
+		reg := prometheus.NewRegistry()
+		proxy := newProxy(t, upstream.URL, reg)
+		defer proxy.Close()
+
+		for range 2 {
+			get(t, proxy)
+		}
+
+		if n := tunnels.Load(); n != 0 {
+			t.Fatalf("expected no HTTP/2 tunnels, got %d", n)
+		}
+		if v := metric(t, reg, "upstream_http2_fallbacks_total"); v != 1 {
+			t.Fatalf("expected 1 fallback, got %v", v)
+		}
+	})
+}
+
+func TestUpstreamHTTP2ConfigValidate(t *testing.T) {
+	c := DefaultUpstreamHTTP2Config()
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.StreamWindow = Kibi
+	if err := c.Validate(); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+// urlFetcher reads a URL like ReadURL, but skips reading if the content has not changed since the last commit.
+// For http and https URLs it sends conditional requests and honors Cache-Control max-age and Expires headers,
+// for local files it checks the modification time and size.
+type urlFetcher struct {
+	url *url.URL
+	rt  http.RoundTripper
+
+	// last are the validators of the last committed content.
+	last urlValidators
+}
+
+// urlValidators identify a version of the content behind the URL.
+type urlValidators struct {
+	etag         string
+	lastModified string
+	expires      time.Time
+	modTime      time.Time
+	size         int64
+}
+
+// refreshable returns true if the content behind the URL can change.
+func (f *urlFetcher) refreshable() bool {
+	switch f.url.Scheme {
+	case "http", "https":
+		return true
+	case "file":
+		return f.url.Path != "-"
+	default:
+		return false
+	}
+}
+
+// fetch returns the content and its validators, or nil content if it has not changed since the last commit.
+// The caller commits the validators after the content is successfully used,
+// so that content that failed to parse is fetched again on the next call.
+func (f *urlFetcher) fetch(ctx context.Context) ([]byte, urlValidators, error) {
+	u := f.url
+
+	switch u.Scheme {
+	case "http", "https":
+		return f.fetchHTTP(ctx)
+	case "file":
+		if u.Path != "-" {
+			fi, err := os.Stat(u.Path)
+			if err != nil {
+				return nil, urlValidators{}, err
+			}
+			if fi.ModTime().Equal(f.last.modTime) && fi.Size() == f.last.size {
+				return nil, f.last, nil
+			}
+			b, err := ReadURL(u, f.rt)
+			if err != nil {
+				return nil, urlValidators{}, err
+			}
+			return b, urlValidators{modTime: fi.ModTime(), size: fi.Size()}, nil
+		}
+	}
+
+	b, err := ReadURL(u, f.rt)
+	return b, urlValidators{}, err
+}
+
+// commit records the validators of the content returned by fetch.
+func (f *urlFetcher) commit(v urlValidators) {
+	f.last = v
+}
+
+func (f *urlFetcher) fetchHTTP(ctx context.Context) ([]byte, urlValidators, error) {
+	if !f.last.expires.IsZero() && time.Now().Before(f.last.expires) {
+		return nil, f.last, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url.String(), http.NoBody)
+	if err != nil {
+		return nil, urlValidators{}, err
+	}
+	if f.last.etag != "" {
+		req.Header.Set("If-None-Match", f.last.etag)
+	}
+	if f.last.lastModified != "" {
+		req.Header.Set("If-Modified-Since", f.last.lastModified)
+	}
+
+	c := http.Client{
+		Transport: f.rt,
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, urlValidators{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		// The committed content is still valid.
+		v := f.last
+		v.expires = expiresFromHeader(resp.Header)
+		return nil, v, nil
+	default:
+		return nil, urlValidators{}, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, urlValidators{}, err
+	}
+
+	return b, urlValidators{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		expires:      expiresFromHeader(resp.Header),
+	}, nil
+}
+
+// runRefresh calls refresh every interval until the context is canceled.
+// It returns immediately if interval is not positive or the content behind the URL cannot change.
+// Refresh errors are logged, name identifies the content in the logs.
+func (f *urlFetcher) runRefresh(ctx context.Context, interval time.Duration, name string, refresh func(context.Context) (bool, error), log log.Logger) error {
+	if interval <= 0 || !f.refreshable() {
+		return nil
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			updated, err := refresh(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				log.Errorf("refresh %s from %s: %v", name, f.url.Redacted(), err)
+				continue
+			}
+			if updated {
+				log.Infof("refreshed %s from %s", name, f.url.Redacted())
+			}
+		}
+	}
+}
+
+// expiresFromHeader returns the time until which the response is fresh according to Cache-Control max-age or Expires headers.
+// It returns zero time if the response must be revalidated.
+func expiresFromHeader(h http.Header) time.Time {
+	for _, v := range strings.Split(h.Get("Cache-Control"), ",") {
+		v = strings.TrimSpace(v)
+		switch {
+		case v == "no-cache" || v == "no-store":
+			return time.Time{}
+		case strings.HasPrefix(v, "max-age="):
+			n, err := strconv.Atoi(strings.TrimPrefix(v, "max-age="))
+			if err != nil || n <= 0 {
+				return time.Time{}
+			}
+			return time.Now().Add(time.Duration(n) * time.Second)
+		}
+	}
+
+	if v := h.Get("Expires"); v != "" {
+		t, err := http.ParseTime(v)
+		if err != nil {
+			return time.Time{}
+		}
+		return t
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,129 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// WPADURL is the PAC URL value that enables discovery of the PAC file using WPAD.
+var WPADURL = &url.URL{Opaque: "auto"}
+
+// IsWPAD returns true if the PAC URL is WPADURL.
+func IsWPAD(u *url.URL) bool {
+	return u != nil && u.Scheme == "" && u.Opaque == WPADURL.Opaque
+}
+
+// DiscoverPACURL finds the PAC file using WPAD DNS discovery.
+// For each search domain from /etc/resolv.conf it tries http://wpad.<domain>/wpad.dat,
+// removing the leftmost label of the domain until it reaches the registrable domain, e.g. for a.example.co.uk
+// it tries wpad.a.example.co.uk and wpad.example.co.uk, but never wpad.co.uk.
+// The first URL that returns 200 OK is returned.
+func DiscoverPACURL(ctx context.Context, rt http.RoundTripper) (*url.URL, error) {
+	domains, err := resolvConfSearchDomains("/etc/resolv.conf")
+	if err != nil {
+		return nil, fmt.Errorf("WPAD: %w", err)
+	}
+	return discoverPACURL(ctx, wpadCandidates(domains), rt)
+}
+
+// ResolvePACURL returns the discovered PAC URL if u is WPADURL, otherwise it returns u.
+func ResolvePACURL(ctx context.Context, u *url.URL, rt http.RoundTripper) (*url.URL, error) {
+	if !IsWPAD(u) {
+		return u, nil
+	}
+	return DiscoverPACURL(ctx, rt)
+}
+
+func wpadCandidates(domains []string) []*url.URL {
+	var (
+		candidates []*url.URL
+		seen       = make(map[string]bool)
+	)
+	for _, d := range domains {
+		d = strings.Trim(strings.ToLower(d), ".")
+		// Going above the registrable domain would query hosts controlled by other parties.
+		reg, err := publicsuffix.EffectiveTLDPlusOne(d)
+		if err != nil {
+			continue
+		}
+		labels := strings.Split(d, ".")
+		for i := 0; len(labels)-i >= strings.Count(reg, ".")+1; i++ {
+			host := "wpad." + strings.Join(labels[i:], ".")
+			if seen[host] {
+				continue
+			}
+			seen[host] = true
+			candidates = append(candidates, &url.URL{Scheme: "http", Host: host, Path: "/wpad.dat"})
+		}
+	}
+	return candidates
+}
+
+func discoverPACURL(ctx context.Context, candidates []*url.URL, rt http.RoundTripper) (*url.URL, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("WPAD: no search domains")
+	}
+
+	c := http.Client{
+		Transport: rt,
+	}
+	var errs []error
+	for _, u := range candidates {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			return u, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: unexpected status code %d", u, resp.StatusCode))
+	}
+
+	return nil, fmt.Errorf("WPAD: PAC file not found: %w", errors.Join(errs...))
+}
+
+// resolvConfSearchDomains returns domains from search and domain directives of resolv.conf.
+func resolvConfSearchDomains(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var domains []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "search", "domain":
+			domains = append(domains, fields[1:]...)
+		}
+	}
+	return domains, s.Err()
+}
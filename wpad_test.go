@@ -0,0 +1,91 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWPADCandidates(t *testing.T) {
+	var got []string
+	for _, u := range wpadCandidates([]string{"a.b.example.com.", "example.com", "local"}) {
+		got = append(got, u.String())
+	}
+	want := []string{
+		"http://wpad.a.b.example.com/wpad.dat",
+		"http://wpad.b.example.com/wpad.dat",
+		"http://wpad.example.com/wpad.dat",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestWPADCandidatesPublicSuffix(t *testing.T) {
+	var got []string
+	for _, u := range wpadCandidates([]string{"corp.example.co.uk", "co.uk"}) {
+		got = append(got, u.String())
+	}
+	want := []string{
+		"http://wpad.corp.example.co.uk/wpad.dat",
+		"http://wpad.example.co.uk/wpad.dat",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestResolvConfSearchDomains(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(name, []byte("nameserver 10.0.0.1\ndomain corp.example.com\nsearch a.example.com b.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := resolvConfSearchDomains(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"corp.example.com", "a.example.com", "b.example.com"}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestDiscoverPACURL(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "wpad.example.com" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`function FindProxyForURL(url, host) { return "DIRECT"; }`))
+	}))
+	defer s.Close()
+
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, s.Listener.Addr().String())
+		},
+	}
+
+	u, err := discoverPACURL(context.Background(), wpadCandidates([]string{"a.example.com"}), tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != "http://wpad.example.com/wpad.dat" {
+		t.Fatalf("unexpected URL %s", u)
+	}
+
+	if _, err := discoverPACURL(context.Background(), wpadCandidates([]string{"a.other.com"}), tr); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}